@@ -0,0 +1,150 @@
+package staticbackend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"staticbackend/internal"
+	"staticbackend/middleware"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// apiKeyRequest creates an API key, AllowedIPs and Expires are optional
+type apiKeyRequest struct {
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	AllowedIPs []string  `json:"allowedIps"`
+	Expires    time.Time `json:"expires"`
+}
+
+// newAPIKey is the response of a new key, the key is not shown again
+type newAPIKey struct {
+	internal.APIKey
+	Key string `json:"key"`
+}
+
+// apiKeys manages the API keys of the base, it's reserved to root users:
+//
+//	GET /apikeys lists the keys
+//	POST /apikeys {"name": "...", "scopes": [], "allowedIps": [], "expires": "..."}
+//	DELETE /apikeys/{id} revokes a key
+func apiKeys(w http.ResponseWriter, r *http.Request) {
+	conf, auth, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	id, _ := ShiftPath(r.URL.Path)
+
+	switch {
+	case r.Method == http.MethodGet && len(id) == 0:
+		keys, err := internal.ListAPIKeys(curDB)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, keys)
+	case r.Method == http.MethodPost && len(id) == 0:
+		var data apiKeyRequest
+		if err := parseBody(r.Body, &data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := validateAPIKey(data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		key, k, err := createAPIKey(curDB, auth, data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusCreated, newAPIKey{APIKey: k, Key: key})
+	case r.Method == http.MethodDelete && len(id) > 0:
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+
+		n, err := internal.DeleteAPIKey(curDB, oid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if n == 0 {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func validateAPIKey(data apiKeyRequest) error {
+	if len(strings.TrimSpace(data.Name)) == 0 {
+		return errors.New("the name is required")
+	} else if len(data.Scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+
+	for _, scope := range data.Scopes {
+		if err := internal.ValidateScope(scope); err != nil {
+			return err
+		}
+	}
+
+	for _, ip := range data.AllowedIPs {
+		if _, _, err := net.ParseCIDR(ip); err == nil {
+			continue
+		} else if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid IP address or range %s", ip)
+		}
+	}
+
+	if !data.Expires.IsZero() && data.Expires.Before(time.Now()) {
+		return errors.New("the expiry date is in the past")
+	}
+	return nil
+}
+
+// createAPIKey saves the key for the root user and returns the key to
+// give to the server using it, only the hash of its secret is stored
+func createAPIKey(db internal.Database, auth internal.Auth, data apiKeyRequest) (string, internal.APIKey, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return "", internal.APIKey{}, err
+	}
+
+	k := internal.APIKey{
+		ID:         primitive.NewObjectID(),
+		AccountID:  auth.AccountID,
+		UserID:     auth.UserID,
+		Name:       strings.TrimSpace(data.Name),
+		Scopes:     data.Scopes,
+		AllowedIPs: data.AllowedIPs,
+		Hash:       internal.HashAPIKeySecret(secret),
+		Created:    time.Now(),
+		Expires:    data.Expires,
+	}
+	if err := internal.CreateAPIKey(db, k); err != nil {
+		return "", k, err
+	}
+
+	key := fmt.Sprintf("%s%s_%s", internal.APIKeyPrefix, k.ID.Hex(), secret)
+	return key, k, nil
+}
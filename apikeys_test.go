@@ -0,0 +1,271 @@
+package staticbackend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"staticbackend/internal"
+	"staticbackend/middleware"
+)
+
+// apiKeyRootReq makes a request with the API key to a route reserved to
+// root users
+func apiKeyRootReq(t *testing.T, hf func(http.ResponseWriter, *http.Request), method, path, key string, v interface{}) *http.Response {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("error marshaling post data:", err)
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(b))
+	req.Header.Set("SB-PUBLIC-KEY", pubKey)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", key))
+
+	w := httptest.NewRecorder()
+	middleware.Chain(http.HandlerFunc(hf), middleware.WithDB(client, volatile), middleware.RequireRoot(client, volatile)).ServeHTTP(w, req)
+	return w.Result()
+}
+
+func createTestAPIKey(t *testing.T, data apiKeyRequest) newAPIKey {
+	resp := dbReq(t, apiKeys, "POST", "/apikeys", data, true)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var k newAPIKey
+	if err := parseBody(resp.Body, &k); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(k.Key, internal.APIKeyPrefix) {
+		t.Fatalf("expected an API key got %s", k.Key)
+	}
+	return k
+}
+
+func TestAPIKeys(t *testing.T) {
+	m := &membership{volatile: volatile}
+
+	resp := dbReq(t, apiKeys, "POST", "/apikeys", apiKeyRequest{Name: "bad", Scopes: []string{"db:read"}}, true)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid scope got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	// httptest requests come from 192.0.2.1
+	k := createTestAPIKey(t, apiKeyRequest{
+		Name:       "orders sync",
+		Scopes:     []string{"db:read:*", "db:write:apikeys_orders"},
+		AllowedIPs: []string{"192.0.2.0/24"},
+	})
+
+	doc := map[string]interface{}{"total": 42}
+	resp = sessionReq(t, database.dbreq, "POST", "/db/apikeys_orders", k.Key, doc)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = sessionReq(t, database.dbreq, "GET", "/db/apikeys_orders", k.Key, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	refused := []struct {
+		hf     func(http.ResponseWriter, *http.Request)
+		method string
+		path   string
+		root   bool
+	}{
+		{database.dbreq, "POST", "/db/apikeys_other", false},
+		{database.dbreq, "GET", "/db/sb_tokens", false},
+		{m.logoutAll, "POST", "/logout/all", false},
+		{database.listCollections, "GET", "/sudolistall/", true},
+		{apiKeys, "GET", "/apikeys", true},
+	}
+	for _, req := range refused {
+		if req.root {
+			resp = apiKeyRootReq(t, req.hf, req.method, req.path, k.Key, doc)
+		} else {
+			resp = sessionReq(t, req.hf, req.method, req.path, k.Key, doc)
+		}
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status 403 for %s %s got %s", req.method, req.path, resp.Status)
+		}
+		resp.Body.Close()
+	}
+
+	resp = apiKeyRootReq(t, database.dbreq, "GET", "/sudo/apikeys_orders", k.Key, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, apiKeys, "GET", "/apikeys", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var keys []internal.APIKey
+	if err := parseBody(resp.Body, &keys); err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, key := range keys {
+		if key.ID == k.ID {
+			found = true
+			if key.LastUsed.IsZero() || key.LastIP != "192.0.2.1" {
+				t.Errorf("expected the last use to be tracked got %v from %s", key.LastUsed, key.LastIP)
+			}
+		}
+	}
+	if !found {
+		t.Error("expected the key to be listed")
+	}
+
+	// references outside the scopes and to system collections are not
+	// expanded
+	item := map[string]interface{}{"name": "not in the scopes"}
+	resp = dbReq(t, database.add, "POST", "/db/apikeys_items", item, true)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal(GetResponseBody(t, resp))
+	} else if err := parseBody(resp.Body, &item); err != nil {
+		t.Fatal(err)
+	}
+
+	owner, err := internal.GetRootForBase(client.Database(dbName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := map[string]interface{}{"item": item["id"], "buyer": owner.ID.Hex()}
+	resp = dbReq(t, database.add, "POST", "/db/apikeys_orders", order, true)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal(GetResponseBody(t, resp))
+	} else if err := parseBody(resp.Body, &order); err != nil {
+		t.Fatal(err)
+	}
+
+	narrow := createTestAPIKey(t, apiKeyRequest{Name: "orders only", Scopes: []string{"db:read:apikeys_orders"}})
+
+	path := fmt.Sprintf("/db/apikeys_orders/%v?expand=item:apikeys_items,buyer:sb_tokens", order["id"])
+	for key, itemExpanded := range map[string]bool{k.Key: true, narrow.Key: false} {
+		resp = sessionReq(t, database.dbreq, "GET", path, key, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(GetResponseBody(t, resp))
+		}
+
+		var expanded map[string]interface{}
+		if err := parseBody(resp.Body, &expanded); err != nil {
+			t.Fatal(err)
+		} else if (expanded["item"] != nil) != itemExpanded {
+			t.Errorf("expected the item to be expanded %v got %v", itemExpanded, expanded["item"])
+		} else if expanded["buyer"] != nil {
+			t.Errorf("expected the reference to sb_tokens to be null got %v", expanded["buyer"])
+		}
+	}
+
+	// revoked keys are refused right away
+	resp = dbReq(t, apiKeys, "DELETE", "/apikeys/"+k.ID.Hex(), nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = sessionReq(t, database.dbreq, "GET", "/db/apikeys_orders", k.Key, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for a revoked key got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	other := createTestAPIKey(t, apiKeyRequest{
+		Name:       "other network",
+		Scopes:     []string{"db:read:*"},
+		AllowedIPs: []string{"203.0.113.7"},
+	})
+
+	resp = sessionReq(t, database.dbreq, "GET", "/db/apikeys_orders", other.Key, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 from an address not allowed got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	// behind a proxy only the address it added is trusted, the client sets
+	// the ones before
+	middleware.TrustProxy = true
+	defer func() { middleware.TrustProxy = false }()
+
+	for fwd, expected := range map[string]int{
+		"203.0.113.7, 198.51.100.1": http.StatusUnauthorized,
+		"198.51.100.1, 203.0.113.7": http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", "/db/apikeys_orders", nil)
+		req.Header.Set("SB-PUBLIC-KEY", pubKey)
+		req.Header.Set("Authorization", "Bearer "+other.Key)
+		req.Header.Set("X-Forwarded-For", fwd)
+
+		w := httptest.NewRecorder()
+		middleware.Chain(http.HandlerFunc(database.dbreq), middleware.WithDB(client, volatile), middleware.RequireAuth(client, volatile)).ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("expected status %d with X-Forwarded-For %s got %d", expected, fwd, w.Code)
+		}
+	}
+
+	root, err := internal.GetRootForBase(client.Database(dbName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := internal.Auth{AccountID: root.AccountID, UserID: root.ID}
+	expired, _, err := createAPIKey(client.Database(dbName), auth, apiKeyRequest{
+		Name:    "expired",
+		Scopes:  []string{"db:read:*"},
+		Expires: time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp = sessionReq(t, database.dbreq, "GET", "/db/apikeys_orders", expired, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for an expired key got %s", resp.Status)
+	}
+	resp.Body.Close()
+}
+
+func TestScopeAllows(t *testing.T) {
+	scopes := []string{"db:read:orders", "fn:exec:*", "storage:upload"}
+
+	tests := map[string]bool{
+		"db:read:orders":  true,
+		"db:write:orders": false,
+		"db:read:users":   false,
+		"fn:exec:sync":    true,
+		"storage:upload":  true,
+		"storage:delete":  false,
+	}
+	for perm, expected := range tests {
+		if got := internal.ScopeAllows(scopes, perm); got != expected {
+			t.Errorf("expected %v for %s got %v", expected, perm, got)
+		}
+	}
+
+	// system collections are refused, named or not
+	for _, scope := range []string{"db:*:*", "db:read:sb_tokens"} {
+		if internal.ScopeAllows([]string{scope}, "db:read:sb_tokens") {
+			t.Errorf("expected %s to not allow system collections", scope)
+		}
+	}
+
+	if err := internal.ValidateScope("db:read:sb_tokens"); err == nil {
+		t.Error("expected a scope naming a system collection to be invalid")
+	} else if err := internal.ValidateScope("db:read:*"); err != nil {
+		t.Errorf("expected db:read:* to be valid got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package staticbackend
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"staticbackend/db"
+	"staticbackend/middleware"
+	"strings"
+	"time"
+)
+
+// export writes all the collections of the base, it's reserved to root
+// users:
+//
+//	GET /export?format=ndjson|tar&skip=col1,col2
+func export(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opt := db.ExportOptions{
+		Format: r.URL.Query().Get("format"),
+		Skip:   splitList(r.URL.Query().Get("skip")),
+	}
+	if len(opt.Format) == 0 {
+		opt.Format = db.FormatNDJSON
+	}
+
+	contentType := "application/x-ndjson"
+	switch opt.Format {
+	case db.FormatNDJSON:
+	case db.FormatTar:
+		contentType = "application/x-tar"
+	default:
+		http.Error(w, "invalid format, use ndjson or tar", http.StatusBadRequest)
+		return
+	}
+
+	filename := fmt.Sprintf("%s-%s.%s", conf.Name, time.Now().Format("20060102-150405"), opt.Format)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	// the status is sent with the first bytes, errors can only be logged
+	if err := db.Export(client.Database(conf.Name), w, opt); err != nil {
+		log.Printf("error exporting base %s: %v\n", conf.Name, err)
+	}
+}
+
+// importBase inserts the documents of an export in the base, it's reserved
+// to root users:
+//
+//	POST /import?skip=col1,col2&remap=oldId:newId,oldId2:newId2
+func importBase(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opt, err := ParseImportOptions(r.URL.Query().Get("skip"), r.URL.Query().Get("remap"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Import(client.Database(conf.Name), r.Body, opt)
+	if err != nil {
+		// what was imported before the error is kept
+		http.Error(w, fmt.Sprintf("%v, imported: %v", err, result.Documents), http.StatusBadRequest)
+		return
+	}
+
+	respond(w, http.StatusOK, result)
+}
+
+// Export writes the base of the data store at dbHost, the data store is
+// chosen as for Start.
+func Export(dbHost, base string, w io.Writer, opt db.ExportOptions) error {
+	if err := openDatabase(dbHost); err != nil {
+		return err
+	}
+	return db.Export(client.Database(base), w, opt)
+}
+
+// Import inserts an export in the base of the data store at dbHost
+func Import(dbHost, base string, r io.Reader, opt db.ImportOptions) (db.ImportResult, error) {
+	if err := openDatabase(dbHost); err != nil {
+		return db.ImportResult{}, err
+	}
+	return db.Import(client.Database(base), r, opt)
+}
+
+// ParseImportOptions parses the comma separated collections to skip and
+// oldId:newId pairs to remap of an import
+func ParseImportOptions(skip, remap string) (db.ImportOptions, error) {
+	opt := db.ImportOptions{
+		Skip:  splitList(skip),
+		Remap: make(map[string]string),
+	}
+
+	for _, pair := range splitList(remap) {
+		ids := strings.SplitN(pair, ":", 2)
+		if len(ids) != 2 {
+			return opt, fmt.Errorf("invalid remap %s, use oldId:newId", pair)
+		}
+		opt.Remap[strings.TrimSpace(ids[0])] = strings.TrimSpace(ids[1])
+	}
+	return opt, nil
+}
@@ -0,0 +1,107 @@
+package staticbackend
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"staticbackend/db"
+	"staticbackend/internal"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestExportImport(t *testing.T) {
+	curDB := database.client.Database(dbName)
+
+	oldAccount, newAccount := primitive.NewObjectID(), primitive.NewObjectID()
+	created := time.Now().UTC().Truncate(time.Millisecond)
+
+	var docs []interface{}
+	for i := 0; i < 3; i++ {
+		docs = append(docs, bson.M{
+			internal.FieldID:        primitive.NewObjectID(),
+			internal.FieldAccountID: oldAccount,
+			"n":                     i,
+			"created":               created,
+		})
+	}
+	if err := curDB.InsertMany("backedup", docs); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := internal.Index{Keys: []internal.IndexKey{{Field: "n"}}, Unique: true}
+	if err := db.ValidateIndex(curDB, "backedup", &idx); err != nil {
+		t.Fatal(err)
+	} else if err := curDB.CreateIndex("backedup", idx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{db.FormatNDJSON, db.FormatTar} {
+		resp := dbReq(t, export, "GET", "/export?format="+format, nil, true)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(GetResponseBody(t, resp))
+		}
+
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the system collections are exported as well
+		if !bytes.Contains(b, []byte("sb_tokens")) {
+			t.Errorf("expected the %s export to have sb_tokens", format)
+		}
+
+		target := database.client.Database("imported_" + format)
+
+		opt := db.ImportOptions{
+			Skip:  []string{"sb_tokens", "sb_accounts"},
+			Remap: map[string]string{oldAccount.Hex(): newAccount.Hex()},
+		}
+		result, err := db.Import(target, bytes.NewReader(b), opt)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		} else if result.Documents["backedup"] != 3 {
+			t.Errorf("%s: expected 3 imported documents got %v", format, result.Documents)
+		} else if _, ok := result.Documents["sb_tokens"]; ok {
+			t.Errorf("%s: expected sb_tokens to be skipped", format)
+		}
+
+		var imported []bson.M
+		if err := target.Find("backedup", bson.M{}, internal.FindOptions{}, &imported); err != nil {
+			t.Fatal(err)
+		} else if len(imported) != 3 {
+			t.Fatalf("%s: expected 3 documents got %d", format, len(imported))
+		}
+
+		doc := imported[0]
+		if _, ok := doc[internal.FieldID].(primitive.ObjectID); !ok {
+			t.Errorf("%s: expected the id to stay an ObjectID got %T", format, doc[internal.FieldID])
+		} else if doc[internal.FieldAccountID] != newAccount {
+			t.Errorf("%s: expected the account to be remapped got %v", format, doc[internal.FieldAccountID])
+		} else if c, ok := doc["created"].(primitive.DateTime); !ok || !c.Time().Equal(created) {
+			t.Errorf("%s: expected the date to be kept got %v (%T)", format, doc["created"], doc["created"])
+		}
+
+		indexes, err := target.ListIndexes("backedup")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+		for _, v := range indexes {
+			found = found || (v.Name == idx.Name && v.Unique)
+		}
+		if !found {
+			t.Errorf("%s: expected the unique index %s to be imported got %v", format, idx.Name, indexes)
+		}
+
+		if err := target.Drop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
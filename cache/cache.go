@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"staticbackend/internal"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -15,6 +16,9 @@ import (
 type Cache struct {
 	Rdb *redis.Client
 	Ctx context.Context
+	// LoadRules reads the rules of a collection when they're not in the
+	// cache, realtime events of the collection are refused without it
+	LoadRules RulesLoader
 }
 
 // NewCache returns an initiated Redis client
@@ -36,7 +40,7 @@ func (c *Cache) Get(key string) (string, error) {
 }
 
 func (c *Cache) Set(key string, value string) error {
-	if _, err := c.Rdb.Set(c.Ctx, key, value, 12*time.Hour).Result(); err != nil {
+	if _, err := c.Rdb.Set(c.Ctx, key, value, internal.CacheTTL).Result(); err != nil {
 		return err
 	}
 	return nil
@@ -59,6 +63,10 @@ func (c *Cache) SetTyped(key string, v interface{}) error {
 	return c.Set(key, string(b))
 }
 
+func (c *Cache) Del(key string) error {
+	return c.Rdb.Del(c.Ctx, key).Err()
+}
+
 func (c *Cache) Inc(key string, by int64) (int64, error) {
 	return c.Rdb.IncrBy(c.Ctx, key, by).Result()
 }
@@ -169,12 +177,43 @@ func (c *Cache) HasPermission(token, repo, payload string) bool {
 		return false
 	}
 
+	rules, ok := rulesFor(c, c.LoadRules, token, repo)
+	if !ok {
+		return false
+	}
+	return canRead(me, rules, repo, payload)
+}
+
+func (c *Cache) QueueWork(key, value string) error {
+	return c.Rdb.RPush(c.Ctx, key, value).Err()
+}
+
+func (c *Cache) DequeueWork(key string) (string, error) {
+	val, err := c.Rdb.LPop(c.Ctx, key).Result()
+	if err != nil {
+		if err.Error() == redis.Nil.Error() {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return val, nil
+}
+
+// canRead returns true if the user can read the document received as JSON
+// payload for this repository. The collection's rules are used when it has
+// some.
+func canRead(me internal.Auth, rules *internal.CollectionRules, repo, payload string) bool {
 	docs := make(map[string]interface{})
 	if err := json.Unmarshal([]byte(payload), &docs); err != nil {
 		fmt.Println("error decoding docs for permissions check", err)
 		return false
 	}
 
+	if rules != nil {
+		return me.Role >= internal.RootRole || rules.Allowed(me, internal.OpRead, docs)
+	}
+
 	switch internal.ReadPermission(repo) {
 	case internal.PermGroup:
 		acctID, ok := docs[internal.FieldAccountID]
@@ -195,18 +234,50 @@ func (c *Cache) HasPermission(token, repo, payload string) bool {
 	}
 }
 
-func (c *Cache) QueueWork(key, value string) error {
-	return c.Rdb.RPush(c.Ctx, key, value).Err()
-}
+// RulesLoader returns the rules of the base's collection, ok is false when
+// it has none
+type RulesLoader func(base, col string) (rules internal.CollectionRules, ok bool, err error)
+
+// rulesFor returns the rules of the repository's collection or nil if it has
+// none. Rules are kept in the cache by the server when they change and loaded
+// on a miss, ok is false when they cannot be known.
+func rulesFor(c internal.PubSuber, load RulesLoader, token, repo string) (*internal.CollectionRules, bool) {
+	var conf internal.BaseConfig
+	if err := c.GetTyped("base:"+token, &conf); err != nil {
+		return nil, false
+	}
 
-func (c *Cache) DequeueWork(key string) (string, error) {
-	val, err := c.Rdb.LPop(c.Ctx, key).Result()
+	col := strings.TrimPrefix(repo, "db-")
+	key := internal.RulesKey(conf.Name, col)
+
+	var rules internal.CollectionRules
+	if v, err := c.Get(key); err == nil {
+		// an empty value is a collection without rules
+		if len(v) == 0 {
+			return nil, true
+		} else if err := json.Unmarshal([]byte(v), &rules); err != nil {
+			return nil, false
+		}
+		return &rules, true
+	}
+
+	if load == nil {
+		return nil, false
+	}
+
+	rules, ok, err := load(conf.Name, col)
 	if err != nil {
-		if err.Error() == redis.Nil.Error() {
-			return "", nil
+		fmt.Println("error loading rules for realtime permissions check", err)
+		return nil, false
+	} else if !ok {
+		if err := c.Set(key, ""); err != nil {
+			fmt.Println("error caching rules", err)
 		}
-		return "", err
+		return nil, true
 	}
 
-	return val, nil
+	if err := c.SetTyped(key, rules); err != nil {
+		fmt.Println("error caching rules", err)
+	}
+	return &rules, true
 }
@@ -0,0 +1,267 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"staticbackend/internal"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errKeyNotFound = errors.New("key not found")
+
+type memoryItem struct {
+	value   string
+	expires time.Time
+}
+
+// Memory is an in-process implementation of internal.PubSuber used when
+// running without Redis. It only works for a single instance.
+type Memory struct {
+	mu     sync.RWMutex
+	items  map[string]memoryItem
+	queues map[string][]string
+	subs   map[string]map[chan internal.Command]bool
+
+	// LoadRules reads the rules of a collection when they're not in the
+	// cache, realtime events of the collection are refused without it
+	LoadRules RulesLoader
+}
+
+// NewMemory returns an initiated in-process cache and pub/sub
+func NewMemory() *Memory {
+	m := &Memory{
+		items:  make(map[string]memoryItem),
+		queues: make(map[string][]string),
+		subs:   make(map[string]map[chan internal.Command]bool),
+	}
+
+	go m.sweep(memorySweepInterval)
+
+	return m
+}
+
+// memorySweepInterval is how often the expired items are removed
+const memorySweepInterval = 10 * time.Minute
+
+func (item memoryItem) expired(now time.Time) bool {
+	return !item.expires.IsZero() && now.After(item.expires)
+}
+
+// sweep removes the expired items that are never read again
+func (m *Memory) sweep(every time.Duration) {
+	for now := range time.Tick(every) {
+		m.mu.Lock()
+		for key, item := range m.items {
+			if item.expired(now) {
+				delete(m.items, key)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *Memory) Get(key string) (string, error) {
+	m.mu.RLock()
+	item, ok := m.items[key]
+	m.mu.RUnlock()
+
+	if !ok {
+		return "", errKeyNotFound
+	} else if item.expired(time.Now()) {
+		m.mu.Lock()
+		// it may have been set again since it was read
+		if cur, ok := m.items[key]; ok && cur.expired(time.Now()) {
+			delete(m.items, key)
+		}
+		m.mu.Unlock()
+
+		return "", errKeyNotFound
+	}
+	return item.value, nil
+}
+
+func (m *Memory) Set(key string, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.items[key] = memoryItem{value: value, expires: time.Now().Add(internal.CacheTTL)}
+	return nil
+}
+
+func (m *Memory) GetTyped(key string, v interface{}) error {
+	s, err := m.Get(key)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte(s), v)
+}
+
+func (m *Memory) SetTyped(key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return m.Set(key, string(b))
+}
+
+func (m *Memory) Del(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.items, key)
+	return nil
+}
+
+func (m *Memory) Inc(key string, by int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item := m.items[key]
+	if item.expired(time.Now()) {
+		item = memoryItem{}
+	}
+
+	var n int64
+	if len(item.value) > 0 {
+		i, err := strconv.ParseInt(item.value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("value is not an integer: %v", err)
+		}
+		n = i
+	}
+
+	n += by
+	item.value = strconv.FormatInt(n, 10)
+	m.items[key] = item
+	return n, nil
+}
+
+func (m *Memory) Dec(key string, by int64) (int64, error) {
+	return m.Inc(key, -by)
+}
+
+func (m *Memory) Subscribe(send chan internal.Command, token, channel string, close chan bool) {
+	ch := make(chan internal.Command, 100)
+
+	m.mu.Lock()
+	if _, ok := m.subs[channel]; !ok {
+		m.subs[channel] = make(map[chan internal.Command]bool)
+	}
+	m.subs[channel][ch] = true
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.subs[channel], ch)
+		if len(m.subs[channel]) == 0 {
+			delete(m.subs, channel)
+		}
+		m.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case msg := <-ch:
+			if msg.Type == internal.MsgTypeChanIn {
+				msg.Type = internal.MsgTypeChanOut
+			} else if msg.IsSystemEvent {
+
+			} else if msg.IsDBEvent() && m.HasPermission(token, channel, msg.Data) == false {
+				continue
+			}
+			send <- msg
+		case <-close:
+			return
+		}
+	}
+}
+
+func (m *Memory) Publish(msg internal.Command) error {
+	// Publish the event to system so server-side function can trigger
+	sysmsg := msg
+	sysmsg.IsSystemEvent = true
+	m.dispatch("sbsys", sysmsg)
+
+	m.dispatch(msg.Channel, msg)
+	return nil
+}
+
+// dispatch sends the message to all subscribers of channel, like Redis
+// messages are dropped for subscribers that are not keeping up.
+func (m *Memory) dispatch(channel string, msg internal.Command) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for ch := range m.subs[channel] {
+		select {
+		case ch <- msg:
+		default:
+			log.Println("dropping message for slow subscriber on channel: ", channel)
+		}
+	}
+}
+
+func (m *Memory) PublishDocument(channel, typ string, v interface{}) {
+	m.mu.RLock()
+	count := len(m.subs[channel])
+	m.mu.RUnlock()
+
+	if count == 0 {
+		return
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("error publishing db doc: ", err)
+		return
+	}
+
+	msg := internal.Command{
+		Channel: channel,
+		Data:    string(b),
+		Type:    typ,
+	}
+
+	if err := m.Publish(msg); err != nil {
+		fmt.Println("unable to publish db doc events:", err)
+	}
+}
+
+func (m *Memory) HasPermission(token, repo, payload string) bool {
+	var me internal.Auth
+	if err := m.GetTyped(token, &me); err != nil {
+		return false
+	}
+
+	rules, ok := rulesFor(m, m.LoadRules, token, repo)
+	if !ok {
+		return false
+	}
+	return canRead(me, rules, repo, payload)
+}
+
+func (m *Memory) QueueWork(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.queues[key] = append(m.queues[key], value)
+	return nil
+}
+
+func (m *Memory) DequeueWork(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := m.queues[key]
+	if len(q) == 0 {
+		return "", nil
+	}
+
+	m.queues[key] = q[1:]
+	return q[0], nil
+}
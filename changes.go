@@ -0,0 +1,123 @@
+package staticbackend
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"staticbackend/internal"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// changesCollection holds the resume token of the change stream in the
+	// "sbsys" database
+	changesCollection = "sb_changes"
+	changesTokenID    = "realtime"
+
+	// changesRetry is the delay before reopening a failed change stream
+	changesRetry = 5 * time.Second
+)
+
+// changeStream returns the data store watcher when DB_CHANGE_STREAM is set
+// and the data store supports it. The realtime database events are then
+// published from the change stream instead of by db.Base.
+func changeStream() (internal.ChangeWatcher, bool) {
+	v := os.Getenv("DB_CHANGE_STREAM")
+	if v != "1" && !strings.EqualFold(v, "true") {
+		return nil, false
+	}
+
+	w, ok := client.(internal.ChangeWatcher)
+	if !ok {
+		log.Println("DB_CHANGE_STREAM is set but the data store has no change stream, it's ignored")
+		return nil, false
+	}
+	return w, true
+}
+
+// documentPublisher returns how db.Base publishes the realtime database
+// events, it publishes nothing when the change stream does it.
+func documentPublisher() func(channel, typ string, v interface{}) {
+	if _, ok := changeStream(); ok {
+		return func(channel, typ string, v interface{}) {}
+	}
+	return volatile.PublishDocument
+}
+
+// watchChanges publishes the realtime events of all the writes to the bases,
+// it runs until ctx is done. The resume token is saved after each event so
+// the events made while the server was down are published at the next start.
+func watchChanges(ctx context.Context, w internal.ChangeWatcher) {
+	sysDB := client.Database("sbsys")
+
+	for {
+		token, err := loadResumeToken(sysDB)
+		if err != nil {
+			log.Println("error loading the change stream resume token: ", err)
+		}
+
+		err = w.Watch(ctx, token, func(e internal.ChangeEvent) error {
+			publishChange(e)
+			return saveResumeToken(sysDB, e.ResumeToken)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, internal.ErrChangeHistoryLost) {
+			log.Println("the change stream cannot resume, events were lost: ", err)
+			if err := saveResumeToken(sysDB, nil); err != nil {
+				log.Println("error resetting the change stream resume token: ", err)
+			}
+			continue
+		}
+
+		log.Println("the change stream stopped, retrying: ", err)
+		time.Sleep(changesRetry)
+	}
+}
+
+// publishChange publishes the event as db.Base does: the document with its
+// id, or the id for deletes.
+func publishChange(e internal.ChangeEvent) {
+	if e.Type == internal.MsgTypeDBDeleted {
+		volatile.PublishDocument("db-"+e.Collection, e.Type, e.ID)
+		return
+	}
+
+	doc := e.Doc
+	doc["id"] = doc[internal.FieldID]
+	delete(doc, internal.FieldID)
+	delete(doc, internal.FieldOwnerID)
+
+	volatile.PublishDocument("db-"+e.Collection, e.Type, doc)
+}
+
+func loadResumeToken(sysDB internal.Database) ([]byte, error) {
+	var doc struct {
+		Token []byte `bson:"token"`
+	}
+	if err := sysDB.FindOne(changesCollection, bson.M{internal.FieldID: changesTokenID}, &doc); err != nil {
+		if errors.Is(err, internal.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return doc.Token, nil
+}
+
+func saveResumeToken(sysDB internal.Database, token []byte) error {
+	filter := bson.M{internal.FieldID: changesTokenID}
+	res, err := sysDB.UpdateOne(changesCollection, filter, bson.M{"$set": bson.M{"token": token}})
+	if err != nil {
+		return err
+	} else if res.MatchedCount > 0 {
+		return nil
+	}
+
+	return sysDB.InsertOne(changesCollection, bson.M{internal.FieldID: changesTokenID, "token": token})
+}
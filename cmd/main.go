@@ -1,12 +1,31 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
 	"os"
 	backend "staticbackend"
+	"staticbackend/db"
+	"strings"
 )
 
 func main() {
 	dbHost := os.Getenv("DATABASE_URL")
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			exportBase(dbHost, os.Args[2:])
+			return
+		case "import":
+			importBase(dbHost, os.Args[2:])
+			return
+		}
+	}
+
 	port := os.Getenv("PORT")
 	if len(port) == 0 {
 		port = "8099"
@@ -14,3 +33,82 @@ func main() {
 
 	backend.Start(dbHost, port)
 }
+
+// exportBase writes a base to a file or stdout:
+//
+//	export -base name [-format ndjson|tar] [-skip col1,col2] [-out file]
+func exportBase(dbHost string, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	base := fs.String("base", "", "name of the base to export")
+	format := fs.String("format", db.FormatNDJSON, "ndjson or tar")
+	skip := fs.String("skip", "", "comma separated collections to skip")
+	out := fs.String("out", "", "file to write, stdout by default")
+	fs.Parse(args)
+
+	if len(*base) == 0 {
+		log.Fatal("the -base flag is required")
+	}
+
+	var w io.Writer = os.Stdout
+	if len(*out) > 0 {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	opt := db.ExportOptions{Format: *format}
+	for _, col := range strings.Split(*skip, ",") {
+		if col = strings.TrimSpace(col); len(col) > 0 {
+			opt.Skip = append(opt.Skip, col)
+		}
+	}
+
+	if err := backend.Export(dbHost, *base, w, opt); err != nil {
+		log.Fatal("error exporting: ", err)
+	}
+}
+
+// importBase inserts an export from a file or stdin:
+//
+//	import -base name [-skip col1,col2] [-remap oldId:newId,...] [-in file]
+func importBase(dbHost string, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	base := fs.String("base", "", "name of the base to import into")
+	skip := fs.String("skip", "", "comma separated collections to skip")
+	remap := fs.String("remap", "", "comma separated oldId:newId accountId and sb_owner to change")
+	in := fs.String("in", "", "file to read, stdin by default")
+	fs.Parse(args)
+
+	if len(*base) == 0 {
+		log.Fatal("the -base flag is required")
+	}
+
+	opt, err := backend.ParseImportOptions(*skip, *remap)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var r io.Reader = os.Stdin
+	if len(*in) > 0 {
+		f, err := os.Open(*in)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	result, err := backend.Import(dbHost, *base, r, opt)
+	if err != nil {
+		log.Fatalf("error importing, imported %v: %v", result.Documents, err)
+	}
+
+	b, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(b))
+}
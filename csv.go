@@ -0,0 +1,112 @@
+package staticbackend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"staticbackend/db"
+	"staticbackend/middleware"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxCSVSize is the largest CSV accepted for an import
+const maxCSVSize = 32 << 20
+
+// importCSV creates a document per row of a CSV, sent as the body or as the
+// "file" of a multipart form. The types of the columns can be set with
+// ?types=price:number,sku:string, the others are inferred.
+func (database *Database) importCSV(w http.ResponseWriter, r *http.Request) {
+	conf, auth, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := database.client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	col, _ := ShiftPath(r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if len(col) == 0 {
+		http.Error(w, "missing collection name", http.StatusBadRequest)
+		return
+	}
+
+	opt, err := getCSVOptions(r.URL.Query().Get("types"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := csvBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+
+	result, err := database.base.ImportCSV(auth, curDB, col, body, opt)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	} else if len(result.Errors) > 0 {
+		respond(w, http.StatusBadRequest, result)
+		return
+	}
+
+	respond(w, http.StatusCreated, result)
+}
+
+// csvBody returns the CSV of a multipart form or the body
+func csvBody(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCSVSize)
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return r.Body, nil
+	}
+
+	if err := r.ParseMultipartForm(maxCSVSize); err != nil {
+		return nil, err
+	}
+
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// getCSVOptions parses the field:type pairs of the columns
+func getCSVOptions(types string) (db.CSVOptions, error) {
+	opt := db.CSVOptions{Types: make(map[string]string)}
+	for _, pair := range splitList(types) {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return opt, fmt.Errorf("invalid type %s, use field:type", pair)
+		}
+		opt.Types[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return opt, nil
+}
+
+// writeCSV sends the documents as a CSV file download
+func writeCSV(w http.ResponseWriter, col string, docs []bson.M) {
+	var buf bytes.Buffer
+	if err := db.WriteCSV(&buf, docs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("%s-%s.csv", col, time.Now().Format("20060102-150405"))
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Write(buf.Bytes())
+}
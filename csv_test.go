@@ -0,0 +1,117 @@
+package staticbackend
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"staticbackend/db"
+	"staticbackend/internal"
+	"staticbackend/middleware"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func csvReq(t *testing.T, path, body string) *http.Response {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	req.Header.Set("SB-PUBLIC-KEY", pubKey)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", adminToken))
+	req.Header.Set("Content-Type", "text/csv")
+
+	h := middleware.Chain(
+		http.HandlerFunc(database.importCSV),
+		middleware.WithDB(database.client, volatile),
+		middleware.RequireAuth(database.client, volatile),
+	)
+	h.ServeHTTP(w, req)
+
+	return w.Result()
+}
+
+func TestCSVImportExport(t *testing.T) {
+	data := "name,price,active,created,zip,meta.tag\n" +
+		"A,10.5,true,2021-01-02,01234,x\n" +
+		"B,3,false,,,y\n"
+
+	resp := csvReq(t, "/csv/csvdocs", data)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var result db.CSVResult
+	if err := parseBody(resp.Body, &result); err != nil {
+		t.Fatal(err)
+	} else if result.Created != 2 {
+		t.Errorf("expected 2 documents created got %d", result.Created)
+	}
+
+	curDB := database.client.Database(dbName)
+
+	var doc bson.M
+	if err := curDB.FindOne("csvdocs", bson.M{"name": "A"}, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc["price"] != 10.5 {
+		t.Errorf("expected price to be the number 10.5 got %v (%T)", doc["price"], doc["price"])
+	} else if doc["active"] != true {
+		t.Errorf("expected active to be true got %v (%T)", doc["active"], doc["active"])
+	} else if _, ok := doc["created"].(primitive.DateTime); !ok {
+		t.Errorf("expected created to be a date got %T", doc["created"])
+	} else if doc["zip"] != "01234" {
+		t.Errorf("expected the zip code to keep its leading zero got %v", doc["zip"])
+	} else if meta, ok := doc["meta"].(bson.M); !ok || meta["tag"] != "x" {
+		t.Errorf("expected meta.tag to be nested got %v", doc["meta"])
+	}
+
+	// one invalid row and nothing is created
+	invalid := "name,price\nC,1\nD,abc\nE,2,extra\n"
+	resp = csvReq(t, "/csv/csvdocs?types=price:number", invalid)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	result = db.CSVResult{}
+	if err := parseBody(resp.Body, &result); err != nil {
+		t.Fatal(err)
+	} else if len(result.Errors) != 2 {
+		t.Fatalf("expected 2 row errors got %v", result.Errors)
+	} else if re := result.Errors[0]; re.Row != 3 || re.Field != "price" {
+		t.Errorf("expected the price of row 3 to be invalid got %v", re)
+	} else if result.Errors[1].Row != 4 {
+		t.Errorf("expected row 4 to have too many fields got %v", result.Errors[1])
+	}
+
+	if n, err := curDB.Count("csvdocs", bson.M{}); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Errorf("expected nothing created from the invalid CSV got %d documents", n)
+	}
+
+	resp = dbReq(t, database.query, "POST", "/query/csvdocs?format=csv&sort=name", [][]interface{}{{"price", ">", 1}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	} else if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("expected a CSV got %s", ct)
+	}
+
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(records) != 3 {
+		t.Fatalf("expected a header and 2 rows got %v", records)
+	}
+
+	header := strings.Join(records[0], ",")
+	if !strings.HasPrefix(header, "id,") || !strings.Contains(header, "meta.tag") {
+		t.Errorf("expected id first and nested fields flattened got %s", header)
+	} else if strings.Contains(header, internal.FieldOwnerID) {
+		t.Errorf("expected the owner to not be exported got %s", header)
+	}
+}
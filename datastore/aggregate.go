@@ -0,0 +1,291 @@
+package datastore
+
+import (
+	"fmt"
+	"staticbackend/internal"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// bucketLayouts are the Go, MongoDB and PostgreSQL formats of the date
+// buckets. They must produce the same keys.
+var bucketLayouts = map[string]struct {
+	goLayout string
+	mongo    string
+	pg       string
+}{
+	internal.BucketHour:  {"2006-01-02T15", "%Y-%m-%dT%H", `YYYY-MM-DD"T"HH24`},
+	internal.BucketDay:   {"2006-01-02", "%Y-%m-%d", "YYYY-MM-DD"},
+	internal.BucketWeek:  {"", "%G-W%V", `IYYY-"W"IW`},
+	internal.BucketMonth: {"2006-01", "%Y-%m", "YYYY-MM"},
+	internal.BucketYear:  {"2006", "%Y", "YYYY"},
+}
+
+// bucketKey truncates the date value to the bucket. Dates received as JSON
+// are stored as ISO 8601 strings, they are accepted as well.
+func bucketKey(v interface{}, bucket string) interface{} {
+	var t time.Time
+	switch x := v.(type) {
+	case primitive.DateTime, time.Time:
+		t = toTime(x)
+	case string:
+		var err error
+		if t, err = time.Parse(time.RFC3339Nano, x); err != nil {
+			if len(x) < 10 {
+				return nil
+			}
+			if t, err = time.Parse("2006-01-02", x[:10]); err != nil {
+				return nil
+			}
+		}
+	default:
+		return nil
+	}
+
+	t = t.UTC()
+	if bucket == internal.BucketWeek {
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", y, w)
+	}
+	return t.Format(bucketLayouts[bucket].goLayout)
+}
+
+// group accumulates the documents of one group
+type group struct {
+	result bson.M
+	sums   map[string]float64
+	floats map[string]bool
+	counts map[string]int64
+}
+
+// aggregateDocs groups the documents in Go, it is used by the embedded data
+// store.
+func aggregateDocs(docs []bson.M, opt internal.AggregateOptions) ([]bson.M, error) {
+	var groups []*group
+	index := make(map[string]*group)
+
+	for _, doc := range docs {
+		keys := bson.M{}
+		for _, key := range opt.GroupBy {
+			v, _ := getPath(doc, key.Field)
+			if len(key.Bucket) > 0 {
+				v = bucketKey(v, key.Bucket)
+			}
+			keys[key.As] = v
+		}
+
+		id, err := toExtJSON(keys)
+		if err != nil {
+			return nil, err
+		}
+
+		g, ok := index[string(id)]
+		if !ok {
+			g = &group{
+				result: keys,
+				sums:   make(map[string]float64),
+				floats: make(map[string]bool),
+				counts: make(map[string]int64),
+			}
+			index[string(id)] = g
+			groups = append(groups, g)
+		}
+
+		for _, acc := range opt.Accumulators {
+			g.add(acc, doc)
+		}
+	}
+
+	results := make([]bson.M, 0, len(groups))
+	for _, g := range groups {
+		for _, acc := range opt.Accumulators {
+			g.finish(acc)
+		}
+		results = append(results, g.result)
+	}
+
+	var sortBy bson.D
+	for _, key := range opt.GroupBy {
+		sortBy = append(sortBy, bson.E{Key: key.As, Value: 1})
+	}
+	sortDocs(results, sortBy)
+
+	return results, nil
+}
+
+func (g *group) add(acc internal.Accumulator, doc bson.M) {
+	if acc.Op == internal.AccumulatorCount {
+		g.counts[acc.As]++
+		return
+	}
+
+	v, ok := getPath(doc, acc.Field)
+	if !ok || v == nil {
+		return
+	}
+
+	switch acc.Op {
+	case internal.AccumulatorSum, internal.AccumulatorAvg:
+		f, ok := toFloat64(v)
+		if !ok {
+			return
+		}
+
+		// the sum stays an integer unless a value is a float
+		if _, ok := toInt64(v); !ok {
+			g.floats[acc.As] = true
+		}
+
+		g.sums[acc.As] += f
+		g.counts[acc.As]++
+	case internal.AccumulatorMin, internal.AccumulatorMax:
+		cur, ok := g.result[acc.As]
+		if !ok || cur == nil {
+			g.result[acc.As] = v
+			return
+		}
+
+		c, ok := compareValues(v, cur)
+		if !ok {
+			c = typeOrder(v) - typeOrder(cur)
+		}
+		if (acc.Op == internal.AccumulatorMin && c < 0) || (acc.Op == internal.AccumulatorMax && c > 0) {
+			g.result[acc.As] = v
+		}
+	}
+}
+
+func (g *group) finish(acc internal.Accumulator) {
+	switch acc.Op {
+	case internal.AccumulatorCount:
+		g.result[acc.As] = g.counts[acc.As]
+	case internal.AccumulatorSum:
+		if !g.floats[acc.As] {
+			g.result[acc.As] = int64(g.sums[acc.As])
+		} else {
+			g.result[acc.As] = g.sums[acc.As]
+		}
+	case internal.AccumulatorAvg:
+		if n := g.counts[acc.As]; n > 0 {
+			g.result[acc.As] = g.sums[acc.As] / float64(n)
+		} else {
+			g.result[acc.As] = nil
+		}
+	default:
+		if _, ok := g.result[acc.As]; !ok {
+			g.result[acc.As] = nil
+		}
+	}
+}
+
+// mongoAggregatePipeline returns the $match, $group and $sort stages
+func mongoAggregatePipeline(filter bson.M, opt internal.AggregateOptions) []bson.M {
+	var id interface{}
+	var sortBy bson.D
+	if len(opt.GroupBy) > 0 {
+		keys := bson.M{}
+		for _, key := range opt.GroupBy {
+			var expr interface{} = "$" + key.Field
+			if len(key.Bucket) > 0 {
+				expr = bson.M{
+					"$dateToString": bson.M{
+						"format": bucketLayouts[key.Bucket].mongo,
+						"date": bson.M{
+							"$convert": bson.M{"input": expr, "to": "date", "onError": nil, "onNull": nil},
+						},
+						"timezone": "UTC",
+					},
+				}
+			}
+			keys[key.As] = expr
+			sortBy = append(sortBy, bson.E{Key: "_id." + key.As, Value: 1})
+		}
+		id = keys
+	}
+
+	stage := bson.M{"_id": id}
+	for _, acc := range opt.Accumulators {
+		switch acc.Op {
+		case internal.AccumulatorCount:
+			stage[acc.As] = bson.M{"$sum": 1}
+		default:
+			stage[acc.As] = bson.M{"$" + acc.Op: "$" + acc.Field}
+		}
+	}
+
+	pipeline := []bson.M{
+		{"$match": filter},
+		{"$group": stage},
+	}
+	if len(sortBy) > 0 {
+		pipeline = append(pipeline, bson.M{"$sort": sortBy})
+	}
+	return pipeline
+}
+
+// flattenGroup moves the group keys out of the _id of a $group result
+func flattenGroup(doc bson.M) {
+	if keys, ok := asMap(doc[internal.FieldID]); ok {
+		for k, v := range keys {
+			doc[k] = v
+		}
+	}
+	delete(doc, internal.FieldID)
+}
+
+// aggregate returns the SELECT list of the group keys and accumulators.
+// Every column is returned as JSONB.
+func (w *sqlWhere) aggregate(opt internal.AggregateOptions) []string {
+	var cols []string
+	for _, key := range opt.GroupBy {
+		if len(key.Bucket) == 0 {
+			cols = append(cols, w.path(key.Field))
+			continue
+		}
+
+		p, tp := w.path(key.Field), w.textPath(key.Field)
+		date := fmt.Sprintf(`CASE
+			WHEN jsonb_typeof(%s) = 'string' AND %s ~ '^\d{4}-\d{2}-\d{2}' THEN (%s)::timestamptz
+			WHEN jsonb_typeof(%s) = 'object' AND jsonb_typeof(%s -> '$date') = 'string' THEN (%s ->> '$date')::timestamptz
+		END`, p, tp, tp, p, p, p)
+		cols = append(cols, fmt.Sprintf("to_jsonb(to_char((%s) AT TIME ZONE 'UTC', '%s'))", date, bucketLayouts[key.Bucket].pg))
+	}
+
+	for _, acc := range opt.Accumulators {
+		if acc.Op == internal.AccumulatorCount {
+			cols = append(cols, "to_jsonb(COUNT(*))")
+			continue
+		}
+
+		p, tp := w.path(acc.Field), w.textPath(acc.Field)
+		num := fmt.Sprintf("CASE WHEN jsonb_typeof(%s) = 'number' THEN (%s)::numeric END", p, tp)
+		str := fmt.Sprintf("CASE WHEN jsonb_typeof(%s) = 'string' THEN %s END", p, tp)
+
+		var expr string
+		switch acc.Op {
+		case internal.AccumulatorSum:
+			expr = fmt.Sprintf("to_jsonb(COALESCE(SUM(%s), 0))", num)
+		case internal.AccumulatorAvg:
+			expr = fmt.Sprintf("to_jsonb(AVG(%s))", num)
+		case internal.AccumulatorMin:
+			// numbers are sorted before strings
+			expr = fmt.Sprintf("COALESCE(to_jsonb(MIN(%s)), to_jsonb(MIN(%s)))", num, str)
+		case internal.AccumulatorMax:
+			expr = fmt.Sprintf("COALESCE(to_jsonb(MAX(%s)), to_jsonb(MAX(%s)))", str, num)
+		}
+		cols = append(cols, expr)
+	}
+	return cols
+}
+
+// groupPositions returns "1, 2, ..., n" used by GROUP BY and ORDER BY
+func groupPositions(n int) string {
+	pos := make([]string, n)
+	for i := range pos {
+		pos[i] = fmt.Sprintf("%d", i+1)
+	}
+	return strings.Join(pos, ", ")
+}
@@ -0,0 +1,71 @@
+package datastore
+
+import (
+	"staticbackend/internal"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBucketKey(t *testing.T) {
+	on := time.Date(2021, 1, 3, 15, 4, 5, 0, time.UTC)
+
+	buckets := map[string]string{
+		internal.BucketHour:  "2021-01-03T15",
+		internal.BucketDay:   "2021-01-03",
+		internal.BucketWeek:  "2020-W53",
+		internal.BucketMonth: "2021-01",
+		internal.BucketYear:  "2021",
+	}
+
+	for bucket, expected := range buckets {
+		for _, v := range []interface{}{on, primitive.NewDateTimeFromTime(on), on.Format(time.RFC3339)} {
+			if key := bucketKey(v, bucket); key != expected {
+				t.Errorf("%s of %v: expected %s got %v", bucket, v, expected, key)
+			}
+		}
+	}
+
+	if key := bucketKey("not a date", internal.BucketDay); key != nil {
+		t.Errorf("expected nil for an invalid date got %v", key)
+	}
+}
+
+func TestAggregateDocs(t *testing.T) {
+	docs := []bson.M{
+		{"status": "open", "n": int32(2)},
+		{"status": "closed", "n": 1.5},
+		{"status": "open", "n": int64(4)},
+		{"status": "open"},
+	}
+
+	opt := internal.AggregateOptions{
+		GroupBy: []internal.GroupKey{{Field: "status"}},
+		Accumulators: []internal.Accumulator{
+			{Op: "count"},
+			{Op: "sum", Field: "n"},
+			{Op: "avg", Field: "n"},
+			{Op: "min", Field: "n"},
+		},
+	}
+	if err := opt.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := aggregateDocs(docs, opt)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(results) != 2 {
+		t.Fatalf("expected 2 groups got %d", len(results))
+	}
+
+	closed, open := results[0], results[1]
+	if closed["status"] != "closed" || closed["sum_n"] != 1.5 {
+		t.Errorf("unexpected closed group: %v", closed)
+	}
+	if open["count"] != int64(3) || open["sum_n"] != int64(6) || open["avg_n"] != 3.0 || open["min_n"] != int32(2) {
+		t.Errorf("unexpected open group: %v", open)
+	}
+}
@@ -0,0 +1,404 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Data stores other than MongoDB keep documents as relaxed extended JSON.
+// It preserves the BSON types (ObjectID, dates, int vs float) so documents
+// decode to the same Go values regardless of the data store.
+
+func toExtJSON(doc interface{}) ([]byte, error) {
+	return bson.MarshalExtJSON(doc, false, false)
+}
+
+// normalize converts doc (struct or map) into a bson.M holding only BSON
+// native types, i.e. int32, int64, float64, primitive.DateTime, bson.M and
+// primitive.A.
+func normalize(doc interface{}) (bson.M, error) {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var m bson.M
+	if err := bson.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// valueToExtJSON returns the extended JSON representation of a single value
+func valueToExtJSON(v interface{}) (string, error) {
+	b, err := toExtJSON(bson.M{"v": v})
+	if err != nil {
+		return "", err
+	}
+
+	var wrapper map[string]json.RawMessage
+	if err := json.Unmarshal(b, &wrapper); err != nil {
+		return "", err
+	}
+	return string(wrapper["v"]), nil
+}
+
+// valueFromExtJSON is the inverse of valueToExtJSON
+func valueFromExtJSON(data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	wrapped := append([]byte(`{"v":`), data...)
+	wrapped = append(wrapped, '}')
+
+	var m bson.M
+	if err := bson.UnmarshalExtJSON(wrapped, false, &m); err != nil {
+		return nil, err
+	}
+	return m["v"], nil
+}
+
+// decodeAll decodes the extended JSON documents into v, a pointer to a slice
+func decodeAll(docs [][]byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("results argument must be a pointer to a slice, got %T", v)
+	}
+
+	sv := rv.Elem()
+	results := reflect.MakeSlice(sv.Type(), 0, len(docs))
+	for _, doc := range docs {
+		ev := reflect.New(sv.Type().Elem())
+		if err := bson.UnmarshalExtJSON(doc, false, ev.Interface()); err != nil {
+			return err
+		}
+		results = reflect.Append(results, ev.Elem())
+	}
+
+	sv.Set(results)
+	return nil
+}
+
+func splitPath(field string) []string {
+	return strings.Split(field, ".")
+}
+
+// getPath returns the value at the dotted path field
+func getPath(doc bson.M, field string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, key := range splitPath(field) {
+		m, ok := asMap(cur)
+		if !ok {
+			return nil, false
+		}
+
+		cur, ok = m[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// setPath sets the value at the dotted path field creating the intermediate
+// sub documents when missing
+func setPath(doc bson.M, field string, v interface{}) error {
+	keys := splitPath(field)
+
+	cur := doc
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := cur[key]
+		if !ok || next == nil {
+			m := bson.M{}
+			cur[key] = m
+			cur = m
+			continue
+		}
+
+		m, ok := asMap(next)
+		if !ok {
+			return fmt.Errorf("cannot create field %s in a non-document value", field)
+		}
+		cur[key] = m
+		cur = m
+	}
+
+	cur[keys[len(keys)-1]] = v
+	return nil
+}
+
+// unsetPath removes the dotted path field and reports if it existed
+func unsetPath(doc bson.M, field string) bool {
+	keys := splitPath(field)
+
+	cur := doc
+	for _, key := range keys[:len(keys)-1] {
+		m, ok := asMap(cur[key])
+		if !ok {
+			return false
+		}
+		cur = m
+	}
+
+	last := keys[len(keys)-1]
+	if _, ok := cur[last]; !ok {
+		return false
+	}
+	delete(cur, last)
+	return true
+}
+
+func asMap(v interface{}) (bson.M, bool) {
+	switch m := v.(type) {
+	case bson.M:
+		return m, true
+	case map[string]interface{}:
+		return bson.M(m), true
+	case primitive.D:
+		return m.Map(), true
+	}
+	return nil, false
+}
+
+func asArray(v interface{}) (primitive.A, bool) {
+	switch a := v.(type) {
+	case primitive.A:
+		return a, true
+	case []interface{}:
+		return primitive.A(a), true
+	}
+	return nil, false
+}
+
+// applyUpdate applies the update operators to doc. Both must be normalized.
+func applyUpdate(doc, update bson.M) (modified bool, err error) {
+	for op, v := range update {
+		fields, ok := asMap(v)
+		if !ok {
+			return false, fmt.Errorf("the %s update operator expects a document", op)
+		}
+
+		for field, val := range fields {
+			changed := false
+
+			switch op {
+			case "$set":
+				cur, ok := getPath(doc, field)
+				changed = !ok || !reflect.DeepEqual(cur, val)
+				err = setPath(doc, field, val)
+			case "$inc":
+				cur, _ := getPath(doc, field)
+				var sum interface{}
+				sum, err = addNumbers(cur, val)
+				if err == nil {
+					changed = !reflect.DeepEqual(cur, sum)
+					err = setPath(doc, field, sum)
+				}
+			case "$unset":
+				changed = unsetPath(doc, field)
+			case "$push", "$addToSet":
+				cur, ok := getPath(doc, field)
+				arr := primitive.A{}
+				if ok && cur != nil {
+					if arr, ok = asArray(cur); !ok {
+						return false, fmt.Errorf("cannot %s to the non-array field %s", op, field)
+					}
+				}
+
+				for _, item := range each(val) {
+					if op == "$addToSet" && containsValue(arr, item) {
+						continue
+					}
+					arr = append(arr, item)
+					changed = true
+				}
+
+				if changed {
+					err = setPath(doc, field, arr)
+				}
+			case "$pull":
+				cur, ok := getPath(doc, field)
+				arr, isArr := asArray(cur)
+				if !ok || !isArr {
+					continue
+				}
+
+				kept := primitive.A{}
+				for _, item := range arr {
+					remove, err := pulled(field, item, val)
+					if err != nil {
+						return false, err
+					} else if !remove {
+						kept = append(kept, item)
+					}
+				}
+
+				if changed = len(kept) != len(arr); changed {
+					err = setPath(doc, field, kept)
+				}
+			case "$rename":
+				to, ok := val.(string)
+				if !ok || len(to) == 0 {
+					return false, fmt.Errorf("$rename of %s expects the new field name", field)
+				}
+
+				cur, ok := getPath(doc, field)
+				if !ok {
+					continue
+				}
+
+				unsetPath(doc, field)
+				changed = true
+				err = setPath(doc, to, cur)
+			default:
+				return false, fmt.Errorf("the %s update operator is not supported", op)
+			}
+
+			if err != nil {
+				return false, err
+			}
+			modified = modified || changed
+		}
+	}
+	return modified, nil
+}
+
+// each returns the items of a {"$each": [...]} modifier or the value itself
+func each(v interface{}) []interface{} {
+	if m, ok := asMap(v); ok && len(m) == 1 {
+		if items, ok := asArray(m["$each"]); ok {
+			return items
+		}
+	}
+	return []interface{}{v}
+}
+
+// pulled returns true if the array item matches the $pull condition, either
+// a value, operators or a filter for arrays of documents.
+func pulled(field string, item, cond interface{}) (bool, error) {
+	if ops, ok := operators(cond); ok {
+		return matchOperators(field, []interface{}{item}, ops)
+	}
+
+	m, ok := asMap(cond)
+	if !ok {
+		return equalValues(item, cond), nil
+	}
+
+	if sub, ok := asMap(item); ok {
+		return match(sub, m)
+	}
+	return equalValues(item, cond), nil
+}
+
+func addNumbers(cur, inc interface{}) (interface{}, error) {
+	if cur == nil {
+		cur = int32(0)
+	}
+
+	ci, cIsInt := toInt64(cur)
+	ii, iIsInt := toInt64(inc)
+	if cIsInt && iIsInt {
+		sum := ci + ii
+		_, cur32 := cur.(int32)
+		_, inc32 := inc.(int32)
+		if cur32 && inc32 && sum >= math.MinInt32 && sum <= math.MaxInt32 {
+			return int32(sum), nil
+		}
+		return sum, nil
+	}
+
+	cf, ok := toFloat64(cur)
+	if !ok {
+		return nil, fmt.Errorf("cannot apply $inc to a non-numeric value: %v", cur)
+	}
+	incf, ok := toFloat64(inc)
+	if !ok {
+		return nil, fmt.Errorf("cannot $inc with a non-numeric value: %v", inc)
+	}
+	return cf + incf, nil
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	if i, ok := toInt64(v); ok {
+		return float64(i), true
+	}
+	if f, ok := v.(float64); ok {
+		return f, true
+	}
+	return 0, false
+}
+
+// applyProjection keeps or removes top-level fields of doc. A projection
+// with at least one truthy value is an inclusion, _id is always kept unless
+// explicitly excluded.
+func applyProjection(doc bson.M, proj bson.M) {
+	if len(proj) == 0 {
+		return
+	}
+
+	include := false
+	for k, v := range proj {
+		if k != "_id" && truthy(v) {
+			include = true
+			break
+		}
+	}
+
+	if !include {
+		for k, v := range proj {
+			if !truthy(v) {
+				unsetPath(doc, k)
+			}
+		}
+		return
+	}
+
+	keep := make(map[string]bool)
+	for k, v := range proj {
+		// nested fields keep their whole top-level field
+		keep[splitPath(k)[0]] = truthy(v)
+	}
+	if _, ok := proj["_id"]; !ok {
+		keep["_id"] = true
+	}
+
+	for k := range doc {
+		if !keep[k] {
+			delete(doc, k)
+		}
+	}
+}
+
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case nil:
+		return false
+	}
+
+	if f, ok := toFloat64(v); ok {
+		return f != 0
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestApplyUpdate(t *testing.T) {
+	doc := bson.M{"name": "unit", "count": int32(1), "sub": bson.M{"a": "b"}}
+
+	update, err := normalize(bson.M{
+		"$set":  bson.M{"sub.c": "d"},
+		"$inc":  bson.M{"count": 2},
+		"$push": bson.M{"tags": "x"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modified, err := applyUpdate(doc, update)
+	if err != nil {
+		t.Fatal(err)
+	} else if !modified {
+		t.Fatal("expected document to be modified")
+	}
+
+	if v, _ := getPath(doc, "sub.c"); v != "d" {
+		t.Errorf("expected sub.c to be d got %v", v)
+	} else if v, _ := getPath(doc, "count"); v != int32(3) {
+		t.Errorf("expected count to be 3 got %v (%T)", v, v)
+	} else if tags, ok := asArray(doc["tags"]); !ok || len(tags) != 1 {
+		t.Errorf("expected tags to have 1 item got %v", doc["tags"])
+	}
+}
+
+func TestApplyUpdateArrays(t *testing.T) {
+	doc := bson.M{
+		"tags":  bson.A{"a", "b", "c"},
+		"nums":  bson.A{1, 5, 9},
+		"old":   "name",
+		"draft": true,
+	}
+
+	update, err := normalize(bson.M{
+		"$addToSet": bson.M{"tags": bson.M{"$each": bson.A{"a", "d"}}},
+		"$pull":     bson.M{"nums": bson.M{"$gt": 4}},
+		"$unset":    bson.M{"draft": ""},
+		"$rename":   bson.M{"old": "new"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := applyUpdate(doc, update); err != nil {
+		t.Fatal(err)
+	}
+
+	if tags, _ := asArray(doc["tags"]); len(tags) != 4 {
+		t.Errorf("expected 4 tags got %v", doc["tags"])
+	} else if nums, _ := asArray(doc["nums"]); len(nums) != 1 {
+		t.Errorf("expected 1 number left got %v", doc["nums"])
+	} else if _, ok := doc["draft"]; ok {
+		t.Errorf("expected draft to be removed")
+	} else if doc["new"] != "name" {
+		t.Errorf("expected old to be renamed to new got %v", doc)
+	}
+}
+
+func TestApplyProjection(t *testing.T) {
+	doc := bson.M{"_id": "id", "name": "unit", "h": bson.A{1, 2}}
+	applyProjection(doc, bson.M{"h": 0})
+
+	if _, ok := doc["h"]; ok {
+		t.Errorf("expected h to be removed")
+	} else if doc["name"] != "unit" {
+		t.Errorf("expected name to be kept got %v", doc["name"])
+	}
+}
+
+func TestSQLWhere(t *testing.T) {
+	w := &sqlWhere{}
+	where, err := w.build(bson.M{"done": true, "count": bson.M{"$gte": 5}})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(where) == 0 || len(w.args) == 0 {
+		t.Fatalf("expected a where clause with arguments got %s %v", where, w.args)
+	}
+
+	if _, err := w.build(bson.M{"$where": "1"}); err == nil {
+		t.Errorf("expected an error for unsupported operator")
+	}
+}
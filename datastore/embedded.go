@@ -0,0 +1,648 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"staticbackend/internal"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Embedded is a single file data store used for local development and
+// tests. Each base is a bucket and each collection a nested bucket holding
+// the documents keyed by their _id. Filters are evaluated in Go.
+type Embedded struct {
+	DB *bolt.DB
+}
+
+// NewEmbedded opens or creates the database file at path
+func NewEmbedded(path string) (*Embedded, error) {
+	if len(path) == 0 {
+		path = "staticbackend.db"
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open embedded database %s: %v", path, err)
+	}
+
+	return &Embedded{DB: db}, nil
+}
+
+func (e *Embedded) Database(name string) internal.Database {
+	return &embeddedDB{db: e.DB, name: name}
+}
+
+func (e *Embedded) Ping() error {
+	return e.DB.View(func(tx *bolt.Tx) error { return nil })
+}
+
+type embeddedDB struct {
+	db   *bolt.DB
+	name string
+
+	// tx is the current transaction if any
+	tx *bolt.Tx
+}
+
+// embeddedDoc is a document found while scanning a collection
+type embeddedDoc struct {
+	key []byte
+	doc bson.M
+}
+
+func (e *embeddedDB) Name() string {
+	return e.name
+}
+
+// bucket returns the collection's bucket or nil if it does not exists yet
+func (e *embeddedDB) bucket(tx *bolt.Tx, col string) *bolt.Bucket {
+	base := tx.Bucket([]byte(e.name))
+	if base == nil {
+		return nil
+	}
+	return base.Bucket([]byte(col))
+}
+
+// read runs fn in a read-only transaction or the current one
+func (e *embeddedDB) read(fn func(tx *bolt.Tx) error) error {
+	if e.tx != nil {
+		return fn(e.tx)
+	}
+	return e.db.View(fn)
+}
+
+// write runs fn in a read-write transaction or the current one
+func (e *embeddedDB) write(fn func(tx *bolt.Tx) error) error {
+	if e.tx != nil {
+		return fn(e.tx)
+	}
+	return e.db.Update(fn)
+}
+
+func (e *embeddedDB) Transaction(fn func(tx internal.Database) error) error {
+	if e.tx != nil {
+		return fn(e)
+	}
+
+	return e.db.Update(func(tx *bolt.Tx) error {
+		return fn(&embeddedDB{db: e.db, name: e.name, tx: tx})
+	})
+}
+
+func (e *embeddedDB) Drop() error {
+	return e.write(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(e.name)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+
+		if indexes := tx.Bucket(indexesBucket); indexes != nil {
+			if err := indexes.DeleteBucket([]byte(e.name)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *embeddedDB) ListCollections() ([]string, error) {
+	var names []string
+	err := e.read(func(tx *bolt.Tx) error {
+		base := tx.Bucket([]byte(e.name))
+		if base == nil {
+			return nil
+		}
+
+		return base.ForEach(func(k, v []byte) error {
+			// nested buckets have a nil value
+			if v == nil {
+				names = append(names, string(k))
+			}
+			return nil
+		})
+	})
+	return names, err
+}
+
+func (e *embeddedDB) InsertOne(col string, doc interface{}) error {
+	return e.InsertMany(col, []interface{}{doc})
+}
+
+func (e *embeddedDB) InsertMany(col string, docs []interface{}) error {
+	return e.write(func(tx *bolt.Tx) error {
+		base, err := tx.CreateBucketIfNotExists([]byte(e.name))
+		if err != nil {
+			return err
+		}
+
+		b, err := base.CreateBucketIfNotExists([]byte(col))
+		if err != nil {
+			return err
+		}
+
+		indexes, err := e.indexes(tx, col)
+		if err != nil {
+			return err
+		} else if err := purgeExpired(b, indexes); err != nil {
+			return err
+		}
+
+		for _, doc := range docs {
+			id, data, err := prepare(doc)
+			if err != nil {
+				return err
+			}
+
+			if b.Get([]byte(id)) != nil {
+				return fmt.Errorf("duplicate key %s in collection %s", id, col)
+			}
+
+			if err := checkUnique(b, indexes, []byte(id), data); err != nil {
+				return fmt.Errorf("%v in collection %s", err, col)
+			}
+
+			if err := b.Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scan returns the documents of the collection matching filter
+func (e *embeddedDB) scan(tx *bolt.Tx, col string, filter bson.M) ([]embeddedDoc, error) {
+	b := e.bucket(tx, col)
+	if b == nil {
+		return nil, nil
+	}
+
+	f, err := normalize(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes, err := e.indexes(tx, col)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	var docs []embeddedDoc
+	err = b.ForEach(func(k, v []byte) error {
+		var doc bson.M
+		if err := bson.UnmarshalExtJSON(v, false, &doc); err != nil {
+			return err
+		}
+
+		// expired documents are removed by the next insert
+		if expired(doc, indexes, now) {
+			return nil
+		}
+
+		ok, err := match(doc, f)
+		if err != nil {
+			return err
+		} else if ok {
+			docs = append(docs, embeddedDoc{key: k, doc: doc})
+		}
+		return nil
+	})
+	return docs, err
+}
+
+func (e *embeddedDB) find(col string, filter bson.M, opt internal.FindOptions) ([][]byte, error) {
+	var matches []embeddedDoc
+	err := e.read(func(tx *bolt.Tx) (err error) {
+		matches, err = e.scan(tx, col, filter)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]bson.M, len(matches))
+	for i, m := range matches {
+		docs[i] = m.doc
+	}
+
+	sortDocs(docs, opt.Sort)
+
+	if opt.Skip > 0 {
+		if opt.Skip >= int64(len(docs)) {
+			docs = nil
+		} else {
+			docs = docs[opt.Skip:]
+		}
+	}
+	if opt.Limit > 0 && opt.Limit < int64(len(docs)) {
+		docs = docs[:opt.Limit]
+	}
+
+	results := make([][]byte, 0, len(docs))
+	for _, doc := range docs {
+		applyProjection(doc, opt.Projection)
+
+		data, err := toExtJSON(doc)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, data)
+	}
+	return results, nil
+}
+
+func (e *embeddedDB) FindOne(col string, filter bson.M, v interface{}) error {
+	docs, err := e.find(col, filter, internal.FindOptions{Limit: 1})
+	if err != nil {
+		return err
+	} else if len(docs) == 0 {
+		return internal.ErrNotFound
+	}
+
+	return bson.UnmarshalExtJSON(docs[0], false, v)
+}
+
+func (e *embeddedDB) Find(col string, filter bson.M, opt internal.FindOptions, v interface{}) error {
+	docs, err := e.find(col, filter, opt)
+	if err != nil {
+		return err
+	}
+
+	return decodeAll(docs, v)
+}
+
+func (e *embeddedDB) Count(col string, filter bson.M) (int64, error) {
+	var count int64
+	err := e.read(func(tx *bolt.Tx) error {
+		matches, err := e.scan(tx, col, filter)
+		count = int64(len(matches))
+		return err
+	})
+	return count, err
+}
+
+func (e *embeddedDB) Distinct(col, field string, filter bson.M) ([]interface{}, error) {
+	var values []interface{}
+	err := e.read(func(tx *bolt.Tx) error {
+		matches, err := e.scan(tx, col, filter)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range matches {
+			for _, v := range expand(lookup(m.doc, field)) {
+				if !containsValue(values, v) {
+					values = append(values, v)
+				}
+			}
+		}
+		return nil
+	})
+	return values, err
+}
+
+func containsValue(values []interface{}, v interface{}) bool {
+	for _, val := range values {
+		if equalValues(val, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *embeddedDB) UpdateOne(col string, filter, update bson.M) (internal.UpdateResult, error) {
+	return e.update(col, filter, update, 1)
+}
+
+func (e *embeddedDB) UpdateMany(col string, filter, update bson.M) (internal.UpdateResult, error) {
+	return e.update(col, filter, update, 0)
+}
+
+func (e *embeddedDB) update(col string, filter, update bson.M, limit int) (internal.UpdateResult, error) {
+	var result internal.UpdateResult
+
+	upd, err := normalize(update)
+	if err != nil {
+		return result, err
+	}
+
+	err = e.write(func(tx *bolt.Tx) error {
+		matches, err := e.scan(tx, col, filter)
+		if err != nil {
+			return err
+		}
+
+		if limit > 0 && len(matches) > limit {
+			matches = matches[:limit]
+		}
+
+		indexes, err := e.indexes(tx, col)
+		if err != nil {
+			return err
+		}
+
+		b := e.bucket(tx, col)
+		for _, m := range matches {
+			result.MatchedCount++
+
+			modified, err := applyUpdate(m.doc, upd)
+			if err != nil {
+				return err
+			} else if !modified {
+				continue
+			}
+
+			data, err := toExtJSON(m.doc)
+			if err != nil {
+				return err
+			}
+
+			if err := checkUnique(b, indexes, m.key, data); err != nil {
+				return fmt.Errorf("%v in collection %s", err, col)
+			}
+
+			if err := b.Put(m.key, data); err != nil {
+				return err
+			}
+			result.ModifiedCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return internal.UpdateResult{}, err
+	}
+	return result, nil
+}
+
+func (e *embeddedDB) DeleteOne(col string, filter bson.M) (int64, error) {
+	return e.delete(col, filter, 1)
+}
+
+func (e *embeddedDB) DeleteMany(col string, filter bson.M) (int64, error) {
+	return e.delete(col, filter, 0)
+}
+
+func (e *embeddedDB) delete(col string, filter bson.M, limit int) (int64, error) {
+	var deleted int64
+	err := e.write(func(tx *bolt.Tx) error {
+		matches, err := e.scan(tx, col, filter)
+		if err != nil {
+			return err
+		}
+
+		if limit > 0 && len(matches) > limit {
+			matches = matches[:limit]
+		}
+
+		b := e.bucket(tx, col)
+		for _, m := range matches {
+			if err := b.Delete(m.key); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+func (e *embeddedDB) Aggregate(col string, filter bson.M, opt internal.AggregateOptions) ([]bson.M, error) {
+	var matches []embeddedDoc
+	err := e.read(func(tx *bolt.Tx) (err error) {
+		matches, err = e.scan(tx, col, filter)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]bson.M, len(matches))
+	for i, m := range matches {
+		docs[i] = m.doc
+	}
+	return aggregateDocs(docs, opt)
+}
+
+// indexesBucket holds the index definitions in a nested bucket per base and
+// collection. Documents are scanned, the indexes are only used for their
+// unique and TTL constraints.
+var indexesBucket = []byte("sb_indexes")
+
+// idIndex is the implicit unique index of the _id field
+var idIndex = internal.Index{
+	Name:   "_id_",
+	Keys:   []internal.IndexKey{{Field: internal.FieldID}},
+	Unique: true,
+}
+
+// indexBucket returns the collection's index definitions bucket or nil
+func (e *embeddedDB) indexBucket(tx *bolt.Tx, col string) *bolt.Bucket {
+	indexes := tx.Bucket(indexesBucket)
+	if indexes == nil {
+		return nil
+	}
+
+	base := indexes.Bucket([]byte(e.name))
+	if base == nil {
+		return nil
+	}
+	return base.Bucket([]byte(col))
+}
+
+// indexes returns the collection's indexes without the _id one
+func (e *embeddedDB) indexes(tx *bolt.Tx, col string) ([]internal.Index, error) {
+	b := e.indexBucket(tx, col)
+	if b == nil {
+		return nil, nil
+	}
+
+	var indexes []internal.Index
+	err := b.ForEach(func(k, v []byte) error {
+		var idx internal.Index
+		if err := json.Unmarshal(v, &idx); err != nil {
+			return err
+		}
+		indexes = append(indexes, idx)
+		return nil
+	})
+	return indexes, err
+}
+
+func (e *embeddedDB) ListIndexes(col string) ([]internal.Index, error) {
+	var indexes []internal.Index
+	err := e.read(func(tx *bolt.Tx) (err error) {
+		indexes, err = e.indexes(tx, col)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]internal.Index{idIndex}, indexes...), nil
+}
+
+func (e *embeddedDB) CreateIndex(col string, idx internal.Index) error {
+	def, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+
+	return e.write(func(tx *bolt.Tx) error {
+		indexes, err := tx.CreateBucketIfNotExists(indexesBucket)
+		if err != nil {
+			return err
+		}
+
+		base, err := indexes.CreateBucketIfNotExists([]byte(e.name))
+		if err != nil {
+			return err
+		}
+
+		b, err := base.CreateBucketIfNotExists([]byte(col))
+		if err != nil {
+			return err
+		}
+
+		if cur := b.Get([]byte(idx.Name)); cur != nil {
+			if string(cur) == string(def) {
+				return nil
+			}
+			return fmt.Errorf("an index named %s already exists with a different definition", idx.Name)
+		}
+
+		// the existing documents must satisfy a unique index
+		if docs := e.bucket(tx, col); docs != nil && idx.Unique {
+			err := docs.ForEach(func(k, v []byte) error {
+				return checkUnique(docs, []internal.Index{idx}, k, v)
+			})
+			if err != nil {
+				return fmt.Errorf("cannot create the unique index: %v", err)
+			}
+		}
+
+		return b.Put([]byte(idx.Name), def)
+	})
+}
+
+func (e *embeddedDB) DropIndex(col, name string) error {
+	if name == idIndex.Name {
+		return fmt.Errorf("the _id index cannot be dropped")
+	}
+
+	return e.write(func(tx *bolt.Tx) error {
+		b := e.indexBucket(tx, col)
+		if b == nil || b.Get([]byte(name)) == nil {
+			return internal.ErrNotFound
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+// checkUnique returns an error if another document of the bucket has the
+// same values as data for the fields of a unique index.
+func checkUnique(b *bolt.Bucket, indexes []internal.Index, key, data []byte) error {
+	var unique []internal.Index
+	for _, idx := range indexes {
+		if idx.Unique {
+			unique = append(unique, idx)
+		}
+	}
+
+	if len(unique) == 0 {
+		return nil
+	}
+
+	var doc bson.M
+	if err := bson.UnmarshalExtJSON(data, false, &doc); err != nil {
+		return err
+	}
+
+	return b.ForEach(func(k, v []byte) error {
+		if string(k) == string(key) {
+			return nil
+		}
+
+		var other bson.M
+		if err := bson.UnmarshalExtJSON(v, false, &other); err != nil {
+			return err
+		}
+
+		for _, idx := range unique {
+			if sameKeys(idx, doc, other) {
+				return fmt.Errorf("duplicate key for the unique index %s", idx.Name)
+			}
+		}
+		return nil
+	})
+}
+
+// sameKeys returns true if both documents have the same values for the
+// index fields, missing fields are null like in MongoDB.
+func sameKeys(idx internal.Index, a, b bson.M) bool {
+	for _, key := range idx.Keys {
+		av, _ := getPath(a, key.Field)
+		bv, _ := getPath(b, key.Field)
+		if !equalValues(av, bv) {
+			return false
+		}
+	}
+	return true
+}
+
+// expired returns true if a TTL index expired the document
+func expired(doc bson.M, indexes []internal.Index, now time.Time) bool {
+	for _, idx := range indexes {
+		if idx.TTL <= 0 {
+			continue
+		}
+
+		v, _ := getPath(doc, idx.Keys[0].Field)
+		t := toTime(v)
+		if !t.IsZero() && t.Add(time.Duration(idx.TTL)*time.Second).Before(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// purgeExpired deletes the documents expired by a TTL index
+func purgeExpired(b *bolt.Bucket, indexes []internal.Index) error {
+	hasTTL := false
+	for _, idx := range indexes {
+		hasTTL = hasTTL || idx.TTL > 0
+	}
+
+	if !hasTTL {
+		return nil
+	}
+
+	now := time.Now()
+
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var doc bson.M
+		if err := bson.UnmarshalExtJSON(v, false, &doc); err != nil {
+			return err
+		}
+
+		if expired(doc, indexes, now) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// a bucket cannot be modified while iterating it
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
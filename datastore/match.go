@@ -0,0 +1,432 @@
+package datastore
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// match reports whether doc satisfies the MongoDB filter document. Data
+// stores without a query engine use it to evaluate filters in Go. Both doc
+// and filter must be normalized.
+func match(doc, filter bson.M) (bool, error) {
+	for field, cond := range filter {
+		var ok bool
+		var err error
+
+		switch field {
+		case "$and", "$or", "$nor":
+			ok, err = matchLogical(doc, field, cond)
+		default:
+			if strings.HasPrefix(field, "$") {
+				return false, fmt.Errorf("the %s operator is not supported", field)
+			}
+			ok, err = matchField(doc, field, cond)
+		}
+
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchLogical(doc bson.M, op string, cond interface{}) (bool, error) {
+	filters, ok := asArray(cond)
+	if !ok || len(filters) == 0 {
+		return false, fmt.Errorf("the %s operator expects a non-empty array", op)
+	}
+
+	for _, item := range filters {
+		f, ok := asMap(item)
+		if !ok {
+			return false, fmt.Errorf("the %s operator expects an array of documents", op)
+		}
+
+		ok, err := match(doc, f)
+		if err != nil {
+			return false, err
+		}
+
+		switch {
+		case op == "$and" && !ok:
+			return false, nil
+		case op == "$or" && ok:
+			return true, nil
+		case op == "$nor" && ok:
+			return false, nil
+		}
+	}
+	return op != "$or", nil
+}
+
+func matchField(doc bson.M, field string, cond interface{}) (bool, error) {
+	values := lookup(doc, field)
+
+	ops, ok := operators(cond)
+	if !ok {
+		return matchEqual(values, cond), nil
+	}
+
+	return matchOperators(field, values, ops)
+}
+
+func matchOperators(field string, values []interface{}, ops bson.M) (bool, error) {
+	for op, arg := range ops {
+		// used by $regex
+		if op == "$options" {
+			continue
+		}
+
+		if op == "$regex" {
+			arg = bson.M{"$regex": arg, "$options": ops["$options"]}
+		}
+
+		ok, err := matchOperator(field, values, op, arg)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchOperator(field string, values []interface{}, op string, arg interface{}) (bool, error) {
+	switch op {
+	case "$eq":
+		return matchEqual(values, arg), nil
+	case "$ne":
+		return !matchEqual(values, arg), nil
+	case "$in", "$nin":
+		args, ok := asArray(arg)
+		if !ok {
+			return false, fmt.Errorf("the %s operator expects an array for field %s", op, field)
+		}
+
+		in := false
+		for _, a := range args {
+			if matchEqual(values, a) {
+				in = true
+				break
+			}
+		}
+
+		if op == "$nin" {
+			return !in, nil
+		}
+		return in, nil
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, v := range expand(values) {
+			c, ok := compareValues(v, arg)
+			if !ok {
+				continue
+			}
+
+			switch {
+			case op == "$gt" && c > 0,
+				op == "$gte" && c >= 0,
+				op == "$lt" && c < 0,
+				op == "$lte" && c <= 0:
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$regex":
+		m, _ := asMap(arg)
+		re, err := compileRegex(m["$regex"], m["$options"])
+		if err != nil {
+			return false, fmt.Errorf("invalid regular expression for field %s: %v", field, err)
+		}
+
+		for _, v := range expand(values) {
+			if s, ok := v.(string); ok && re.MatchString(s) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$exists":
+		return truthy(arg) == (len(values) > 0), nil
+	case "$all":
+		args, ok := asArray(arg)
+		if !ok {
+			return false, fmt.Errorf("the $all operator expects an array for field %s", field)
+		} else if len(args) == 0 {
+			return false, nil
+		}
+
+		for _, a := range args {
+			if !matchEqual(values, a) {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "$size":
+		n, ok := toInt64(arg)
+		if !ok {
+			return false, fmt.Errorf("the $size operator expects an integer for field %s", field)
+		}
+
+		for _, v := range values {
+			if a, ok := asArray(v); ok && int64(len(a)) == n {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$not":
+		ops, ok := operators(arg)
+		if !ok {
+			return false, fmt.Errorf("the $not operator expects an operator document for field %s", field)
+		}
+
+		ok, err := matchOperators(field, values, ops)
+		return !ok, err
+	}
+
+	return false, fmt.Errorf("the %s operator is not supported", op)
+}
+
+// compileRegex returns the Go regular expression for the $regex and
+// $options values
+func compileRegex(pattern, options interface{}) (*regexp.Regexp, error) {
+	var p, opts string
+	switch v := pattern.(type) {
+	case string:
+		p = v
+	case primitive.Regex:
+		p, opts = v.Pattern, v.Options
+	default:
+		return nil, fmt.Errorf("the $regex operator expects a string")
+	}
+
+	if s, ok := options.(string); ok {
+		opts += s
+	}
+
+	var flags string
+	for _, f := range opts {
+		if f == 'i' || f == 'm' || f == 's' {
+			flags += string(f)
+		}
+	}
+	if len(flags) > 0 {
+		p = "(?" + flags + ")" + p
+	}
+
+	return regexp.Compile(p)
+}
+
+// matchEqual follows MongoDB equality where a missing field equals null and
+// an array matches when one of its elements is equal.
+func matchEqual(values []interface{}, arg interface{}) bool {
+	if len(values) == 0 {
+		return arg == nil
+	}
+
+	for _, v := range values {
+		if equalValues(v, arg) {
+			return true
+		}
+
+		if a, ok := asArray(v); ok {
+			for _, item := range a {
+				if equalValues(item, arg) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// lookup returns the values at the dotted path field, traversing arrays of
+// sub documents like MongoDB does.
+func lookup(v interface{}, field string) []interface{} {
+	keys := splitPath(field)
+
+	cur := []interface{}{v}
+	for _, key := range keys {
+		var next []interface{}
+		for _, c := range cur {
+			if m, ok := asMap(c); ok {
+				if val, ok := m[key]; ok {
+					next = append(next, val)
+				}
+				continue
+			}
+
+			if a, ok := asArray(c); ok {
+				for _, item := range a {
+					if m, ok := asMap(item); ok {
+						if val, ok := m[key]; ok {
+							next = append(next, val)
+						}
+					}
+				}
+			}
+		}
+		cur = next
+	}
+	return cur
+}
+
+// expand flattens the array values so each element can be compared
+func expand(values []interface{}) []interface{} {
+	var all []interface{}
+	for _, v := range values {
+		if a, ok := asArray(v); ok {
+			all = append(all, a...)
+			continue
+		}
+		all = append(all, v)
+	}
+	return all
+}
+
+func equalValues(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	if aa, ok := asArray(a); ok {
+		ba, ok := asArray(b)
+		if !ok || len(aa) != len(ba) {
+			return false
+		}
+		for i := range aa {
+			if !equalValues(aa[i], ba[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if am, ok := asMap(a); ok {
+		bm, ok := asMap(b)
+		if !ok || len(am) != len(bm) {
+			return false
+		}
+		for k, v := range am {
+			if !equalValues(v, bm[k]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	c, ok := compareValues(a, b)
+	return ok && c == 0
+}
+
+// typeOrder is the MongoDB sort order between BSON types
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 1
+	case string:
+		return 3
+	case bson.M, map[string]interface{}, primitive.D:
+		return 4
+	case primitive.A, []interface{}:
+		return 5
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime, time.Time:
+		return 9
+	}
+
+	if _, ok := toFloat64(v); ok {
+		return 2
+	}
+	return 10
+}
+
+// compareValues compares two scalar values of the same BSON type, ok is
+// false when they cannot be compared.
+func compareValues(a, b interface{}) (c int, ok bool) {
+	if typeOrder(a) != typeOrder(b) {
+		return 0, false
+	}
+
+	switch av := a.(type) {
+	case nil:
+		return 0, true
+	case string:
+		return strings.Compare(av, b.(string)), true
+	case primitive.ObjectID:
+		bv := b.(primitive.ObjectID)
+		return strings.Compare(av.Hex(), bv.Hex()), true
+	case bool:
+		bv := b.(bool)
+		if av == bv {
+			return 0, true
+		} else if !av {
+			return -1, true
+		}
+		return 1, true
+	case primitive.DateTime, time.Time:
+		at, bt := toTime(a), toTime(b)
+		if at.Before(bt) {
+			return -1, true
+		} else if at.After(bt) {
+			return 1, true
+		}
+		return 0, true
+	}
+
+	af, aok := toFloat64(a)
+	bf, bok := toFloat64(b)
+	if !aok || !bok {
+		return 0, false
+	}
+
+	if af < bf {
+		return -1, true
+	} else if af > bf {
+		return 1, true
+	}
+	return 0, true
+}
+
+func toTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case primitive.DateTime:
+		return t.Time()
+	case time.Time:
+		return t
+	}
+	return time.Time{}
+}
+
+// sortDocs sorts the documents in place following the sort specification
+func sortDocs(docs []bson.M, spec bson.D) {
+	if len(spec) == 0 {
+		return
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, e := range spec {
+			a, _ := getPath(docs[i], e.Key)
+			b, _ := getPath(docs[j], e.Key)
+
+			c, ok := compareValues(a, b)
+			if !ok {
+				c = typeOrder(a) - typeOrder(b)
+			}
+			if c == 0 {
+				continue
+			}
+
+			if f, ok := toFloat64(e.Value); ok && f < 0 {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
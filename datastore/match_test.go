@@ -0,0 +1,58 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMatch(t *testing.T) {
+	doc, err := normalize(bson.M{
+		"title": "unit",
+		"count": 5,
+		"tags":  []string{"a", "b"},
+		"sub":   bson.M{"done": true},
+		"on":    time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filters := map[string]struct {
+		filter bson.M
+		match  bool
+	}{
+		"equal":         {bson.M{"title": "unit"}, true},
+		"not equal":     {bson.M{"title": bson.M{"$ne": "unit"}}, false},
+		"array contain": {bson.M{"tags": "b"}, true},
+		"in":            {bson.M{"tags": bson.M{"$in": []string{"c", "a"}}}, true},
+		"nin":           {bson.M{"tags": bson.M{"$nin": []string{"a"}}}, false},
+		"range":         {bson.M{"count": bson.M{"$gt": 2, "$lte": 5.0}}, true},
+		"range type":    {bson.M{"count": bson.M{"$gt": "2"}}, false},
+		"nested":        {bson.M{"sub.done": true}, true},
+		"missing":       {bson.M{"nope": nil}, true},
+		"date":          {bson.M{"on": bson.M{"$lt": time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)}}, true},
+		"or":            {bson.M{"$or": bson.A{bson.M{"title": "x"}, bson.M{"count": 5}}}, true},
+		"nor":           {bson.M{"$nor": bson.A{bson.M{"title": "unit"}}}, false},
+		"regex":         {bson.M{"title": bson.M{"$regex": "^UN", "$options": "i"}}, true},
+		"not regex":     {bson.M{"tags": bson.M{"$not": bson.M{"$regex": "b"}}}, false},
+		"exists":        {bson.M{"sub.done": bson.M{"$exists": true}, "nope": bson.M{"$exists": false}}, true},
+		"all":           {bson.M{"tags": bson.M{"$all": bson.A{"b", "a"}}}, true},
+		"size":          {bson.M{"tags": bson.M{"$size": 3}}, false},
+	}
+
+	for name, tc := range filters {
+		f, err := normalize(tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ok, err := match(doc, f)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		} else if ok != tc.match {
+			t.Errorf("%s: expected match to be %v got %v", name, tc.match, ok)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"staticbackend/internal"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Mongo is the MongoDB data store
+type Mongo struct {
+	Client *mongo.Client
+}
+
+// NewMongo connects to the MongoDB server at uri
+func NewMongo(uri string) (*Mongo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	cl, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to mongo: %v", err)
+	}
+
+	if err := cl.Ping(ctx, readpref.Primary()); err != nil {
+		return nil, fmt.Errorf("Ping failed: %v", err)
+	}
+
+	return &Mongo{Client: cl}, nil
+}
+
+func (m *Mongo) Database(name string) internal.Database {
+	return &mongoDB{db: m.Client.Database(name), ctx: context.Background()}
+}
+
+func (m *Mongo) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	return m.Client.Ping(ctx, readpref.Primary())
+}
+
+type mongoDB struct {
+	db  *mongo.Database
+	ctx context.Context
+}
+
+func (m *mongoDB) Name() string {
+	return m.db.Name()
+}
+
+// Transaction runs fn in a session transaction, MongoDB retries it on
+// transient errors.
+func (m *mongoDB) Transaction(fn func(tx internal.Database) error) error {
+	if _, ok := m.ctx.(mongo.SessionContext); ok {
+		return fn(m)
+	}
+
+	sess, err := m.db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(m.ctx)
+
+	_, err = sess.WithTransaction(m.ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(&mongoDB{db: m.db, ctx: sc})
+	})
+	return err
+}
+
+func (m *mongoDB) Drop() error {
+	return m.db.Drop(m.ctx)
+}
+
+func (m *mongoDB) ListCollections() ([]string, error) {
+	return m.db.ListCollectionNames(m.ctx, bson.D{})
+}
+
+func (m *mongoDB) InsertOne(col string, doc interface{}) error {
+	if _, err := m.db.Collection(col).InsertOne(m.ctx, doc); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *mongoDB) InsertMany(col string, docs []interface{}) error {
+	if _, err := m.db.Collection(col).InsertMany(m.ctx, docs); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *mongoDB) FindOne(col string, filter bson.M, v interface{}) error {
+	sr := m.db.Collection(col).FindOne(m.ctx, filter)
+	if err := sr.Decode(v); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return internal.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *mongoDB) Find(col string, filter bson.M, opt internal.FindOptions, v interface{}) error {
+	fo := options.Find()
+	if opt.Skip > 0 {
+		fo.SetSkip(opt.Skip)
+	}
+	if opt.Limit > 0 {
+		fo.SetLimit(opt.Limit)
+	}
+	if len(opt.Sort) > 0 {
+		fo.SetSort(opt.Sort)
+	}
+	if len(opt.Projection) > 0 {
+		fo.SetProjection(opt.Projection)
+	}
+
+	cur, err := m.db.Collection(col).Find(m.ctx, filter, fo)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(m.ctx)
+
+	return cur.All(m.ctx, v)
+}
+
+func (m *mongoDB) Count(col string, filter bson.M) (int64, error) {
+	return m.db.Collection(col).CountDocuments(m.ctx, filter)
+}
+
+func (m *mongoDB) Distinct(col, field string, filter bson.M) ([]interface{}, error) {
+	return m.db.Collection(col).Distinct(m.ctx, field, filter)
+}
+
+func (m *mongoDB) UpdateOne(col string, filter, update bson.M) (internal.UpdateResult, error) {
+	res, err := m.db.Collection(col).UpdateOne(m.ctx, filter, update)
+	if err != nil {
+		return internal.UpdateResult{}, err
+	}
+	return internal.UpdateResult{MatchedCount: res.MatchedCount, ModifiedCount: res.ModifiedCount}, nil
+}
+
+func (m *mongoDB) UpdateMany(col string, filter, update bson.M) (internal.UpdateResult, error) {
+	res, err := m.db.Collection(col).UpdateMany(m.ctx, filter, update)
+	if err != nil {
+		return internal.UpdateResult{}, err
+	}
+	return internal.UpdateResult{MatchedCount: res.MatchedCount, ModifiedCount: res.ModifiedCount}, nil
+}
+
+func (m *mongoDB) DeleteOne(col string, filter bson.M) (int64, error) {
+	res, err := m.db.Collection(col).DeleteOne(m.ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (m *mongoDB) DeleteMany(col string, filter bson.M) (int64, error) {
+	res, err := m.db.Collection(col).DeleteMany(m.ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (m *mongoDB) Aggregate(col string, filter bson.M, opt internal.AggregateOptions) ([]bson.M, error) {
+	cur, err := m.db.Collection(col).Aggregate(m.ctx, mongoAggregatePipeline(filter, opt))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(m.ctx)
+
+	var results []bson.M
+	if err := cur.All(m.ctx, &results); err != nil {
+		return nil, err
+	}
+
+	for _, doc := range results {
+		flattenGroup(doc)
+	}
+	return results, nil
+}
+
+// mongoIndex is an index specification returned by listIndexes
+type mongoIndex struct {
+	Name               string `bson:"name"`
+	Key                bson.D `bson:"key"`
+	Unique             bool   `bson:"unique"`
+	ExpireAfterSeconds *int32 `bson:"expireAfterSeconds"`
+	Weights            bson.M `bson:"weights"`
+}
+
+// isMongoCode returns true if err is a server error with one of the codes
+func isMongoCode(err error, codes ...int32) bool {
+	var ce mongo.CommandError
+	if !errors.As(err, &ce) {
+		return false
+	}
+
+	for _, code := range codes {
+		if ce.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mongoDB) ListIndexes(col string) ([]internal.Index, error) {
+	cur, err := m.db.Collection(col).Indexes().List(m.ctx)
+	if err != nil {
+		// NamespaceNotFound, the collection does not exists yet
+		if isMongoCode(err, 26) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer cur.Close(m.ctx)
+
+	var specs []mongoIndex
+	if err := cur.All(m.ctx, &specs); err != nil {
+		return nil, err
+	}
+
+	indexes := make([]internal.Index, 0, len(specs))
+	for _, spec := range specs {
+		idx := internal.Index{Name: spec.Name, Unique: spec.Unique}
+		if spec.ExpireAfterSeconds != nil {
+			idx.TTL = *spec.ExpireAfterSeconds
+		}
+
+		for _, e := range spec.Key {
+			// the fields of text indexes are in the weights
+			if e.Key == "_fts" || e.Key == "_ftsx" {
+				idx.Text = true
+				continue
+			}
+
+			n, _ := toNumber(e.Value)
+			idx.Keys = append(idx.Keys, internal.IndexKey{Field: e.Key, Desc: n < 0})
+		}
+
+		if idx.Text {
+			var fields []string
+			for field := range spec.Weights {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+
+			for _, field := range fields {
+				w, _ := toNumber(spec.Weights[field])
+				idx.Keys = append(idx.Keys, internal.IndexKey{Field: field, Weight: int32(w)})
+			}
+		}
+
+		// the _id index is unique without having the option
+		if spec.Name == "_id_" {
+			idx.Unique = true
+		}
+
+		indexes = append(indexes, idx)
+	}
+	return indexes, nil
+}
+
+func (m *mongoDB) CreateIndex(col string, idx internal.Index) error {
+	keys := bson.D{}
+	weights := bson.M{}
+	for _, key := range idx.Keys {
+		var order interface{} = 1
+		if idx.Text {
+			order = "text"
+			weights[key.Field] = textWeight(key)
+		} else if key.Desc {
+			order = -1
+		}
+		keys = append(keys, bson.E{Key: key.Field, Value: order})
+	}
+
+	opts := options.Index().SetName(idx.Name)
+	if idx.Text {
+		// words are matched as is like the other data stores
+		opts.SetWeights(weights).SetDefaultLanguage("none")
+	}
+	if idx.Unique {
+		opts.SetUnique(true)
+	}
+	if idx.TTL > 0 {
+		opts.SetExpireAfterSeconds(idx.TTL)
+	}
+
+	_, err := m.db.Collection(col).Indexes().CreateOne(m.ctx, mongo.IndexModel{Keys: keys, Options: opts})
+	return err
+}
+
+func (m *mongoDB) DropIndex(col, name string) error {
+	if _, err := m.db.Collection(col).Indexes().DropOne(m.ctx, name); err != nil {
+		// NamespaceNotFound or IndexNotFound
+		if isMongoCode(err, 26, 27) {
+			return internal.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// scoreField is the projected text search score
+const scoreField = "sb_score"
+
+func (m *mongoDB) Search(col string, filter bson.M, opt internal.SearchOptions) ([]internal.SearchHit, int64, error) {
+	f := bson.M{}
+	for k, v := range filter {
+		f[k] = v
+	}
+	f["$text"] = bson.M{"$search": opt.Text}
+
+	total, err := m.db.Collection(col).CountDocuments(m.ctx, f)
+	if err != nil {
+		return nil, 0, err
+	} else if total == 0 {
+		return nil, 0, nil
+	}
+
+	score := bson.M{"$meta": "textScore"}
+	fo := options.Find().
+		SetProjection(bson.M{scoreField: score}).
+		SetSort(bson.D{{Key: scoreField, Value: score}, {Key: internal.FieldID, Value: 1}})
+	if opt.Skip > 0 {
+		fo.SetSkip(opt.Skip)
+	}
+	if opt.Limit > 0 {
+		fo.SetLimit(opt.Limit)
+	}
+
+	cur, err := m.db.Collection(col).Find(m.ctx, f, fo)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cur.Close(m.ctx)
+
+	var docs []bson.M
+	if err := cur.All(m.ctx, &docs); err != nil {
+		return nil, 0, err
+	}
+
+	hits := make([]internal.SearchHit, len(docs))
+	for i, doc := range docs {
+		score, _ := toNumber(doc[scoreField])
+		delete(doc, scoreField)
+
+		hits[i] = internal.SearchHit{Score: score, Doc: doc}
+	}
+	return hits, total, nil
+}
+
+// Watch opens a change stream on the whole deployment, MongoDB must run as a
+// replica set. Soft deletes are reported as deletes and restores as
+// creations.
+func (m *Mongo) Watch(ctx context.Context, resumeToken []byte, fn func(internal.ChangeEvent) error) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"operationType": bson.M{"$in": bson.A{"insert", "update", "replace", "delete"}},
+			"ns.db":         bson.M{"$ne": "sbsys"},
+			"ns.coll":       bson.M{"$not": primitive.Regex{Pattern: "^sb_"}},
+		}}},
+	}
+
+	opt := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if len(resumeToken) > 0 {
+		opt.SetStartAfter(bson.Raw(resumeToken))
+	}
+
+	cs, err := m.Client.Watch(ctx, pipeline, opt)
+	if isMongoCode(err, 260, 280, 286) {
+		return fmt.Errorf("%w: %v", internal.ErrChangeHistoryLost, err)
+	} else if err != nil {
+		return err
+	}
+	defer cs.Close(context.Background())
+
+	for cs.Next(ctx) {
+		var change bson.M
+		if err := cs.Decode(&change); err != nil {
+			return err
+		}
+
+		e, ok := changeEvent(change)
+		if !ok {
+			continue
+		}
+		e.ResumeToken = cs.ResumeToken()
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	if err := cs.Err(); isMongoCode(err, 260, 280, 286) {
+		return fmt.Errorf("%w: %v", internal.ErrChangeHistoryLost, err)
+	} else if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// changeEvent converts a change stream document, documents moved to the
+// trash are deleted and documents restored from it are created.
+func changeEvent(change bson.M) (internal.ChangeEvent, bool) {
+	var e internal.ChangeEvent
+
+	ns, _ := change["ns"].(bson.M)
+	key, _ := change["documentKey"].(bson.M)
+	if ns == nil || key == nil {
+		return e, false
+	}
+
+	e.Base, _ = ns["db"].(string)
+	e.Collection, _ = ns["coll"].(string)
+
+	if oid, ok := key[internal.FieldID].(primitive.ObjectID); ok {
+		e.ID = oid.Hex()
+	} else {
+		e.ID = fmt.Sprintf("%v", key[internal.FieldID])
+	}
+
+	doc, _ := change["fullDocument"].(bson.M)
+
+	switch change["operationType"] {
+	case "insert":
+		e.Type = internal.MsgTypeDBCreated
+	case "update", "replace":
+		// the document was deleted before the lookup
+		if doc == nil {
+			return e, false
+		}
+
+		e.Type = internal.MsgTypeDBUpdated
+		if _, ok := doc[internal.FieldDeleted]; ok {
+			e.Type = internal.MsgTypeDBDeleted
+		} else if restored(change) {
+			e.Type = internal.MsgTypeDBCreated
+		}
+	case "delete":
+		e.Type = internal.MsgTypeDBDeleted
+	default:
+		return e, false
+	}
+
+	if e.Type != internal.MsgTypeDBDeleted {
+		if doc == nil {
+			return e, false
+		}
+		e.Doc = doc
+	}
+	return e, true
+}
+
+// restored returns true if the update removed the document from the trash
+func restored(change bson.M) bool {
+	desc, _ := change["updateDescription"].(bson.M)
+	if desc == nil {
+		return false
+	}
+
+	removed, _ := desc["removedFields"].(bson.A)
+	for _, field := range removed {
+		if field == internal.FieldDeleted {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package datastore
+
+import (
+	"staticbackend/internal"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestChangeEvent(t *testing.T) {
+	id := primitive.NewObjectID()
+	ns := bson.M{"db": "base", "coll": "tasks"}
+	key := bson.M{"_id": id}
+
+	changes := []struct {
+		change   bson.M
+		expected string
+	}{
+		{bson.M{"operationType": "insert", "ns": ns, "documentKey": key, "fullDocument": bson.M{"_id": id}}, internal.MsgTypeDBCreated},
+		{bson.M{"operationType": "update", "ns": ns, "documentKey": key, "fullDocument": bson.M{"_id": id}}, internal.MsgTypeDBUpdated},
+		{bson.M{"operationType": "replace", "ns": ns, "documentKey": key, "fullDocument": bson.M{"_id": id}}, internal.MsgTypeDBUpdated},
+		{bson.M{"operationType": "delete", "ns": ns, "documentKey": key}, internal.MsgTypeDBDeleted},
+		// soft deletes and restores
+		{bson.M{"operationType": "update", "ns": ns, "documentKey": key, "fullDocument": bson.M{"_id": id, internal.FieldDeleted: 1}}, internal.MsgTypeDBDeleted},
+		{bson.M{
+			"operationType":     "update",
+			"ns":                ns,
+			"documentKey":       key,
+			"fullDocument":      bson.M{"_id": id},
+			"updateDescription": bson.M{"removedFields": bson.A{internal.FieldDeleted}},
+		}, internal.MsgTypeDBCreated},
+	}
+
+	for _, c := range changes {
+		e, ok := changeEvent(c.change)
+		if !ok {
+			t.Errorf("expected an event for %v", c.change)
+			continue
+		}
+
+		if e.Type != c.expected {
+			t.Errorf("expected %s for %v got %s", c.expected, c.change["operationType"], e.Type)
+		} else if e.Base != "base" || e.Collection != "tasks" || e.ID != id.Hex() {
+			t.Errorf("expected base.tasks %s got %s.%s %s", id.Hex(), e.Base, e.Collection, e.ID)
+		} else if (e.Type == internal.MsgTypeDBDeleted) != (e.Doc == nil) {
+			t.Errorf("expected a document for %s events only got %v", e.Type, e.Doc)
+		}
+	}
+
+	// updated documents deleted before the lookup have no event
+	if _, ok := changeEvent(bson.M{"operationType": "update", "ns": ns, "documentKey": key}); ok {
+		t.Error("expected no event for an update without the document")
+	}
+	if _, ok := changeEvent(bson.M{"operationType": "drop", "ns": ns, "documentKey": key}); ok {
+		t.Error("expected no event for a drop")
+	}
+}
@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	"sort"
+	"staticbackend/internal"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// textWeight returns the weight of a text index field, 1 by default
+func textWeight(key internal.IndexKey) int32 {
+	if key.Weight <= 0 {
+		return 1
+	}
+	return key.Weight
+}
+
+// textScore returns the relevance of the document for the search terms:
+// the number of matching words of each field times the field's weight,
+// relative to the field's number of words.
+func textScore(doc bson.M, terms []string, fields []internal.IndexKey) float64 {
+	var score float64
+	for _, key := range fields {
+		for _, v := range expand(lookup(doc, key.Field)) {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+
+			words := strings.FieldsFunc(strings.ToLower(s), internal.IsWordSeparator)
+			if len(words) == 0 {
+				continue
+			}
+
+			var matches int
+			for _, word := range words {
+				for _, term := range terms {
+					if word == term {
+						matches++
+					}
+				}
+			}
+
+			// like MongoDB, longer fields weight less per match
+			score += float64(textWeight(key)) * float64(matches) * (0.5 + 0.5/float64(len(words)))
+		}
+	}
+	return score
+}
+
+func (e *embeddedDB) Search(col string, filter bson.M, opt internal.SearchOptions) ([]internal.SearchHit, int64, error) {
+	terms := internal.SearchTerms(opt.Text)
+	if len(terms) == 0 {
+		return nil, 0, nil
+	}
+
+	var matches []embeddedDoc
+	err := e.read(func(tx *bolt.Tx) (err error) {
+		matches, err = e.scan(tx, col, filter)
+		return
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var hits []internal.SearchHit
+	for _, m := range matches {
+		if score := textScore(m.doc, terms, opt.Fields); score > 0 {
+			hits = append(hits, internal.SearchHit{Score: score, Doc: m.doc})
+		}
+	}
+
+	// the id breaks ties so pages are stable
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return idString(hits[i].Doc[internal.FieldID]) < idString(hits[j].Doc[internal.FieldID])
+	})
+
+	total := int64(len(hits))
+	if opt.Skip > 0 {
+		if opt.Skip >= total {
+			hits = nil
+		} else {
+			hits = hits[opt.Skip:]
+		}
+	}
+	if opt.Limit > 0 && opt.Limit < int64(len(hits)) {
+		hits = hits[:opt.Limit]
+	}
+
+	return hits, total, nil
+}
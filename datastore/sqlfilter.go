@@ -0,0 +1,362 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"staticbackend/internal"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sqlWhere translates a MongoDB filter document into a PostgreSQL WHERE
+// clause over the JSONB data column. Values are always sent as arguments.
+type sqlWhere struct {
+	args []interface{}
+}
+
+var sqlComparisons = map[string]string{
+	"$gt":  ">",
+	"$gte": ">=",
+	"$lt":  "<",
+	"$lte": "<=",
+}
+
+func (w *sqlWhere) arg(v interface{}) string {
+	w.args = append(w.args, v)
+	return fmt.Sprintf("$%d", len(w.args))
+}
+
+// path returns the expression selecting the JSONB value of the dotted field
+func (w *sqlWhere) path(field string, suffix ...string) string {
+	keys := append(splitPath(field), suffix...)
+	return fmt.Sprintf("(data #> %s::text[])", w.arg(pq.Array(keys)))
+}
+
+// textPath is the same as path but returns the value as text
+func (w *sqlWhere) textPath(field string, suffix ...string) string {
+	keys := append(splitPath(field), suffix...)
+	return fmt.Sprintf("(data #>> %s::text[])", w.arg(pq.Array(keys)))
+}
+
+func (w *sqlWhere) build(filter bson.M) (string, error) {
+	if len(filter) == 0 {
+		return "TRUE", nil
+	}
+
+	// sorted for stable queries
+	var keys []string
+	for k := range filter {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, field := range keys {
+		var part string
+		var err error
+
+		switch field {
+		case "$and", "$or", "$nor":
+			part, err = w.logical(field, filter[field])
+		default:
+			if strings.HasPrefix(field, "$") {
+				return "", fmt.Errorf("the %s operator is not supported", field)
+			}
+			part, err = w.field(field, filter[field])
+		}
+
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, part)
+	}
+
+	return strings.Join(parts, " AND "), nil
+}
+
+func (w *sqlWhere) logical(op string, v interface{}) (string, error) {
+	filters, ok := toSlice(v)
+	if !ok || len(filters) == 0 {
+		return "", fmt.Errorf("the %s operator expects a non-empty array", op)
+	}
+
+	var parts []string
+	for _, item := range filters {
+		f, ok := asMap(item)
+		if !ok {
+			return "", fmt.Errorf("the %s operator expects an array of documents", op)
+		}
+
+		part, err := w.build(f)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, "("+part+")")
+	}
+
+	switch op {
+	case "$or":
+		return "(" + strings.Join(parts, " OR ") + ")", nil
+	case "$nor":
+		return "NOT COALESCE((" + strings.Join(parts, " OR ") + "), FALSE)", nil
+	}
+	return "(" + strings.Join(parts, " AND ") + ")", nil
+}
+
+func (w *sqlWhere) field(field string, v interface{}) (string, error) {
+	ops, ok := operators(v)
+	if !ok {
+		return w.compare(field, "$eq", v)
+	}
+
+	return w.operators(field, ops)
+}
+
+func (w *sqlWhere) operators(field string, ops bson.M) (string, error) {
+	var keys []string
+	for k := range ops {
+		// used by $regex
+		if k != "$options" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, op := range keys {
+		arg := ops[op]
+		if op == "$regex" {
+			arg = bson.M{"$regex": arg, "$options": ops["$options"]}
+		}
+
+		part, err := w.compare(field, op, arg)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, part)
+	}
+	return "(" + strings.Join(parts, " AND ") + ")", nil
+}
+
+// operators returns v as a document if all its keys are operators
+func operators(v interface{}) (bson.M, bool) {
+	m, ok := asMap(v)
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+func (w *sqlWhere) compare(field, op string, v interface{}) (string, error) {
+	switch op {
+	case "$eq":
+		return w.equal(field, v)
+	case "$ne":
+		eq, err := w.equal(field, v)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("NOT COALESCE(%s, FALSE)", eq), nil
+	case "$in", "$nin":
+		values, ok := toSlice(v)
+		if !ok {
+			return "", fmt.Errorf("the %s operator expects an array for field %s", op, field)
+		}
+
+		var parts []string
+		for _, val := range values {
+			eq, err := w.equal(field, val)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, eq)
+		}
+
+		in := "FALSE"
+		if len(parts) > 0 {
+			in = "(" + strings.Join(parts, " OR ") + ")"
+		}
+
+		if op == "$nin" {
+			return fmt.Sprintf("NOT COALESCE(%s, FALSE)", in), nil
+		}
+		return in, nil
+	case "$gt", "$gte", "$lt", "$lte":
+		return w.rangeCompare(field, sqlComparisons[op], v)
+	case "$regex":
+		return w.regex(field, v)
+	case "$exists":
+		if truthy(v) {
+			return fmt.Sprintf("%s IS NOT NULL", w.path(field)), nil
+		}
+		return fmt.Sprintf("%s IS NULL", w.path(field)), nil
+	case "$all":
+		values, ok := toSlice(v)
+		if !ok {
+			return "", fmt.Errorf("the $all operator expects an array for field %s", field)
+		} else if len(values) == 0 {
+			return "FALSE", nil
+		}
+
+		j, err := valueToExtJSON(primitive.A(values))
+		if err != nil {
+			return "", err
+		}
+
+		p := w.path(field)
+		return fmt.Sprintf("(jsonb_typeof(%s) = 'array' AND %s @> %s::jsonb)", p, p, w.arg(j)), nil
+	case "$size":
+		n, ok := toInt64(v)
+		if !ok {
+			return "", fmt.Errorf("the $size operator expects an integer for field %s", field)
+		}
+
+		p := w.path(field)
+		return fmt.Sprintf("(jsonb_typeof(%s) = 'array' AND jsonb_array_length(%s) = %s)", p, p, w.arg(n)), nil
+	case "$not":
+		ops, ok := operators(v)
+		if !ok {
+			return "", fmt.Errorf("the $not operator expects an operator document for field %s", field)
+		}
+
+		part, err := w.operators(field, ops)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("NOT COALESCE(%s, FALSE)", part), nil
+	}
+
+	return "", fmt.Errorf("the %s operator is not supported", op)
+}
+
+func (w *sqlWhere) equal(field string, v interface{}) (string, error) {
+	if v == nil {
+		p := w.path(field)
+		return fmt.Sprintf("(%s IS NULL OR %s = 'null'::jsonb)", p, p), nil
+	}
+
+	// the id column is the primary key
+	if oid, ok := v.(primitive.ObjectID); ok && field == internal.FieldID {
+		return fmt.Sprintf("id = %s", w.arg(oid.Hex())), nil
+	}
+
+	j, err := valueToExtJSON(v)
+	if err != nil {
+		return "", err
+	}
+
+	p, val := w.path(field), w.arg(j)
+
+	// like MongoDB, a value matches an array containing it
+	return fmt.Sprintf("(%s = %s::jsonb OR (jsonb_typeof(%s) = 'array' AND %s @> jsonb_build_array(%s::jsonb)))",
+		p, val, p, p, val), nil
+}
+
+func (w *sqlWhere) rangeCompare(field, op string, v interface{}) (string, error) {
+	switch val := v.(type) {
+	case primitive.ObjectID:
+		if field == internal.FieldID {
+			return fmt.Sprintf("id COLLATE \"C\" %s %s", op, w.arg(val.Hex())), nil
+		}
+		return fmt.Sprintf("%s COLLATE \"C\" %s %s", w.textPath(field, "$oid"), op, w.arg(val.Hex())), nil
+	case string:
+		p := w.path(field)
+		return fmt.Sprintf("(jsonb_typeof(%s) = 'string' AND %s COLLATE \"C\" %s %s)",
+			p, w.textPath(field), op, w.arg(val)), nil
+	case bool:
+		p := w.path(field)
+		return fmt.Sprintf("(jsonb_typeof(%s) = 'boolean' AND %s::boolean %s %s)",
+			p, w.textPath(field), op, w.arg(val)), nil
+	case time.Time:
+		return w.dateCompare(field, op, val)
+	case primitive.DateTime:
+		return w.dateCompare(field, op, val.Time())
+	}
+
+	if f, ok := toNumber(v); ok {
+		p := w.path(field)
+		return fmt.Sprintf("(jsonb_typeof(%s) = 'number' AND %s::numeric %s %s::numeric)",
+			p, w.textPath(field), op, w.arg(f)), nil
+	}
+
+	return "", fmt.Errorf("cannot compare field %s with value %v", field, v)
+}
+
+// regex matches a string value or any string element of an array value
+func (w *sqlWhere) regex(field string, v interface{}) (string, error) {
+	m, _ := asMap(v)
+
+	var pattern, opts string
+	switch p := m["$regex"].(type) {
+	case string:
+		pattern = p
+	case primitive.Regex:
+		pattern, opts = p.Pattern, p.Options
+	default:
+		return "", fmt.Errorf("the $regex operator expects a string for field %s", field)
+	}
+
+	if o, ok := m["$options"].(string); ok {
+		opts += o
+	}
+
+	op := "~"
+	if strings.Contains(opts, "i") {
+		op = "~*"
+	}
+
+	p, pat := w.path(field), w.arg(pattern)
+	return fmt.Sprintf(`(CASE jsonb_typeof(%s)
+		WHEN 'string' THEN %s %s %s
+		WHEN 'array' THEN EXISTS (SELECT 1 FROM jsonb_array_elements(%s) e WHERE jsonb_typeof(e) = 'string' AND e #>> '{}' %s %s)
+		ELSE FALSE END)`, p, w.textPath(field), op, pat, p, op, pat), nil
+}
+
+func (w *sqlWhere) dateCompare(field, op string, t time.Time) (string, error) {
+	p := w.path(field, "$date")
+	return fmt.Sprintf("(jsonb_typeof(%s) = 'string' AND %s::timestamptz %s %s)",
+		p, w.textPath(field, "$date"), op, w.arg(t)), nil
+}
+
+// toNumber converts any Go numeric value to float64
+func toNumber(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// toSlice converts any slice or array value into []interface{}
+func toSlice(v interface{}) ([]interface{}, bool) {
+	if a, ok := asArray(v); ok {
+		return a, true
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+
+	values := make([]interface{}, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		values[i] = rv.Index(i).Interface()
+	}
+	return values, true
+}
@@ -2,6 +2,7 @@ package staticbackend
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -11,15 +12,12 @@ import (
 	"strconv"
 	"strings"
 
-	"staticbackend/cache"
-
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type Database struct {
-	client *mongo.Client
-	cache  *cache.Cache
+	client internal.Persister
+	cache  internal.PubSuber
 	base   *db.Base
 }
 
@@ -31,9 +29,17 @@ func (database *Database) dbreq(w http.ResponseWriter, r *http.Request) {
 			database.add(w, r)
 		}
 	} else if r.Method == http.MethodPut {
-		database.update(w, r)
+		if len(r.URL.Query().Get("bulk")) > 0 {
+			database.bulkUpdate(w, r)
+		} else {
+			database.update(w, r)
+		}
 	} else if r.Method == http.MethodDelete {
-		database.del(w, r)
+		if len(r.URL.Query().Get("bulk")) > 0 {
+			database.bulkDelete(w, r)
+		} else {
+			database.del(w, r)
+		}
 	} else if r.Method == http.MethodGet {
 		p := r.URL.Path
 		if strings.HasSuffix(p, "/") == false {
@@ -78,7 +84,7 @@ func (database *Database) add(w http.ResponseWriter, r *http.Request) {
 
 	doc, err = database.base.Add(auth, curDB, col, doc)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err)
 		return
 	}
 
@@ -104,7 +110,7 @@ func (database *Database) bulkAdd(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := database.base.BulkAdd(auth, curDB, col, v); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err)
 		return
 	}
 
@@ -118,6 +124,13 @@ func (database *Database) list(w http.ResponseWriter, r *http.Request) {
 		Page:           page,
 		Size:           size,
 		SortDescending: len(r.URL.Query().Get("desc")) > 0,
+		Cursor:         getCursor(r.URL),
+		SkipTotal:      len(r.URL.Query().Get("skiptotal")) > 0,
+		ReadParams:     getReadParams(r.URL),
+	}
+	if err := params.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	conf, auth, err := middleware.Extract(r, true)
@@ -133,7 +146,7 @@ func (database *Database) list(w http.ResponseWriter, r *http.Request) {
 
 	result, err := database.base.List(auth, curDB, col, params)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err)
 		return
 	}
 
@@ -155,12 +168,19 @@ func (database *Database) get(w http.ResponseWriter, r *http.Request) {
 	col, r.URL.Path = ShiftPath(r.URL.Path)
 	id, r.URL.Path = ShiftPath(r.URL.Path)
 
-	result, err := database.base.GetByID(auth, curDB, col, id)
+	params := getReadParams(r.URL)
+	if err := params.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := database.base.GetByID(auth, curDB, col, id, params)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err)
 		return
 	}
 
+	setETag(w, result)
 	respond(w, http.StatusOK, result)
 }
 
@@ -190,6 +210,13 @@ func (database *Database) query(w http.ResponseWriter, r *http.Request) {
 		Size:           size,
 		SortBy:         sort,
 		SortDescending: len(r.URL.Query().Get("desc")) > 0,
+		Cursor:         getCursor(r.URL),
+		SkipTotal:      len(r.URL.Query().Get("skiptotal")) > 0,
+		ReadParams:     getReadParams(r.URL),
+	}
+	if err := params.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	conf, auth, err := middleware.Extract(r, true)
@@ -208,7 +235,100 @@ func (database *Database) query(w http.ResponseWriter, r *http.Request) {
 
 	result, err := database.base.Query(auth, curDB, col, filter, params)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		writeCSV(w, col, result.Results)
+		return
+	}
+
+	respond(w, http.StatusOK, result)
+}
+
+func (database *Database) aggregate(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Filter [][]interface{} `json:"filter"`
+		internal.AggregateOptions
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := db.ParseQuery(data.Filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := data.AggregateOptions.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conf, auth, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := database.client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	col, _ := ShiftPath(r.URL.Path)
+
+	results, err := database.base.Aggregate(auth, curDB, col, filter, data.AggregateOptions)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	respond(w, http.StatusOK, results)
+}
+
+// search is a full-text search of a collection having a text index, the
+// optional filter uses the query clauses:
+//
+//	POST /search/{col}?page=1&size=25 {"text": "...", "filter": [...], "highlight": true}
+func (database *Database) search(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Filter [][]interface{} `json:"filter"`
+		db.SearchParams
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := db.ParseQuery(data.Filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params := data.SearchParams
+	params.Page, params.Size = getPagination(r.URL)
+	if err := params.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conf, auth, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := database.client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	col, _ := ShiftPath(r.URL.Path)
+
+	result, err := database.base.Search(auth, curDB, col, filter, params)
+	if err != nil {
+		writeDBError(w, err)
 		return
 	}
 
@@ -242,12 +362,19 @@ func (database *Database) update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := database.base.Update(auth, curDB, col, id, doc)
+	opt, err := getUpdateOptions(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := database.base.Update(auth, curDB, col, id, doc, opt)
+	if err != nil {
+		writeDBError(w, err)
 		return
 	}
 
+	setETag(w, result)
 	respond(w, http.StatusOK, result)
 }
 
@@ -274,13 +401,46 @@ func (database *Database) increase(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := database.base.Increase(auth, curDB, col, id, v.Field, v.Range); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err)
 		return
 	}
 
 	respond(w, http.StatusOK, true)
 }
 
+// tx runs a batch of create, update, increase and delete operations in a
+// transaction, either all of them are applied or none.
+func (database *Database) tx(w http.ResponseWriter, r *http.Request) {
+	conf, auth, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := database.client.Database(conf.Name)
+
+	var ops []db.TxOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for i, op := range ops {
+		if err := op.Validate(); err != nil {
+			http.Error(w, fmt.Sprintf("operation %d: %v", i+1, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results, err := database.base.Batch(auth, curDB, ops)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	respond(w, http.StatusOK, results)
+}
+
 func (database *Database) del(w http.ResponseWriter, r *http.Request) {
 	conf, auth, err := middleware.Extract(r, true)
 	if err != nil {
@@ -298,7 +458,86 @@ func (database *Database) del(w http.ResponseWriter, r *http.Request) {
 
 	count, err := database.base.Delete(auth, curDB, col, id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err)
+		return
+	}
+
+	respond(w, http.StatusOK, count)
+}
+
+// bulkUpdate sets the fields of the "update" object on the documents
+// matching the "filter" query clauses.
+func (database *Database) bulkUpdate(w http.ResponseWriter, r *http.Request) {
+	conf, auth, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := database.client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	col, _ := ShiftPath(r.URL.Path)
+
+	var data struct {
+		Filter [][]interface{}        `json:"filter"`
+		Update map[string]interface{} `json:"update"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(data.Update) == 0 {
+		http.Error(w, "missing the fields to update", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := db.ParseQuery(data.Filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := database.base.UpdateMany(auth, curDB, col, filter, data.Update)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	respond(w, http.StatusOK, result)
+}
+
+// bulkDelete deletes the documents matching the "filter" query clauses
+func (database *Database) bulkDelete(w http.ResponseWriter, r *http.Request) {
+	conf, auth, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := database.client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	col, _ := ShiftPath(r.URL.Path)
+
+	var data struct {
+		Filter [][]interface{} `json:"filter"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := db.ParseQuery(data.Filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	count, err := database.base.DeleteMany(auth, curDB, col, filter)
+	if err != nil {
+		writeDBError(w, err)
 		return
 	}
 
@@ -343,3 +582,86 @@ func getPagination(u *url.URL) (page int64, size int64) {
 
 	return
 }
+
+// getCursor returns the cursor query string parameter, an empty cursor
+// requests the first page.
+func getCursor(u *url.URL) string {
+	values, ok := u.Query()["cursor"]
+	if !ok {
+		return ""
+	} else if len(values[0]) == 0 {
+		return db.FirstCursor
+	}
+	return values[0]
+}
+
+// getReadParams returns the fields and expand query string parameters, both
+// are comma separated lists i.e. ?fields=title,done&expand=assignee:users
+func getReadParams(u *url.URL) (params db.ReadParams) {
+	for _, s := range u.Query()["fields"] {
+		params.Fields = append(params.Fields, splitList(s)...)
+	}
+	for _, s := range u.Query()["expand"] {
+		params.Expand = append(params.Expand, splitList(s)...)
+	}
+	return
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getUpdateOptions returns the expected version from the If-Match header,
+// the upsert and update operators modes from the upsert and operators query
+// string parameters.
+func getUpdateOptions(r *http.Request) (opt db.UpdateOptions, err error) {
+	opt.Upsert = len(r.URL.Query().Get("upsert")) > 0
+	opt.Operators = len(r.URL.Query().Get("operators")) > 0
+
+	etag := strings.TrimPrefix(r.Header.Get("If-Match"), "W/")
+	if etag = strings.Trim(etag, `"`); len(etag) == 0 || etag == "*" {
+		return opt, nil
+	}
+
+	opt.Version, err = strconv.ParseInt(etag, 10, 64)
+	if err != nil || opt.Version <= 0 {
+		return opt, fmt.Errorf("invalid If-Match header, expected the document version")
+	}
+	return opt, nil
+}
+
+// setETag sets the document version as ETag, clients send it back via
+// If-Match to update the document only if it's unchanged.
+func setETag(w http.ResponseWriter, doc map[string]interface{}) {
+	if v, ok := doc[internal.FieldVersion]; ok {
+		w.Header().Set("ETag", fmt.Sprintf(`"%v"`, v))
+	}
+}
+
+// writeDBError writes the error of a database operation, documents not
+// matching the collection's schema are reported per field.
+func writeDBError(w http.ResponseWriter, err error) {
+	if ve, ok := db.IsValidationError(err); ok {
+		respond(w, http.StatusBadRequest, ve)
+		return
+	} else if errors.Is(err, internal.ErrPermissionDenied) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if errors.Is(err, internal.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if errors.Is(err, db.ErrVersionConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if errors.Is(err, db.ErrInvalidUpdate) || errors.Is(err, db.ErrNoTextIndex) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
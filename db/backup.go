@@ -0,0 +1,450 @@
+package db
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"staticbackend/internal"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// FormatNDJSON exports one line per document: {"col": "name", "doc": {}}
+	// and one line per index: {"col": "name", "index": {}}
+	FormatNDJSON = "ndjson"
+	// FormatTar exports a tar archive with a {col}.ndjson file of one
+	// document per line and a {col}.indexes.json file per collection
+	FormatTar = "tar"
+)
+
+// backupBatch is the number of documents read or inserted at once
+const backupBatch = 500
+
+// ExportOptions controls the format of an export and the collections to skip
+type ExportOptions struct {
+	Format string
+	Skip   []string
+}
+
+// ImportOptions controls the collections to skip and the accountId and
+// sb_owner to change, Remap maps the old ids to the new ones.
+type ImportOptions struct {
+	Skip  []string
+	Remap map[string]string
+}
+
+// ImportResult is the number of documents imported per collection
+type ImportResult struct {
+	Documents map[string]int64 `json:"documents"`
+	Indexes   int              `json:"indexes"`
+}
+
+// backupLine is a line of an NDJSON export
+type backupLine struct {
+	Col   string          `bson:"col"`
+	Doc   bson.M          `bson:"doc,omitempty"`
+	Index *internal.Index `bson:"index,omitempty"`
+}
+
+// Export writes all the collections of the base, system collections
+// included, documents are in canonical extended JSON to keep their types.
+// Files are not exported, only their metadata.
+func Export(db internal.Database, w io.Writer, opt ExportOptions) error {
+	cols, err := db.ListCollections()
+	if err != nil {
+		return err
+	}
+
+	skip := toSet(opt.Skip)
+
+	switch opt.Format {
+	case "", FormatNDJSON:
+		for _, col := range cols {
+			if skip[col] {
+				continue
+			}
+
+			if err := exportNDJSON(db, col, w); err != nil {
+				return fmt.Errorf("cannot export %s: %w", col, err)
+			}
+		}
+		return nil
+	case FormatTar:
+		tw := tar.NewWriter(w)
+		for _, col := range cols {
+			if skip[col] {
+				continue
+			}
+
+			if err := exportTar(db, col, tw); err != nil {
+				return fmt.Errorf("cannot export %s: %w", col, err)
+			}
+		}
+		return tw.Close()
+	}
+	return fmt.Errorf("invalid export format: %s", opt.Format)
+}
+
+func exportNDJSON(db internal.Database, col string, w io.Writer) error {
+	indexes, err := exportedIndexes(db, col)
+	if err != nil {
+		return err
+	}
+
+	for i := range indexes {
+		if err := writeLine(w, backupLine{Col: col, Index: &indexes[i]}); err != nil {
+			return err
+		}
+	}
+
+	return eachDocument(db, col, func(doc bson.M) error {
+		return writeLine(w, backupLine{Col: col, Doc: doc})
+	})
+}
+
+func exportTar(db internal.Database, col string, tw *tar.Writer) error {
+	indexes, err := exportedIndexes(db, col)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(indexes)
+	if err != nil {
+		return err
+	}
+
+	if err := writeTarFile(tw, col+".indexes.json", int64(len(b)), bytes.NewReader(b)); err != nil {
+		return err
+	}
+
+	// the size of a tar entry is needed before its content
+	f, err := os.CreateTemp("", "sb-export-*.ndjson")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	if err := eachDocument(db, col, func(doc bson.M) error {
+		return writeLine(bw, doc)
+	}); err != nil {
+		return err
+	} else if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return writeTarFile(tw, col+".ndjson", size, f)
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// exportedIndexes returns the indexes of the collection but the _id one
+func exportedIndexes(db internal.Database, col string) ([]internal.Index, error) {
+	indexes, err := db.ListIndexes(col)
+	if err != nil {
+		return nil, err
+	}
+
+	exported := make([]internal.Index, 0, len(indexes))
+	for _, idx := range indexes {
+		if idx.Name != "_id_" {
+			exported = append(exported, idx)
+		}
+	}
+	return exported, nil
+}
+
+// eachDocument calls fn for every document of the collection by batch
+func eachDocument(db internal.Database, col string, fn func(doc bson.M) error) error {
+	opt := internal.FindOptions{
+		Limit: backupBatch,
+		Sort:  bson.D{{Key: internal.FieldID, Value: 1}},
+	}
+
+	for {
+		var docs []bson.M
+		if err := db.Find(col, bson.M{}, opt, &docs); err != nil {
+			return err
+		}
+
+		for _, doc := range docs {
+			if err := fn(doc); err != nil {
+				return err
+			}
+		}
+
+		if len(docs) < backupBatch {
+			return nil
+		}
+		opt.Skip += backupBatch
+	}
+}
+
+func writeLine(w io.Writer, v interface{}) error {
+	b, err := bson.MarshalExtJSON(v, true, false)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Import inserts the documents and creates the indexes of an export, the
+// format is detected. Documents already in the base are not replaced, the
+// import fails on their ids.
+func Import(db internal.Database, r io.Reader, opt ImportOptions) (ImportResult, error) {
+	result := ImportResult{Documents: make(map[string]int64)}
+
+	remap, err := parseRemap(opt.Remap)
+	if err != nil {
+		return result, err
+	}
+
+	imp := &importer{
+		db:     db,
+		skip:   toSet(opt.Skip),
+		remap:  remap,
+		result: &result,
+	}
+
+	br := bufio.NewReader(r)
+
+	// tar archives have their magic after the first header fields, an empty
+	// archive is only zeros
+	block, _ := br.Peek(512)
+	if len(block) == 512 && (bytes.HasPrefix(block[257:], []byte("ustar")) || len(bytes.Trim(block, "\x00")) == 0) {
+		err = imp.tar(tar.NewReader(br))
+	} else {
+		err = imp.ndjson(br)
+	}
+	return result, err
+}
+
+type importer struct {
+	db     internal.Database
+	skip   map[string]bool
+	remap  map[primitive.ObjectID]primitive.ObjectID
+	result *ImportResult
+
+	col     string
+	pending []interface{}
+}
+
+func (imp *importer) ndjson(br *bufio.Reader) error {
+	for n := 1; ; n++ {
+		b, readErr := br.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return readErr
+		}
+
+		if line := bytes.TrimSpace(b); len(line) > 0 {
+			var bl backupLine
+			if err := bson.UnmarshalExtJSON(line, true, &bl); err != nil {
+				return fmt.Errorf("line %d: %v", n, err)
+			} else if len(bl.Col) == 0 {
+				return fmt.Errorf("line %d: missing collection", n)
+			}
+
+			var err error
+			if bl.Index != nil {
+				err = imp.index(bl.Col, *bl.Index)
+			} else if bl.Doc != nil {
+				err = imp.add(bl.Col, bl.Doc)
+			}
+			if err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+		}
+
+		if errors.Is(readErr, io.EOF) {
+			return imp.flush()
+		}
+	}
+}
+
+func (imp *importer) tar(tr *tar.Reader) error {
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return imp.flush()
+		} else if err != nil {
+			return err
+		}
+
+		name := path.Base(hdr.Name)
+		switch {
+		case strings.HasSuffix(name, ".indexes.json"):
+			col := strings.TrimSuffix(name, ".indexes.json")
+
+			var indexes []internal.Index
+			if err := json.NewDecoder(tr).Decode(&indexes); err != nil {
+				return fmt.Errorf("%s: %v", hdr.Name, err)
+			}
+
+			for _, idx := range indexes {
+				if err := imp.index(col, idx); err != nil {
+					return fmt.Errorf("%s: %w", hdr.Name, err)
+				}
+			}
+		case strings.HasSuffix(name, ".ndjson"):
+			col := strings.TrimSuffix(name, ".ndjson")
+
+			br := bufio.NewReader(tr)
+			for n := 1; ; n++ {
+				b, readErr := br.ReadBytes('\n')
+				if readErr != nil && !errors.Is(readErr, io.EOF) {
+					return readErr
+				}
+
+				if line := bytes.TrimSpace(b); len(line) > 0 {
+					var doc bson.M
+					if err := bson.UnmarshalExtJSON(line, true, &doc); err != nil {
+						return fmt.Errorf("%s line %d: %v", hdr.Name, n, err)
+					} else if err := imp.add(col, doc); err != nil {
+						return fmt.Errorf("%s line %d: %w", hdr.Name, n, err)
+					}
+				}
+
+				if errors.Is(readErr, io.EOF) {
+					break
+				}
+			}
+		}
+	}
+}
+
+// add queues the document, they're inserted by batch per collection
+func (imp *importer) add(col string, doc bson.M) error {
+	if imp.skip[col] {
+		return nil
+	}
+
+	if col != imp.col {
+		if err := imp.flush(); err != nil {
+			return err
+		}
+		imp.col = col
+	}
+
+	for _, field := range []string{internal.FieldAccountID, internal.FieldOwnerID} {
+		oid, ok := toObjectID(doc[field])
+		if !ok {
+			continue
+		}
+
+		if to, ok := imp.remap[oid]; ok {
+			// the id keeps its type
+			if _, ok := doc[field].(string); ok {
+				doc[field] = to.Hex()
+			} else {
+				doc[field] = to
+			}
+		}
+	}
+
+	imp.pending = append(imp.pending, doc)
+	if len(imp.pending) >= backupBatch {
+		return imp.flush()
+	}
+	return nil
+}
+
+func (imp *importer) flush() error {
+	if len(imp.pending) == 0 {
+		return nil
+	}
+
+	if err := imp.db.InsertMany(imp.col, imp.pending); err != nil {
+		return fmt.Errorf("cannot import %s: %w", imp.col, err)
+	}
+
+	imp.result.Documents[imp.col] += int64(len(imp.pending))
+	imp.pending = nil
+	return nil
+}
+
+func (imp *importer) index(col string, idx internal.Index) error {
+	if imp.skip[col] {
+		return nil
+	}
+
+	if err := imp.db.CreateIndex(col, idx); err != nil {
+		return fmt.Errorf("cannot create the index %s of %s: %w", idx.Name, col, err)
+	}
+
+	imp.result.Indexes++
+	return nil
+}
+
+// parseRemap parses the ids to remap, they're hex ObjectIDs
+func parseRemap(remap map[string]string) (map[primitive.ObjectID]primitive.ObjectID, error) {
+	ids := make(map[primitive.ObjectID]primitive.ObjectID)
+	for from, to := range remap {
+		fromID, err := primitive.ObjectIDFromHex(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id to remap %s: %v", from, err)
+		}
+
+		toID, err := primitive.ObjectIDFromHex(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id to remap to %s: %v", to, err)
+		}
+
+		ids[fromID] = toID
+	}
+	return ids, nil
+}
+
+// toObjectID returns the ObjectID of v, it can be stored as a hex string
+func toObjectID(v interface{}) (primitive.ObjectID, bool) {
+	switch id := v.(type) {
+	case primitive.ObjectID:
+		return id, true
+	case string:
+		oid, err := primitive.ObjectIDFromHex(id)
+		return oid, err == nil
+	}
+	return primitive.NilObjectID, false
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
@@ -1,34 +1,59 @@
 package db
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"staticbackend/internal"
 	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Base struct {
 	PublishDocument func(topic, msg string, doc interface{})
+
+	// tx is true for the Base of a transaction
+	tx bool
 }
 
-func (b *Base) Add(auth internal.Auth, db *mongo.Database, col string, doc map[string]interface{}) (map[string]interface{}, error) {
-	delete(doc, "id")
-	delete(doc, internal.FieldID)
-	delete(doc, internal.FieldAccountID)
-	delete(doc, internal.FieldOwnerID)
+func (b *Base) Add(auth internal.Auth, db internal.Database, col string, doc map[string]interface{}) (map[string]interface{}, error) {
+	removeSystemFields(doc)
+	return b.insert(auth, db, col, primitive.NewObjectID(), doc)
+}
 
-	doc[internal.FieldID] = primitive.NewObjectID()
+// insert validates and creates the document with the id
+func (b *Base) insert(auth internal.Auth, db internal.Database, col string, id primitive.ObjectID, doc map[string]interface{}) (map[string]interface{}, error) {
+	schema, err := schemaFor(db, col)
+	if err != nil {
+		return nil, err
+	} else if schema != nil {
+		if err := schema.Validate(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	doc[internal.FieldID] = id
 	doc[internal.FieldAccountID] = auth.AccountID
 	doc[internal.FieldOwnerID] = auth.UserID
+	doc[internal.FieldVersion] = 1
+
+	if err := canCreate(auth, db, col, doc); err != nil {
+		return nil, err
+	} else if err := b.ensureIndexes(db, col); err != nil {
+		return nil, err
+	}
+
+	if err := db.InsertOne(col, doc); err != nil {
+		return nil, err
+	}
 
-	ctx := context.Background()
-	if _, err := db.Collection(col).InsertOne(ctx, doc); err != nil {
+	if ok, err := HistoryEnabled(db, col); err != nil {
 		return nil, err
+	} else if ok {
+		if err := recordHistory(auth, db, col, internal.OpCreate, id, nil, doc); err != nil {
+			return nil, err
+		}
 	}
 
 	doc["id"] = doc[internal.FieldID]
@@ -39,108 +64,222 @@ func (b *Base) Add(auth internal.Auth, db *mongo.Database, col string, doc map[s
 	return doc, nil
 }
 
-func (b *Base) BulkAdd(auth internal.Auth, db *mongo.Database, col string, docs []interface{}) error {
-	for _, item := range docs {
+// removeSystemFields removes the fields only the server sets
+func removeSystemFields(doc map[string]interface{}) {
+	for field := range systemFields {
+		delete(doc, field)
+	}
+}
+
+func (b *Base) BulkAdd(auth internal.Auth, db internal.Database, col string, docs []interface{}) error {
+	schema, err := schemaFor(db, col)
+	if err != nil {
+		return err
+	}
+
+	// all documents are validated before inserting any
+	invalid := &ValidationError{}
+	for i, item := range docs {
 		doc, ok := item.(map[string]interface{})
 		if !ok {
 			return fmt.Errorf("unable to cast docs to map")
 		}
 
-		delete(doc, "id")
-		delete(doc, internal.FieldID)
-		delete(doc, internal.FieldAccountID)
-		delete(doc, internal.FieldOwnerID)
+		removeSystemFields(doc)
+
+		if schema == nil {
+			continue
+		}
+
+		if err := schema.Validate(doc); err != nil {
+			ve, _ := IsValidationError(err)
+			for _, fe := range ve.Errors {
+				invalid.add(fmt.Sprintf("%d.%s", i, fe.Field), fe.Message)
+			}
+		}
+	}
+
+	if len(invalid.Errors) > 0 {
+		return invalid
+	}
+
+	news := make([]map[string]interface{}, len(docs))
+	for i, item := range docs {
+		doc := item.(map[string]interface{})
 
 		doc[internal.FieldID] = primitive.NewObjectID()
 		doc[internal.FieldAccountID] = auth.AccountID
 		doc[internal.FieldOwnerID] = auth.UserID
+		doc[internal.FieldVersion] = 1
+
+		news[i] = doc
+	}
+
+	if err := canCreate(auth, db, col, news...); err != nil {
+		return err
+	} else if err := b.ensureIndexes(db, col); err != nil {
+		return err
 	}
 
-	ctx := context.Background()
-	if _, err := db.Collection(col).InsertMany(ctx, docs); err != nil {
+	if err := db.InsertMany(col, docs); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// PagedResult is a page of documents. With cursor pagination Next is the
+// cursor of the following page, empty on the last page. Total is -1 when
+// the count was skipped.
 type PagedResult struct {
 	Page    int64    `json:"page"`
 	Size    int64    `json:"size"`
 	Total   int64    `json:"total"`
+	Next    string   `json:"next,omitempty"`
 	Results []bson.M `json:"results"`
 }
 
+// ListParams controls the paging and sorting of List and Query. Pages are
+// selected via Page and Size, unless Cursor is set: use FirstCursor for the
+// first page and the Next cursor of the result for the following ones.
 type ListParams struct {
-	Page           int64
-	Size           int64
-	SortBy         string
-	SortDescending bool
+	Page           int64  `json:"page"`
+	Size           int64  `json:"size"`
+	SortBy         string `json:"sortBy"`
+	SortDescending bool   `json:"desc"`
+	Cursor         string `json:"cursor"`
+	SkipTotal      bool   `json:"skipTotal"`
+
+	ReadParams
 }
 
-func (b *Base) List(auth internal.Auth, db *mongo.Database, col string, params ListParams) (PagedResult, error) {
+// Validate returns an error when the cursor, a field or an expansion is
+// invalid.
+func (p ListParams) Validate() error {
+	if len(p.Cursor) > 0 && p.Cursor != FirstCursor {
+		if _, err := decodeCursor(p.Cursor); err != nil {
+			return err
+		}
+	}
+	return p.ReadParams.Validate()
+}
+
+func (b *Base) List(auth internal.Auth, db internal.Database, col string, params ListParams) (PagedResult, error) {
+	return b.Query(auth, db, col, bson.M{}, params)
+}
+
+func (b *Base) Query(auth internal.Auth, db internal.Database, col string, filter bson.M, params ListParams) (PagedResult, error) {
 	result := PagedResult{
 		Page: params.Page,
 		Size: params.Size,
 	}
 
-	filter := bson.M{}
-
-	// if they're not root
-	if !strings.HasPrefix(col, "pub_") && auth.Role < 100 {
-		switch internal.ReadPermission(col) {
-		case internal.PermGroup:
-			filter = bson.M{internal.FieldAccountID: auth.AccountID}
-		case internal.PermOwner:
-			filter = bson.M{internal.FieldAccountID: auth.AccountID, internal.FieldOwnerID: auth.UserID}
-		}
+	expands, err := params.parse()
+	if err != nil {
+		return result, err
 	}
 
-	ctx := context.Background()
-	count, err := db.Collection(col).CountDocuments(ctx, filter)
-	if err != nil {
+	if err := secureRead(auth, db, col, filter); err != nil {
 		return result, err
 	}
 
-	result.Total = count
+	if params.SkipTotal {
+		result.Total = -1
+	} else {
+		count, err := db.Count(col, filter)
+		if err != nil {
+			return result, err
+		}
+
+		result.Total = count
 
-	skips := params.Size * (params.Page - 1)
+		if count == 0 {
+			result.Results = make([]bson.M, 0)
+			return result, nil
+		}
+	}
 
 	if len(params.SortBy) == 0 || strings.EqualFold(params.SortBy, "id") {
 		params.SortBy = internal.FieldID
 	}
-	sortBy := bson.M{params.SortBy: 1}
+
+	dir := 1
 	if params.SortDescending {
-		sortBy[params.SortBy] = -1
+		dir = -1
 	}
 
-	opt := options.Find()
-	opt.SetSkip(skips)
-	opt.SetLimit(params.Size)
-	opt.SetSort(sortBy)
+	// _id breaks ties so pages are stable
+	sortBy := bson.D{{Key: params.SortBy, Value: dir}}
+	if params.SortBy != internal.FieldID {
+		sortBy = append(sortBy, bson.E{Key: internal.FieldID, Value: dir})
+	}
 
-	cur, err := db.Collection(col).Find(ctx, filter, opt)
-	if err != nil {
-		return result, err
+	opt := internal.FindOptions{
+		Limit:      params.Size,
+		Sort:       sortBy,
+		Projection: params.projection(expands),
+	}
+
+	// the sort field is needed for the next cursor but only returned when
+	// the caller asked for it
+	unrequested := ""
+
+	useCursor := len(params.Cursor) > 0
+	if useCursor {
+		if params.Size <= 0 {
+			params.Size = 25
+			result.Size = params.Size
+		}
+		result.Page = 0
+
+		if params.Cursor != FirstCursor {
+			c, err := decodeCursor(params.Cursor)
+			if err != nil {
+				return result, err
+			} else if c.Field != params.SortBy || c.Desc != params.SortDescending {
+				return result, fmt.Errorf("the cursor was created with a different sort")
+			}
+
+			filter = bson.M{"$and": bson.A{filter, c.filter()}}
+		}
+
+		// one more document tells if there's a next page
+		opt.Limit = params.Size + 1
+		// _id is always returned
+		if opt.Projection != nil && params.SortBy != internal.FieldID && !projects(opt.Projection, params.SortBy) {
+			opt.Projection[params.SortBy] = 1
+			unrequested = params.SortBy
+		}
+	} else {
+		opt.Skip = params.Size * (params.Page - 1)
 	}
-	defer cur.Close(ctx)
 
 	var results []bson.M
+	if err := db.Find(col, filter, opt, &results); err != nil {
+		return result, err
+	}
+
+	if useCursor && int64(len(results)) > params.Size {
+		results = results[:params.Size]
 
-	for cur.Next(ctx) {
-		var v bson.M
-		err := cur.Decode(&v)
+		next, err := newCursor(results[len(results)-1], params.SortBy, params.SortDescending).encode()
 		if err != nil {
 			return result, err
 		}
+		result.Next = next
+	}
+
+	for _, v := range results {
+		if len(unrequested) > 0 {
+			removeField(v, unrequested)
+		}
 
 		v["id"] = v[internal.FieldID]
 		delete(v, internal.FieldID)
 		delete(v, internal.FieldOwnerID)
-
-		results = append(results, v)
 	}
-	if err := cur.Err(); err != nil {
+
+	if err := b.expand(auth, db, results, expands); err != nil {
 		return result, err
 	}
 
@@ -153,87 +292,184 @@ func (b *Base) List(auth internal.Auth, db *mongo.Database, col string, params L
 	return result, nil
 }
 
-func (b *Base) Query(auth internal.Auth, db *mongo.Database, col string, filter bson.M, params ListParams) (PagedResult, error) {
-	result := PagedResult{
-		Page: params.Page,
-		Size: params.Size,
+// secureRead restricts the filter to the documents the user can read
+func secureRead(auth internal.Auth, db internal.Database, col string, filter bson.M) error {
+	return secure(auth, db, col, internal.OpRead, filter)
+}
+
+// secure restricts the filter to the documents the user can read, update or
+// delete. The collection's rules are used when it has some, otherwise the
+// permission of the collection's name.
+func secure(auth internal.Auth, db internal.Database, col, op string, filter bson.M) error {
+	// documents in the trash are only reachable via the trash functions
+	filter[internal.FieldDeleted] = bson.M{"$exists": false}
+
+	if !keyAllows(auth, col, op) {
+		return internal.ErrPermissionDenied
+	} else if auth.Role >= internal.RootRole {
+		return nil
+	} else if isReserved(col) {
+		return internal.ErrPermissionDenied
 	}
 
-	// either not a public repo or not root
-	if strings.HasPrefix(col, "pub_") == false && auth.Role < 100 {
-		switch internal.ReadPermission(col) {
-		case internal.PermGroup:
-			filter[internal.FieldAccountID] = auth.AccountID
-		case internal.PermOwner:
-			filter[internal.FieldAccountID] = auth.AccountID
-			filter[internal.FieldOwnerID] = auth.UserID
+	rules, ok, err := internal.GetRules(db, col)
+	if err != nil {
+		return err
+	} else if ok {
+		f, err := rules.Filter(auth, op)
+		if err != nil {
+			return err
+		} else if len(f) == 0 {
+			return nil
 		}
 
+		if and, ok := filter["$and"]; ok {
+			filter["$and"] = bson.A{bson.M{"$and": and}, f}
+		} else {
+			filter["$and"] = bson.A{f}
+		}
+		return nil
 	}
 
-	ctx := context.Background()
-	count, err := db.Collection(col).CountDocuments(ctx, filter)
-	if err != nil {
-		return result, err
+	perm := internal.WritePermission(col)
+	if op == internal.OpRead {
+		// public repos are readable by everyone
+		if strings.HasPrefix(col, "pub_") {
+			return nil
+		}
+		perm = internal.ReadPermission(col)
+	}
+
+	switch perm {
+	case internal.PermGroup:
+		filter[internal.FieldAccountID] = auth.AccountID
+	case internal.PermOwner:
+		filter[internal.FieldAccountID] = auth.AccountID
+		filter[internal.FieldOwnerID] = auth.UserID
 	}
+	return nil
+}
 
-	result.Total = count
+// isReserved returns true for the system collections only root users can
+// access, they all start with sb_
+func isReserved(col string) bool {
+	return strings.HasPrefix(col, "sb_")
+}
 
-	if count == 0 {
-		result.Results = make([]bson.M, 0)
-		return result, nil
+// keyAllows returns false when the request is made with an API key whose
+// scopes do not include the collection, API keys never reach the system
+// collections
+func keyAllows(auth internal.Auth, col, op string) bool {
+	if len(auth.APIKeyID) == 0 {
+		return true
 	}
 
-	skips := params.Size * (params.Page - 1)
+	action := "write"
+	if op == internal.OpRead {
+		action = "read"
+	}
+	return !isReserved(col) && auth.Allowed("db:"+action+":"+col)
+}
 
-	if len(params.SortBy) == 0 || strings.EqualFold(params.SortBy, "id") {
-		params.SortBy = internal.FieldID
+// canCreate returns ErrPermissionDenied if the collection has rules and none
+// allows the user to create the document.
+func canCreate(auth internal.Auth, db internal.Database, col string, docs ...map[string]interface{}) error {
+	if !keyAllows(auth, col, internal.OpCreate) {
+		return internal.ErrPermissionDenied
+	} else if auth.Role >= internal.RootRole {
+		return nil
+	} else if isReserved(col) {
+		return internal.ErrPermissionDenied
 	}
-	sortBy := bson.M{params.SortBy: 1}
-	if params.SortDescending {
-		sortBy[params.SortBy] = -1
+
+	rules, ok, err := internal.GetRules(db, col)
+	if err != nil || !ok {
+		return err
 	}
 
-	opt := options.Find()
-	opt.SetSkip(skips)
-	opt.SetLimit(params.Size)
-	opt.SetSort(sortBy)
+	for _, doc := range docs {
+		if !rules.Allowed(auth, internal.OpCreate, doc) {
+			return internal.ErrPermissionDenied
+		}
+	}
+	return nil
+}
 
-	cur, err := db.Collection(col).Find(ctx, filter, opt)
-	if err != nil {
-		return result, err
+// updateRules returns the rules the updated documents must still be allowed
+// by, ok is false when the user is not restricted by rules.
+func updateRules(auth internal.Auth, db internal.Database, col string) (rules internal.CollectionRules, ok bool, err error) {
+	if !keyAllows(auth, col, internal.OpUpdate) {
+		return rules, false, internal.ErrPermissionDenied
+	} else if auth.Role >= internal.RootRole {
+		return rules, false, nil
 	}
-	defer cur.Close(ctx)
+	return internal.GetRules(db, col)
+}
 
-	var results []bson.M
+// maxRuledUpdateTries is how many times ruledUpdate reads the document again
+// when it changed before it could be updated
+const maxRuledUpdateTries = 3
+
+// ruledUpdate applies the update to the document matching filter when the
+// updated document is still allowed by the rules. The updated document is
+// computed by change from the current one, the update only applies if the
+// document's version did not change since so no transaction is needed.
+func ruledUpdate(auth internal.Auth, db internal.Database, col string, oid primitive.ObjectID, filter bson.M, rules internal.CollectionRules, update bson.M, change func(cur bson.M)) (bson.M, error) {
+	for i := 0; i < maxRuledUpdateTries; i++ {
+		var cur bson.M
+		if err := db.FindOne(col, filter, &cur); errors.Is(err, internal.ErrNotFound) {
+			return nil, errNoMatch
+		} else if err != nil {
+			return nil, err
+		}
 
-	for cur.Next(ctx) {
-		var v bson.M
-		if err := cur.Decode(&v); err != nil {
-			return result, err
+		unchanged := bson.M{"$and": bson.A{filter, sameVersion(cur)}}
+
+		change(cur)
+		if !rules.Allowed(auth, internal.OpUpdate, cur) {
+			return nil, internal.ErrPermissionDenied
 		}
 
-		v["id"] = v[internal.FieldID]
-		delete(v, internal.FieldID)
-		delete(v, internal.FieldOwnerID)
+		result, err := applyUpdate(db, col, oid, unchanged, update)
+		if errors.Is(err, errNoMatch) {
+			continue
+		}
+		return result, err
+	}
+	return nil, ErrVersionConflict
+}
 
-		results = append(results, v)
+// sameVersion matches the document while its version is the one of doc
+func sameVersion(doc bson.M) bson.M {
+	if v, ok := doc[internal.FieldVersion]; ok {
+		return bson.M{internal.FieldVersion: v}
 	}
+	return bson.M{internal.FieldVersion: bson.M{"$exists": false}}
+}
 
-	if err := cur.Err(); err != nil {
-		return result, err
+// Aggregate groups the documents matching filter the user can read and
+// computes the accumulators of each group.
+func (b *Base) Aggregate(auth internal.Auth, db internal.Database, col string, filter bson.M, opt internal.AggregateOptions) ([]bson.M, error) {
+	if err := opt.Validate(); err != nil {
+		return nil, err
 	}
 
-	if len(results) == 0 {
-		results = make([]bson.M, 1)
+	if err := secureRead(auth, db, col, filter); err != nil {
+		return nil, err
 	}
 
-	result.Results = results
+	results, err := db.Aggregate(col, filter, opt)
+	if err != nil {
+		return nil, err
+	}
 
-	return result, nil
+	if len(results) == 0 {
+		results = make([]bson.M, 0)
+	}
+	return results, nil
 }
 
-func (b *Base) GetByID(auth internal.Auth, db *mongo.Database, col, id string) (bson.M, error) {
+func (b *Base) GetByID(auth internal.Auth, db internal.Database, col, id string, params ReadParams) (bson.M, error) {
 	var result bson.M
 
 	oid, err := primitive.ObjectIDFromHex(id)
@@ -241,79 +477,165 @@ func (b *Base) GetByID(auth internal.Auth, db *mongo.Database, col, id string) (
 		return result, err
 	}
 
+	expands, err := params.parse()
+	if err != nil {
+		return result, err
+	}
+
 	filter := bson.M{internal.FieldID: oid}
+	if err := secureRead(auth, db, col, filter); err != nil {
+		return result, err
+	}
 
-	// if they're not root and repo is not public
-	if !strings.HasPrefix(col, "pub_") && auth.Role < 100 {
-		switch internal.ReadPermission(col) {
-		case internal.PermGroup:
-			filter[internal.FieldAccountID] = auth.AccountID
-		case internal.PermOwner:
-			filter[internal.FieldAccountID] = auth.AccountID
-			filter[internal.FieldOwnerID] = auth.UserID
-		}
+	opt := internal.FindOptions{
+		Limit:      1,
+		Projection: params.projection(expands),
 	}
 
-	ctx := context.Background()
-	sr := db.Collection(col).FindOne(ctx, filter)
-	if err := sr.Decode(&result); err != nil {
-		return result, err
-	} else if err := sr.Err(); err != nil {
+	var results []bson.M
+	if err := db.Find(col, filter, opt, &results); err != nil {
 		return result, err
+	} else if len(results) == 0 {
+		return result, internal.ErrNotFound
 	}
 
+	result = results[0]
 	result["id"] = result[internal.FieldID]
 	delete(result, internal.FieldID)
 	delete(result, internal.FieldOwnerID)
 
+	if err := b.expand(auth, db, results, expands); err != nil {
+		return result, err
+	}
+
 	return result, nil
 }
 
-func (b *Base) Update(auth internal.Auth, db *mongo.Database, col, id string, doc map[string]interface{}) (map[string]interface{}, error) {
+// ErrVersionConflict is returned by conditional updates when the document
+// was modified since the expected version.
+var ErrVersionConflict = errors.New("the document was modified since the expected version")
+
+// UpdateOptions controls conditional updates, upserts and the update mode.
+// With Version set the document is updated only if it's still at that
+// version, otherwise ErrVersionConflict is returned. With Upsert the document
+// is created when it does not exists. With Operators the document holds
+// update operators, see UpdateOperators, instead of the fields to set.
+type UpdateOptions struct {
+	Version   int64 `json:"version"`
+	Upsert    bool  `json:"upsert"`
+	Operators bool  `json:"operators"`
+}
+
+// errNoMatch is returned by applyUpdate when no document matched
+var errNoMatch = errors.New("no document matched the update")
+
+func (b *Base) Update(auth internal.Auth, db internal.Database, col, id string, doc map[string]interface{}, opt UpdateOptions) (map[string]interface{}, error) {
 	oid, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		return doc, err
 	}
 
-	delete(doc, "id")
-	delete(doc, internal.FieldID)
-	delete(doc, internal.FieldAccountID)
-	delete(doc, internal.FieldOwnerID)
+	schema, err := schemaFor(db, col)
+	if err != nil {
+		return doc, err
+	}
 
-	filter := bson.M{internal.FieldID: oid}
+	var update bson.M
+	if opt.Operators {
+		if opt.Upsert {
+			return doc, fmt.Errorf("%w: upsert cannot be used with update operators", ErrInvalidUpdate)
+		}
+
+		update, err = operatorsUpdate(doc, schema)
+		if err != nil {
+			return doc, err
+		}
+	} else {
+		removeSystemFields(doc)
+
+		if schema != nil {
+			if err := schema.ValidatePartial(doc); err != nil {
+				return doc, err
+			}
+		}
+
+		newProps := bson.M{}
+		for k, v := range doc {
+			newProps[k] = v
+		}
 
-	// if they are not "root", we use permission
-	if auth.Role < 100 {
-		switch internal.WritePermission(col) {
-		case internal.PermGroup:
-			filter[internal.FieldAccountID] = auth.AccountID
-		case internal.PermOwner:
-			filter[internal.FieldAccountID] = auth.AccountID
-			filter[internal.FieldOwnerID] = auth.UserID
+		update = bson.M{
+			"$set": newProps,
+			"$inc": bson.M{internal.FieldVersion: 1},
 		}
 	}
 
-	newProps := bson.M{}
-	for k, v := range doc {
-		newProps[k] = v
+	filter := bson.M{internal.FieldID: oid}
+	if err := secure(auth, db, col, internal.OpUpdate, filter); err != nil {
+		return doc, err
 	}
 
-	update := bson.M{"$set": newProps}
+	before, err := historyBefore(db, col, filter)
+	if err != nil {
+		return doc, err
+	}
 
-	ctx := context.Background()
-	res := db.Collection(col).FindOneAndUpdate(ctx, filter, update)
-	if err := res.Err(); err != nil {
+	rules, hasRules, err := updateRules(auth, db, col)
+	if err != nil {
 		return doc, err
 	}
 
+	versioned := filter
+	if opt.Version > 0 {
+		versioned = bson.M{"$and": bson.A{filter, bson.M{internal.FieldVersion: opt.Version}}}
+	}
+
 	var result bson.M
-	sr := db.Collection(col).FindOne(ctx, filter)
-	if err := sr.Decode(&result); err != nil {
-		return doc, err
-	} else if err := sr.Err(); err != nil {
+	if opt.Operators && (schema != nil || hasRules) {
+		// the result of the operators is validated and the updated document
+		// must still be allowed by the rules, the update is rolled back
+		// otherwise
+		err = db.Transaction(func(tx internal.Database) error {
+			updated, err := applyUpdate(tx, col, oid, versioned, update)
+			if err != nil {
+				return err
+			}
+
+			if opt.Operators && schema != nil {
+				if err := schema.Validate(updated); err != nil {
+					return err
+				}
+			}
+
+			if hasRules && !rules.Allowed(auth, internal.OpUpdate, updated) {
+				return internal.ErrPermissionDenied
+			}
+
+			result = updated
+			return nil
+		})
+	} else if hasRules {
+		result, err = ruledUpdate(auth, db, col, oid, versioned, rules, update, func(cur bson.M) {
+			for k, v := range doc {
+				setField(cur, k, v)
+			}
+		})
+	} else {
+		result, err = applyUpdate(db, col, oid, versioned, update)
+	}
+
+	if errors.Is(err, errNoMatch) {
+		return b.updateMissed(auth, db, col, oid, filter, doc, opt)
+	} else if err != nil {
 		return doc, err
 	}
 
+	if before != nil {
+		if err := recordHistory(auth, db, col, internal.OpUpdate, oid, before, result); err != nil {
+			return doc, err
+		}
+	}
+
 	result["id"] = result[internal.FieldID]
 	delete(result, internal.FieldID)
 	delete(result, internal.FieldOwnerID)
@@ -323,41 +645,121 @@ func (b *Base) Update(auth internal.Auth, db *mongo.Database, col, id string, do
 	return result, nil
 }
 
-func (b *Base) Increase(auth internal.Auth, db *mongo.Database, col, id, field string, n int) error {
+// applyUpdate updates the document oid if it matches filter and returns it.
+// The document is read back by id since the update can change the fields
+// filter is on.
+func applyUpdate(db internal.Database, col string, oid primitive.ObjectID, filter, update bson.M) (bson.M, error) {
+	res, err := db.UpdateOne(col, filter, update)
+	if err != nil {
+		return nil, err
+	} else if res.MatchedCount == 0 {
+		return nil, errNoMatch
+	}
+
+	var result bson.M
+	if err := db.FindOne(col, bson.M{internal.FieldID: oid}, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// updateMissed finds out why an update matched no document: the version
+// changed, the document does not exists and is upserted or it's not found.
+func (b *Base) updateMissed(auth internal.Auth, db internal.Database, col string, oid primitive.ObjectID, filter bson.M, doc map[string]interface{}, opt UpdateOptions) (map[string]interface{}, error) {
+	exists, err := db.Count(col, bson.M{internal.FieldID: oid})
+	if err != nil {
+		return doc, err
+	}
+
+	if exists == 0 {
+		if opt.Upsert && opt.Version == 0 {
+			return b.insert(auth, db, col, oid, doc)
+		}
+		return doc, internal.ErrNotFound
+	}
+
+	// the user can update the document, the version is not the expected one
+	if opt.Version > 0 {
+		allowed, err := db.Count(col, filter)
+		if err != nil {
+			return doc, err
+		} else if allowed > 0 {
+			return doc, ErrVersionConflict
+		}
+	}
+	return doc, internal.ErrNotFound
+}
+
+func (b *Base) Increase(auth internal.Auth, db internal.Database, col, id, field string, n int) error {
 	oid, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		return err
+	} else if systemFields[field] {
+		return fmt.Errorf("the field %s cannot be increased", field)
 	}
 
 	filter := bson.M{internal.FieldID: oid}
+	if err := secure(auth, db, col, internal.OpUpdate, filter); err != nil {
+		return err
+	}
 
-	// if they are not "root", we use permission
-	if auth.Role < 100 {
-		switch internal.WritePermission(col) {
-		case internal.PermGroup:
-			filter[internal.FieldAccountID] = auth.AccountID
-		case internal.PermOwner:
-			filter[internal.FieldAccountID] = auth.AccountID
-			filter[internal.FieldOwnerID] = auth.UserID
+	schema, err := schemaFor(db, col)
+	if err != nil {
+		return err
+	} else if schema != nil {
+		// the incremented value is validated
+		var cur bson.M
+		if err := db.FindOne(col, filter, &cur); err != nil {
+			return err
+		}
+
+		next := float64(n)
+		if v, ok := toFloat(fieldValue(cur, field)); ok {
+			next += v
+		}
+
+		if err := schema.ValidatePartial(map[string]interface{}{field: next}); err != nil {
+			return err
 		}
 	}
 
-	update := bson.M{"$inc": bson.M{field: n}}
+	before, err := historyBefore(db, col, filter)
+	if err != nil {
+		return err
+	}
 
-	ctx := context.Background()
-	res := db.Collection(col).FindOneAndUpdate(ctx, filter, update)
-	if err := res.Err(); err != nil {
+	rules, hasRules, err := updateRules(auth, db, col)
+	if err != nil {
 		return err
 	}
 
+	update := bson.M{"$inc": bson.M{field: n, internal.FieldVersion: 1}}
+
 	var result bson.M
-	sr := db.Collection(col).FindOne(ctx, filter)
-	if err := sr.Decode(&result); err != nil {
-		return err
-	} else if err := sr.Err(); err != nil {
+	if hasRules {
+		result, err = ruledUpdate(auth, db, col, oid, filter, rules, update, func(cur bson.M) {
+			next := float64(n)
+			if v, ok := toFloat(fieldValue(cur, field)); ok {
+				next += v
+			}
+			setField(cur, field, next)
+		})
+	} else {
+		result, err = applyUpdate(db, col, oid, filter, update)
+	}
+
+	if errors.Is(err, errNoMatch) {
+		return internal.ErrNotFound
+	} else if err != nil {
 		return err
 	}
 
+	if before != nil {
+		if err := recordHistory(auth, db, col, internal.OpUpdate, oid, before, result); err != nil {
+			return err
+		}
+	}
+
 	result["id"] = result[internal.FieldID]
 	delete(result, internal.FieldID)
 	delete(result, internal.FieldOwnerID)
@@ -367,55 +769,52 @@ func (b *Base) Increase(auth internal.Auth, db *mongo.Database, col, id, field s
 	return nil
 }
 
-func (b *Base) Delete(auth internal.Auth, db *mongo.Database, col, id string) (int64, error) {
+func (b *Base) Delete(auth internal.Auth, db internal.Database, col, id string) (int64, error) {
 	oid, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		return 0, err
 	}
 
 	filter := bson.M{internal.FieldID: oid}
-
-	// if they're not root
-	if auth.Role < 100 {
-		switch internal.WritePermission(col) {
-		case internal.PermGroup:
-			filter[internal.FieldAccountID] = auth.AccountID
-		case internal.PermOwner:
-			filter[internal.FieldAccountID] = auth.AccountID
-			filter[internal.FieldOwnerID] = auth.UserID
-
-		}
+	if err := secure(auth, db, col, internal.OpDelete, filter); err != nil {
+		return 0, err
 	}
-	ctx := context.Background()
-	res, err := db.Collection(col).DeleteOne(ctx, filter)
+
+	soft, err := softDeleted(db, col)
 	if err != nil {
 		return 0, err
 	}
 
-	b.PublishDocument("db-"+col, internal.MsgTypeDBDeleted, id)
-
-	return res.DeletedCount, nil
-}
-
-func (b *Base) ListCollections(db *mongo.Database) ([]string, error) {
-	ctx := context.Background()
-
-	cur, err := db.ListCollections(ctx, bson.D{})
+	before, err := historyBefore(db, col, filter)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	defer cur.Close(ctx)
 
-	var names []string
-	for cur.Next(ctx) {
-		var result bson.M
-		err := cur.Decode(&result)
+	var deleted int64
+	if soft {
+		res, err := db.UpdateOne(col, filter, trashUpdate())
 		if err != nil {
-			return nil, err
+			return 0, err
+		}
+		deleted = res.MatchedCount
+	} else {
+		deleted, err = db.DeleteOne(col, filter)
+		if err != nil {
+			return 0, err
 		}
+	}
 
-		names = append(names, fmt.Sprintf("%v", result["name"]))
+	if before != nil && deleted > 0 {
+		if err := recordHistory(auth, db, col, internal.OpDelete, oid, before, nil); err != nil {
+			return 0, err
+		}
 	}
 
-	return names, nil
+	b.PublishDocument("db-"+col, internal.MsgTypeDBDeleted, id)
+
+	return deleted, nil
+}
+
+func (b *Base) ListCollections(db internal.Database) ([]string, error) {
+	return db.ListCollections()
 }
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"fmt"
+	"staticbackend/internal"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxBulkEvents is the number of documents a bulk operation can affect while
+// publishing one event per document, a single summary event is published
+// above that.
+const maxBulkEvents = 50
+
+// UpdateMany sets the fields of doc on all documents matching filter the user
+// can update.
+func (b *Base) UpdateMany(auth internal.Auth, db internal.Database, col string, filter bson.M, doc map[string]interface{}) (internal.UpdateResult, error) {
+	var result internal.UpdateResult
+
+	removeSystemFields(doc)
+
+	if len(doc) == 0 {
+		return result, fmt.Errorf("nothing to update")
+	}
+
+	schema, err := schemaFor(db, col)
+	if err != nil {
+		return result, err
+	} else if schema != nil {
+		if err := schema.ValidatePartial(doc); err != nil {
+			return result, err
+		}
+	}
+
+	if err := secure(auth, db, col, internal.OpUpdate, filter); err != nil {
+		return result, err
+	}
+
+	ids, err := matchingIDs(db, col, filter)
+	if err != nil || len(ids) == 0 {
+		return result, err
+	}
+
+	newProps := bson.M{}
+	for k, v := range doc {
+		newProps[k] = v
+	}
+
+	byIDs := bson.M{"$and": bson.A{filter, bson.M{internal.FieldID: bson.M{"$in": ids}}}}
+
+	update := bson.M{
+		"$set": newProps,
+		"$inc": bson.M{internal.FieldVersion: 1},
+	}
+
+	rules, hasRules, err := updateRules(auth, db, col)
+	if err != nil {
+		return result, err
+	} else if hasRules {
+		// all updated documents must still be allowed by the rules, they're
+		// only updated if they did not change since they were checked
+		var curs []bson.M
+		if err := db.Find(col, byIDs, internal.FindOptions{}, &curs); err != nil {
+			return result, err
+		}
+
+		unchanged := bson.A{}
+		for _, cur := range curs {
+			same := sameVersion(cur)
+			same[internal.FieldID] = cur[internal.FieldID]
+			unchanged = append(unchanged, same)
+
+			for k, v := range doc {
+				setField(cur, k, v)
+			}
+			if !rules.Allowed(auth, internal.OpUpdate, cur) {
+				return result, internal.ErrPermissionDenied
+			}
+		}
+
+		if len(unchanged) == 0 {
+			return result, nil
+		}
+		byIDs = bson.M{"$and": bson.A{filter, bson.M{"$or": unchanged}}}
+	}
+
+	befores, err := historyBeforeMany(db, col, byIDs)
+	if err != nil {
+		return result, err
+	}
+
+	result, err = db.UpdateMany(col, byIDs, update)
+	if err != nil {
+		return result, err
+	}
+
+	// the updated documents are read to record the history or publish one
+	// event per document
+	var docs []bson.M
+	if befores != nil || len(ids) <= maxBulkEvents {
+		if err := db.Find(col, bson.M{internal.FieldID: bson.M{"$in": ids}}, internal.FindOptions{}, &docs); err != nil {
+			return result, err
+		}
+	}
+
+	for _, updated := range docs {
+		oid, ok := updated[internal.FieldID].(primitive.ObjectID)
+		if before, found := befores[oid]; ok && found {
+			if err := recordHistory(auth, db, col, internal.OpUpdate, oid, before, updated); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if len(ids) > maxBulkEvents {
+		b.PublishDocument("db-"+col, internal.MsgTypeDBBulkUpdated, bson.M{"count": result.ModifiedCount})
+		return result, nil
+	}
+
+	for _, updated := range docs {
+		updated["id"] = updated[internal.FieldID]
+		delete(updated, internal.FieldID)
+		delete(updated, internal.FieldOwnerID)
+
+		b.PublishDocument("db-"+col, internal.MsgTypeDBUpdated, updated)
+	}
+	return result, nil
+}
+
+// DeleteMany deletes all documents matching filter the user can delete
+func (b *Base) DeleteMany(auth internal.Auth, db internal.Database, col string, filter bson.M) (int64, error) {
+	if err := secure(auth, db, col, internal.OpDelete, filter); err != nil {
+		return 0, err
+	}
+
+	ids, err := matchingIDs(db, col, filter)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	byIDs := bson.M{"$and": bson.A{filter, bson.M{internal.FieldID: bson.M{"$in": ids}}}}
+
+	soft, err := softDeleted(db, col)
+	if err != nil {
+		return 0, err
+	}
+
+	befores, err := historyBeforeMany(db, col, byIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	if soft {
+		res, err := db.UpdateMany(col, byIDs, trashUpdate())
+		if err != nil {
+			return 0, err
+		}
+		deleted = res.MatchedCount
+	} else {
+		deleted, err = db.DeleteMany(col, byIDs)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for oid, before := range befores {
+		if err := recordHistory(auth, db, col, internal.OpDelete, oid, before, nil); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(ids) > maxBulkEvents {
+		b.PublishDocument("db-"+col, internal.MsgTypeDBBulkDeleted, bson.M{"count": deleted})
+		return deleted, nil
+	}
+
+	for _, id := range ids {
+		b.PublishDocument("db-"+col, internal.MsgTypeDBDeleted, idString(id))
+	}
+	return deleted, nil
+}
+
+// matchingIDs returns the _id of the documents matching filter
+func matchingIDs(db internal.Database, col string, filter bson.M) ([]interface{}, error) {
+	var docs []bson.M
+	opt := internal.FindOptions{Projection: bson.M{internal.FieldID: 1}}
+	if err := db.Find(col, filter, opt, &docs); err != nil {
+		return nil, err
+	}
+
+	ids := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc[internal.FieldID]
+	}
+	return ids, nil
+}
+
+// idString returns the hex of an ObjectID, like the id published by Delete
+func idString(id interface{}) interface{} {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	return id
+}
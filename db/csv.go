@@ -0,0 +1,387 @@
+package db
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"staticbackend/internal"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The types a CSV column is converted to. With CSVAuto, the default, the
+// type of the collection's schema is used when the field has one, otherwise
+// numbers, booleans and dates are inferred.
+const (
+	CSVAuto    = "auto"
+	CSVString  = "string"
+	CSVNumber  = "number"
+	CSVInteger = "integer"
+	CSVBoolean = "boolean"
+	CSVDate    = "date"
+	CSVJSON    = "json"
+)
+
+var csvTypes = map[string]bool{
+	CSVAuto:    true,
+	CSVString:  true,
+	CSVNumber:  true,
+	CSVInteger: true,
+	CSVBoolean: true,
+	CSVDate:    true,
+	CSVJSON:    true,
+}
+
+// csvDateLayouts are the date formats recognized when importing
+var csvDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// CSVOptions are the types of the columns, by header name
+type CSVOptions struct {
+	Types map[string]string
+}
+
+// RowError is why a CSV row cannot be imported, rows start at 1 with the
+// header
+type RowError struct {
+	Row     int    `json:"row"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// CSVResult is the number of documents created or the invalid rows, nothing
+// is created when a row is invalid.
+type CSVResult struct {
+	Created int        `json:"created"`
+	Errors  []RowError `json:"errors,omitempty"`
+}
+
+// ImportCSV creates a document per row of the CSV, the header has the field
+// names and dotted names create nested objects. Empty cells are left out.
+func (b *Base) ImportCSV(auth internal.Auth, db internal.Database, col string, r io.Reader, opt CSVOptions) (CSVResult, error) {
+	var result CSVResult
+
+	for field, typ := range opt.Types {
+		if !csvTypes[typ] {
+			return result, fmt.Errorf("invalid type %s for %s", typ, field)
+		}
+	}
+
+	schema, err := schemaFor(db, col)
+	if err != nil {
+		return result, err
+	}
+
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return result, fmt.Errorf("the CSV is empty")
+	} else if err != nil {
+		return result, err
+	}
+
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if len(header[i]) == 0 {
+			return result, fmt.Errorf("column %d has no name", i+1)
+		}
+	}
+
+	var docs []interface{}
+	var rows []int
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			var pe *csv.ParseError
+			if !errors.As(err, &pe) {
+				return result, err
+			}
+			result.Errors = append(result.Errors, RowError{Row: pe.StartLine, Message: pe.Err.Error()})
+			continue
+		}
+
+		row, _ := cr.FieldPos(0)
+
+		doc := make(map[string]interface{})
+		for i, cell := range record {
+			if len(cell) == 0 {
+				continue
+			}
+
+			field := header[i]
+			typ := opt.Types[field]
+			if len(typ) == 0 || typ == CSVAuto {
+				typ = schemaTypeOf(schema, field)
+			}
+
+			v, err := convertCSV(cell, typ)
+			if err != nil {
+				result.Errors = append(result.Errors, RowError{Row: row, Field: field, Message: err.Error()})
+				continue
+			}
+
+			setPath(doc, field, v)
+		}
+
+		docs = append(docs, doc)
+		rows = append(rows, row)
+	}
+
+	if len(result.Errors) > 0 {
+		return result, nil
+	} else if len(docs) == 0 {
+		return result, fmt.Errorf("the CSV has no rows")
+	}
+
+	if err := b.BulkAdd(auth, db, col, docs); err != nil {
+		ve, ok := IsValidationError(err)
+		if !ok {
+			return result, err
+		}
+
+		// the fields are prefixed with the index of the document
+		for _, fe := range ve.Errors {
+			parts := strings.SplitN(fe.Field, ".", 2)
+			i, _ := strconv.Atoi(parts[0])
+			re := RowError{Message: fe.Message}
+			if i < len(rows) {
+				re.Row = rows[i]
+			}
+			if len(parts) == 2 {
+				re.Field = parts[1]
+			}
+			result.Errors = append(result.Errors, re)
+		}
+		return result, nil
+	}
+
+	result.Created = len(docs)
+	return result, nil
+}
+
+// schemaTypeOf returns the CSV type of the field from the collection's
+// schema, CSVAuto when there's no schema or the field is not described
+func schemaTypeOf(schema *Schema, field string) string {
+	s := schema
+	for _, name := range strings.Split(field, ".") {
+		if s == nil || s.Properties == nil {
+			return CSVAuto
+		}
+		s = s.Properties[name]
+	}
+
+	if s == nil {
+		return CSVAuto
+	}
+
+	for _, t := range s.Type {
+		switch t {
+		case "string":
+			return CSVString
+		case "number":
+			return CSVNumber
+		case "integer":
+			return CSVInteger
+		case "boolean":
+			return CSVBoolean
+		case "object", "array":
+			return CSVJSON
+		}
+	}
+	return CSVAuto
+}
+
+// convertCSV converts a cell to the type, CSVAuto infers it
+func convertCSV(cell, typ string) (interface{}, error) {
+	switch typ {
+	case CSVString:
+		return cell, nil
+	case CSVNumber:
+		f, err := strconv.ParseFloat(strings.TrimSpace(cell), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a number", cell)
+		}
+		return f, nil
+	case CSVInteger:
+		i, err := strconv.ParseInt(strings.TrimSpace(cell), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not an integer", cell)
+		}
+		return i, nil
+	case CSVBoolean:
+		b, err := strconv.ParseBool(strings.TrimSpace(cell))
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a boolean", cell)
+		}
+		return b, nil
+	case CSVDate:
+		if t, ok := parseCSVDate(cell); ok {
+			return t, nil
+		}
+		return nil, fmt.Errorf("%s is not a date", cell)
+	case CSVJSON:
+		var v interface{}
+		if err := json.Unmarshal([]byte(cell), &v); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		return v, nil
+	}
+
+	s := strings.TrimSpace(cell)
+
+	// leading zeros are kept, i.e. zip codes and phone numbers
+	if !(len(s) > 1 && s[0] == '0' && s[1] != '.') {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		} else if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, nil
+		}
+	}
+
+	switch strings.ToLower(s) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+
+	if t, ok := parseCSVDate(s); ok {
+		return t, nil
+	}
+	return cell, nil
+}
+
+func parseCSVDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range csvDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// setPath sets the value of a dotted field, creating the nested objects
+func setPath(doc map[string]interface{}, field string, v interface{}) {
+	parts := strings.Split(field, ".")
+	for _, name := range parts[:len(parts)-1] {
+		sub, ok := doc[name].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			doc[name] = sub
+		}
+		doc = sub
+	}
+	doc[parts[len(parts)-1]] = v
+}
+
+// WriteCSV writes the documents as CSV. The columns are the fields of all
+// the documents, id first, nested objects are flattened to dotted columns
+// and arrays are written as JSON.
+func WriteCSV(w io.Writer, docs []bson.M) error {
+	flat := make([]map[string]string, len(docs))
+	columns := make(map[string]bool)
+	for i, doc := range docs {
+		flat[i] = make(map[string]string)
+		if err := flatten("", doc, flat[i]); err != nil {
+			return err
+		}
+
+		for k := range flat[i] {
+			columns[k] = true
+		}
+	}
+
+	header := make([]string, 0, len(columns))
+	for k := range columns {
+		if k != "id" {
+			header = append(header, k)
+		}
+	}
+	sort.Strings(header)
+	if columns["id"] {
+		header = append([]string{"id"}, header...)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	record := make([]string, len(header))
+	for _, values := range flat {
+		for i, k := range header {
+			record[i] = values[k]
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func flatten(prefix string, doc map[string]interface{}, values map[string]string) error {
+	for k, v := range doc {
+		if len(prefix) > 0 {
+			k = prefix + "." + k
+		}
+
+		if m := toMap(v); m != nil {
+			if err := flatten(k, m, values); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, err := csvValue(v)
+		if err != nil {
+			return err
+		}
+		values[k] = s
+	}
+	return nil
+}
+
+// csvValue formats a value as imported back by convertCSV
+func csvValue(v interface{}) (string, error) {
+	switch x := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return x, nil
+	case primitive.ObjectID:
+		return x.Hex(), nil
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano), nil
+	case primitive.DateTime:
+		return x.Time().UTC().Format(time.RFC3339Nano), nil
+	case bool, int, int32, int64, float32, float64:
+		return fmt.Sprintf("%v", x), nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
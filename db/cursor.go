@@ -0,0 +1,150 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"staticbackend/internal"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// FirstCursor requests the first page when using cursor pagination
+const FirstCursor = "*"
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// cursor is the position after the last document of a page. It contains
+// the sort field and direction it was created with so it cannot be used
+// with a different sort.
+type cursor struct {
+	Field string      `bson:"f"`
+	Desc  bool        `bson:"d"`
+	Value interface{} `bson:"v"`
+	ID    interface{} `bson:"id"`
+}
+
+func (c cursor) encode() (string, error) {
+	b, err := bson.MarshalExtJSON(c, true, false)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(s string) (c cursor, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errInvalidCursor
+	}
+
+	if err := bson.UnmarshalExtJSON(b, true, &c); err != nil {
+		return c, errInvalidCursor
+	} else if len(c.Field) == 0 || c.ID == nil {
+		return c, errInvalidCursor
+	}
+	return c, nil
+}
+
+// newCursor returns the cursor positioned after doc
+func newCursor(doc bson.M, field string, desc bool) cursor {
+	return cursor{
+		Field: field,
+		Desc:  desc,
+		Value: fieldValue(doc, field),
+		ID:    doc[internal.FieldID],
+	}
+}
+
+// filter matches the documents after the cursor. Documents are sorted by
+// the field and then by _id, null values come first in ascending order.
+func (c cursor) filter() bson.M {
+	op := "$gt"
+	if c.Desc {
+		op = "$lt"
+	}
+
+	afterID := bson.M{internal.FieldID: bson.M{op: c.ID}}
+	if c.Field == internal.FieldID {
+		return afterID
+	}
+
+	sameValue := bson.M{c.Field: c.Value, internal.FieldID: bson.M{op: c.ID}}
+	if c.Value == nil {
+		if c.Desc {
+			return sameValue
+		}
+		return bson.M{"$or": bson.A{bson.M{c.Field: bson.M{"$ne": nil}}, sameValue}}
+	}
+
+	after := bson.M{c.Field: bson.M{op: c.Value}}
+	if c.Desc {
+		return bson.M{"$or": bson.A{after, sameValue, bson.M{c.Field: nil}}}
+	}
+	return bson.M{"$or": bson.A{after, sameValue}}
+}
+
+// fieldValue returns the value of the dotted field or nil
+func fieldValue(doc bson.M, field string) interface{} {
+	var v interface{} = doc
+	for _, key := range strings.Split(field, ".") {
+		m, ok := v.(bson.M)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// projects returns true when the projection already returns the dotted
+// field, either directly or via one of its parents.
+func projects(proj bson.M, field string) bool {
+	for path := field; ; {
+		if _, ok := proj[path]; ok {
+			return true
+		}
+
+		i := strings.LastIndex(path, ".")
+		if i < 0 {
+			return false
+		}
+		path = path[:i]
+	}
+}
+
+// removeField removes the dotted field from doc and the objects it leaves
+// empty.
+func removeField(doc bson.M, field string) {
+	keys := strings.SplitN(field, ".", 2)
+	if len(keys) == 1 {
+		delete(doc, field)
+		return
+	}
+
+	m, ok := doc[keys[0]].(bson.M)
+	if !ok {
+		return
+	}
+
+	removeField(m, keys[1])
+	if len(m) == 0 {
+		delete(doc, keys[0])
+	}
+}
+
+// setField sets the dotted field of doc, the missing objects are created
+func setField(doc bson.M, field string, v interface{}) {
+	keys := strings.SplitN(field, ".", 2)
+	if len(keys) == 1 {
+		doc[field] = v
+		return
+	}
+
+	m, ok := doc[keys[0]].(bson.M)
+	if !ok {
+		m = bson.M{}
+		doc[keys[0]] = m
+	}
+	setField(m, keys[1], v)
+}
@@ -0,0 +1,394 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"staticbackend/internal"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// AuditCollection holds the collections with history
+	AuditCollection = "sb_audit"
+	// HistoryCollection holds the version records of the documents
+	HistoryCollection = "sb_history"
+)
+
+// OpRevert is the operation of a record reverting a document to a previous
+// version
+const OpRevert = "revert"
+
+// historyIndex speeds up listing a document's history and finding a version
+var historyIndex = internal.Index{
+	Name: "sb_col_doc_version",
+	Keys: []internal.IndexKey{
+		{Field: "col"},
+		{Field: "docId"},
+		{Field: "version", Desc: true},
+	},
+}
+
+// Change is the old and new value of a field, a missing value is nil
+type Change struct {
+	Field string      `bson:"field" json:"field"`
+	Old   interface{} `bson:"old" json:"old"`
+	New   interface{} `bson:"new" json:"new"`
+}
+
+// HistoryRecord is a version of a document: who changed it, when, with
+// which operation and the changed fields. Doc is the document at this
+// version, it's nil for deletes.
+type HistoryRecord struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	Collection string             `bson:"col" json:"collection"`
+	DocID      primitive.ObjectID `bson:"docId" json:"docId"`
+	Version    int64              `bson:"version" json:"version"`
+	Op         string             `bson:"op" json:"op"`
+	AccountID  primitive.ObjectID `bson:"accountId" json:"accountId"`
+	UserID     primitive.ObjectID `bson:"userId" json:"userId"`
+	Changes    []Change           `bson:"changes" json:"changes"`
+	Doc        bson.M             `bson:"doc,omitempty" json:"doc,omitempty"`
+	Created    time.Time          `bson:"created" json:"created"`
+}
+
+// HistoryResult is a page of a document's history, the latest version first
+type HistoryResult struct {
+	Page    int64           `json:"page"`
+	Size    int64           `json:"size"`
+	Total   int64           `json:"total"`
+	Results []HistoryRecord `json:"results"`
+}
+
+// HistoryEnabled returns true if the changes of the collection's documents
+// are recorded
+func HistoryEnabled(db internal.Database, col string) (bool, error) {
+	if isReserved(col) {
+		return false, nil
+	}
+
+	n, err := db.Count(AuditCollection, bson.M{"col": col})
+	return n > 0, err
+}
+
+// ListHistoryEnabled returns the collections with history
+func ListHistoryEnabled(db internal.Database) ([]string, error) {
+	var results []bson.M
+	opt := internal.FindOptions{Sort: bson.D{{Key: "col", Value: 1}}}
+	if err := db.Find(AuditCollection, bson.M{}, opt, &results); err != nil {
+		return nil, err
+	}
+
+	cols := make([]string, 0, len(results))
+	for _, v := range results {
+		if col, ok := v["col"].(string); ok {
+			cols = append(cols, col)
+		}
+	}
+	return cols, nil
+}
+
+// EnableHistory records the changes of the collection's documents from now
+// on
+func EnableHistory(db internal.Database, col string) error {
+	if isReserved(col) {
+		return fmt.Errorf("the history of %s cannot be recorded", col)
+	}
+
+	if err := db.CreateIndex(HistoryCollection, historyIndex); err != nil {
+		return fmt.Errorf("cannot create the history index: %v", err)
+	}
+
+	if ok, err := HistoryEnabled(db, col); err != nil || ok {
+		return err
+	}
+
+	doc := bson.M{
+		internal.FieldID: primitive.NewObjectID(),
+		"col":            col,
+		"updated":        time.Now(),
+	}
+	return db.InsertOne(AuditCollection, doc)
+}
+
+// DisableHistory stops recording the changes, the existing records are kept
+func DisableHistory(db internal.Database, col string) error {
+	_, err := db.DeleteOne(AuditCollection, bson.M{"col": col})
+	return err
+}
+
+// historyBefore returns the current document when the collection has
+// history, nil otherwise. It's called before a change to diff the document.
+func historyBefore(db internal.Database, col string, filter bson.M) (bson.M, error) {
+	ok, err := HistoryEnabled(db, col)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var before bson.M
+	if err := db.FindOne(col, filter, &before); err != nil {
+		if errors.Is(err, internal.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return before, nil
+}
+
+// historyBeforeMany is historyBefore for bulk changes, the documents are
+// keyed by their id.
+func historyBeforeMany(db internal.Database, col string, filter bson.M) (map[primitive.ObjectID]bson.M, error) {
+	ok, err := HistoryEnabled(db, col)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var docs []bson.M
+	if err := db.Find(col, filter, internal.FindOptions{}, &docs); err != nil {
+		return nil, err
+	}
+
+	befores := make(map[primitive.ObjectID]bson.M)
+	for _, doc := range docs {
+		if oid, ok := doc[internal.FieldID].(primitive.ObjectID); ok {
+			befores[oid] = doc
+		}
+	}
+	return befores, nil
+}
+
+// recordHistory writes the version record of a change, before is nil for a
+// creation and after is nil for a deletion.
+func recordHistory(auth internal.Auth, db internal.Database, col, op string, oid primitive.ObjectID, before, after bson.M) error {
+	rec := HistoryRecord{
+		ID:         primitive.NewObjectID(),
+		Collection: col,
+		DocID:      oid,
+		Op:         op,
+		AccountID:  auth.AccountID,
+		UserID:     auth.UserID,
+		Changes:    diff(before, after),
+		Created:    time.Now(),
+	}
+
+	if after != nil {
+		rec.Version = versionOf(after)
+		rec.Doc = bson.M{}
+		for k, v := range after {
+			if k != internal.FieldID && k != "id" {
+				rec.Doc[k] = v
+			}
+		}
+	} else {
+		rec.Version = versionOf(before)
+	}
+
+	return db.InsertOne(HistoryCollection, rec)
+}
+
+// diff returns the changed fields, system fields are ignored
+func diff(before, after bson.M) []Change {
+	fields := make(map[string]bool)
+	for k := range before {
+		fields[k] = true
+	}
+	for k := range after {
+		fields[k] = true
+	}
+
+	changes := make([]Change, 0)
+	for field := range fields {
+		if systemFields[field] {
+			continue
+		}
+
+		old, okOld := before[field]
+		cur, okCur := after[field]
+		if okOld == okCur && reflect.DeepEqual(old, cur) {
+			continue
+		}
+
+		changes = append(changes, Change{Field: field, Old: old, New: cur})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes
+}
+
+// versionOf returns the version of the document, 0 if it has none
+func versionOf(doc bson.M) int64 {
+	v, ok := toFloat(doc[internal.FieldVersion])
+	if !ok {
+		return 0
+	}
+	return int64(v)
+}
+
+// History returns the version records of a document the user can read,
+// the latest first. Only root users can read the history of deleted
+// documents.
+func (b *Base) History(auth internal.Auth, db internal.Database, col, id string, params ListParams) (HistoryResult, error) {
+	if params.Page <= 0 {
+		params.Page = 1
+	}
+	if params.Size <= 0 {
+		params.Size = 25
+	}
+
+	result := HistoryResult{Page: params.Page, Size: params.Size}
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return result, err
+	}
+
+	if !keyAllows(auth, col, internal.OpRead) {
+		return result, internal.ErrPermissionDenied
+	} else if auth.Role < internal.RootRole {
+		filter := bson.M{internal.FieldID: oid}
+		if err := secureRead(auth, db, col, filter); err != nil {
+			return result, err
+		}
+
+		n, err := db.Count(col, filter)
+		if err != nil {
+			return result, err
+		} else if n == 0 {
+			return result, internal.ErrNotFound
+		}
+	}
+
+	filter := bson.M{"col": col, "docId": oid}
+
+	count, err := db.Count(HistoryCollection, filter)
+	if err != nil {
+		return result, err
+	}
+	result.Total = count
+
+	opt := internal.FindOptions{
+		Skip:  params.Size * (params.Page - 1),
+		Limit: params.Size,
+		Sort:  bson.D{{Key: "version", Value: -1}, {Key: internal.FieldID, Value: -1}},
+	}
+
+	var results []HistoryRecord
+	if err := db.Find(HistoryCollection, filter, opt, &results); err != nil {
+		return result, err
+	}
+
+	if len(results) == 0 {
+		results = make([]HistoryRecord, 0)
+	}
+	result.Results = results
+	return result, nil
+}
+
+// Revert sets the document back to a previous version, fields added since
+// are removed. The revert is itself a new version of the document.
+func (b *Base) Revert(auth internal.Auth, db internal.Database, col, id string, version int64) (map[string]interface{}, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var rec HistoryRecord
+	recFilter := bson.M{"col": col, "docId": oid, "version": version, "doc": bson.M{"$exists": true}}
+	if err := db.FindOne(HistoryCollection, recFilter, &rec); err != nil {
+		if errors.Is(err, internal.ErrNotFound) {
+			return nil, fmt.Errorf("version %d of the document is not in its history: %w", version, err)
+		}
+		return nil, err
+	}
+
+	filter := bson.M{internal.FieldID: oid}
+	if err := secure(auth, db, col, internal.OpUpdate, filter); err != nil {
+		return nil, err
+	}
+
+	var before bson.M
+	if err := db.FindOne(col, filter, &before); err != nil {
+		return nil, err
+	}
+
+	doc := bson.M{}
+	for k, v := range rec.Doc {
+		doc[k] = v
+	}
+	removeSystemFields(doc)
+
+	schema, err := schemaFor(db, col)
+	if err != nil {
+		return nil, err
+	} else if schema != nil {
+		if err := schema.Validate(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	// the reverted document must be allowed by the rules
+	if rules, ok, err := updateRules(auth, db, col); err != nil {
+		return nil, err
+	} else if ok {
+		reverted := bson.M{}
+		for k, v := range doc {
+			reverted[k] = v
+		}
+		for k := range systemFields {
+			if v, ok := before[k]; ok {
+				reverted[k] = v
+			}
+		}
+
+		if !rules.Allowed(auth, internal.OpUpdate, reverted) {
+			return nil, internal.ErrPermissionDenied
+		}
+	}
+
+	update := bson.M{"$inc": bson.M{internal.FieldVersion: 1}}
+	if len(doc) > 0 {
+		update["$set"] = doc
+	}
+
+	unset := bson.M{}
+	for k := range before {
+		if _, ok := doc[k]; !ok && !systemFields[k] {
+			unset[k] = ""
+		}
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	// the version must not change between the read and the update
+	versioned := bson.M{"$and": bson.A{filter, bson.M{internal.FieldVersion: before[internal.FieldVersion]}}}
+
+	result, err := applyUpdate(db, col, oid, versioned, update)
+	if errors.Is(err, errNoMatch) {
+		return nil, ErrVersionConflict
+	} else if err != nil {
+		return nil, err
+	}
+
+	if ok, err := HistoryEnabled(db, col); err != nil {
+		return nil, err
+	} else if ok {
+		if err := recordHistory(auth, db, col, OpRevert, oid, before, result); err != nil {
+			return nil, err
+		}
+	}
+
+	result["id"] = result[internal.FieldID]
+	delete(result, internal.FieldID)
+	delete(result, internal.FieldOwnerID)
+
+	b.PublishDocument("db-"+col, internal.MsgTypeDBUpdated, result)
+
+	return result, nil
+}
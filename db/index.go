@@ -0,0 +1,43 @@
+package db
+
+import (
+	"fmt"
+	"staticbackend/internal"
+	"strings"
+	"sync"
+)
+
+// permissionIndex is created on every collection since all non-root reads
+// filter on the account and, for owner permission, the owner.
+var permissionIndex = internal.Index{
+	Name: "sb_account_owner",
+	Keys: []internal.IndexKey{
+		{Field: internal.FieldAccountID},
+		{Field: internal.FieldOwnerID},
+	},
+}
+
+// indexed are the collections having their permission index, keyed by
+// base.collection
+var indexed sync.Map
+
+// ensureIndexes creates the permission index the first time a collection is
+// written. It's skipped inside transactions, some data stores cannot create
+// indexes there, the next write outside of one creates it.
+func (b *Base) ensureIndexes(db internal.Database, col string) error {
+	if b.tx || strings.HasPrefix(col, "sb_") {
+		return nil
+	}
+
+	key := db.Name() + "." + col
+	if _, ok := indexed.Load(key); ok {
+		return nil
+	}
+
+	if err := db.CreateIndex(col, permissionIndex); err != nil {
+		return fmt.Errorf("cannot create the permission index: %v", err)
+	}
+
+	indexed.Store(key, true)
+	return nil
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"staticbackend/internal"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// UpdateOperators are the update operators clients can use, each one takes
+// an object of fields:
+//
+//	$set: {"field": value} sets the fields
+//	$unset: {"field": ""} removes the fields
+//	$inc: {"field": n} increases numeric fields by n
+//	$push: {"field": value} appends to arrays, {"$each": [...]} for many
+//	$addToSet: {"field": value} appends when not already in the array
+//	$pull: {"field": value} removes the matching items from arrays
+//	$rename: {"field": "newName"} renames the fields
+var UpdateOperators = map[string]bool{
+	"$set":      true,
+	"$unset":    true,
+	"$inc":      true,
+	"$push":     true,
+	"$addToSet": true,
+	"$pull":     true,
+	"$rename":   true,
+}
+
+// ErrInvalidUpdate is returned when the update operators are not allowed or
+// malformed
+var ErrInvalidUpdate = errors.New("invalid update")
+
+// operatorsUpdate validates the update operators and returns the update.
+// System fields cannot be modified and the values set are validated against
+// the schema if any.
+func operatorsUpdate(doc map[string]interface{}, schema *Schema) (bson.M, error) {
+	if len(doc) == 0 {
+		return nil, fmt.Errorf("%w: missing update operators", ErrInvalidUpdate)
+	}
+
+	update := bson.M{}
+	for op, v := range doc {
+		if !UpdateOperators[op] {
+			return nil, fmt.Errorf("%w: the update operator %s is not allowed", ErrInvalidUpdate, op)
+		}
+
+		fields, ok := v.(map[string]interface{})
+		if !ok || len(fields) == 0 {
+			return nil, fmt.Errorf("%w: the %s operator expects an object of fields", ErrInvalidUpdate, op)
+		}
+
+		for field, val := range fields {
+			if err := checkUpdateField(op, field); err != nil {
+				return nil, err
+			}
+
+			switch op {
+			case "$inc":
+				if _, ok := toFloat(val); !ok {
+					return nil, fmt.Errorf("%w: $inc of %s expects a number", ErrInvalidUpdate, field)
+				}
+			case "$rename":
+				to, ok := val.(string)
+				if !ok {
+					return nil, fmt.Errorf("%w: $rename of %s expects the new field name", ErrInvalidUpdate, field)
+				} else if err := checkUpdateField(op, to); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if op == "$set" && schema != nil {
+			if err := schema.ValidatePartial(fields); err != nil {
+				return nil, err
+			}
+		}
+
+		update[op] = bson.M(fields)
+	}
+
+	inc, _ := update["$inc"].(bson.M)
+	if inc == nil {
+		inc = bson.M{}
+	}
+	inc[internal.FieldVersion] = 1
+	update["$inc"] = inc
+
+	return update, nil
+}
+
+// checkUpdateField returns an error for system fields and invalid names
+func checkUpdateField(op, field string) error {
+	if len(field) == 0 || strings.HasPrefix(field, "$") || strings.Contains(field, "..") {
+		return fmt.Errorf("%w: invalid field for %s: %s", ErrInvalidUpdate, op, field)
+	}
+
+	root := strings.Split(field, ".")[0]
+	if systemFields[root] {
+		return fmt.Errorf("%w: the field %s cannot be modified", ErrInvalidUpdate, root)
+	}
+	return nil
+}
@@ -2,48 +2,294 @@ package db
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
 )
 
+// ParseQuery converts query clauses into a filter. All clauses must match.
+//
+// A clause is either a condition [field, operator, value] or a group
+// ["or" | "and" | "nor", [clause, ...]]. An item of a group can also be a list
+// of clauses that must all match, allowing nested boolean expressions:
+//
+//	[
+//		["status", "in", ["open", "pending"]],
+//		["or", [
+//			["priority", ">=", 3],
+//			[["assignee", "exists", false], ["title", "contains", "urgent"]]
+//		]]
+//	]
+//
+// Errors refer to the clause by its position, i.e. 2.2.1 is the first clause
+// of the second item of the second clause.
 func ParseQuery(clauses [][]interface{}) (bson.M, error) {
-	filter := bson.M{}
+	list := make([]interface{}, len(clauses))
 	for i, clause := range clauses {
-		if len(clause) != 3 {
-			return filter, fmt.Errorf("The %d query clause did not contains the required 3 parameters (field, operator, value)", i+1)
+		list[i] = clause
+	}
+	return parseClauses(list, "")
+}
+
+func parseClauses(clauses []interface{}, path string) (bson.M, error) {
+	b := &filterBuilder{filter: bson.M{}}
+	for i, item := range clauses {
+		if err := b.add(item, position(path, i)); err != nil {
+			return nil, err
+		}
+	}
+	return b.result(), nil
+}
+
+// filterBuilder ANDs clauses together
+type filterBuilder struct {
+	filter bson.M
+	and    []interface{}
+}
+
+func (b *filterBuilder) add(item interface{}, pos string) error {
+	clause, ok := toClause(item)
+	if !ok {
+		return fmt.Errorf("The %s query clause must be an array: %v", pos, item)
+	}
+
+	if isGroup(clause) {
+		group, err := parseGroup(clause, pos)
+		if err != nil {
+			return err
 		}
+		b.and = append(b.and, group)
+		return nil
+	}
+
+	field, ops, err := parseCondition(clause, pos)
+	if err != nil {
+		return err
+	}
+
+	cur, ok := b.filter[field]
+	if !ok {
+		b.filter[field] = ops
+		return nil
+	}
+
+	// ranges on the same field are merged, otherwise both must match
+	merged := cur.(bson.M)
+	for op := range ops {
+		if _, ok := merged[op]; ok {
+			b.and = append(b.and, bson.M{field: ops})
+			return nil
+		}
+	}
+
+	for op, v := range ops {
+		merged[op] = v
+	}
+	return nil
+}
+
+func (b *filterBuilder) result() bson.M {
+	// a lone equality is kept as a plain value
+	for field, v := range b.filter {
+		b.filter[field] = simplify(v.(bson.M))
+	}
+
+	for _, v := range b.and {
+		m := v.(bson.M)
+		for field, cond := range m {
+			if ops, ok := cond.(bson.M); ok && !strings.HasPrefix(field, "$") {
+				m[field] = simplify(ops)
+			}
+		}
+	}
+
+	if len(b.and) > 0 {
+		b.filter["$and"] = b.and
+	}
+	return b.filter
+}
+
+func simplify(ops bson.M) interface{} {
+	if eq, ok := ops["$eq"]; ok && len(ops) == 1 {
+		return eq
+	}
+	return ops
+}
+
+func position(path string, i int) string {
+	if len(path) == 0 {
+		return fmt.Sprintf("%d", i+1)
+	}
+	return fmt.Sprintf("%s.%d", path, i+1)
+}
+
+func toClause(v interface{}) ([]interface{}, bool) {
+	switch c := v.(type) {
+	case []interface{}:
+		return c, true
+	case bson.A:
+		return []interface{}(c), true
+	}
+	return nil, false
+}
+
+// isGroup returns true for ["or", [...]] style clauses
+func isGroup(clause []interface{}) bool {
+	if len(clause) != 2 {
+		return false
+	}
 
-		field, ok := clause[0].(string)
+	s, ok := clause[0].(string)
+	if !ok {
+		return false
+	}
+
+	switch strings.ToLower(s) {
+	case "or", "and", "nor":
+		return true
+	}
+	return false
+}
+
+func parseGroup(clause []interface{}, pos string) (bson.M, error) {
+	op := "$" + strings.ToLower(clause[0].(string))
+
+	items, ok := toClause(clause[1])
+	if !ok || len(items) == 0 {
+		return nil, fmt.Errorf("The %s query clause's %s group must contain an array of clauses", pos, clause[0])
+	}
+
+	var subs []interface{}
+	for i, item := range items {
+		itemPos := position(pos, i)
+
+		// a list of clauses that all need to match
+		if sub, ok := toClause(item); ok && len(sub) > 0 {
+			if _, nested := toClause(sub[0]); nested {
+				f, err := parseClauses(sub, itemPos)
+				if err != nil {
+					return nil, err
+				}
+				subs = append(subs, f)
+				continue
+			}
+		}
+
+		b := &filterBuilder{filter: bson.M{}}
+		if err := b.add(item, itemPos); err != nil {
+			return nil, err
+		}
+		subs = append(subs, b.result())
+	}
+
+	return bson.M{op: subs}, nil
+}
+
+func parseCondition(clause []interface{}, pos string) (string, bson.M, error) {
+	if len(clause) != 3 {
+		return "", nil, fmt.Errorf("The %s query clause did not contains the required 3 parameters (field, operator, value)", pos)
+	}
+
+	field, ok := clause[0].(string)
+	if !ok || len(field) == 0 {
+		return "", nil, fmt.Errorf("The %s query clause's field parameter must be a string: %v", pos, clause[0])
+	} else if strings.HasPrefix(field, "$") {
+		return "", nil, fmt.Errorf("The %s query clause's field cannot start with $: %s", pos, field)
+	}
+
+	op, ok := clause[1].(string)
+	if !ok {
+		return "", nil, fmt.Errorf("The %s query clause's operator must be a string: %v", pos, clause[1])
+	}
+
+	v := clause[2]
+
+	op = strings.ToLower(op)
+	switch op {
+	case "=", "==":
+		return field, bson.M{"$eq": v}, nil
+	case "!=", "<>":
+		return field, bson.M{"$ne": v}, nil
+	case ">":
+		return field, bson.M{"$gt": v}, nil
+	case "<":
+		return field, bson.M{"$lt": v}, nil
+	case ">=":
+		return field, bson.M{"$gte": v}, nil
+	case "<=":
+		return field, bson.M{"$lte": v}, nil
+	case "in":
+		if _, ok := toClause(v); !ok {
+			return "", nil, fmt.Errorf("The %s query clause's value for %s must be an array: %v", pos, op, v)
+		}
+		return field, bson.M{"$in": v}, nil
+	case "!in", "nin":
+		if _, ok := toClause(v); !ok {
+			return "", nil, fmt.Errorf("The %s query clause's value for %s must be an array: %v", pos, op, v)
+		}
+		return field, bson.M{"$nin": v}, nil
+	case "contains", "!contains":
+		s, ok := v.(string)
 		if !ok {
-			return filter, fmt.Errorf("The %d query clause's field parameter must be a string: %v", i+1, clause[0])
+			return "", nil, fmt.Errorf("The %s query clause's value for %s must be a string: %v", pos, op, v)
 		}
 
-		op, ok := clause[1].(string)
+		re := bson.M{"$regex": regexp.QuoteMeta(s), "$options": "i"}
+		if strings.HasPrefix(op, "!") {
+			return field, bson.M{"$not": re}, nil
+		}
+		return field, re, nil
+	case "regex", "~", "iregex", "~*":
+		s, ok := v.(string)
+		if !ok {
+			return "", nil, fmt.Errorf("The %s query clause's value for %s must be a string: %v", pos, op, v)
+		} else if _, err := regexp.Compile(s); err != nil {
+			return "", nil, fmt.Errorf("The %s query clause's regular expression is invalid: %v", pos, err)
+		}
+
+		if op == "iregex" || op == "~*" {
+			return field, bson.M{"$regex": s, "$options": "i"}, nil
+		}
+		return field, bson.M{"$regex": s}, nil
+	case "exists":
+		b, ok := v.(bool)
 		if !ok {
-			return filter, fmt.Errorf("The %d query clause's operator must be a string: %v", i+1, clause[1])
-		}
-
-		switch op {
-		case "=", "==":
-			filter[field] = clause[2]
-		case "!=", "<>":
-			filter[field] = bson.M{"$ne": clause[2]}
-		case ">":
-			filter[field] = bson.M{"$gt": clause[2]}
-		case "<":
-			filter[field] = bson.M{"$lt": clause[2]}
-		case ">=":
-			filter[field] = bson.M{"$gte": clause[2]}
-		case "<=":
-			filter[field] = bson.M{"$lte": clause[2]}
-		case "in":
-			filter[field] = bson.M{"$in": clause[2]}
-		case "!in", "nin":
-			filter[field] = bson.M{"$nin": clause[2]}
-		default:
-			return filter, fmt.Errorf("The %d query clause's operator: %s is not supported at the moment.", i+1, op)
-		}
-	}
-
-	return filter, nil
+			return "", nil, fmt.Errorf("The %s query clause's value for exists must be true or false: %v", pos, v)
+		}
+		return field, bson.M{"$exists": b}, nil
+	case "all":
+		if _, ok := toClause(v); !ok {
+			return "", nil, fmt.Errorf("The %s query clause's value for all must be an array: %v", pos, v)
+		}
+		return field, bson.M{"$all": v}, nil
+	case "size":
+		n, ok := toSize(v)
+		if !ok {
+			return "", nil, fmt.Errorf("The %s query clause's value for size must be a positive integer: %v", pos, v)
+		}
+		return field, bson.M{"$size": n}, nil
+	}
+
+	return "", nil, fmt.Errorf("The %s query clause's operator: %s is not supported at the moment.", pos, op)
+}
+
+func toSize(v interface{}) (int64, bool) {
+	var n int64
+	switch x := v.(type) {
+	case int:
+		n = int64(x)
+	case int32:
+		n = int64(x)
+	case int64:
+		n = x
+	case float64:
+		if x != float64(int64(x)) {
+			return 0, false
+		}
+		n = int64(x)
+	default:
+		return 0, false
+	}
+	return n, n >= 0
 }
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"fmt"
+	"staticbackend/internal"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ReadParams selects the fields returned when reading documents and the
+// reference fields to expand.
+//
+// An expansion is written "field:collection", the field holds the id or an
+// array of ids of documents from the collection. Those are replaced by the
+// referenced documents, or null when the document does not exists or the
+// user cannot read it.
+type ReadParams struct {
+	Fields []string `json:"fields"`
+	Expand []string `json:"expand"`
+}
+
+type expansion struct {
+	field string
+	col   string
+}
+
+// projection returns the projection for the requested fields, fields being
+// expanded are always included.
+func (p ReadParams) projection(expands []expansion) bson.M {
+	if len(p.Fields) == 0 {
+		return nil
+	}
+
+	proj := bson.M{}
+	for _, field := range p.Fields {
+		if field == "id" {
+			field = internal.FieldID
+		}
+		proj[field] = 1
+	}
+	for _, e := range expands {
+		proj[e.field] = 1
+	}
+	return proj
+}
+
+// Validate returns an error when a field or an expansion is invalid
+func (p ReadParams) Validate() error {
+	_, err := p.parse()
+	return err
+}
+
+// parse validates the parameters and returns the expansions
+func (p ReadParams) parse() ([]expansion, error) {
+	for _, field := range p.Fields {
+		if len(field) == 0 || strings.HasPrefix(field, "$") {
+			return nil, fmt.Errorf("invalid field: %s", field)
+		}
+	}
+
+	var expands []expansion
+	for _, s := range p.Expand {
+		parts := strings.Split(s, ":")
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid expand %s, the format is field:collection", s)
+		}
+
+		field, col := parts[0], parts[1]
+		if strings.ContainsAny(field, ".$") || field == "id" || field == internal.FieldID {
+			return nil, fmt.Errorf("the field %s cannot be expanded", field)
+		} else if strings.HasPrefix(col, "$") {
+			return nil, fmt.Errorf("invalid collection for expand: %s", col)
+		}
+
+		expands = append(expands, expansion{field: field, col: col})
+	}
+	return expands, nil
+}
+
+// expand replaces the reference fields of the documents by the referenced
+// documents. Each expansion is a single query for all documents.
+func (b *Base) expand(auth internal.Auth, db internal.Database, docs []bson.M, expands []expansion) error {
+	for _, e := range expands {
+		var ids []primitive.ObjectID
+		for _, doc := range docs {
+			ids = append(ids, refIDs(doc[e.field])...)
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		filter := bson.M{internal.FieldID: bson.M{"$in": ids}}
+
+		// references the user cannot read resolve to null
+		var refs []bson.M
+		if err := secureRead(auth, db, e.col, filter); err == nil {
+			if err := db.Find(e.col, filter, internal.FindOptions{}, &refs); err != nil {
+				return err
+			}
+		} else if err != internal.ErrPermissionDenied {
+			return err
+		}
+
+		byID := make(map[primitive.ObjectID]bson.M)
+		for _, ref := range refs {
+			oid, ok := ref[internal.FieldID].(primitive.ObjectID)
+			if !ok {
+				continue
+			}
+
+			ref["id"] = oid
+			delete(ref, internal.FieldID)
+			delete(ref, internal.FieldOwnerID)
+
+			byID[oid] = ref
+		}
+
+		for _, doc := range docs {
+			v, ok := doc[e.field]
+			if !ok {
+				continue
+			}
+
+			if arr, ok := toArray(v); ok {
+				expanded := make([]interface{}, len(arr))
+				for i, item := range arr {
+					expanded[i] = resolveRef(item, byID)
+				}
+				doc[e.field] = expanded
+				continue
+			}
+
+			doc[e.field] = resolveRef(v, byID)
+		}
+	}
+	return nil
+}
+
+// resolveRef returns the referenced document or nil
+func resolveRef(v interface{}, byID map[primitive.ObjectID]bson.M) interface{} {
+	ids := refIDs(v)
+	if len(ids) != 1 {
+		return nil
+	}
+
+	if ref, ok := byID[ids[0]]; ok {
+		return ref
+	}
+	return nil
+}
+
+// refIDs returns the ids referenced by v which can be an ObjectID, its hex
+// string or an array of those.
+func refIDs(v interface{}) []primitive.ObjectID {
+	if arr, ok := toArray(v); ok {
+		var ids []primitive.ObjectID
+		for _, item := range arr {
+			ids = append(ids, refIDs(item)...)
+		}
+		return ids
+	}
+
+	switch x := v.(type) {
+	case primitive.ObjectID:
+		return []primitive.ObjectID{x}
+	case string:
+		if oid, err := primitive.ObjectIDFromHex(x); err == nil {
+			return []primitive.ObjectID{oid}
+		}
+	}
+	return nil
+}
+
+func toArray(v interface{}) ([]interface{}, bool) {
+	switch x := v.(type) {
+	case primitive.A:
+		return []interface{}(x), true
+	case []interface{}:
+		return x, true
+	}
+	return nil, false
+}
@@ -0,0 +1,485 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"staticbackend/internal"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SchemaCollection holds the schema of the collections of a base
+const SchemaCollection = "sb_schemas"
+
+// Schema is the subset of JSON Schema used to validate documents. The root
+// schema describes the document and must be of type object.
+type Schema struct {
+	Type                 SchemaTypes        `bson:"type,omitempty" json:"type,omitempty"`
+	Required             []string           `bson:"required,omitempty" json:"required,omitempty"`
+	Properties           map[string]*Schema `bson:"properties,omitempty" json:"properties,omitempty"`
+	AdditionalProperties *bool              `bson:"additionalProperties,omitempty" json:"additionalProperties,omitempty"`
+	Items                *Schema            `bson:"items,omitempty" json:"items,omitempty"`
+	Enum                 []interface{}      `bson:"enum,omitempty" json:"enum,omitempty"`
+	Minimum              *float64           `bson:"minimum,omitempty" json:"minimum,omitempty"`
+	Maximum              *float64           `bson:"maximum,omitempty" json:"maximum,omitempty"`
+	MinLength            *int               `bson:"minLength,omitempty" json:"minLength,omitempty"`
+	MaxLength            *int               `bson:"maxLength,omitempty" json:"maxLength,omitempty"`
+	Pattern              string             `bson:"pattern,omitempty" json:"pattern,omitempty"`
+	MinItems             *int               `bson:"minItems,omitempty" json:"minItems,omitempty"`
+	MaxItems             *int               `bson:"maxItems,omitempty" json:"maxItems,omitempty"`
+}
+
+// SchemaTypes are the allowed types of a value: string, number, integer,
+// boolean, object, array or null. It is a single string or an array in JSON.
+type SchemaTypes []string
+
+func (t *SchemaTypes) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = SchemaTypes{s}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+	*t = list
+	return nil
+}
+
+// CollectionSchema is the schema of a collection as stored in SchemaCollection
+type CollectionSchema struct {
+	ID         primitive.ObjectID `bson:"_id" json:"-"`
+	Collection string             `bson:"col" json:"collection"`
+	Schema     Schema             `bson:"schema" json:"schema"`
+	Updated    time.Time          `bson:"updated" json:"updated"`
+}
+
+// FieldError is the reason why a field is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a document does not match the schema of
+// its collection.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	var msgs []string
+	for _, fe := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", fe.Field, fe.Message))
+	}
+	return "invalid document: " + strings.Join(msgs, ", ")
+}
+
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// IsValidationError returns the ValidationError wrapped in err if any
+func IsValidationError(err error) (*ValidationError, bool) {
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		return ve, true
+	}
+	return nil, false
+}
+
+var schemaTypes = map[string]bool{
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"null":    true,
+}
+
+// Check makes sure the schema is usable, the root must be an object.
+func (s *Schema) Check() error {
+	if len(s.Type) != 1 || s.Type[0] != "object" {
+		return fmt.Errorf("the schema type must be object")
+	}
+	return s.check("")
+}
+
+func (s *Schema) check(path string) error {
+	name := path
+	if len(name) == 0 {
+		name = "the root"
+	}
+
+	for _, t := range s.Type {
+		if !schemaTypes[t] {
+			return fmt.Errorf("%s has an unsupported type: %s", name, t)
+		}
+	}
+
+	if len(s.Pattern) > 0 {
+		if _, err := regexp.Compile(s.Pattern); err != nil {
+			return fmt.Errorf("%s has an invalid pattern: %v", name, err)
+		}
+	}
+
+	for _, field := range s.Required {
+		if len(field) == 0 {
+			return fmt.Errorf("%s has an empty required field", name)
+		}
+	}
+
+	for field, prop := range s.Properties {
+		if prop == nil {
+			return fmt.Errorf("%s has no schema", joinPath(path, field))
+		} else if strings.ContainsAny(field, ".$") || len(field) == 0 {
+			return fmt.Errorf("invalid property name: %s", joinPath(path, field))
+		}
+
+		if err := prop.check(joinPath(path, field)); err != nil {
+			return err
+		}
+	}
+
+	if s.Items != nil {
+		return s.Items.check(path + "[]")
+	}
+	return nil
+}
+
+func joinPath(path, field string) string {
+	if len(path) == 0 {
+		return field
+	}
+	return path + "." + field
+}
+
+// systemFields are set by the server and never validated
+var systemFields = map[string]bool{
+	"id":                    true,
+	internal.FieldID:        true,
+	internal.FieldAccountID: true,
+	internal.FieldOwnerID:   true,
+	internal.FieldVersion:   true,
+	internal.FieldDeleted:   true,
+}
+
+// Validate validates the whole document
+func (s *Schema) Validate(doc map[string]interface{}) error {
+	ve := &ValidationError{}
+	s.validateObject("", doc, true, ve)
+	if len(ve.Errors) > 0 {
+		return ve
+	}
+	return nil
+}
+
+// ValidatePartial validates only the fields present in doc, used for
+// updates. Keys can be dotted paths to nested fields.
+func (s *Schema) ValidatePartial(doc map[string]interface{}) error {
+	ve := &ValidationError{}
+
+	keys := sortedKeys(doc)
+	for _, key := range keys {
+		if systemFields[key] {
+			continue
+		}
+
+		prop, parent := s.lookup(key)
+		if prop == nil {
+			if parent.AdditionalProperties != nil && !*parent.AdditionalProperties {
+				ve.add(key, "is not allowed")
+			}
+			continue
+		}
+
+		v := doc[key]
+		if v == nil && parent.isRequired(lastKey(key)) {
+			ve.add(key, "is required")
+			continue
+		}
+
+		prop.validate(key, v, ve)
+	}
+
+	if len(ve.Errors) > 0 {
+		return ve
+	}
+	return nil
+}
+
+// lookup returns the schema of the dotted field and the schema of the object
+// holding it. When the field is not described prop is nil and parent is the
+// deepest object schema found.
+func (s *Schema) lookup(field string) (prop *Schema, parent *Schema) {
+	parent = s
+	keys := strings.Split(field, ".")
+	for i, key := range keys {
+		prop = parent.Properties[key]
+		if prop == nil {
+			return nil, parent
+		}
+
+		if i < len(keys)-1 {
+			parent = prop
+		}
+	}
+	return prop, parent
+}
+
+func lastKey(field string) string {
+	keys := strings.Split(field, ".")
+	return keys[len(keys)-1]
+}
+
+func (s *Schema) isRequired(field string) bool {
+	for _, f := range s.Required {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schema) validateObject(path string, doc map[string]interface{}, root bool, ve *ValidationError) {
+	for _, field := range s.Required {
+		if v, ok := doc[field]; !ok || v == nil {
+			ve.add(joinPath(path, field), "is required")
+		}
+	}
+
+	for _, key := range sortedKeys(doc) {
+		if root && systemFields[key] {
+			continue
+		}
+
+		field := joinPath(path, key)
+
+		prop, ok := s.Properties[key]
+		if !ok {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				ve.add(field, "is not allowed")
+			}
+			continue
+		}
+
+		v := doc[key]
+		if v == nil && s.isRequired(key) {
+			// already reported
+			continue
+		}
+
+		prop.validate(field, v, ve)
+	}
+}
+
+func (s *Schema) validate(field string, v interface{}, ve *ValidationError) {
+	typ := typeOf(v)
+	if len(s.Type) > 0 && !s.allows(typ, v) {
+		ve.add(field, "must be of type %s", strings.Join(s.Type, " or "))
+		return
+	}
+
+	if len(s.Enum) > 0 && !inEnum(s.Enum, v) {
+		ve.add(field, "must be one of %v", s.Enum)
+		return
+	}
+
+	switch typ {
+	case "string":
+		str := v.(string)
+		n := len([]rune(str))
+		if s.MinLength != nil && n < *s.MinLength {
+			ve.add(field, "must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			ve.add(field, "must be at most %d characters", *s.MaxLength)
+		}
+		if len(s.Pattern) > 0 {
+			if re, err := regexp.Compile(s.Pattern); err == nil && !re.MatchString(str) {
+				ve.add(field, "must match the pattern %s", s.Pattern)
+			}
+		}
+	case "number":
+		f, _ := toFloat(v)
+		if s.Minimum != nil && f < *s.Minimum {
+			ve.add(field, "must be greater than or equal to %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			ve.add(field, "must be less than or equal to %v", *s.Maximum)
+		}
+	case "object":
+		s.validateObject(field, toMap(v), false, ve)
+	case "array":
+		items, _ := toArray(v)
+		if s.MinItems != nil && len(items) < *s.MinItems {
+			ve.add(field, "must contain at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(items) > *s.MaxItems {
+			ve.add(field, "must contain at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range items {
+				s.Items.validate(fmt.Sprintf("%s.%d", field, i), item, ve)
+			}
+		}
+	}
+}
+
+func (s *Schema) allows(typ string, v interface{}) bool {
+	for _, t := range s.Type {
+		if t == typ {
+			return true
+		}
+		if t == "integer" && typ == "number" {
+			if f, _ := toFloat(v); f == math.Trunc(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// typeOf returns the JSON Schema type of v, integers are reported as number.
+// Values the schema cannot describe, i.e. dates, are reported as their Go
+// type.
+func typeOf(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case map[string]interface{}, bson.M, bson.D:
+		return "object"
+	case []interface{}, primitive.A:
+		return "array"
+	default:
+		if _, ok := toFloat(x); ok {
+			return "number"
+		}
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func toMap(v interface{}) map[string]interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return x
+	case bson.M:
+		return x
+	case bson.D:
+		return x.Map()
+	}
+	return nil
+}
+
+func inEnum(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if a, ok := toFloat(e); ok {
+			if b, ok := toFloat(v); ok && a == b {
+				return true
+			}
+			continue
+		}
+		if fmt.Sprintf("%T:%v", e, e) == fmt.Sprintf("%T:%v", v, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(doc map[string]interface{}) []string {
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// GetSchema returns the schema of the collection or nil if it has none
+func GetSchema(db internal.Database, col string) (*Schema, error) {
+	var cs CollectionSchema
+	if err := db.FindOne(SchemaCollection, bson.M{"col": col}, &cs); err != nil {
+		if errors.Is(err, internal.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &cs.Schema, nil
+}
+
+// schemaFor returns the schema used to validate writes to the collection.
+// Writes to the schema collection itself are refused.
+func schemaFor(db internal.Database, col string) (*Schema, error) {
+	if col == SchemaCollection {
+		return nil, fmt.Errorf("the %s collection can only be changed via the schema API", SchemaCollection)
+	}
+	return GetSchema(db, col)
+}
+
+// ListSchemas returns the schema of all collections having one
+func ListSchemas(db internal.Database) ([]CollectionSchema, error) {
+	var results []CollectionSchema
+	opt := internal.FindOptions{Sort: bson.D{{Key: "col", Value: 1}}}
+	if err := db.Find(SchemaCollection, bson.M{}, opt, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// SetSchema creates or replaces the schema of the collection
+func SetSchema(db internal.Database, col string, schema Schema) error {
+	if err := schema.Check(); err != nil {
+		return err
+	}
+
+	update := bson.M{"$set": bson.M{"schema": schema, "updated": time.Now()}}
+	res, err := db.UpdateOne(SchemaCollection, bson.M{"col": col}, update)
+	if err != nil {
+		return err
+	} else if res.MatchedCount > 0 {
+		return nil
+	}
+
+	cs := CollectionSchema{
+		ID:         primitive.NewObjectID(),
+		Collection: col,
+		Schema:     schema,
+		Updated:    time.Now(),
+	}
+	return db.InsertOne(SchemaCollection, cs)
+}
+
+// DeleteSchema removes the schema of the collection
+func DeleteSchema(db internal.Database, col string) error {
+	_, err := db.DeleteOne(SchemaCollection, bson.M{"col": col})
+	return err
+}
@@ -0,0 +1,257 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"staticbackend/internal"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrNoTextIndex is returned when searching a collection without text index
+var ErrNoTextIndex = errors.New("the collection has no text index")
+
+// snippetLength is the maximum number of characters of a highlight
+const snippetLength = 160
+
+// SearchParams is a full-text search of Text, any of its words matches.
+// With Highlight the results have snippets of their matching fields.
+type SearchParams struct {
+	Text      string `json:"text"`
+	Page      int64  `json:"page"`
+	Size      int64  `json:"size"`
+	Highlight bool   `json:"highlight"`
+}
+
+// Validate returns an error when there's no word to search
+func (p SearchParams) Validate() error {
+	if len(internal.SearchTerms(p.Text)) == 0 {
+		return fmt.Errorf("missing search text")
+	}
+	return nil
+}
+
+// SearchResult is a page of documents ordered by relevance
+type SearchResult struct {
+	Page    int64                `json:"page"`
+	Size    int64                `json:"size"`
+	Total   int64                `json:"total"`
+	Results []internal.SearchHit `json:"results"`
+}
+
+// ValidateIndex validates the index and makes sure the collection has at
+// most one text index.
+func ValidateIndex(db internal.Database, col string, idx *internal.Index) error {
+	if err := idx.Validate(); err != nil {
+		return err
+	} else if !idx.Text {
+		return nil
+	}
+
+	indexes, err := db.ListIndexes(col)
+	if err != nil {
+		return err
+	}
+
+	if cur, ok := internal.TextIndex(indexes); ok && cur.Name != idx.Name {
+		return fmt.Errorf("the collection already has the text index %s", cur.Name)
+	}
+	return nil
+}
+
+// Search returns the documents matching the text and filter the user can
+// read, the collection must have a text index.
+func (b *Base) Search(auth internal.Auth, db internal.Database, col string, filter bson.M, params SearchParams) (SearchResult, error) {
+	if params.Page <= 0 {
+		params.Page = 1
+	}
+	if params.Size <= 0 {
+		params.Size = 25
+	}
+
+	result := SearchResult{
+		Page: params.Page,
+		Size: params.Size,
+	}
+
+	if err := params.Validate(); err != nil {
+		return result, err
+	}
+
+	indexes, err := db.ListIndexes(col)
+	if err != nil {
+		return result, err
+	}
+
+	idx, ok := internal.TextIndex(indexes)
+	if !ok {
+		return result, ErrNoTextIndex
+	}
+
+	if filter == nil {
+		filter = bson.M{}
+	}
+	if err := secureRead(auth, db, col, filter); err != nil {
+		return result, err
+	}
+
+	opt := internal.SearchOptions{
+		Text:   params.Text,
+		Fields: idx.Keys,
+		Skip:   params.Size * (params.Page - 1),
+		Limit:  params.Size,
+	}
+
+	hits, total, err := db.Search(col, filter, opt)
+	if err != nil {
+		return result, err
+	}
+
+	terms := internal.SearchTerms(params.Text)
+	for i, hit := range hits {
+		if params.Highlight {
+			hits[i].Highlights = highlights(hit.Doc, idx.Keys, terms)
+		}
+
+		hit.Doc["id"] = hit.Doc[internal.FieldID]
+		delete(hit.Doc, internal.FieldID)
+		delete(hit.Doc, internal.FieldOwnerID)
+	}
+
+	if len(hits) == 0 {
+		hits = make([]internal.SearchHit, 0)
+	}
+
+	result.Total = total
+	result.Results = hits
+	return result, nil
+}
+
+// highlights returns the snippets of the text fields having search words
+func highlights(doc bson.M, fields []internal.IndexKey, terms []string) map[string]string {
+	h := make(map[string]string)
+	for _, key := range fields {
+		v, ok := lookupField(doc, key.Field)
+		if !ok {
+			continue
+		}
+
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		if snippet, ok := highlight(s, terms); ok {
+			h[key.Field] = snippet
+		}
+	}
+
+	if len(h) == 0 {
+		return nil
+	}
+	return h
+}
+
+// highlight returns the HTML escaped snippet of s around the first search
+// word with all the search words wrapped in <mark> tags.
+func highlight(s string, terms []string) (string, bool) {
+	type word struct{ start, end int }
+
+	// words as rune offsets
+	runes := []rune(s)
+	var words []word
+	start := -1
+	for i, r := range runes {
+		if internal.IsWordSeparator(r) {
+			if start >= 0 {
+				words = append(words, word{start, i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		words = append(words, word{start, len(runes)})
+	}
+
+	isTerm := func(w word) bool {
+		text := strings.ToLower(string(runes[w.start:w.end]))
+		for _, t := range terms {
+			if text == t {
+				return true
+			}
+		}
+		return false
+	}
+
+	var marked []word
+	for _, w := range words {
+		if isTerm(w) {
+			marked = append(marked, w)
+		}
+	}
+
+	if len(marked) == 0 {
+		return "", false
+	}
+
+	// the snippet starts a little before the first match
+	from, to := 0, len(runes)
+	if len(runes) > snippetLength {
+		from = marked[0].start - snippetLength/4
+		if from < 0 {
+			from = 0
+		}
+		to = from + snippetLength
+		if to > len(runes) {
+			to = len(runes)
+			from = to - snippetLength
+		}
+	}
+
+	var sb strings.Builder
+	if from > 0 {
+		sb.WriteString("…")
+	}
+
+	pos := from
+	for _, w := range marked {
+		if w.start < from || w.end > to {
+			continue
+		}
+
+		sb.WriteString(html.EscapeString(string(runes[pos:w.start])))
+		sb.WriteString("<mark>")
+		sb.WriteString(html.EscapeString(string(runes[w.start:w.end])))
+		sb.WriteString("</mark>")
+		pos = w.end
+	}
+	sb.WriteString(html.EscapeString(string(runes[pos:to])))
+
+	if to < len(runes) {
+		sb.WriteString("…")
+	}
+
+	return sb.String(), true
+}
+
+// lookupField returns the value at the dotted path field
+func lookupField(doc bson.M, field string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, key := range strings.Split(field, ".") {
+		m := toMap(cur)
+		if m == nil {
+			return nil, false
+		}
+
+		v, ok := m[key]
+		if !ok {
+			return nil, false
+		}
+		cur = v
+	}
+	return cur, true
+}
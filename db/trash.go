@@ -0,0 +1,206 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"staticbackend/internal"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SoftDeleteCollection holds the soft delete settings of the collections
+const SoftDeleteCollection = "sb_softdelete"
+
+// DefaultRetentionDays is how long deleted documents stay in the trash when
+// the retention is not set
+const DefaultRetentionDays = 30
+
+// SoftDelete are the settings of a collection with soft delete. Deleted
+// documents are moved to the trash, they can be restored until they're
+// purged RetentionDays after their deletion.
+type SoftDelete struct {
+	ID            primitive.ObjectID `bson:"_id" json:"-"`
+	Collection    string             `bson:"col" json:"collection"`
+	RetentionDays int                `bson:"retention" json:"retentionDays"`
+	Updated       time.Time          `bson:"updated" json:"updated"`
+}
+
+// GetSoftDelete returns the soft delete settings of the collection or nil
+// when its documents are deleted permanently.
+func GetSoftDelete(db internal.Database, col string) (*SoftDelete, error) {
+	var sd SoftDelete
+	if err := db.FindOne(SoftDeleteCollection, bson.M{"col": col}, &sd); err != nil {
+		if errors.Is(err, internal.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &sd, nil
+}
+
+// ListSoftDelete returns the settings of all collections with soft delete
+func ListSoftDelete(db internal.Database) ([]SoftDelete, error) {
+	var results []SoftDelete
+	opt := internal.FindOptions{Sort: bson.D{{Key: "col", Value: 1}}}
+	if err := db.Find(SoftDeleteCollection, bson.M{}, opt, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// SetSoftDelete enables soft delete for the collection or changes its
+// retention
+func SetSoftDelete(db internal.Database, col string, retentionDays int) error {
+	if retentionDays < 0 {
+		return fmt.Errorf("the retention must be a positive number of days")
+	} else if retentionDays == 0 {
+		retentionDays = DefaultRetentionDays
+	}
+
+	update := bson.M{"$set": bson.M{"retention": retentionDays, "updated": time.Now()}}
+	res, err := db.UpdateOne(SoftDeleteCollection, bson.M{"col": col}, update)
+	if err != nil {
+		return err
+	} else if res.MatchedCount > 0 {
+		return nil
+	}
+
+	sd := SoftDelete{
+		ID:            primitive.NewObjectID(),
+		Collection:    col,
+		RetentionDays: retentionDays,
+		Updated:       time.Now(),
+	}
+	return db.InsertOne(SoftDeleteCollection, sd)
+}
+
+// DeleteSoftDelete disables soft delete, the documents already in the trash
+// stay there until they're restored or purged.
+func DeleteSoftDelete(db internal.Database, col string) error {
+	_, err := db.DeleteOne(SoftDeleteCollection, bson.M{"col": col})
+	return err
+}
+
+// softDeleted returns true if the collection's documents are moved to the
+// trash when deleted
+func softDeleted(db internal.Database, col string) (bool, error) {
+	sd, err := GetSoftDelete(db, col)
+	return sd != nil, err
+}
+
+// trashUpdate marks the documents as deleted
+func trashUpdate() bson.M {
+	return bson.M{
+		"$set": bson.M{internal.FieldDeleted: time.Now()},
+		"$inc": bson.M{internal.FieldVersion: 1},
+	}
+}
+
+// inTrash returns the filter of the deleted documents
+func inTrash(filter bson.M) bson.M {
+	trashed := bson.M{internal.FieldDeleted: bson.M{"$exists": true}}
+	if len(filter) == 0 {
+		return trashed
+	}
+	return bson.M{"$and": bson.A{filter, trashed}}
+}
+
+// ListTrash returns the deleted documents of the collection, the most
+// recently deleted first.
+func (b *Base) ListTrash(db internal.Database, col string, params ListParams) (PagedResult, error) {
+	if params.Page <= 0 {
+		params.Page = 1
+	}
+	if params.Size <= 0 {
+		params.Size = 25
+	}
+
+	result := PagedResult{Page: params.Page, Size: params.Size}
+
+	filter := inTrash(nil)
+
+	count, err := db.Count(col, filter)
+	if err != nil {
+		return result, err
+	}
+	result.Total = count
+
+	opt := internal.FindOptions{
+		Skip:  params.Size * (params.Page - 1),
+		Limit: params.Size,
+		Sort:  bson.D{{Key: internal.FieldDeleted, Value: -1}, {Key: internal.FieldID, Value: -1}},
+	}
+
+	var results []bson.M
+	if err := db.Find(col, filter, opt, &results); err != nil {
+		return result, err
+	}
+
+	for _, v := range results {
+		v["id"] = v[internal.FieldID]
+		delete(v, internal.FieldID)
+	}
+
+	if len(results) == 0 {
+		results = make([]bson.M, 0)
+	}
+	result.Results = results
+	return result, nil
+}
+
+// Restore moves the document out of the trash, it's published as created
+func (b *Base) Restore(db internal.Database, col, id string) (bson.M, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := inTrash(bson.M{internal.FieldID: oid})
+	update := bson.M{
+		"$unset": bson.M{internal.FieldDeleted: ""},
+		"$inc":   bson.M{internal.FieldVersion: 1},
+	}
+
+	res, err := db.UpdateOne(col, filter, update)
+	if err != nil {
+		return nil, err
+	} else if res.MatchedCount == 0 {
+		return nil, internal.ErrNotFound
+	}
+
+	var doc bson.M
+	if err := db.FindOne(col, bson.M{internal.FieldID: oid}, &doc); err != nil {
+		return nil, err
+	}
+
+	doc["id"] = doc[internal.FieldID]
+	delete(doc, internal.FieldID)
+
+	b.PublishDocument("db-"+col, internal.MsgTypeDBCreated, doc)
+
+	return doc, nil
+}
+
+// Purge permanently deletes a document of the trash
+func (b *Base) Purge(db internal.Database, col, id string) (int64, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return 0, err
+	}
+
+	return db.DeleteOne(col, inTrash(bson.M{internal.FieldID: oid}))
+}
+
+// PurgeExpired permanently deletes the documents deleted more than the
+// retention ago
+func PurgeExpired(db internal.Database, sd SoftDelete) (int64, error) {
+	days := sd.RetentionDays
+	if days <= 0 {
+		days = DefaultRetentionDays
+	}
+
+	before := time.Now().AddDate(0, 0, -days)
+	return db.DeleteMany(sd.Collection, bson.M{internal.FieldDeleted: bson.M{"$lt": before}})
+}
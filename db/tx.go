@@ -0,0 +1,149 @@
+package db
+
+import (
+	"fmt"
+	"staticbackend/internal"
+)
+
+// OpIncrease is the transaction operation increasing a numeric field
+const OpIncrease = "increase"
+
+// TxOp is an operation of a transaction: create, update, increase or delete
+type TxOp struct {
+	Op    string                 `json:"op"`
+	Col   string                 `json:"col"`
+	ID    string                 `json:"id"`
+	Doc   map[string]interface{} `json:"doc"`
+	Field string                 `json:"field"`
+	Range int                    `json:"range"`
+
+	// Version, Upsert and Operators are the UpdateOptions of an update
+	Version   int64 `json:"version"`
+	Upsert    bool  `json:"upsert"`
+	Operators bool  `json:"operators"`
+}
+
+// Validate returns an error when the operation is incomplete
+func (op TxOp) Validate() error {
+	if len(op.Col) == 0 {
+		return fmt.Errorf("missing collection")
+	}
+
+	switch op.Op {
+	case internal.OpCreate:
+		if op.Doc == nil {
+			return fmt.Errorf("missing doc to create")
+		}
+	case internal.OpUpdate:
+		if len(op.ID) == 0 || op.Doc == nil {
+			return fmt.Errorf("update requires an id and a doc")
+		}
+	case OpIncrease:
+		if len(op.ID) == 0 || len(op.Field) == 0 {
+			return fmt.Errorf("increase requires an id and a field")
+		}
+	case internal.OpDelete:
+		if len(op.ID) == 0 {
+			return fmt.Errorf("missing id to delete")
+		}
+	default:
+		return fmt.Errorf("invalid operation: %s", op.Op)
+	}
+	return nil
+}
+
+type event struct {
+	topic string
+	typ   string
+	doc   interface{}
+}
+
+// Transaction runs fn atomically. fn must do all its operations via the Base
+// and Database it receives, their realtime events are published only once
+// the transaction is committed.
+func (b *Base) Transaction(db internal.Database, fn func(tb *Base, tx internal.Database) error) error {
+	var events []event
+	err := db.Transaction(func(tx internal.Database) error {
+		// the transaction can be retried
+		events = nil
+
+		tb := &Base{
+			PublishDocument: func(topic, typ string, doc interface{}) {
+				events = append(events, event{topic: topic, typ: typ, doc: doc})
+			},
+			tx: true,
+		}
+		return fn(tb, tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		b.PublishDocument(e.topic, e.typ, e.doc)
+	}
+	return nil
+}
+
+// Batch runs the operations in a transaction, nothing is applied if one of
+// them fails. The results are the created or updated documents, true for
+// increases and the number of deleted documents.
+func (b *Base) Batch(auth internal.Auth, db internal.Database, ops []TxOp) ([]interface{}, error) {
+	for i, op := range ops {
+		if err := op.Validate(); err != nil {
+			return nil, fmt.Errorf("operation %d: %v", i+1, err)
+		}
+	}
+
+	var results []interface{}
+	err := b.Transaction(db, func(tb *Base, tx internal.Database) error {
+		results = make([]interface{}, len(ops))
+		for i, op := range ops {
+			result, err := tb.apply(auth, tx, op)
+			if err != nil {
+				return fmt.Errorf("operation %d: %w", i+1, err)
+			}
+			results[i] = result
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (b *Base) apply(auth internal.Auth, db internal.Database, op TxOp) (interface{}, error) {
+	switch op.Op {
+	case internal.OpCreate:
+		return b.Add(auth, db, op.Col, copyDoc(op.Doc))
+	case internal.OpUpdate:
+		opt := UpdateOptions{Version: op.Version, Upsert: op.Upsert, Operators: op.Operators}
+		return b.Update(auth, db, op.Col, op.ID, copyDoc(op.Doc), opt)
+	case OpIncrease:
+		if err := b.Increase(auth, db, op.Col, op.ID, op.Field, op.Range); err != nil {
+			return nil, err
+		}
+		return true, nil
+	case internal.OpDelete:
+		n, err := b.Delete(auth, db, op.Col, op.ID)
+		if err != nil {
+			return nil, err
+		} else if n == 0 {
+			// the whole batch fails when a document is missing
+			return nil, internal.ErrNotFound
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("invalid operation: %s", op.Op)
+}
+
+// copyDoc returns a shallow copy since Add and Update modify the document
+// and the transaction can be retried.
+func copyDoc(doc map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		c[k] = v
+	}
+	return c
+}
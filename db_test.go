@@ -7,10 +7,15 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"staticbackend/db"
 	"staticbackend/internal"
 	"staticbackend/middleware"
+	"strings"
 	"testing"
 	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // dbReq post on behalf of adminToken by default (use params[0] true for root)
@@ -46,7 +51,7 @@ func dbReq(t *testing.T, hf func(http.ResponseWriter, *http.Request), method, pa
 	if params[0] {
 		stdAuth = []middleware.Middleware{
 			middleware.WithDB(client, volatile),
-			middleware.RequireRoot(client),
+			middleware.RequireRoot(client, volatile),
 		}
 	}
 	h := middleware.Chain(http.HandlerFunc(hf), stdAuth...)
@@ -131,7 +136,7 @@ func TestDBListCollections(t *testing.T) {
 
 	stdRoot := []middleware.Middleware{
 		middleware.WithDB(database.client, volatile),
-		middleware.RequireRoot(database.client),
+		middleware.RequireRoot(database.client, volatile),
 	}
 	h := middleware.Chain(http.HandlerFunc(database.listCollections), stdRoot...)
 
@@ -202,3 +207,667 @@ func TestDBIncrease(t *testing.T) {
 		t.Errorf("expected count to be 5 got %d", increased.Count)
 	}
 }
+
+func TestDBQueryOperators(t *testing.T) {
+	docs := []map[string]interface{}{
+		{"title": "Urgent fix", "status": "open", "priority": 5, "tags": []string{"bug", "ui"}},
+		{"title": "write docs", "status": "open", "priority": 1, "assignee": "dom", "tags": []string{"docs"}},
+		{"title": "release", "status": "closed", "priority": 3, "assignee": "dom", "tags": []string{"bug"}},
+	}
+	for _, doc := range docs {
+		resp := dbReq(t, database.add, "POST", "/db/queryops", doc)
+		if resp.StatusCode > 299 {
+			t.Fatal(GetResponseBody(t, resp))
+		}
+		resp.Body.Close()
+	}
+
+	queries := map[string]struct {
+		clauses [][]interface{}
+		count   int64
+	}{
+		"range on same field": {[][]interface{}{
+			{"priority", ">", 1},
+			{"priority", "<=", 5},
+		}, 2},
+		"or group": {[][]interface{}{
+			{"or", []interface{}{
+				[]interface{}{"status", "==", "closed"},
+				[]interface{}{"title", "contains", "URGENT"},
+			}},
+		}, 2},
+		"nested group": {[][]interface{}{
+			{"status", "==", "open"},
+			{"or", []interface{}{
+				[]interface{}{"priority", ">=", 5},
+				[]interface{}{
+					[]interface{}{"assignee", "exists", true},
+					[]interface{}{"title", "regex", "^write"},
+				},
+			}},
+		}, 2},
+		"array operators": {[][]interface{}{
+			{"tags", "all", []string{"bug", "ui"}},
+			{"tags", "size", 2},
+		}, 1},
+		"not exists": {[][]interface{}{
+			{"assignee", "exists", false},
+		}, 1},
+	}
+
+	for name, q := range queries {
+		resp := dbReq(t, database.query, "POST", "/query/queryops", q.clauses)
+		if resp.StatusCode > 299 {
+			t.Fatalf("%s: %s", name, GetResponseBody(t, resp))
+		}
+
+		var result struct {
+			Total int64 `json:"total"`
+		}
+		if err := parseBody(resp.Body, &result); err != nil {
+			t.Fatal(err)
+		} else if result.Total != q.count {
+			t.Errorf("%s: expected %d results got %d", name, q.count, result.Total)
+		}
+		resp.Body.Close()
+	}
+
+	invalid := [][]interface{}{
+		{"status", "==", "open"},
+		{"or", []interface{}{
+			[]interface{}{"priority", ">=", 5},
+			[]interface{}{"title", "unknown", "x"},
+		}},
+	}
+
+	resp := dbReq(t, database.query, "POST", "/query/queryops", invalid)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 got %s", resp.Status)
+	} else if body := GetResponseBody(t, resp); !strings.Contains(body, "The 2.2 query clause") {
+		t.Errorf("expected error to point at clause 2.2 got %s", body)
+	}
+}
+
+func TestDBAggregate(t *testing.T) {
+	docs := []map[string]interface{}{
+		{"status": "open", "amount": 10, "created": "2021-11-01T10:00:00Z"},
+		{"status": "open", "amount": 5.5, "created": "2021-11-01T18:30:00Z"},
+		{"status": "closed", "amount": 3, "created": "2021-11-02T08:00:00Z"},
+	}
+
+	var created struct {
+		AccountID string `json:"accountId"`
+	}
+	for _, doc := range docs {
+		resp := dbReq(t, database.add, "POST", "/db/aggs", doc)
+		if resp.StatusCode > 299 {
+			t.Fatal(GetResponseBody(t, resp))
+		}
+		if err := parseBody(resp.Body, &created); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	type group struct {
+		Status string  `json:"status"`
+		Day    string  `json:"day"`
+		Count  int64   `json:"count"`
+		Sum    float64 `json:"sum_amount"`
+		Avg    float64 `json:"avg_amount"`
+		Max    float64 `json:"max_amount"`
+	}
+
+	data := map[string]interface{}{
+		"groupBy": []map[string]string{{"field": "status"}},
+		"accumulators": []map[string]string{
+			{"op": "count"},
+			{"op": "sum", "field": "amount"},
+			{"op": "avg", "field": "amount"},
+			{"op": "max", "field": "amount"},
+		},
+	}
+
+	resp := dbReq(t, database.aggregate, "POST", "/aggregate/aggs", data)
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	defer resp.Body.Close()
+
+	var groups []group
+	if err := parseBody(resp.Body, &groups); err != nil {
+		t.Fatal(err)
+	} else if len(groups) != 2 {
+		t.Fatalf("expected 2 groups got %d", len(groups))
+	}
+
+	closed, open := groups[0], groups[1]
+	if closed.Status != "closed" || closed.Count != 1 || closed.Sum != 3 {
+		t.Errorf("unexpected closed group: %v", closed)
+	}
+	if open.Status != "open" || open.Count != 2 || open.Sum != 15.5 || open.Avg != 7.75 || open.Max != 10 {
+		t.Errorf("unexpected open group: %v", open)
+	}
+
+	data = map[string]interface{}{
+		"filter":  [][]interface{}{{"amount", ">", 4}},
+		"groupBy": []map[string]string{{"field": "created", "bucket": "day", "as": "day"}},
+	}
+
+	resp = dbReq(t, database.aggregate, "POST", "/aggregate/aggs", data)
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	defer resp.Body.Close()
+
+	groups = nil
+	if err := parseBody(resp.Body, &groups); err != nil {
+		t.Fatal(err)
+	} else if len(groups) != 1 {
+		t.Fatalf("expected 1 group got %d", len(groups))
+	} else if groups[0].Day != "2021-11-01" || groups[0].Count != 2 {
+		t.Errorf("unexpected day group: %v", groups[0])
+	}
+
+	data = map[string]interface{}{
+		"accumulators": []map[string]string{{"op": "median", "field": "amount"}},
+	}
+
+	resp = dbReq(t, database.aggregate, "POST", "/aggregate/aggs", data)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 got %s", resp.Status)
+	}
+
+	// a document from another account is only aggregated for root
+	curDB := database.client.Database(dbName)
+	other := bson.M{
+		internal.FieldID:        primitive.NewObjectID(),
+		internal.FieldAccountID: primitive.NewObjectID(),
+		"status":                "open",
+	}
+	if err := curDB.InsertOne("aggs", other); err != nil {
+		t.Fatal(err)
+	}
+
+	acctID, err := primitive.ObjectIDFromHex(created.AccountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for role, expected := range map[int]int64{0: 3, 100: 4} {
+		auth := internal.Auth{AccountID: acctID, UserID: primitive.NewObjectID(), Role: role}
+		results, err := database.base.Aggregate(auth, curDB, "aggs", bson.M{}, internal.AggregateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(results) != 1 || results[0]["count"] != expected {
+			t.Errorf("role %d: expected a count of %d got %v", role, expected, results)
+		}
+	}
+}
+
+func TestDBFieldsAndExpand(t *testing.T) {
+	resp := dbReq(t, database.add, "POST", "/db/projects", map[string]interface{}{"name": "sb", "budget": 42})
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	defer resp.Body.Close()
+
+	var project struct {
+		ID string `json:"id"`
+	}
+	if err := parseBody(resp.Body, &project); err != nil {
+		t.Fatal(err)
+	}
+
+	task := map[string]interface{}{
+		"title":   "expand me",
+		"done":    false,
+		"project": project.ID,
+		"related": []string{project.ID, primitive.NewObjectID().Hex()},
+	}
+	resp = dbReq(t, database.add, "POST", "/db/exptasks", task)
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	defer resp.Body.Close()
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := parseBody(resp.Body, &created); err != nil {
+		t.Fatal(err)
+	}
+
+	type expanded struct {
+		ID      string                   `json:"id"`
+		Title   string                   `json:"title"`
+		Done    *bool                    `json:"done"`
+		Project map[string]interface{}   `json:"project"`
+		Related []map[string]interface{} `json:"related"`
+	}
+
+	resp = dbReq(t, database.get, "GET", "/db/exptasks/"+created.ID+"?fields=title&expand=project:projects,related:projects", nil)
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	defer resp.Body.Close()
+
+	var doc expanded
+	if err := parseBody(resp.Body, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.ID != created.ID || doc.Title != "expand me" {
+		t.Errorf("expected id and title to be returned got %v", doc)
+	} else if doc.Done != nil {
+		t.Errorf("expected done to be excluded by fields got %v", *doc.Done)
+	} else if doc.Project["name"] != "sb" || doc.Project["id"] != project.ID {
+		t.Errorf("expected project to be expanded got %v", doc.Project)
+	} else if len(doc.Related) != 2 || doc.Related[0]["name"] != "sb" || doc.Related[1] != nil {
+		t.Errorf("expected related to contain the project and null got %v", doc.Related)
+	}
+
+	resp = dbReq(t, database.list, "GET", "/db/exptasks?fields=done", nil)
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Results []expanded `json:"results"`
+	}
+	if err := parseBody(resp.Body, &result); err != nil {
+		t.Fatal(err)
+	} else if len(result.Results) != 1 {
+		t.Fatalf("expected 1 result got %d", len(result.Results))
+	} else if r := result.Results[0]; r.Title != "" || r.Done == nil || r.Project != nil {
+		t.Errorf("expected only done to be returned got %v", r)
+	}
+
+	resp = dbReq(t, database.get, "GET", "/db/exptasks/"+created.ID+"?expand=project", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid expand got %s", resp.Status)
+	}
+}
+
+func TestDBCursorPagination(t *testing.T) {
+	ranks := []interface{}{3, 1, nil, 2, 3, 1, nil}
+	for _, rank := range ranks {
+		doc := map[string]interface{}{"rank": rank}
+		resp := dbReq(t, database.add, "POST", "/db/cursors", doc)
+		if resp.StatusCode > 299 {
+			t.Fatal(GetResponseBody(t, resp))
+		}
+		resp.Body.Close()
+	}
+
+	type page struct {
+		Total   int64  `json:"total"`
+		Next    string `json:"next"`
+		Results []struct {
+			ID   string      `json:"id"`
+			Rank interface{} `json:"rank"`
+		} `json:"results"`
+	}
+
+	expected := map[string]string{
+		"":        "[<nil> <nil> 1 1 2 3 3]",
+		"&desc=1": "[3 3 2 1 1 <nil> <nil>]",
+	}
+
+	for desc, order := range expected {
+		seen := make(map[string]bool)
+		var got []interface{}
+
+		cursor := ""
+		for i := 0; i <= len(ranks); i++ {
+			path := "/query/cursors?size=3&sort=rank&skiptotal=1" + desc + "&cursor=" + cursor
+			resp := dbReq(t, database.query, "POST", path, []interface{}{})
+			if resp.StatusCode > 299 {
+				t.Fatal(GetResponseBody(t, resp))
+			}
+
+			var p page
+			if err := parseBody(resp.Body, &p); err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if p.Total != -1 {
+				t.Errorf("expected total to be skipped got %d", p.Total)
+			}
+
+			for _, doc := range p.Results {
+				if seen[doc.ID] {
+					t.Fatalf("document %s returned twice", doc.ID)
+				}
+				seen[doc.ID] = true
+				got = append(got, doc.Rank)
+			}
+
+			if len(p.Next) == 0 {
+				break
+			}
+			cursor = p.Next
+		}
+
+		if s := fmt.Sprintf("%v", got); s != order {
+			t.Errorf("expected ranks %s got %s", order, s)
+		}
+	}
+
+	// the sort field is only returned when it's part of the fields
+	resp := dbReq(t, database.query, "POST", "/query/cursors?size=3&sort=rank&fields=id&cursor=*", []interface{}{})
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	defer resp.Body.Close()
+
+	var p struct {
+		Next    string   `json:"next"`
+		Results []bson.M `json:"results"`
+	}
+	if err := parseBody(resp.Body, &p); err != nil {
+		t.Fatal(err)
+	} else if len(p.Next) == 0 || len(p.Results) != 3 {
+		t.Fatalf("expected 3 results and a next cursor got %d and %q", len(p.Results), p.Next)
+	}
+
+	for _, doc := range p.Results {
+		if _, ok := doc["rank"]; ok {
+			t.Errorf("expected rank to be excluded by fields got %v", doc)
+		} else if _, ok := doc["id"]; !ok {
+			t.Errorf("expected id in %v", doc)
+		}
+	}
+
+	resp = dbReq(t, database.query, "POST", "/query/cursors?cursor=nope", []interface{}{})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid cursor got %s", resp.Status)
+	}
+}
+
+func TestDBTransaction(t *testing.T) {
+	resp := dbReq(t, database.add, "POST", "/db/txstock", map[string]interface{}{"sku": "a", "qty": 10})
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var stock struct {
+		ID string `json:"id"`
+	}
+	if err := parseBody(resp.Body, &stock); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := []db.TxOp{
+		{Op: internal.OpCreate, Col: "txorders", Doc: map[string]interface{}{"sku": "a", "qty": 3}},
+		{Op: db.OpIncrease, Col: "txstock", ID: stock.ID, Field: "qty", Range: -3},
+	}
+
+	resp = dbReq(t, database.tx, "POST", "/tx", ops)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var results []interface{}
+	if err := parseBody(resp.Body, &results); err != nil {
+		t.Fatal(err)
+	} else if len(results) != 2 {
+		t.Fatalf("expected 2 results got %v", results)
+	}
+
+	// the missing document fails the update and rolls back the create
+	ops = []db.TxOp{
+		{Op: internal.OpCreate, Col: "txorders", Doc: map[string]interface{}{"sku": "a", "qty": 1}},
+		{Op: db.OpIncrease, Col: "txstock", ID: stock.ID, Field: "qty", Range: -1},
+		{Op: internal.OpUpdate, Col: "txstock", ID: primitive.NewObjectID().Hex(), Doc: map[string]interface{}{"qty": 0}},
+	}
+
+	resp = dbReq(t, database.tx, "POST", "/tx", ops)
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("expected the transaction to fail")
+	}
+	resp.Body.Close()
+
+	curDB := database.client.Database(dbName)
+
+	if count, err := curDB.Count("txorders", bson.M{}); err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Errorf("expected 1 order got %d", count)
+	}
+
+	var cur bson.M
+	oid, _ := primitive.ObjectIDFromHex(stock.ID)
+	if err := curDB.FindOne("txstock", bson.M{internal.FieldID: oid}, &cur); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(cur["qty"]) != "7" {
+		t.Errorf("expected qty to be 7 got %v", cur["qty"])
+	}
+
+	resp = dbReq(t, database.tx, "POST", "/tx", []db.TxOp{{Op: "upsert", Col: "txstock"}})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid operation got %s", resp.Status)
+	}
+	resp.Body.Close()
+}
+
+func TestDBBulkUpdateAndDelete(t *testing.T) {
+	var docs []interface{}
+	for i := 0; i < 6; i++ {
+		docs = append(docs, map[string]interface{}{"n": i, "status": "open"})
+	}
+
+	resp := dbReq(t, database.dbreq, "POST", "/db/bulkops?bulk=1", docs)
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	update := map[string]interface{}{
+		"filter": [][]interface{}{{"n", ">=", 3}},
+		"update": map[string]interface{}{"status": "closed"},
+	}
+
+	resp = dbReq(t, database.dbreq, "PUT", "/db/bulkops?bulk=1", update)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var result internal.UpdateResult
+	if err := parseBody(resp.Body, &result); err != nil {
+		t.Fatal(err)
+	} else if result.MatchedCount != 3 || result.ModifiedCount != 3 {
+		t.Errorf("expected 3 matched and modified got %v", result)
+	}
+
+	curDB := database.client.Database(dbName)
+	if count, err := curDB.Count("bulkops", bson.M{"status": "closed"}); err != nil {
+		t.Fatal(err)
+	} else if count != 3 {
+		t.Errorf("expected 3 closed documents got %d", count)
+	}
+
+	// users without permission on the documents do not change them
+	other := internal.Auth{AccountID: primitive.NewObjectID(), UserID: primitive.NewObjectID()}
+	res, err := database.base.UpdateMany(other, curDB, "bulkops", bson.M{}, map[string]interface{}{"status": "x"})
+	if err != nil {
+		t.Fatal(err)
+	} else if res.MatchedCount != 0 {
+		t.Errorf("expected no documents matched for another account got %d", res.MatchedCount)
+	}
+
+	del := map[string]interface{}{
+		"filter": [][]interface{}{{"status", "==", "closed"}},
+	}
+
+	resp = dbReq(t, database.dbreq, "DELETE", "/db/bulkops?bulk=1", del)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var deleted int64
+	if err := parseBody(resp.Body, &deleted); err != nil {
+		t.Fatal(err)
+	} else if deleted != 3 {
+		t.Errorf("expected 3 deleted got %d", deleted)
+	}
+
+	if count, err := curDB.Count("bulkops", bson.M{}); err != nil {
+		t.Fatal(err)
+	} else if count != 3 {
+		t.Errorf("expected 3 remaining documents got %d", count)
+	}
+}
+
+func TestDBConditionalUpdateAndUpsert(t *testing.T) {
+	resp := dbReq(t, database.add, "POST", "/db/versioned", map[string]interface{}{"title": "v1"})
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var created map[string]interface{}
+	if err := parseBody(resp.Body, &created); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(created[internal.FieldVersion]) != "1" {
+		t.Fatalf("expected version 1 got %v", created[internal.FieldVersion])
+	}
+
+	id := created["id"].(string)
+
+	update := func(version string, doc map[string]interface{}) *http.Response {
+		b, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("PUT", "/db/versioned/"+id, bytes.NewReader(b))
+		req.Header.Set("SB-PUBLIC-KEY", pubKey)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		req.Header.Set("If-Match", version)
+
+		w := httptest.NewRecorder()
+		h := middleware.Chain(http.HandlerFunc(database.update),
+			middleware.WithDB(database.client, volatile),
+			middleware.RequireAuth(database.client, volatile),
+		)
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	resp = update(`"1"`, map[string]interface{}{"title": "v2"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	} else if etag := resp.Header.Get("ETag"); etag != `"2"` {
+		t.Errorf(`expected ETag "2" got %s`, etag)
+	}
+	resp.Body.Close()
+
+	// a client still at version 1 cannot overwrite version 2
+	resp = update(`"1"`, map[string]interface{}{"title": "stale"})
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected status 409 got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.increase, "PUT", "/inc/versioned/"+id, map[string]interface{}{"field": "views", "range": 1})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.get, "GET", "/db/versioned/"+id, nil)
+	if etag := resp.Header.Get("ETag"); etag != `"3"` {
+		t.Errorf(`expected the increase to bump the version to "3" got %s`, etag)
+	}
+	resp.Body.Close()
+
+	newID := primitive.NewObjectID().Hex()
+	resp = dbReq(t, database.update, "PUT", "/db/versioned/"+newID, map[string]interface{}{"title": "new"})
+	if resp.StatusCode == http.StatusOK {
+		t.Error("expected updating a missing document to fail without upsert")
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.update, "PUT", "/db/versioned/"+newID+"?upsert=1", map[string]interface{}{"title": "new"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var upserted map[string]interface{}
+	if err := parseBody(resp.Body, &upserted); err != nil {
+		t.Fatal(err)
+	} else if upserted["id"] != newID || upserted["title"] != "new" {
+		t.Errorf("expected the upserted document got %v", upserted)
+	}
+}
+
+func TestDBUpdateOperators(t *testing.T) {
+	resp := dbReq(t, database.add, "POST", "/db/operators", map[string]interface{}{
+		"tags":  []string{"a", "b"},
+		"old":   "value",
+		"draft": true,
+	})
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var created map[string]interface{}
+	if err := parseBody(resp.Body, &created); err != nil {
+		t.Fatal(err)
+	}
+
+	id := created["id"].(string)
+
+	resp = dbReq(t, database.update, "PUT", "/db/operators/"+id+"?operators=1", map[string]interface{}{
+		"$push":     map[string]interface{}{"log": map[string]interface{}{"$each": []string{"x", "y"}}},
+		"$addToSet": map[string]interface{}{"tags": "a"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.update, "PUT", "/db/operators/"+id+"?operators=1", map[string]interface{}{
+		"$pull":   map[string]interface{}{"log": "x"},
+		"$unset":  map[string]interface{}{"draft": ""},
+		"$rename": map[string]interface{}{"old": "new"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var updated map[string]interface{}
+	if err := parseBody(resp.Body, &updated); err != nil {
+		t.Fatal(err)
+	}
+
+	if tags, ok := updated["tags"].([]interface{}); !ok || len(tags) != 2 {
+		t.Errorf("expected tags to stay a, b got %v", updated["tags"])
+	} else if log, ok := updated["log"].([]interface{}); !ok || len(log) != 1 || log[0] != "y" {
+		t.Errorf("expected log to be [y] got %v", updated["log"])
+	} else if _, ok := updated["draft"]; ok {
+		t.Errorf("expected draft to be removed got %v", updated)
+	} else if updated["new"] != "value" {
+		t.Errorf("expected old to be renamed to new got %v", updated)
+	} else if fmt.Sprint(updated[internal.FieldVersion]) != "3" {
+		t.Errorf("expected version 3 got %v", updated[internal.FieldVersion])
+	}
+
+	invalids := []map[string]interface{}{
+		{"$set": map[string]interface{}{internal.FieldAccountID: "other"}},
+		{"$unset": map[string]interface{}{internal.FieldOwnerID: ""}},
+		{"$rename": map[string]interface{}{"new": internal.FieldOwnerID}},
+		{"$inc": map[string]interface{}{internal.FieldVersion: 10}},
+		{"$where": map[string]interface{}{"new": "1"}},
+		{"$inc": map[string]interface{}{"count": "one"}},
+	}
+	for _, ops := range invalids {
+		resp := dbReq(t, database.update, "PUT", "/db/operators/"+id+"?operators=1", ops)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400 for %v got %s", ops, resp.Status)
+		}
+		resp.Body.Close()
+	}
+}
@@ -1,7 +1,6 @@
 package staticbackend
 
 import (
-	"context"
 	"net/http"
 	"staticbackend/internal"
 	"staticbackend/middleware"
@@ -50,8 +49,7 @@ func submitForm(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
-	if _, err := db.Collection("sb_forms").InsertOne(ctx, doc); err != nil {
+	if err := db.InsertOne("sb_forms", doc); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
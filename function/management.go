@@ -1,14 +1,11 @@
 package function
 
 import (
-	"context"
 	"staticbackend/internal"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // ExecData represents a server-side function with its name, code and execution
@@ -34,26 +31,20 @@ type ExecHistory struct {
 	Output    []string  `bson:"out" json:"output"`
 }
 
-func Add(db *mongo.Database, data ExecData) (string, error) {
+func Add(db internal.Database, data ExecData) (string, error) {
 	data.ID = primitive.NewObjectID()
 	data.Version = 1
 	data.LastUpdated = time.Now()
 	data.History = make([]ExecHistory, 0)
 
-	ctx := context.Background()
-	res, err := db.Collection("sb_functions").InsertOne(ctx, data)
-	if err != nil {
+	if err := db.InsertOne("sb_functions", data); err != nil {
 		return "", err
 	}
 
-	oid, ok := res.InsertedID.(primitive.ObjectID)
-	if !ok {
-		return "", nil
-	}
-	return oid.Hex(), nil
+	return data.ID.Hex(), nil
 }
 
-func Update(db *mongo.Database, id, code, trigger string) error {
+func Update(db internal.Database, id, code, trigger string) error {
 	oid, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		return err
@@ -65,35 +56,37 @@ func Update(db *mongo.Database, id, code, trigger string) error {
 	}
 	filter := bson.M{internal.FieldID: oid}
 
-	ctx := context.Background()
-	res := db.Collection("sb_functions").FindOneAndUpdate(ctx, filter, update)
-	if err := res.Err(); err != nil {
+	res, err := db.UpdateOne("sb_functions", filter, update)
+	if err != nil {
 		return err
+	} else if res.MatchedCount == 0 {
+		return internal.ErrNotFound
 	}
 
 	return nil
 }
 
-func GetForExecution(db *mongo.Database, name string) (ExecData, error) {
+func GetForExecution(db internal.Database, name string) (ExecData, error) {
 	var result ExecData
 
 	filter := bson.M{"name": name}
 
-	ctx := context.Background()
-	opt := &options.FindOneOptions{}
-	opt.SetProjection(bson.M{"h": false})
+	opt := internal.FindOptions{
+		Limit:      1,
+		Projection: bson.M{"h": false},
+	}
 
-	sr := db.Collection("sb_functions").FindOne(ctx, filter, opt)
-	if err := sr.Decode(&result); err != nil {
-		return result, err
-	} else if err := sr.Err(); err != nil {
+	var results []ExecData
+	if err := db.Find("sb_functions", filter, opt, &results); err != nil {
 		return result, err
+	} else if len(results) == 0 {
+		return result, internal.ErrNotFound
 	}
 
-	return result, nil
+	return results[0], nil
 }
 
-func GetByID(db *mongo.Database, id string) (ExecData, error) {
+func GetByID(db internal.Database, id string) (ExecData, error) {
 	var result ExecData
 
 	oid, err := primitive.ObjectIDFromHex(id)
@@ -103,105 +96,70 @@ func GetByID(db *mongo.Database, id string) (ExecData, error) {
 
 	filter := bson.M{internal.FieldID: oid}
 
-	ctx := context.Background()
-	sr := db.Collection("sb_functions").FindOne(ctx, filter)
-	if err := sr.Decode(&result); err != nil {
-		return result, err
-	} else if err := sr.Err(); err != nil {
+	if err := db.FindOne("sb_functions", filter, &result); err != nil {
 		return result, err
 	}
 
 	return result, nil
 }
 
-func GetByName(db *mongo.Database, name string) (ExecData, error) {
+func GetByName(db internal.Database, name string) (ExecData, error) {
 	var result ExecData
 
 	filter := bson.M{"name": name}
 
-	ctx := context.Background()
-	sr := db.Collection("sb_functions").FindOne(ctx, filter)
-	if err := sr.Decode(&result); err != nil {
-		return result, err
-	} else if err := sr.Err(); err != nil {
+	if err := db.FindOne("sb_functions", filter, &result); err != nil {
 		return result, err
 	}
 
 	return result, nil
 }
 
-func List(db *mongo.Database) ([]ExecData, error) {
-	opt := &options.FindOptions{}
-	opt.SetProjection(bson.M{"h": 0})
-
-	ctx := context.Background()
-	cur, err := db.Collection("sb_functions").Find(ctx, bson.M{}, opt)
-	if err != nil {
-		return nil, err
-	}
-	defer cur.Close(ctx)
+func List(db internal.Database) ([]ExecData, error) {
+	opt := internal.FindOptions{Projection: bson.M{"h": 0}}
 
 	var results []ExecData
-	for cur.Next(ctx) {
-		var ed ExecData
-		err := cur.Decode(&ed)
-		if err != nil {
-			return nil, err
-		}
-
-		results = append(results, ed)
+	if err := db.Find("sb_functions", bson.M{}, opt, &results); err != nil {
+		return nil, err
 	}
 
 	return results, nil
 }
 
-func ListByTrigger(db *mongo.Database, trigger string) ([]ExecData, error) {
-	opt := &options.FindOptions{}
-	opt.SetProjection(bson.M{"h": 0})
+func ListByTrigger(db internal.Database, trigger string) ([]ExecData, error) {
+	opt := internal.FindOptions{Projection: bson.M{"h": 0}}
 
 	filter := bson.M{"tr": trigger}
-	ctx := context.Background()
-	cur, err := db.Collection("sb_functions").Find(ctx, filter, opt)
-	if err != nil {
-		return nil, err
-	}
-	defer cur.Close(ctx)
 
 	var results []ExecData
-	for cur.Next(ctx) {
-		var ed ExecData
-		err := cur.Decode(&ed)
-		if err != nil {
-			return nil, err
-		}
-
-		results = append(results, ed)
+	if err := db.Find("sb_functions", filter, opt, &results); err != nil {
+		return nil, err
 	}
 
 	return results, nil
 }
 
-func Delete(db *mongo.Database, name string) error {
+func Delete(db internal.Database, name string) error {
 	filter := bson.M{"name": name}
 
-	ctx := context.Background()
-	if _, err := db.Collection("sb_functions").DeleteOne(ctx, filter); err != nil {
+	if _, err := db.DeleteOne("sb_functions", filter); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func Ran(db *mongo.Database, id primitive.ObjectID, rh ExecHistory) error {
+func Ran(db internal.Database, id primitive.ObjectID, rh ExecHistory) error {
 	filter := bson.M{internal.FieldID: id}
 	update := bson.M{
 		"$set":  bson.M{"lr": time.Now()},
 		"$push": bson.M{"h": rh},
 	}
-	ctx := context.Background()
-	res := db.Collection("sb_functions").FindOneAndUpdate(ctx, filter, update)
-	if err := res.Err(); err != nil {
+	res, err := db.UpdateOne("sb_functions", filter, update)
+	if err != nil {
 		return err
+	} else if res.MatchedCount == 0 {
+		return internal.ErrNotFound
 	}
 	return nil
 }
@@ -12,17 +12,21 @@ import (
 
 	"github.com/dop251/goja"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type ExecutionEnvironment struct {
 	Auth     internal.Auth
-	DB       *mongo.Database
+	DB       internal.Database
 	Base     *db.Base
 	Volatile internal.PubSuber
 	Data     ExecData
 
 	CurrentRun ExecHistory
+
+	// inTx is set while running a transaction and txErr is the error of its
+	// first failed operation.
+	inTx  bool
+	txErr error
 }
 
 type Result struct {
@@ -134,7 +138,10 @@ func (env *ExecutionEnvironment) addDatabaseFunctions(vm *goja.Runtime) {
 		}
 
 		doc, err := env.Base.Add(env.Auth, env.DB, col, doc)
-		if err != nil {
+		env.txFailed(err)
+		if ve, ok := db.IsValidationError(err); ok {
+			return vm.ToValue(Result{Content: ve})
+		} else if err != nil {
 			return vm.ToValue(Result{Content: fmt.Sprintf("error calling create(): %s", err.Error())})
 		}
 
@@ -160,6 +167,10 @@ func (env *ExecutionEnvironment) addDatabaseFunctions(vm *goja.Runtime) {
 				if err := vm.ExportTo(v, &params); err != nil {
 					return vm.ToValue(Result{Content: "the second argument should be an object"})
 				}
+				// embedded structs are not filled by ExportTo
+				if err := vm.ExportTo(v, &params.ReadParams); err != nil {
+					return vm.ToValue(Result{Content: "the second argument should be an object"})
+				}
 			}
 		}
 
@@ -177,8 +188,8 @@ func (env *ExecutionEnvironment) addDatabaseFunctions(vm *goja.Runtime) {
 		return vm.ToValue(Result{OK: true, Content: result})
 	})
 	vm.Set("getById", func(call goja.FunctionCall) goja.Value {
-		if len(call.Arguments) != 2 {
-			return vm.ToValue(Result{Content: "argument missmatch: you need 2 arguments for get(col, id)"})
+		if len(call.Arguments) < 2 {
+			return vm.ToValue(Result{Content: "argument missmatch: you need at least 2 arguments for get(col, id, [params])"})
 		}
 		var col, id string
 		if err := vm.ExportTo(call.Argument(0), &col); err != nil {
@@ -188,7 +199,17 @@ func (env *ExecutionEnvironment) addDatabaseFunctions(vm *goja.Runtime) {
 			return vm.ToValue(Result{Content: "the second argument should be a string"})
 		}
 
-		doc, err := env.Base.GetByID(env.Auth, env.DB, col, id)
+		var params db.ReadParams
+		if len(call.Arguments) >= 3 {
+			v := call.Argument(2)
+			if !goja.IsNull(v) && !goja.IsUndefined(v) {
+				if err := vm.ExportTo(v, &params); err != nil {
+					return vm.ToValue(Result{Content: "the third argument should be an object"})
+				}
+			}
+		}
+
+		doc, err := env.Base.GetByID(env.Auth, env.DB, col, id, params)
 		if err != nil {
 			return vm.ToValue(Result{Content: fmt.Sprintf("error calling get(): %s", err.Error())})
 		}
@@ -224,6 +245,10 @@ func (env *ExecutionEnvironment) addDatabaseFunctions(vm *goja.Runtime) {
 				if err := vm.ExportTo(v, &params); err != nil {
 					return vm.ToValue(Result{Content: "the second argument should be an object"})
 				}
+				// embedded structs are not filled by ExportTo
+				if err := vm.ExportTo(v, &params.ReadParams); err != nil {
+					return vm.ToValue(Result{Content: "the second argument should be an object"})
+				}
 			}
 		}
 
@@ -240,9 +265,99 @@ func (env *ExecutionEnvironment) addDatabaseFunctions(vm *goja.Runtime) {
 
 		return vm.ToValue(Result{OK: true, Content: result})
 	})
-	vm.Set("update", func(call goja.FunctionCall) goja.Value {
+	vm.Set("search", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 2 {
+			return vm.ToValue(Result{Content: "argument missmatch: you need at least 2 arguments for search(col, text, [filter], [params])"})
+		}
+		var col, text string
+		if err := vm.ExportTo(call.Argument(0), &col); err != nil {
+			return vm.ToValue(Result{Content: "the first argument should be a string"})
+		}
+		if err := vm.ExportTo(call.Argument(1), &text); err != nil {
+			return vm.ToValue(Result{Content: "the second argument should be a string"})
+		}
+
+		var clauses [][]interface{}
+		if len(call.Arguments) >= 3 {
+			v := call.Argument(2)
+			if !goja.IsNull(v) && !goja.IsUndefined(v) {
+				if err := vm.ExportTo(v, &clauses); err != nil {
+					return vm.ToValue(Result{Content: "the third argument should be a query filter: [['field', '==', 'value'], ...]"})
+				}
+			}
+		}
+
+		filter, err := db.ParseQuery(clauses)
+		if err != nil {
+			return vm.ToValue(Result{Content: fmt.Sprintf("error parsing query filter: %v", err)})
+		}
+
+		var params db.SearchParams
+		if len(call.Arguments) >= 4 {
+			v := call.Argument(3)
+			if !goja.IsNull(v) && !goja.IsUndefined(v) {
+				if err := vm.ExportTo(v, &params); err != nil {
+					return vm.ToValue(Result{Content: "the fourth argument should be an object: {page, size, highlight}"})
+				}
+			}
+		}
+		params.Text = text
+
+		result, err := env.Base.Search(env.Auth, env.DB, col, filter, params)
+		if err != nil {
+			return vm.ToValue(Result{Content: fmt.Sprintf("error executing search: %v", err)})
+		}
+
+		for _, hit := range result.Results {
+			if err := env.clean(hit.Doc); err != nil {
+				return vm.ToValue(Result{Content: fmt.Sprintf("error cleaning doc: %v", err)})
+			}
+		}
+
+		return vm.ToValue(Result{OK: true, Content: result})
+	})
+	vm.Set("aggregate", func(call goja.FunctionCall) goja.Value {
 		if len(call.Arguments) != 3 {
-			return vm.ToValue(Result{Content: "argument missmatch: you need 3 arguments for update(col, id, doc)"})
+			return vm.ToValue(Result{Content: "argument missmatch: you need 3 arguments for aggregate(col, filter, {groupBy, accumulators})"})
+		}
+		var col string
+		if err := vm.ExportTo(call.Argument(0), &col); err != nil {
+			return vm.ToValue(Result{Content: "the first argument should be a string"})
+		}
+		var clauses [][]interface{}
+		if err := vm.ExportTo(call.Argument(1), &clauses); err != nil {
+			return vm.ToValue(Result{Content: "the second argument should be a query filter: [['field', '==', 'value'], ...]"})
+		}
+
+		filter, err := db.ParseQuery(clauses)
+		if err != nil {
+			return vm.ToValue(Result{Content: fmt.Sprintf("error parsing query filter: %v", err)})
+		}
+
+		var opt internal.AggregateOptions
+		if err := vm.ExportTo(call.Argument(2), &opt); err != nil {
+			return vm.ToValue(Result{Content: "the third argument should be an object: {groupBy: [{field: 'status'}], accumulators: [{op: 'count'}]}"})
+		}
+
+		results, err := env.Base.Aggregate(env.Auth, env.DB, col, filter, opt)
+		if err != nil {
+			return vm.ToValue(Result{Content: fmt.Sprintf("error executing aggregate: %v", err)})
+		}
+
+		// ids used as group keys are returned as string
+		for _, doc := range results {
+			for k, v := range doc {
+				if oid, ok := v.(primitive.ObjectID); ok {
+					doc[k] = oid.Hex()
+				}
+			}
+		}
+
+		return vm.ToValue(Result{OK: true, Content: results})
+	})
+	vm.Set("update", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 3 {
+			return vm.ToValue(Result{Content: "argument missmatch: you need at least 3 arguments for update(col, id, doc, [options])"})
 		}
 
 		var col, id string
@@ -258,8 +373,21 @@ func (env *ExecutionEnvironment) addDatabaseFunctions(vm *goja.Runtime) {
 			return vm.ToValue(Result{Content: fmt.Sprintf("error executing update: %v", err)})
 		}
 
-		updated, err := env.Base.Update(env.Auth, env.DB, col, id, doc)
-		if err != nil {
+		var opt db.UpdateOptions
+		if len(call.Arguments) >= 4 {
+			v := call.Argument(3)
+			if !goja.IsNull(v) && !goja.IsUndefined(v) {
+				if err := vm.ExportTo(v, &opt); err != nil {
+					return vm.ToValue(Result{Content: "the fourth argument should be an object"})
+				}
+			}
+		}
+
+		updated, err := env.Base.Update(env.Auth, env.DB, col, id, doc, opt)
+		env.txFailed(err)
+		if ve, ok := db.IsValidationError(err); ok {
+			return vm.ToValue(Result{Content: ve})
+		} else if err != nil {
 			return vm.ToValue(Result{Content: fmt.Sprintf("error executing update: %v", err)})
 		}
 
@@ -283,15 +411,94 @@ func (env *ExecutionEnvironment) addDatabaseFunctions(vm *goja.Runtime) {
 		}
 
 		deleted, err := env.Base.Delete(env.Auth, env.DB, col, id)
+		env.txFailed(err)
 		if err != nil {
 			return vm.ToValue(Result{Content: fmt.Sprintf("error executing del: %v", err)})
 		}
 
 		return vm.ToValue(Result{OK: true, Content: deleted})
 	})
+	vm.Set("increase", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) != 4 {
+			return vm.ToValue(Result{Content: "argument missmatch: you need 4 arguments for increase(col, id, field, n)"})
+		}
+
+		var col, id, field string
+		var n int
+		if err := vm.ExportTo(call.Argument(0), &col); err != nil {
+			return vm.ToValue(Result{Content: "the first argument should be a string"})
+		}
+		if err := vm.ExportTo(call.Argument(1), &id); err != nil {
+			return vm.ToValue(Result{Content: "the second argument should be a string"})
+		}
+		if err := vm.ExportTo(call.Argument(2), &field); err != nil {
+			return vm.ToValue(Result{Content: "the third argument should be a string"})
+		}
+		if err := vm.ExportTo(call.Argument(3), &n); err != nil {
+			return vm.ToValue(Result{Content: "the fourth argument should be a number"})
+		}
+
+		err := env.Base.Increase(env.Auth, env.DB, col, id, field, n)
+		env.txFailed(err)
+		if ve, ok := db.IsValidationError(err); ok {
+			return vm.ToValue(Result{Content: ve})
+		} else if err != nil {
+			return vm.ToValue(Result{Content: fmt.Sprintf("error executing increase: %v", err)})
+		}
+
+		return vm.ToValue(Result{OK: true, Content: true})
+	})
+	vm.Set("transaction", func(call goja.FunctionCall) goja.Value {
+		fn, ok := goja.AssertFunction(call.Argument(0))
+		if !ok {
+			return vm.ToValue(Result{Content: "the argument should be a function: transaction(fn)"})
+		} else if env.inTx {
+			return vm.ToValue(Result{Content: "transactions cannot be nested"})
+		}
+
+		base, curDB := env.Base, env.DB
+		defer func() {
+			env.Base, env.DB = base, curDB
+			env.inTx, env.txErr = false, nil
+		}()
+
+		// the database functions called by fn run in the transaction, it's
+		// rolled back if fn throws or one of them fails
+		var ret goja.Value
+		err := base.Transaction(curDB, func(tb *db.Base, tx internal.Database) error {
+			env.Base, env.DB = tb, tx
+			env.inTx, env.txErr = true, nil
+
+			v, err := fn(goja.Undefined())
+			if err != nil {
+				return err
+			} else if env.txErr != nil {
+				return env.txErr
+			}
+
+			ret = v
+			return nil
+		})
+		if err != nil {
+			return vm.ToValue(Result{Content: fmt.Sprintf("transaction rolled back: %v", err)})
+		}
+
+		var content interface{}
+		if ret != nil {
+			content = ret.Export()
+		}
+		return vm.ToValue(Result{OK: true, Content: content})
+	})
+}
+
+// txFailed records the error of an operation made in a transaction
+func (env *ExecutionEnvironment) txFailed(err error) {
+	if env.inTx && env.txErr == nil && err != nil {
+		env.txErr = err
+	}
 }
 
-func (*ExecutionEnvironment) clean(doc map[string]interface{}) error {
+func (env *ExecutionEnvironment) clean(doc map[string]interface{}) error {
 	if id, ok := doc["id"]; ok {
 		oid, ok := id.(primitive.ObjectID)
 		if !ok {
@@ -308,6 +515,24 @@ func (*ExecutionEnvironment) clean(doc map[string]interface{}) error {
 		doc[internal.FieldAccountID] = oid.Hex()
 	}
 
+	// expanded documents
+	for _, v := range doc {
+		switch x := v.(type) {
+		case primitive.M:
+			if err := env.clean(x); err != nil {
+				return err
+			}
+		case []interface{}:
+			for _, item := range x {
+				if ref, ok := item.(primitive.M); ok {
+					if err := env.clean(ref); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
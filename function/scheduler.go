@@ -1,22 +1,28 @@
 package function
 
 import (
-	"context"
+	"fmt"
 	"log"
 	"staticbackend/db"
 	"staticbackend/internal"
+	"sync"
 	"time"
 
 	"github.com/go-co-op/gocron"
+	"github.com/robfig/cron/v3"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type TaskScheduler struct {
-	Client    *mongo.Client
-	Volatile  internal.PubSuber
+	Client   internal.Persister
+	Volatile internal.PubSuber
+	// Base runs the database functions of the tasks, it publishes the
+	// realtime events the same way as the API
+	Base      *db.Base
 	Scheduler *gocron.Scheduler
+
+	mu sync.Mutex
 }
 
 const (
@@ -41,24 +47,85 @@ type MetaMessage struct {
 	Channel string `bson:"channel" json:"channel"`
 }
 
+// MetaMessage returns the task's meta data as a MetaMessage. The meta data
+// comes back from the database as a generic document and needs conversion.
+func (t Task) MetaMessage() (MetaMessage, error) {
+	var meta MetaMessage
+
+	switch v := t.Meta.(type) {
+	case nil:
+		return meta, fmt.Errorf("no meta data for this task")
+	case MetaMessage:
+		return v, nil
+	}
+
+	b, err := bson.Marshal(t.Meta)
+	if err != nil {
+		return meta, err
+	}
+
+	err = bson.Unmarshal(b, &meta)
+	return meta, err
+}
+
+// Start loads all tasks from all active bases and starts the scheduler.
+// Tasks can be added, rescheduled or removed afterwards via Schedule and
+// Unschedule without restarting.
 func (ts *TaskScheduler) Start() {
+	ts.Scheduler = gocron.NewScheduler(time.UTC)
+	ts.Scheduler.TagsUnique()
+	ts.Scheduler.StartAsync()
+
 	tasks, err := ts.listTasks()
 	if err != nil {
 		log.Println("error loading tasks: ", err)
 		return
 	}
 
-	ts.Scheduler = gocron.NewScheduler(time.UTC)
-	ts.Scheduler.TagsUnique()
-
 	for _, task := range tasks {
-		_, err := ts.Scheduler.Cron(task.Interval).Tag(task.ID.Hex()).Do(ts.run, task)
-		if err != nil {
+		if err := ts.Schedule(task); err != nil {
 			log.Printf("error scheduling this task: %s -> %v\n", task.ID.Hex(), err)
 		}
 	}
 }
 
+// Schedule adds the task to the scheduler, replacing the job previously
+// scheduled for this task if any.
+func (ts *TaskScheduler) Schedule(task Task) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.Scheduler == nil {
+		return fmt.Errorf("the task scheduler is not started")
+	}
+
+	// gocron keeps the unique tag of a job that failed to schedule, so the
+	// interval is validated before replacing the current job
+	if _, err := cron.ParseStandard(task.Interval); err != nil {
+		return err
+	}
+
+	// RemoveByTag returns an error when the task was not scheduled yet
+	_ = ts.Scheduler.RemoveByTag(task.ID.Hex())
+
+	if _, err := ts.Scheduler.Cron(task.Interval).Tag(task.ID.Hex()).Do(ts.run, task); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Unschedule removes the task's job from the scheduler.
+func (ts *TaskScheduler) Unschedule(id string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.Scheduler == nil {
+		return fmt.Errorf("the task scheduler is not started")
+	}
+
+	return ts.Scheduler.RemoveByTag(id)
+}
+
 func (ts *TaskScheduler) listTasks() ([]Task, error) {
 	bases, err := internal.ListDatabases(ts.Client.Database("sbsys"))
 	if err != nil {
@@ -70,32 +137,18 @@ func (ts *TaskScheduler) listTasks() ([]Task, error) {
 	//TODO: Might be worth doing this concurrently
 	var results []Task
 
-	ctx := context.Background()
-
 	for _, base := range bases {
 		db := ts.Client.Database(base.Name)
-		cur, err := db.Collection("sb_tasks").Find(ctx, filter)
-		if err != nil {
-			return nil, err
-		}
-		defer cur.Close(ctx)
 
 		var tasks []Task
-
-		for cur.Next(ctx) {
-			var t Task
-			if err := cur.Decode(&t); err != nil {
-				return nil, err
-			}
-
-			t.BaseName = base.Name
-
-			tasks = append(tasks, t)
-		}
-		if err := cur.Err(); err != nil {
+		if err := db.Find("sb_tasks", filter, internal.FindOptions{}, &tasks); err != nil {
 			return nil, err
 		}
 
+		for i := range tasks {
+			tasks[i].BaseName = base.Name
+		}
+
 		results = append(results, tasks...)
 	}
 
@@ -134,9 +187,13 @@ func (ts *TaskScheduler) run(task Task) {
 	case TaskTypeMessage:
 		ts.sendMessage(curDB, auth, task)
 	}
+
+	if err := TaskRan(curDB, task.ID); err != nil {
+		log.Println("error updating task last run: ", err)
+	}
 }
 
-func (ts *TaskScheduler) execFunction(curDB *mongo.Database, auth internal.Auth, task Task) {
+func (ts *TaskScheduler) execFunction(curDB internal.Database, auth internal.Auth, task Task) {
 
 	fn, err := GetForExecution(curDB, task.Value)
 	if err != nil {
@@ -147,7 +204,7 @@ func (ts *TaskScheduler) execFunction(curDB *mongo.Database, auth internal.Auth,
 	exe := &ExecutionEnvironment{
 		Auth:     auth,
 		DB:       curDB,
-		Base:     &db.Base{PublishDocument: ts.Volatile.PublishDocument},
+		Base:     ts.Base,
 		Volatile: ts.Volatile,
 		Data:     fn,
 	}
@@ -157,12 +214,12 @@ func (ts *TaskScheduler) execFunction(curDB *mongo.Database, auth internal.Auth,
 	}
 }
 
-func (ts *TaskScheduler) sendMessage(curDB *mongo.Database, auth internal.Auth, task Task) {
+func (ts *TaskScheduler) sendMessage(curDB internal.Database, auth internal.Auth, task Task) {
 	token := auth.ReconstructToken()
 
-	meta, ok := task.Meta.(MetaMessage)
-	if !ok {
-		log.Println("unable to get meta data for type MetaMessage for task: ", task.ID.Hex())
+	meta, err := task.MetaMessage()
+	if err != nil {
+		log.Println("unable to get meta data for type MetaMessage for task: ", task.ID.Hex(), err)
 		return
 	}
 
@@ -0,0 +1,104 @@
+package function
+
+import (
+	"staticbackend/internal"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func AddTask(db internal.Database, task Task) (string, error) {
+	task.ID = primitive.NewObjectID()
+
+	if err := db.InsertOne("sb_tasks", task); err != nil {
+		return "", err
+	}
+
+	return task.ID.Hex(), nil
+}
+
+func UpdateTask(db internal.Database, task Task) error {
+	update := bson.M{
+		"$set": bson.M{
+			"name":     task.Name,
+			"type":     task.Type,
+			"value":    task.Value,
+			"meta":     task.Meta,
+			"invertal": task.Interval,
+		},
+	}
+	filter := bson.M{internal.FieldID: task.ID}
+
+	res, err := db.UpdateOne("sb_tasks", filter, update)
+	if err != nil {
+		return err
+	} else if res.MatchedCount == 0 {
+		return internal.ErrNotFound
+	}
+
+	return nil
+}
+
+func GetTaskByID(db internal.Database, id string) (Task, error) {
+	var result Task
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return result, err
+	}
+
+	filter := bson.M{internal.FieldID: oid}
+
+	if err := db.FindOne("sb_tasks", filter, &result); err != nil {
+		return result, err
+	}
+
+	result.BaseName = db.Name()
+
+	return result, nil
+}
+
+func ListTasks(db internal.Database) ([]Task, error) {
+	opt := internal.FindOptions{Sort: bson.D{{Key: "name", Value: 1}}}
+
+	var results []Task
+	if err := db.Find("sb_tasks", bson.M{}, opt, &results); err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		results[i].BaseName = db.Name()
+	}
+
+	if results == nil {
+		results = make([]Task, 0)
+	}
+
+	return results, nil
+}
+
+func DeleteTask(db internal.Database, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{internal.FieldID: oid}
+
+	if _, err := db.DeleteOne("sb_tasks", filter); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func TaskRan(db internal.Database, id primitive.ObjectID) error {
+	filter := bson.M{internal.FieldID: id}
+	update := bson.M{"$set": bson.M{"last": time.Now()}}
+
+	if _, err := db.UpdateOne("sb_tasks", filter, update); err != nil {
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package staticbackend
 
 import (
+	"fmt"
 	"net/http"
 	"staticbackend/db"
 	"staticbackend/function"
@@ -97,6 +98,11 @@ func (f *functions) exec(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !auth.Allowed("fn:exec:" + data.FunctionName) {
+		http.Error(w, fmt.Sprintf("this API key does not have the fn:exec:%s scope", data.FunctionName), http.StatusForbidden)
+		return
+	}
+
 	curDB := client.Database(conf.Name)
 
 	fn, err := function.GetForExecution(curDB, data.FunctionName)
@@ -105,6 +111,10 @@ func (f *functions) exec(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the key may run the function, it runs with the permissions of the
+	// root user who created the key like scheduled functions
+	auth.APIKeyID, auth.Scopes = "", nil
+
 	env := &function.ExecutionEnvironment{
 		Auth: auth,
 		DB:   curDB,
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"staticbackend/function"
 	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func TestFunctionsExecuteDBOperations(t *testing.T) {
@@ -92,3 +94,48 @@ func TestFunctionsExecuteDBOperations(t *testing.T) {
 		t.Errorf("expected status 200 got %s", execResp.Status)
 	}
 }
+
+func TestFunctionsTransaction(t *testing.T) {
+	code := `
+	function handle(body) {
+		var ok = transaction(function() {
+			create("jstx", {step: 1});
+			create("jstx", {step: 2});
+		});
+		if (!ok.ok) {
+			log("ERROR: committing transaction");
+			log(ok.content);
+		}
+
+		var failed = transaction(function() {
+			create("jstx", {step: 3});
+			update("jstx", "000000000000000000000000", {step: 4});
+		});
+		if (failed.ok) {
+			log("ERROR: expected the transaction to be rolled back");
+		}
+	}`
+	data := function.ExecData{
+		FunctionName: "unittesttx",
+		Code:         code,
+		TriggerTopic: "web",
+	}
+	addResp := dbReq(t, funexec.add, "POST", "/", data, true)
+	if addResp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, addResp))
+	}
+	addResp.Body.Close()
+
+	execResp := dbReq(t, funexec.exec, "POST", "/", data, true)
+	if execResp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, execResp))
+	}
+	execResp.Body.Close()
+
+	count, err := database.client.Database(dbName).Count("jstx", bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Errorf("expected the 2 documents of the committed transaction got %d", count)
+	}
+}
@@ -6,15 +6,18 @@ require (
 	github.com/aws/aws-sdk-go v1.27.2
 	github.com/dop251/goja v0.0.0-20210804101310-32956a348b49
 	github.com/gbrlsnchs/jwt/v3 v3.0.0-rc.1
-	github.com/go-co-op/gocron v1.6.2 // indirect
+	github.com/go-co-op/gocron v1.6.2
 	github.com/go-redis/redis/v8 v8.4.4
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/google/uuid v1.1.4
 	github.com/gorilla/websocket v1.4.2
 	github.com/klauspost/compress v1.13.1 // indirect
+	github.com/lib/pq v1.10.2
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/stripe/stripe-go/v71 v71.44.0
 	github.com/youmark/pkcs8 v0.0.0-20201027041543-1326539a0a0a // indirect
+	go.etcd.io/bbolt v1.3.6
 	go.mongodb.org/mongo-driver v1.7.0
 	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 )
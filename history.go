@@ -0,0 +1,124 @@
+package staticbackend
+
+import (
+	"net/http"
+	"staticbackend/db"
+	"staticbackend/middleware"
+	"strconv"
+)
+
+// audit turns the history of the collections on and off, it's reserved to
+// root users:
+//
+//	GET /audit/ lists the collections with history
+//	PUT /audit/{col} records the changes of the collection's documents
+//	DELETE /audit/{col} stops recording them, the history is kept
+func (database *Database) audit(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := database.client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	col, _ := ShiftPath(r.URL.Path)
+
+	if len(col) == 0 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "missing collection name", http.StatusBadRequest)
+			return
+		}
+
+		cols, err := db.ListHistoryEnabled(curDB)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, cols)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ok, err := db.HistoryEnabled(curDB, col)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, ok)
+	case http.MethodPost, http.MethodPut:
+		if err := db.EnableHistory(curDB, col); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	case http.MethodDelete:
+		if err := db.DisableHistory(curDB, col); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// history returns the version records of a document and reverts it to a
+// previous version:
+//
+//	GET /history/{col}/{id}?page=1&size=25 lists the versions, latest first
+//	POST /history/{col}/{id}/{version} reverts the document to the version
+func (database *Database) history(w http.ResponseWriter, r *http.Request) {
+	conf, auth, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := database.client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	col, rest := ShiftPath(r.URL.Path)
+	id, rest := ShiftPath(rest)
+	version, _ := ShiftPath(rest)
+
+	if len(col) == 0 || len(id) == 0 {
+		http.Error(w, "missing collection name or document id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		page, size := getPagination(r.URL)
+		result, err := database.base.History(auth, curDB, col, id, db.ListParams{Page: page, Size: size})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	case http.MethodPost, http.MethodPut:
+		v, err := strconv.ParseInt(version, 10, 64)
+		if err != nil || v <= 0 {
+			http.Error(w, "invalid version to revert to", http.StatusBadRequest)
+			return
+		}
+
+		doc, err := database.base.Revert(auth, curDB, col, id, v)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		setETag(w, doc)
+		respond(w, http.StatusOK, doc)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
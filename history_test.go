@@ -0,0 +1,184 @@
+package staticbackend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"staticbackend/db"
+	"staticbackend/internal"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestHistory(t *testing.T) {
+	resp := dbReq(t, database.audit, "PUT", "/audit/audited", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.add, "POST", "/db/audited", map[string]interface{}{"title": "v1", "count": 1})
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := parseBody(resp.Body, &created); err != nil {
+		t.Fatal(err)
+	}
+
+	update := map[string]interface{}{"title": "v2", "extra": true}
+	resp = dbReq(t, database.update, "PUT", "/db/audited/"+created.ID, update)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.increase, "PUT", "/inc/audited/"+created.ID, map[string]interface{}{"field": "count", "range": 2})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.history, "GET", "/history/audited/"+created.ID, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var result db.HistoryResult
+	if err := parseBody(resp.Body, &result); err != nil {
+		t.Fatal(err)
+	} else if result.Total != 3 {
+		t.Fatalf("expected 3 versions got %d", result.Total)
+	}
+
+	latest := result.Results[0]
+	if latest.Version != 3 || latest.Op != internal.OpUpdate {
+		t.Errorf("expected the increase as version 3 got %d %s", latest.Version, latest.Op)
+	} else if len(latest.Changes) != 1 || latest.Changes[0].Field != "count" {
+		t.Errorf("expected only count to change got %v", latest.Changes)
+	}
+
+	if changes := result.Results[1].Changes; len(changes) != 2 || changes[0].Field != "extra" || changes[1].Field != "title" {
+		t.Errorf("expected extra and title to change got %v", changes)
+	}
+
+	resp = dbReq(t, database.history, "POST", "/history/audited/"+created.ID+"/1", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var reverted map[string]interface{}
+	if err := parseBody(resp.Body, &reverted); err != nil {
+		t.Fatal(err)
+	} else if reverted["title"] != "v1" {
+		t.Errorf("expected title v1 after the revert got %v", reverted["title"])
+	} else if _, ok := reverted["extra"]; ok {
+		t.Errorf("expected the field added after version 1 to be removed got %v", reverted)
+	} else if reverted[internal.FieldVersion] != float64(4) {
+		t.Errorf("expected the revert to be version 4 got %v", reverted[internal.FieldVersion])
+	}
+
+	resp = dbReq(t, database.history, "POST", "/history/audited/"+created.ID+"/9", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404 reverting to an unknown version got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	// the history is readable only by the users who can read the document
+	curDB := database.client.Database(dbName)
+	other := internal.Auth{AccountID: primitive.NewObjectID(), UserID: primitive.NewObjectID()}
+	if _, err := database.base.History(other, curDB, "audited", created.ID, db.ListParams{}); !errors.Is(err, internal.ErrNotFound) {
+		t.Errorf("expected not found reading another account's history got %v", err)
+	}
+
+	if _, err := database.base.List(other, curDB, db.HistoryCollection, db.ListParams{Page: 1, Size: 25}); !errors.Is(err, internal.ErrPermissionDenied) {
+		t.Errorf("expected permission denied reading the history collection got %v", err)
+	}
+
+	resp = dbReq(t, database.del, "DELETE", "/db/audited/"+created.ID, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	result, err := database.base.History(internal.Auth{Role: internal.RootRole}, curDB, "audited", created.ID, db.ListParams{})
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Total != 5 || result.Results[0].Op != internal.OpDelete {
+		t.Errorf("expected the delete as the 5th record got %d %v", result.Total, result.Results[0])
+	}
+
+	resp = dbReq(t, database.audit, "DELETE", "/audit/audited", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	if ok, err := db.HistoryEnabled(curDB, "audited"); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("expected the history to be turned off")
+	}
+}
+
+func TestHistoryBulk(t *testing.T) {
+	curDB := database.client.Database(dbName)
+	if err := db.EnableHistory(curDB, "auditedbulk"); err != nil {
+		t.Fatal(err)
+	}
+
+	root := internal.Auth{AccountID: primitive.NewObjectID(), UserID: primitive.NewObjectID(), Role: internal.RootRole}
+
+	var ids []string
+	for _, status := range []string{"open", "open", "closed"} {
+		doc, err := database.base.Add(root, curDB, "auditedbulk", map[string]interface{}{"status": status})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, doc["id"].(primitive.ObjectID).Hex())
+	}
+
+	if _, err := database.base.UpdateMany(root, curDB, "auditedbulk", bson.M{"status": "open"}, map[string]interface{}{"status": "done"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := database.base.DeleteMany(root, curDB, "auditedbulk", bson.M{"status": "done"}); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("expected 2 deleted documents got %d", n)
+	}
+
+	expected := map[string][]string{
+		ids[0]: {internal.OpDelete, internal.OpUpdate, internal.OpCreate},
+		ids[1]: {internal.OpDelete, internal.OpUpdate, internal.OpCreate},
+		ids[2]: {internal.OpCreate},
+	}
+
+	for id, ops := range expected {
+		result, err := database.base.History(root, curDB, "auditedbulk", id, db.ListParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, rec := range result.Results {
+			got = append(got, rec.Op)
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(ops) {
+			t.Errorf("expected operations %v for %s got %v", ops, id, got)
+		}
+	}
+
+	result, err := database.base.History(root, curDB, "auditedbulk", ids[0], db.ListParams{})
+	if err != nil {
+		t.Fatal(err)
+	} else if changes := result.Results[1].Changes; len(changes) != 1 || changes[0].Old != "open" || changes[0].New != "done" {
+		t.Errorf("expected status to change from open to done got %v", changes)
+	}
+}
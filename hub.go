@@ -2,7 +2,6 @@ package staticbackend
 
 import (
 	"fmt"
-	"staticbackend/cache"
 	"staticbackend/internal"
 	"strings"
 
@@ -32,10 +31,10 @@ type Hub struct {
 	unregister chan *Socket
 
 	// Cache used for keys and pub/sub (Redis)
-	volatile *cache.Cache
+	volatile internal.PubSuber
 }
 
-func newHub(c *cache.Cache) *Hub {
+func newHub(c internal.PubSuber) *Hub {
 	return &Hub{
 		broadcast:  make(chan internal.Command),
 		register:   make(chan *Socket),
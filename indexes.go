@@ -0,0 +1,84 @@
+package staticbackend
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"staticbackend/db"
+	"staticbackend/internal"
+	"staticbackend/middleware"
+)
+
+// indexes manages the collection indexes, it's reserved to root users:
+//
+//	GET /indexes/{col} lists the collection's indexes
+//	POST /indexes/{col} creates an index
+//	DELETE /indexes/{col}/{name} drops the index
+func (database *Database) indexes(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := database.client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	col, rest := ShiftPath(r.URL.Path)
+	name, _ := ShiftPath(rest)
+
+	if len(col) == 0 {
+		http.Error(w, "missing collection name", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list, err := curDB.ListIndexes(col)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(list) == 0 {
+			list = make([]internal.Index, 0)
+		}
+
+		respond(w, http.StatusOK, list)
+	case http.MethodPost, http.MethodPut:
+		var idx internal.Index
+		if err := json.NewDecoder(r.Body).Decode(&idx); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := db.ValidateIndex(curDB, col, &idx); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := curDB.CreateIndex(col, idx); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusCreated, idx)
+	case http.MethodDelete:
+		if len(name) == 0 {
+			http.Error(w, "missing index name", http.StatusBadRequest)
+			return
+		}
+
+		if err := curDB.DropIndex(col, name); errors.Is(err, internal.ErrNotFound) {
+			http.Error(w, "index not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,99 @@
+package staticbackend
+
+import (
+	"net/http"
+	"staticbackend/internal"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestIndexes(t *testing.T) {
+	resp := dbReq(t, database.indexes, "POST", "/indexes/indexed", internal.Index{}, true)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an index without fields got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	idx := internal.Index{Keys: []internal.IndexKey{{Field: "email"}}, Unique: true}
+	resp = dbReq(t, database.indexes, "POST", "/indexes/indexed", idx, true)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	if err := parseBody(resp.Body, &idx); err != nil {
+		t.Fatal(err)
+	} else if idx.Name != "email_1" {
+		t.Errorf("expected default name email_1 got %s", idx.Name)
+	}
+
+	doc := map[string]interface{}{"email": "unique@test.com"}
+	resp = dbReq(t, database.add, "POST", "/db/indexed", doc)
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.add, "POST", "/db/indexed", doc)
+	if resp.StatusCode < 300 {
+		t.Error("expected the unique index to reject a duplicate email")
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.indexes, "GET", "/indexes/indexed", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var indexes []internal.Index
+	if err := parseBody(resp.Body, &indexes); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]bool)
+	for _, idx := range indexes {
+		names[idx.Name] = true
+	}
+
+	// the permission index is created on the first write
+	for _, name := range []string{"_id_", "sb_account_owner", "email_1"} {
+		if !names[name] {
+			t.Errorf("expected the %s index got %v", name, indexes)
+		}
+	}
+
+	resp = dbReq(t, database.indexes, "DELETE", "/indexes/indexed/email_1", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.indexes, "DELETE", "/indexes/indexed/email_1", nil, true)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404 dropping a missing index got %s", resp.Status)
+	}
+	resp.Body.Close()
+}
+
+func TestIndexesTTL(t *testing.T) {
+	idx := internal.Index{Keys: []internal.IndexKey{{Field: "at"}}, TTL: 60}
+	resp := dbReq(t, database.indexes, "POST", "/indexes/expiring", idx, true)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	curDB := database.client.Database(dbName)
+	for _, at := range []time.Time{time.Now().Add(-2 * time.Hour), time.Now()} {
+		if err := curDB.InsertOne("expiring", bson.M{"at": at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := curDB.Count("expiring", bson.M{}); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("expected the expired document to be removed got %d documents", n)
+	}
+}
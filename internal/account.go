@@ -1,7 +1,6 @@
 package internal
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"strings"
@@ -10,7 +9,6 @@ import (
 	"github.com/gbrlsnchs/jwt/v3"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // Auth represents an authenticated user.
@@ -20,6 +18,21 @@ type Auth struct {
 	Email     string
 	Role      int
 	Token     string
+	// Attributes are set by root users and used by permission rules
+	Attributes map[string]interface{}
+	// SessionID is the session of the access token, empty for tokens
+	// issued without one
+	SessionID string `json:"-"`
+	// APIKeyID is set when the request is made with an API key, it's limited
+	// to the key's Scopes
+	APIKeyID string   `json:"-"`
+	Scopes   []string `json:"-"`
+}
+
+// Allowed returns true if the request can use the permission, requests not
+// made with an API key are not limited by scopes
+func (auth Auth) Allowed(permission string) bool {
+	return len(auth.APIKeyID) == 0 || ScopeAllows(auth.Scopes, permission)
 }
 
 func (auth Auth) ReconstructToken() string {
@@ -33,12 +46,10 @@ func (auth Auth) ReconstructToken() string {
 type JWTPayload struct {
 	jwt.Payload
 	Token string `json:"token,omitempty"`
+	// Session is the id of the session the token was issued for
+	Session string `json:"sid,omitempty"`
 }
 
-var (
-	ctx = context.Background()
-)
-
 type Account struct {
 	ID    primitive.ObjectID `bson:"_id" json:"id"`
 	Email string             `bson:"email" json:"email"`
@@ -52,6 +63,21 @@ type Token struct {
 	Password  string             `bson:"pw" json:"-"`
 	Role      int                `bson:"role" json:"role"`
 	ResetCode string             `bson:"resetCode" json:"-"`
+	// Attributes are set by root users and used by permission rules
+	Attributes map[string]interface{} `bson:"attrs" json:"attributes"`
+	// Identities are the subjects of the user at the OAuth providers
+	Identities map[string]string `bson:"identities,omitempty" json:"identities,omitempty"`
+	// Unverified is true until the user confirms their email, when the base
+	// verifies emails
+	Unverified bool `bson:"unverified,omitempty" json:"unverified,omitempty"`
+	// TOTPSecret is set when the user signs in with a second factor
+	TOTPSecret string `bson:"totp,omitempty" json:"-"`
+	// RecoveryCodes are the hashes of the codes the user may use once
+	// instead of a TOTP code
+	RecoveryCodes []string `bson:"recovery,omitempty" json:"-"`
+	// TOTPStep is the time step of the last TOTP code used, a code cannot
+	// be used twice
+	TOTPStep int64 `bson:"totpStep,omitempty" json:"-"`
 }
 
 type Login struct {
@@ -69,58 +95,54 @@ type Customer struct {
 	Created          time.Time          `bson:"created" json:"created"`
 }
 
-func EmailExists(db *mongo.Database, email string) (bool, error) {
-	count, err := db.Collection("accounts").CountDocuments(ctx, bson.M{"email": email})
+func EmailExists(db Database, email string) (bool, error) {
+	count, err := db.Count("accounts", bson.M{"email": email})
 	if err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
 
-func FindToken(db *mongo.Database, id primitive.ObjectID, token string) (tok Token, err error) {
-	sr := db.Collection("sb_tokens").FindOne(ctx, bson.M{FieldID: id, FieldToken: token})
-	err = sr.Decode(&tok)
+func FindToken(db Database, id primitive.ObjectID, token string) (tok Token, err error) {
+	err = db.FindOne("sb_tokens", bson.M{FieldID: id, FieldToken: token}, &tok)
 	return
 }
 
-func FindRootToken(db *mongo.Database, id, accountID primitive.ObjectID, token string) (tok Token, err error) {
+func FindRootToken(db Database, id, accountID primitive.ObjectID, token string) (tok Token, err error) {
 	filter := bson.M{
 		FieldID:        id,
 		FieldAccountID: accountID,
 		FieldToken:     token,
 	}
-	sr := db.Collection("sb_tokens").FindOne(ctx, filter)
-	err = sr.Decode(&tok)
+	err = db.FindOne("sb_tokens", filter, &tok)
 	return
 }
 
-func GetRootForBase(db *mongo.Database) (tok Token, err error) {
+func GetRootForBase(db Database) (tok Token, err error) {
 	filter := bson.M{
-		FieldRole: 100,
+		FieldRole: RootRole,
 	}
-	sr := db.Collection("sb_tokens").FindOne(ctx, filter)
-	err = sr.Decode(&tok)
+	err = db.FindOne("sb_tokens", filter, &tok)
 	return
 }
 
-func FindTokenByEmail(db *mongo.Database, email string) (tok Token, err error) {
-	sr := db.Collection("sb_tokens").FindOne(ctx, bson.M{"email": email})
-	err = sr.Decode(&tok)
+func FindTokenByEmail(db Database, email string) (tok Token, err error) {
+	err = db.FindOne("sb_tokens", bson.M{"email": email}, &tok)
 	return
 }
 
-func SetPasswordResetCode(db *mongo.Database, id primitive.ObjectID, code string) error {
+func SetPasswordResetCode(db Database, id primitive.ObjectID, code string) error {
 	update := bson.M{"$set": bson.M{"resetCode": code}}
-	if _, err := db.Collection("sb_tokens").UpdateByID(ctx, id, update); err != nil {
+	if _, err := db.UpdateOne("sb_tokens", bson.M{FieldID: id}, update); err != nil {
 		return err
 	}
 	return nil
 }
 
-func ResetPassword(db *mongo.Database, email, code, password string) error {
+func ResetPassword(db Database, email, code, password string) error {
 	filter := bson.M{"email": email, "resetCode": code}
 	update := bson.M{"$set": bson.M{"pw": password}}
-	res, err := db.Collection("sb_tokens").UpdateOne(ctx, filter, update)
+	res, err := db.UpdateOne("sb_tokens", filter, update)
 	if err != nil {
 		return err
 	} else if res.ModifiedCount != 1 {
@@ -129,63 +151,44 @@ func ResetPassword(db *mongo.Database, email, code, password string) error {
 	return nil
 }
 
-func FindAccount(db *mongo.Database, accountID primitive.ObjectID) (cus Customer, err error) {
+func FindAccount(db Database, accountID primitive.ObjectID) (cus Customer, err error) {
 	filter := bson.M{FieldID: accountID}
-	sr := db.Collection("accounts").FindOne(ctx, filter)
-	err = sr.Decode(&cus)
+	err = db.FindOne("accounts", filter, &cus)
 	return
 }
 
-func CreateAccount(db *mongo.Database, cus Customer) error {
-	if _, err := db.Collection("accounts").InsertOne(ctx, cus); err != nil {
+func CreateAccount(db Database, cus Customer) error {
+	if err := db.InsertOne("accounts", cus); err != nil {
 		return err
 	}
 	return nil
 }
 
-func CreateBase(db *mongo.Database, base BaseConfig) error {
-	if _, err := db.Collection("bases").InsertOne(ctx, base); err != nil {
+func CreateBase(db Database, base BaseConfig) error {
+	if err := db.InsertOne("bases", base); err != nil {
 		return err
 	}
 	return nil
 }
 
-func FindDatabase(db *mongo.Database, id primitive.ObjectID) (conf BaseConfig, err error) {
-	sr := db.Collection("bases").FindOne(ctx, bson.M{FieldID: id})
-	err = sr.Decode(&conf)
+func FindDatabase(db Database, id primitive.ObjectID) (conf BaseConfig, err error) {
+	err = db.FindOne("bases", bson.M{FieldID: id}, &conf)
 	return
 }
 
-func DatabaseExists(db *mongo.Database, name string) (bool, error) {
-	count, err := db.Collection("bases").CountDocuments(ctx, bson.M{"name": name})
+func DatabaseExists(db Database, name string) (bool, error) {
+	count, err := db.Count("bases", bson.M{"name": name})
 	if err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
 
-func ListDatabases(db *mongo.Database) ([]BaseConfig, error) {
+func ListDatabases(db Database) ([]BaseConfig, error) {
 	filter := bson.M{FieldIsActive: true}
 
-	ctx := context.Background()
-
-	cur, err := db.Collection("bases").Find(ctx, filter)
-	if err != nil {
-		return nil, err
-	}
-	defer cur.Close(ctx)
-
 	var results []BaseConfig
-
-	for cur.Next(ctx) {
-		var bc BaseConfig
-		if err := cur.Decode(&bc); err != nil {
-			return nil, err
-		}
-
-		results = append(results, bc)
-	}
-	if err := cur.Err(); err != nil {
+	if err := db.Find("bases", filter, FindOptions{}, &results); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// APIKeysCollection holds the API keys of a base, only the hashes of
+	// their secrets are stored
+	APIKeysCollection = "sb_apikeys"
+	// APIKeyPrefix starts every API key, they're made of the prefix, the id
+	// of the key and its secret separated by underscores
+	APIKeyPrefix = "sbk_"
+)
+
+// APIKey gives a server access to the parts of the base allowed by its
+// scopes, with the permissions of the root user who created it.
+type APIKey struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	AccountID primitive.ObjectID `bson:"accountId" json:"-"`
+	UserID    primitive.ObjectID `bson:"userId" json:"-"`
+	Name      string             `bson:"name" json:"name"`
+	Scopes    []string           `bson:"scopes" json:"scopes"`
+	// AllowedIPs are the IP addresses or CIDR ranges the key can be used
+	// from, any address when empty
+	AllowedIPs []string  `bson:"allowedIps" json:"allowedIps"`
+	Hash       string    `bson:"hash" json:"-"`
+	Created    time.Time `bson:"created" json:"created"`
+	// Expires is zero for keys that do not expire
+	Expires  time.Time `bson:"expires" json:"expires"`
+	LastUsed time.Time `bson:"lastUsed" json:"lastUsed"`
+	LastIP   string    `bson:"lastIp" json:"lastIp"`
+}
+
+// Expired returns true if the key cannot be used anymore at now
+func (k APIKey) Expired(now time.Time) bool {
+	return !k.Expires.IsZero() && now.After(k.Expires)
+}
+
+// AllowsIP returns true if the key can be used from the IP address
+func (k APIKey) AllowsIP(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, allowed := range k.AllowedIPs {
+		if _, cidr, err := net.ParseCIDR(allowed); err == nil {
+			if cidr.Contains(addr) {
+				return true
+			}
+		} else if a := net.ParseIP(allowed); a != nil && a.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyScopes are the actions of each resource an API key can be allowed,
+// with true when the scope names a target, like a collection
+var apiKeyScopes = map[string]map[string]bool{
+	"db":      {"read": true, "write": true},
+	"fn":      {"exec": true},
+	"storage": {"upload": false, "delete": false},
+	"email":   {"send": false},
+}
+
+// ValidateScope returns an error if the scope is not one of
+// db:read:<collection>, db:write:<collection>, fn:exec:<function>,
+// storage:upload, storage:delete or email:send. The action and target can
+// be *, the system collections cannot be targeted.
+func ValidateScope(scope string) error {
+	parts := strings.Split(scope, ":")
+
+	actions, ok := apiKeyScopes[parts[0]]
+	if !ok || len(parts) < 2 {
+		return fmt.Errorf("invalid scope %s", scope)
+	}
+
+	hasTarget := false
+	if parts[1] == "*" {
+		for _, t := range actions {
+			hasTarget = hasTarget || t
+		}
+	} else if t, ok := actions[parts[1]]; ok {
+		hasTarget = t
+	} else {
+		return fmt.Errorf("invalid scope %s, unknown action %s", scope, parts[1])
+	}
+
+	if hasTarget && (len(parts) != 3 || len(parts[2]) == 0) {
+		return fmt.Errorf("invalid scope %s, expected %s:%s:name", scope, parts[0], parts[1])
+	} else if !hasTarget && len(parts) != 2 {
+		return fmt.Errorf("invalid scope %s, expected %s:%s", scope, parts[0], parts[1])
+	} else if parts[0] == "db" && strings.HasPrefix(parts[2], "sb_") {
+		return fmt.Errorf("invalid scope %s, API keys cannot access system collections", scope)
+	}
+	return nil
+}
+
+// ScopeAllows returns true if one of the scopes grants the permission, a *
+// in a scope matches any action or target. The system collections are never
+// allowed.
+func ScopeAllows(scopes []string, permission string) bool {
+	want := strings.Split(permission, ":")
+	if want[0] == "db" && len(want) == 3 && strings.HasPrefix(want[2], "sb_") {
+		return false
+	}
+
+	for _, scope := range scopes {
+		parts := strings.Split(scope, ":")
+		if len(parts) != len(want) {
+			continue
+		}
+
+		match := true
+		for i, p := range parts {
+			if p == want[i] {
+				continue
+			} else if p != "*" {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// HashAPIKeySecret returns the hash stored for the secret of an API key
+func HashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func CreateAPIKey(db Database, k APIKey) error {
+	return db.InsertOne(APIKeysCollection, k)
+}
+
+func FindAPIKey(db Database, id primitive.ObjectID) (k APIKey, err error) {
+	err = db.FindOne(APIKeysCollection, bson.M{FieldID: id}, &k)
+	return
+}
+
+func ListAPIKeys(db Database) ([]APIKey, error) {
+	opt := FindOptions{Sort: bson.D{{Key: "created", Value: -1}}}
+
+	var keys []APIKey
+	if err := db.Find(APIKeysCollection, bson.M{}, opt, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// DeleteAPIKey revokes the key, it returns the number of keys deleted
+func DeleteAPIKey(db Database, id primitive.ObjectID) (int64, error) {
+	return db.DeleteOne(APIKeysCollection, bson.M{FieldID: id})
+}
+
+// TouchAPIKey records when and from where the key was last used
+func TouchAPIKey(db Database, id primitive.ObjectID, ip string, now time.Time) error {
+	update := bson.M{"$set": bson.M{"lastUsed": now, "lastIp": ip}}
+	_, err := db.UpdateOne(APIKeysCollection, bson.M{FieldID: id}, update)
+	return err
+}
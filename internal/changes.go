@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrChangeHistoryLost is returned by Watch when the data store does not
+// have the changes after the resume token anymore
+var ErrChangeHistoryLost = errors.New("the changes after the resume token are not available anymore")
+
+// ChangeEvent is a write to a collection of a base. Type is one of
+// MsgTypeDBCreated, MsgTypeDBUpdated or MsgTypeDBDeleted, Doc is nil for
+// deletes.
+type ChangeEvent struct {
+	Base        string
+	Collection  string
+	Type        string
+	ID          string
+	Doc         bson.M
+	ResumeToken []byte
+}
+
+// ChangeWatcher is implemented by the data stores reporting all the writes
+// made to the bases, including the ones not made via the server.
+type ChangeWatcher interface {
+	// Watch calls fn for every write after the resume token, or from now
+	// when it's empty, until ctx is done or fn returns an error. System
+	// collections and the "sbsys" database are not watched.
+	Watch(ctx context.Context, resumeToken []byte, fn func(ChangeEvent) error) error
+}
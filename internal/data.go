@@ -25,6 +25,8 @@ const (
 	FieldID        = "_id"
 	FieldAccountID = "accountId"
 	FieldOwnerID   = "sb_owner"
+	FieldVersion   = "sb_version"
+	FieldDeleted   = "sb_deleted"
 	FieldToken     = "token"
 	FieldIsActive  = "active"
 	FieldRole      = "role"
@@ -47,6 +49,10 @@ const (
 	MsgTypeDBCreated = "db_created"
 	MsgTypeDBUpdated = "db_updated"
 	MsgTypeDBDeleted = "db_deleted"
+	// bulk operations affecting many documents publish a single event
+	// containing the number of documents
+	MsgTypeDBBulkUpdated = "db_bulk_updated"
+	MsgTypeDBBulkDeleted = "db_bulk_deleted"
 )
 
 type Command struct {
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OAuthCollection holds the OAuth2 / OpenID Connect providers of a base
+const OAuthCollection = "sb_oauth"
+
+// OAuthProvider is an identity provider users can sign in with. With an
+// Issuer the endpoints are discovered from its OpenID configuration,
+// OAuth2 providers without discovery, like GitHub, set them instead.
+type OAuthProvider struct {
+	ID           primitive.ObjectID `bson:"_id" json:"-"`
+	Name         string             `bson:"name" json:"name"`
+	Issuer       string             `bson:"issuer" json:"issuer,omitempty"`
+	ClientID     string             `bson:"clientId" json:"clientId"`
+	ClientSecret string             `bson:"clientSecret" json:"clientSecret,omitempty"`
+	Scopes       []string           `bson:"scopes" json:"scopes"`
+	AuthURL      string             `bson:"authUrl" json:"authUrl,omitempty"`
+	TokenURL     string             `bson:"tokenUrl" json:"tokenUrl,omitempty"`
+	UserInfoURL  string             `bson:"userInfoUrl" json:"userInfoUrl,omitempty"`
+	Updated      time.Time          `bson:"updated" json:"updated"`
+}
+
+func FindOAuthProvider(db Database, name string) (p OAuthProvider, err error) {
+	err = db.FindOne(OAuthCollection, bson.M{"name": name}, &p)
+	return
+}
+
+func ListOAuthProviders(db Database) ([]OAuthProvider, error) {
+	var providers []OAuthProvider
+	opt := FindOptions{Sort: bson.D{{Key: "name", Value: 1}}}
+	if err := db.Find(OAuthCollection, bson.M{}, opt, &providers); err != nil {
+		return nil, err
+	}
+
+	if providers == nil {
+		providers = make([]OAuthProvider, 0)
+	}
+	return providers, nil
+}
+
+// SaveOAuthProvider creates or replaces the provider with the same name
+func SaveOAuthProvider(db Database, p OAuthProvider) error {
+	if _, err := db.DeleteOne(OAuthCollection, bson.M{"name": p.Name}); err != nil {
+		return err
+	}
+
+	p.ID = primitive.NewObjectID()
+	p.Updated = time.Now()
+	return db.InsertOne(OAuthCollection, p)
+}
+
+func DeleteOAuthProvider(db Database, name string) (int64, error) {
+	return db.DeleteOne(OAuthCollection, bson.M{"name": name})
+}
+
+// FindTokenByIdentity returns the user linked to the provider's subject
+func FindTokenByIdentity(db Database, provider, subject string) (tok Token, err error) {
+	err = db.FindOne("sb_tokens", bson.M{"identities." + provider: subject}, &tok)
+	return
+}
+
+// LinkIdentity links the provider's subject to the user, they can then sign
+// in with the provider even if their email changes there.
+func LinkIdentity(db Database, id primitive.ObjectID, provider, subject string) error {
+	update := bson.M{"$set": bson.M{"identities." + provider: subject}}
+	_, err := db.UpdateOne("sb_tokens", bson.M{FieldID: id}, update)
+	return err
+}
@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	DataStoreMongo      = "mongo"
+	DataStorePostgreSQL = "postgresql"
+	DataStoreEmbedded   = "embedded"
+)
+
+// ErrNotFound is returned when a single document lookup or update did not
+// match any document.
+var ErrNotFound = errors.New("document not found")
+
+// Persister is used to have different implementation for the data store.
+// Each application (base) has its own database, system data lives in the
+// "sbsys" database.
+type Persister interface {
+	Database(name string) Database
+	Ping() error
+}
+
+// Database is a document database. Filters and updates use the MongoDB
+// query and update document syntax, documents are either bson.M or struct
+// with bson tags.
+type Database interface {
+	Name() string
+	Drop() error
+	ListCollections() ([]string, error)
+
+	InsertOne(col string, doc interface{}) error
+	InsertMany(col string, docs []interface{}) error
+	// FindOne decodes the first document matching filter into v and returns
+	// ErrNotFound when there's none.
+	FindOne(col string, filter bson.M, v interface{}) error
+	// Find decodes all documents matching filter into v which must be a
+	// pointer to a slice.
+	Find(col string, filter bson.M, opt FindOptions, v interface{}) error
+	Count(col string, filter bson.M) (int64, error)
+	Distinct(col, field string, filter bson.M) ([]interface{}, error)
+	UpdateOne(col string, filter, update bson.M) (UpdateResult, error)
+	UpdateMany(col string, filter, update bson.M) (UpdateResult, error)
+	DeleteOne(col string, filter bson.M) (int64, error)
+	DeleteMany(col string, filter bson.M) (int64, error)
+	// Aggregate groups the documents matching filter and returns one
+	// document per group containing the group keys and accumulators.
+	Aggregate(col string, filter bson.M, opt AggregateOptions) ([]bson.M, error)
+	// Transaction runs fn atomically, all operations must be done via the
+	// Database fn receives. Everything is rolled back if fn returns an
+	// error. fn can be called more than once when the transaction is
+	// retried.
+	Transaction(fn func(tx Database) error) error
+
+	// ListIndexes returns the indexes of the collection
+	ListIndexes(col string) ([]Index, error)
+	// CreateIndex creates the index, it does nothing if the same index
+	// already exists.
+	CreateIndex(col string, idx Index) error
+	// DropIndex removes the index and returns ErrNotFound when there's none
+	// with that name.
+	DropIndex(col, name string) error
+
+	// Search returns a page of the documents matching filter and any word of
+	// the text in the fields of the collection's text index, ordered by
+	// relevance, and the total number of matching documents.
+	Search(col string, filter bson.M, opt SearchOptions) ([]SearchHit, int64, error)
+}
+
+// FindOptions controls paging, sorting and projection of Find.
+type FindOptions struct {
+	Skip       int64
+	Limit      int64
+	Sort       bson.D
+	Projection bson.M
+}
+
+// UpdateResult contains the number of documents matched and modified by an
+// update.
+type UpdateResult struct {
+	MatchedCount  int64 `json:"matched"`
+	ModifiedCount int64 `json:"modified"`
+}
+
+const (
+	BucketHour  = "hour"
+	BucketDay   = "day"
+	BucketWeek  = "week"
+	BucketMonth = "month"
+	BucketYear  = "year"
+)
+
+const (
+	AccumulatorCount = "count"
+	AccumulatorSum   = "sum"
+	AccumulatorAvg   = "avg"
+	AccumulatorMin   = "min"
+	AccumulatorMax   = "max"
+)
+
+// AggregateOptions controls how Aggregate groups documents. Without group
+// keys all matching documents are in the same group.
+type AggregateOptions struct {
+	GroupBy      []GroupKey    `json:"groupBy"`
+	Accumulators []Accumulator `json:"accumulators"`
+}
+
+// GroupKey groups documents by the value of Field. When Bucket is set the
+// field is a date truncated to the hour, day, ISO week, month or year and the
+// key is a string i.e. 2021-11-23 for a day.
+type GroupKey struct {
+	Field  string `json:"field"`
+	Bucket string `json:"bucket"`
+	As     string `json:"as"`
+}
+
+// Accumulator computes Op over the Field of all documents of a group. The
+// count accumulator does not need a field.
+type Accumulator struct {
+	Op    string `json:"op"`
+	Field string `json:"field"`
+	As    string `json:"as"`
+}
+
+// Validate makes sure the options are valid and sets the default output
+// names of the group keys and accumulators.
+func (opt *AggregateOptions) Validate() error {
+	if len(opt.Accumulators) == 0 {
+		opt.Accumulators = []Accumulator{{Op: AccumulatorCount}}
+	}
+
+	names := make(map[string]bool)
+	checkName := func(name string) error {
+		if len(name) == 0 || strings.HasPrefix(name, "$") || strings.Contains(name, ".") {
+			return fmt.Errorf("invalid output name: %s", name)
+		} else if names[name] {
+			return fmt.Errorf("duplicate output name: %s", name)
+		}
+		names[name] = true
+		return nil
+	}
+
+	for i, key := range opt.GroupBy {
+		if len(key.Field) == 0 || strings.HasPrefix(key.Field, "$") {
+			return fmt.Errorf("invalid group by field: %s", key.Field)
+		}
+
+		switch key.Bucket {
+		case "", BucketHour, BucketDay, BucketWeek, BucketMonth, BucketYear:
+		default:
+			return fmt.Errorf("the %s date bucket is not supported", key.Bucket)
+		}
+
+		if len(key.As) == 0 {
+			key.As = strings.ReplaceAll(key.Field, ".", "_")
+		}
+		if err := checkName(key.As); err != nil {
+			return err
+		}
+		opt.GroupBy[i] = key
+	}
+
+	for i, acc := range opt.Accumulators {
+		acc.Op = strings.ToLower(acc.Op)
+		switch acc.Op {
+		case AccumulatorCount:
+			acc.Field = ""
+		case AccumulatorSum, AccumulatorAvg, AccumulatorMin, AccumulatorMax:
+			if len(acc.Field) == 0 || strings.HasPrefix(acc.Field, "$") {
+				return fmt.Errorf("the %s accumulator requires a field", acc.Op)
+			}
+		default:
+			return fmt.Errorf("the %s accumulator is not supported", acc.Op)
+		}
+
+		if len(acc.As) == 0 {
+			acc.As = acc.Op
+			if len(acc.Field) > 0 {
+				acc.As += "_" + strings.ReplaceAll(acc.Field, ".", "_")
+			}
+		}
+		if err := checkName(acc.As); err != nil {
+			return err
+		}
+		opt.Accumulators[i] = acc
+	}
+	return nil
+}
+
+// Index is a collection index on the values of the Keys fields in order. A
+// Unique index rejects documents having the same values. A TTL index has a
+// single date field, the documents are removed TTL seconds after that date.
+// A Text index is the full-text index of its string fields used by Search, a
+// collection can have only one.
+type Index struct {
+	Name   string     `json:"name"`
+	Keys   []IndexKey `json:"keys"`
+	Unique bool       `json:"unique"`
+	TTL    int32      `json:"ttl"`
+	Text   bool       `json:"text"`
+}
+
+// IndexKey is an indexed field in ascending or descending order. The Weight
+// of a text index field is its importance relative to the other fields,
+// the default is 1.
+type IndexKey struct {
+	Field  string `json:"field"`
+	Desc   bool   `json:"desc"`
+	Weight int32  `json:"weight,omitempty"`
+}
+
+// Validate makes sure the index is valid and sets its default name from its
+// keys, i.e. lastName_1_age_-1 or title_text_body_text.
+func (idx *Index) Validate() error {
+	if len(idx.Keys) == 0 {
+		return fmt.Errorf("the index requires at least one field")
+	}
+
+	var parts []string
+	fields := make(map[string]bool)
+	for _, key := range idx.Keys {
+		if len(key.Field) == 0 || strings.HasPrefix(key.Field, "$") || strings.Contains(key.Field, "..") {
+			return fmt.Errorf("invalid index field: %s", key.Field)
+		} else if fields[key.Field] {
+			return fmt.Errorf("duplicate index field: %s", key.Field)
+		}
+		fields[key.Field] = true
+
+		if key.Weight < 0 || (key.Weight > 0 && !idx.Text) {
+			return fmt.Errorf("invalid weight for %s, only text index fields have a positive weight", key.Field)
+		}
+
+		order := "1"
+		if idx.Text {
+			order = "text"
+		} else if key.Desc {
+			order = "-1"
+		}
+		parts = append(parts, key.Field, order)
+	}
+
+	if idx.TTL < 0 {
+		return fmt.Errorf("the TTL must be a positive number of seconds")
+	} else if idx.TTL > 0 && len(idx.Keys) > 1 {
+		return fmt.Errorf("a TTL index must have a single date field")
+	} else if idx.Text && (idx.Unique || idx.TTL > 0) {
+		return fmt.Errorf("a text index cannot be unique or have a TTL")
+	}
+
+	if len(idx.Name) == 0 {
+		idx.Name = strings.Join(parts, "_")
+	} else if strings.ContainsAny(idx.Name, "/$ ") {
+		return fmt.Errorf("invalid index name: %s", idx.Name)
+	}
+	return nil
+}
@@ -0,0 +1,761 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RootRole is the minimum role of root users, they bypass all permissions
+const RootRole = 100
+
+// RulesCollection holds the permission rules of the collections of a base
+const RulesCollection = "sb_rules"
+
+const (
+	OpRead   = "read"
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// ErrPermissionDenied is returned when no rule allows the operation
+var ErrPermissionDenied = errors.New("permission denied")
+
+// CollectionRules are the permission rules of a collection. When a
+// collection has rules they replace the permission suffix of its name, an
+// operation is allowed when at least one rule allows it.
+type CollectionRules struct {
+	ID         primitive.ObjectID `bson:"_id" json:"-"`
+	Collection string             `bson:"col" json:"collection"`
+	Rules      []Rule             `bson:"rules" json:"rules"`
+	Updated    time.Time          `bson:"updated" json:"updated"`
+}
+
+// Rule allows the operations to users having one of the roles, or any role
+// when Roles is empty, on documents matching the condition.
+//
+// A condition compares document fields with the user's properties or
+// literals, i.e.:
+//
+//	doc.teamId in auth.teams && doc.status != "archived"
+//
+// The operators are ==, !=, <, <=, >, >=, in, && and || with parenthesis.
+// The user's properties are accountId, userId, email, role and the
+// attributes set by root users. An empty condition matches all documents.
+type Rule struct {
+	Roles      []int    `bson:"roles" json:"roles"`
+	Operations []string `bson:"ops" json:"operations"`
+	Condition  string   `bson:"cond" json:"condition"`
+}
+
+// Check makes sure the rules are valid
+func (cr CollectionRules) Check() error {
+	for i, rule := range cr.Rules {
+		if len(rule.Operations) == 0 {
+			return fmt.Errorf("rule %d has no operations", i+1)
+		}
+
+		for _, op := range rule.Operations {
+			switch op {
+			case OpRead, OpCreate, OpUpdate, OpDelete:
+			default:
+				return fmt.Errorf("rule %d has an invalid operation: %s", i+1, op)
+			}
+		}
+
+		if _, err := ParseCondition(rule.Condition); err != nil {
+			return fmt.Errorf("rule %d has an invalid condition: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// applicable returns the conditions of the rules allowing op to the user
+func (cr CollectionRules) applicable(auth Auth, op string) ([]*Condition, error) {
+	var conds []*Condition
+	for _, rule := range cr.Rules {
+		if !containsString(rule.Operations, op) || !rule.hasRole(auth.Role) {
+			continue
+		}
+
+		cond, err := ParseCondition(rule.Condition)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, cond)
+	}
+	return conds, nil
+}
+
+func (r Rule) hasRole(role int) bool {
+	if len(r.Roles) == 0 {
+		return true
+	}
+	for _, rr := range r.Roles {
+		if rr == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the filter restricting op to the documents the user is
+// allowed to access. It returns ErrPermissionDenied when no rule applies.
+func (cr CollectionRules) Filter(auth Auth, op string) (bson.M, error) {
+	conds, err := cr.applicable(auth, op)
+	if err != nil {
+		return nil, err
+	} else if len(conds) == 0 {
+		return nil, ErrPermissionDenied
+	}
+
+	var ors []interface{}
+	for _, cond := range conds {
+		f := cond.filter(auth)
+		if f.all {
+			return bson.M{}, nil
+		} else if !f.none {
+			ors = append(ors, f.m)
+		}
+	}
+
+	if len(ors) == 0 {
+		return nil, ErrPermissionDenied
+	} else if len(ors) == 1 {
+		return ors[0].(bson.M), nil
+	}
+	return bson.M{"$or": ors}, nil
+}
+
+// Allowed returns true if a rule allows op on the document
+func (cr CollectionRules) Allowed(auth Auth, op string, doc map[string]interface{}) bool {
+	conds, err := cr.applicable(auth, op)
+	if err != nil {
+		return false
+	}
+
+	for _, cond := range conds {
+		if cond.Match(doc, auth) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRules returns the rules of the collection, ok is false when the
+// collection has no rules.
+func GetRules(db Database, col string) (rules CollectionRules, ok bool, err error) {
+	if err := db.FindOne(RulesCollection, bson.M{"col": col}, &rules); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return rules, false, nil
+		}
+		return rules, false, err
+	}
+	return rules, true, nil
+}
+
+// ListRules returns the rules of all collections having rules
+func ListRules(db Database) ([]CollectionRules, error) {
+	var results []CollectionRules
+	opt := FindOptions{Sort: bson.D{{Key: "col", Value: 1}}}
+	if err := db.Find(RulesCollection, bson.M{}, opt, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// SetRules creates or replaces the rules of the collection
+func SetRules(db Database, col string, rules []Rule) error {
+	cr := CollectionRules{
+		ID:         primitive.NewObjectID(),
+		Collection: col,
+		Rules:      rules,
+		Updated:    time.Now(),
+	}
+	if err := cr.Check(); err != nil {
+		return err
+	}
+
+	update := bson.M{"$set": bson.M{"rules": rules, "updated": cr.Updated}}
+	res, err := db.UpdateOne(RulesCollection, bson.M{"col": col}, update)
+	if err != nil {
+		return err
+	} else if res.MatchedCount > 0 {
+		return nil
+	}
+
+	return db.InsertOne(RulesCollection, cr)
+}
+
+// DeleteRules removes the rules of the collection
+func DeleteRules(db Database, col string) error {
+	_, err := db.DeleteOne(RulesCollection, bson.M{"col": col})
+	return err
+}
+
+// RulesKey is the cache key of a collection's rules used by the realtime
+// permission checks.
+func RulesKey(base, col string) string {
+	return fmt.Sprintf("rules:%s:%s", base, col)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Condition is a parsed rule condition
+type Condition struct {
+	op          string
+	left, right *Condition
+	a, b        operand
+}
+
+const (
+	operandLiteral = iota
+	operandDoc
+	operandAuth
+)
+
+type operand struct {
+	kind  int
+	path  string
+	value interface{}
+}
+
+// ParseCondition parses a rule condition, an empty condition returns nil
+// which matches all documents.
+func ParseCondition(s string) (*Condition, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return nil, nil
+	}
+
+	toks, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &condParser{toks: toks}
+	cond, err := p.or()
+	if err != nil {
+		return nil, err
+	} else if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %s", p.toks[p.pos])
+	}
+	return cond, nil
+}
+
+type condParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *condParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *condParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *condParser) or() (*Condition, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &Condition{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *condParser) and() (*Condition, error) {
+	left, err := p.comparison()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.comparison()
+		if err != nil {
+			return nil, err
+		}
+		left = &Condition{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *condParser) comparison() (*Condition, error) {
+	if p.peek() == "(" {
+		p.next()
+		cond, err := p.or()
+		if err != nil {
+			return nil, err
+		} else if p.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return cond, nil
+	}
+
+	a, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.next()
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=", "in":
+	default:
+		return nil, fmt.Errorf("expected an operator after %s", a.String())
+	}
+
+	b, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	if a.kind == operandDoc && b.kind == operandDoc {
+		return nil, fmt.Errorf("cannot compare two document fields: %s and %s", a.String(), b.String())
+	}
+	return &Condition{op: op, a: a, b: b}, nil
+}
+
+func (p *condParser) operand() (operand, error) {
+	tok := p.next()
+	switch {
+	case len(tok) == 0:
+		return operand{}, fmt.Errorf("unexpected end of condition")
+	case tok[0] == '"' || tok[0] == '\'':
+		return operand{kind: operandLiteral, value: tok[1 : len(tok)-1]}, nil
+	case tok == "true" || tok == "false":
+		return operand{kind: operandLiteral, value: tok == "true"}, nil
+	case tok == "null":
+		return operand{kind: operandLiteral}, nil
+	case strings.HasPrefix(tok, "doc.") && len(tok) > 4:
+		path := tok[4:]
+		if path == "id" {
+			path = FieldID
+		}
+		return operand{kind: operandDoc, path: path}, nil
+	case strings.HasPrefix(tok, "auth.") && len(tok) > 5:
+		return operand{kind: operandAuth, path: tok[5:]}, nil
+	}
+
+	if f, err := strconv.ParseFloat(tok, 64); err == nil {
+		return operand{kind: operandLiteral, value: f}, nil
+	}
+	return operand{}, fmt.Errorf("unexpected %s, expected doc.field, auth.property or a value", tok)
+}
+
+func (o operand) String() string {
+	switch o.kind {
+	case operandDoc:
+		return "doc." + o.path
+	case operandAuth:
+		return "auth." + o.path
+	}
+	return fmt.Sprintf("%v", o.value)
+}
+
+func tokenize(s string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, string(c))
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			toks = append(toks, s[i:i+end+2])
+			i += end + 2
+		case strings.ContainsRune("=!<>&|", rune(c)):
+			j := i + 1
+			for j < len(s) && strings.ContainsRune("=&|", rune(s[j])) && j-i < 2 {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n()=!<>&|\"'", rune(s[j])) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// value returns the operand's value for the user and document, ok is false
+// when the field or property does not exists.
+func (o operand) resolve(auth Auth, doc map[string]interface{}) (interface{}, bool) {
+	switch o.kind {
+	case operandDoc:
+		return docValue(doc, o.path)
+	case operandAuth:
+		return authValue(auth, o.path)
+	}
+	return o.value, true
+}
+
+func authValue(auth Auth, prop string) (interface{}, bool) {
+	switch prop {
+	case "accountId":
+		return auth.AccountID, true
+	case "userId":
+		return auth.UserID, true
+	case "email":
+		return auth.Email, true
+	case "role":
+		return auth.Role, true
+	}
+
+	v, ok := auth.Attributes[prop]
+	return v, ok
+}
+
+func docValue(doc map[string]interface{}, path string) (interface{}, bool) {
+	// documents sent to clients have their _id as id
+	if path == FieldID {
+		if v, ok := doc[FieldID]; ok {
+			return v, true
+		}
+		path = "id"
+	}
+
+	var v interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := toMap(v)
+		if !ok {
+			return nil, false
+		}
+
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Match evaluates the condition on the document
+func (c *Condition) Match(doc map[string]interface{}, auth Auth) bool {
+	if c == nil {
+		return true
+	}
+
+	switch c.op {
+	case "&&":
+		return c.left.Match(doc, auth) && c.right.Match(doc, auth)
+	case "||":
+		return c.left.Match(doc, auth) || c.right.Match(doc, auth)
+	}
+
+	if !c.validAuth(auth) {
+		return false
+	}
+
+	a, _ := c.a.resolve(auth, doc)
+	b, _ := c.b.resolve(auth, doc)
+	return compare(c.op, a, b)
+}
+
+// validAuth returns false when an auth operand is missing, null or of a type
+// the operator cannot use. The condition then matches no documents.
+func (c *Condition) validAuth(auth Auth) bool {
+	for i, o := range []operand{c.a, c.b} {
+		if o.kind != operandAuth {
+			continue
+		}
+
+		v, ok := o.resolve(auth, nil)
+		if !ok || v == nil {
+			return false
+		}
+
+		_, isList := normalizeList(v)
+		_, isMap := toMap(v)
+		if c.op == "in" && i == 1 {
+			// the right side of in is the list of values
+			if !isList {
+				return false
+			}
+		} else if isList || isMap {
+			return false
+		}
+	}
+	return true
+}
+
+func compare(op string, a, b interface{}) bool {
+	a, b = normalizeValue(a), normalizeValue(b)
+
+	switch op {
+	case "==":
+		return equalAny(a, b)
+	case "!=":
+		return !equalAny(a, b)
+	case "in":
+		if list, ok := b.([]interface{}); ok {
+			for _, item := range list {
+				if equalAny(a, item) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if x, ok := a.(float64); ok {
+		if y, ok := b.(float64); ok {
+			return compareOrdered(op, x < y, x == y)
+		}
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return compareOrdered(op, x < y, x == y)
+		}
+	}
+	return false
+}
+
+func compareOrdered(op string, less, equal bool) bool {
+	switch op {
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	case ">=":
+		return !less
+	}
+	return false
+}
+
+// equalAny returns true if the values are equal or one is an array
+// containing the other, like MongoDB.
+func equalAny(a, b interface{}) bool {
+	if list, ok := a.([]interface{}); ok {
+		if _, ok := b.([]interface{}); !ok {
+			for _, item := range list {
+				if reflect.DeepEqual(item, b) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	if list, ok := b.([]interface{}); ok {
+		if _, ok := a.([]interface{}); !ok {
+			for _, item := range list {
+				if reflect.DeepEqual(a, item) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// normalizeValue converts ids to their hex string and numbers to float64 so
+// values coming from the database and from JSON compare equal.
+func normalizeValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case primitive.ObjectID:
+		return x.Hex()
+	case int:
+		return float64(x)
+	case int32:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case primitive.A:
+		return normalizeValue([]interface{}(x))
+	case []string:
+		list := make([]interface{}, len(x))
+		for i, s := range x {
+			list[i] = s
+		}
+		return list
+	case []interface{}:
+		list := make([]interface{}, len(x))
+		for i, item := range x {
+			list[i] = normalizeValue(item)
+		}
+		return list
+	}
+	return v
+}
+
+func toMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case bson.M:
+		return m, true
+	case bson.D:
+		return m.Map(), true
+	}
+	return nil, false
+}
+
+// condFilter is a filter, all and none are set when the condition matches
+// all or no documents.
+type condFilter struct {
+	m    bson.M
+	all  bool
+	none bool
+}
+
+func (c *Condition) filter(auth Auth) condFilter {
+	if c == nil {
+		return condFilter{all: true}
+	}
+
+	switch c.op {
+	case "&&":
+		l, r := c.left.filter(auth), c.right.filter(auth)
+		if l.none || r.none {
+			return condFilter{none: true}
+		} else if l.all {
+			return r
+		} else if r.all {
+			return l
+		}
+		return condFilter{m: bson.M{"$and": []interface{}{l.m, r.m}}}
+	case "||":
+		l, r := c.left.filter(auth), c.right.filter(auth)
+		if l.all || r.all {
+			return condFilter{all: true}
+		} else if l.none {
+			return r
+		} else if r.none {
+			return l
+		}
+		return condFilter{m: bson.M{"$or": []interface{}{l.m, r.m}}}
+	}
+
+	if !c.validAuth(auth) {
+		return condFilter{none: true}
+	}
+
+	a, b, op := c.a, c.b, c.op
+
+	// without document fields the condition is a constant
+	if a.kind != operandDoc && b.kind != operandDoc {
+		av, _ := a.resolve(auth, nil)
+		bv, _ := b.resolve(auth, nil)
+		if compare(op, av, bv) {
+			return condFilter{all: true}
+		}
+		return condFilter{none: true}
+	}
+
+	// the document field is on the left
+	if b.kind == operandDoc {
+		a, b = b, a
+		switch op {
+		case "<":
+			op = ">"
+		case "<=":
+			op = ">="
+		case ">":
+			op = "<"
+		case ">=":
+			op = "<="
+		case "in":
+			// value in doc.field matches arrays containing the value
+			v, _ := b.resolve(auth, nil)
+			return condFilter{m: bson.M{a.path: bson.M{"$in": idForms(v)}}}
+		}
+	}
+
+	v, _ := b.resolve(auth, nil)
+	switch op {
+	case "==":
+		if v == nil {
+			return condFilter{m: bson.M{a.path: nil}}
+		}
+		return condFilter{m: bson.M{a.path: bson.M{"$in": idForms(v)}}}
+	case "!=":
+		if v == nil {
+			return condFilter{m: bson.M{a.path: bson.M{"$ne": nil}}}
+		}
+		return condFilter{m: bson.M{a.path: bson.M{"$nin": idForms(v)}}}
+	case "in":
+		list, ok := normalizeList(v)
+		if !ok {
+			return condFilter{none: true}
+		}
+
+		var values []interface{}
+		for _, item := range list {
+			values = append(values, idForms(item)...)
+		}
+
+		if len(values) == 0 {
+			return condFilter{none: true}
+		}
+		return condFilter{m: bson.M{a.path: bson.M{"$in": values}}}
+	}
+
+	ops := map[string]string{"<": "$lt", "<=": "$lte", ">": "$gt", ">=": "$gte"}
+	return condFilter{m: bson.M{a.path: bson.M{ops[op]: v}}}
+}
+
+func normalizeList(v interface{}) ([]interface{}, bool) {
+	switch x := v.(type) {
+	case []interface{}:
+		return x, true
+	case primitive.A:
+		return []interface{}(x), true
+	case []string:
+		return normalizeValue(x).([]interface{}), true
+	}
+	return nil, false
+}
+
+// idForms returns the value as an ObjectID and as its hex string since ids
+// can be stored in both forms.
+func idForms(v interface{}) []interface{} {
+	switch x := v.(type) {
+	case primitive.ObjectID:
+		return []interface{}{x, x.Hex()}
+	case string:
+		if oid, err := primitive.ObjectIDFromHex(x); err == nil {
+			return []interface{}{x, oid}
+		}
+	}
+	return []interface{}{v}
+}
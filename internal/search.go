@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SearchOptions controls a full-text search. Fields are the keys of the
+// collection's text index.
+type SearchOptions struct {
+	Text   string
+	Fields []IndexKey
+	Skip   int64
+	Limit  int64
+}
+
+// SearchHit is a document found by a full-text search with its relevance
+// score. Highlights are snippets of the matching fields with the search
+// words wrapped in <mark> tags.
+type SearchHit struct {
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights,omitempty"`
+	Doc        bson.M            `json:"doc"`
+}
+
+// SearchTerms returns the distinct lower case words of the text
+func SearchTerms(text string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), IsWordSeparator) {
+		if !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// IsWordSeparator returns true for the characters that are not part of a
+// searchable word
+func IsWordSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+// TextIndex returns the text index among the indexes if any
+func TextIndex(indexes []Index) (Index, bool) {
+	for _, idx := range indexes {
+		if idx.Text {
+			return idx, true
+		}
+	}
+	return Index{}, false
+}
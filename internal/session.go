@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SessionsCollection holds the sessions of the users, one per device they
+// signed in from
+const SessionsCollection = "sb_sessions"
+
+// Session is a device the user signed in from. Its refresh token gets new
+// access tokens, only the hash of the refresh token is stored.
+type Session struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	AccountID   primitive.ObjectID `bson:"accountId" json:"-"`
+	UserID      primitive.ObjectID `bson:"userId" json:"-"`
+	Device      string             `bson:"device" json:"device"`
+	IP          string             `bson:"ip" json:"ip"`
+	RefreshHash string             `bson:"refresh" json:"-"`
+	Created     time.Time          `bson:"created" json:"created"`
+	LastUsed    time.Time          `bson:"lastUsed" json:"lastUsed"`
+	Expires     time.Time          `bson:"expires" json:"expires"`
+	// PreviousHash is the hash of the refresh token replaced last, using it
+	// again means it was stolen
+	PreviousHash string `bson:"previous,omitempty" json:"-"`
+	// Current is true for the session making the request
+	Current bool `bson:"-" json:"current"`
+}
+
+func CreateSession(db Database, s Session) error {
+	return db.InsertOne(SessionsCollection, s)
+}
+
+func FindSession(db Database, id primitive.ObjectID) (s Session, err error) {
+	err = db.FindOne(SessionsCollection, bson.M{FieldID: id}, &s)
+	return
+}
+
+// ListSessions returns the sessions of the user that are not expired, the
+// last used first
+func ListSessions(db Database, userID primitive.ObjectID) ([]Session, error) {
+	filter := bson.M{"userId": userID, "expires": bson.M{"$gt": time.Now()}}
+	opt := FindOptions{Sort: bson.D{{Key: "lastUsed", Value: -1}}}
+
+	var sessions []Session
+	if err := db.Find(SessionsCollection, filter, opt, &sessions); err != nil {
+		return nil, err
+	}
+
+	if sessions == nil {
+		sessions = make([]Session, 0)
+	}
+	return sessions, nil
+}
+
+// RotateSession replaces the refresh token of the session, it fails if the
+// current one was already replaced
+func RotateSession(db Database, id primitive.ObjectID, oldHash, newHash string, expires time.Time) (bool, error) {
+	filter := bson.M{FieldID: id, "refresh": oldHash}
+	update := bson.M{"$set": bson.M{
+		"refresh":  newHash,
+		"previous": oldHash,
+		"lastUsed": time.Now(),
+		"expires":  expires,
+	}}
+
+	res, err := db.UpdateOne(SessionsCollection, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+func DeleteSession(db Database, userID, id primitive.ObjectID) (int64, error) {
+	return db.DeleteOne(SessionsCollection, bson.M{FieldID: id, "userId": userID})
+}
+
+// DeleteSessions removes all the sessions of the user and returns their ids
+func DeleteSessions(db Database, userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	var sessions []Session
+	if err := db.Find(SessionsCollection, bson.M{"userId": userID}, FindOptions{}, &sessions); err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(sessions))
+	for _, s := range sessions {
+		ids = append(ids, s.ID)
+	}
+
+	if _, err := db.DeleteMany(SessionsCollection, bson.M{"userId": userID}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// DeleteExpiredSessions removes the sessions of the user that cannot be
+// refreshed anymore
+func DeleteExpiredSessions(db Database, userID primitive.ObjectID) error {
+	filter := bson.M{"userId": userID, "expires": bson.M{"$lte": time.Now()}}
+	_, err := db.DeleteMany(SessionsCollection, filter)
+	return err
+}
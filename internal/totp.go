@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The TOTP (RFC 6238) parameters authenticator apps use by default
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpModulo is 10^totpDigits
+	totpModulo = 1000000
+	// totpSkew accepts the codes of the previous and next periods for clocks
+	// that drift
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random base32 secret to add in an authenticator
+// app
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPURI returns the otpauth:// URI authenticator apps read from a QR code
+func TOTPURI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprintf("%d", totpDigits))
+	q.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// TOTPStep returns the time step of t
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// TOTPCode returns the code of the secret for the time step
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%totpModulo), nil
+}
+
+// ValidateTOTP returns the time step of the code if it's valid at now
+func ValidateTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(secret) == 0 || len(code) != totpDigits {
+		return 0, false
+	}
+
+	cur := TOTPStep(now)
+	for step := cur - totpSkew; step <= cur+totpSkew; step++ {
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// EnableTOTP turns on two-factor authentication for the user with the
+// hashes of their recovery codes. step is the time step of the code used
+// to confirm the secret.
+func EnableTOTP(db Database, id primitive.ObjectID, secret string, recovery []string, step int64) error {
+	update := bson.M{"$set": bson.M{
+		"totp":     secret,
+		"recovery": recovery,
+		"totpStep": step,
+	}}
+	_, err := db.UpdateOne("sb_tokens", bson.M{FieldID: id}, update)
+	return err
+}
+
+func DisableTOTP(db Database, id primitive.ObjectID) error {
+	update := bson.M{"$unset": bson.M{
+		"totp":     "",
+		"recovery": "",
+		"totpStep": "",
+	}}
+	_, err := db.UpdateOne("sb_tokens", bson.M{FieldID: id}, update)
+	return err
+}
+
+// SetRecoveryCodes replaces the hashes of the user's recovery codes
+func SetRecoveryCodes(db Database, id primitive.ObjectID, recovery []string) error {
+	update := bson.M{"$set": bson.M{"recovery": recovery}}
+	_, err := db.UpdateOne("sb_tokens", bson.M{FieldID: id}, update)
+	return err
+}
+
+// UseTOTPStep records the time step of a valid code, it returns false if a
+// code of this step or a later one was already used
+func UseTOTPStep(db Database, id primitive.ObjectID, step int64) (bool, error) {
+	filter := bson.M{
+		FieldID: id,
+		"$or": bson.A{
+			bson.M{"totpStep": bson.M{"$exists": false}},
+			bson.M{"totpStep": bson.M{"$lt": step}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"totpStep": step}}
+
+	res, err := db.UpdateOne("sb_tokens", filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// UseRecoveryCode removes the recovery code, it returns false if the user
+// does not have it
+func UseRecoveryCode(db Database, id primitive.ObjectID, hash string) (bool, error) {
+	filter := bson.M{FieldID: id, "recovery": hash}
+	update := bson.M{"$pull": bson.M{"recovery": hash}}
+
+	res, err := db.UpdateOne("sb_tokens", filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// TwoFactorRequired returns true if the user must enter a code to sign in,
+// because they enabled it or their role requires it
+func TwoFactorRequired(db Database, tok Token) (bool, error) {
+	if len(tok.TOTPSecret) > 0 {
+		return true, nil
+	}
+
+	settings, err := GetAuthSettings(db)
+	if err != nil {
+		return false, err
+	}
+	return settings.RequiresTwoFactor(tok.Role), nil
+}
+
+// TwoFactorSession is a web UI sign in of a root user who entered their
+// code. Root requests of users who must use a second factor are refused
+// without one.
+type TwoFactorSession struct {
+	Base    string
+	TokenID primitive.ObjectID
+	Expires time.Time
+}
+
+// TwoFactorSessionKey returns the cache key of the session
+func TwoFactorSessionKey(id string) string {
+	return "2fasession:" + id
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// AuthSettingsCollection holds the email verification, magic link and
+	// two-factor settings of a base
+	AuthSettingsCollection = "sb_auth"
+	// EmailTokensCollection holds the tokens sent by email, only their
+	// hashes are stored
+	EmailTokensCollection = "sb_emailtokens"
+)
+
+// The purposes of the tokens sent by email, they're also the names of their
+// email templates
+const (
+	EmailTokenVerify    = "verify"
+	EmailTokenMagicLink = "magiclink"
+)
+
+// EmailTemplate is the subject and HTML body of an email, both are Go
+// templates receiving the Email, Link, Token and Expires of the token.
+type EmailTemplate struct {
+	Subject string `bson:"subject" json:"subject"`
+	Body    string `bson:"body" json:"body"`
+}
+
+// AuthSettings controls email verification, magic links and two-factor
+// authentication. The URLs are pages of the app receiving the token in the
+// token query string parameter.
+type AuthSettings struct {
+	ID primitive.ObjectID `bson:"_id" json:"-"`
+	// VerifyEmail sends a confirmation email to new users
+	VerifyEmail bool `bson:"verifyEmail" json:"verifyEmail"`
+	// RequireVerified refuses to sign in users who did not confirm their
+	// email
+	RequireVerified bool   `bson:"requireVerified" json:"requireVerified"`
+	VerifyURL       string `bson:"verifyUrl" json:"verifyUrl"`
+	MagicLinkURL    string `bson:"magicLinkUrl" json:"magicLinkUrl"`
+	// Templates replace the default emails, by token purpose
+	Templates map[string]EmailTemplate `bson:"templates" json:"templates"`
+	// TwoFactorMinRole requires two-factor authentication for the users
+	// with this role or a higher one, nil when it's optional
+	TwoFactorMinRole *int `bson:"twoFactorMinRole,omitempty" json:"twoFactorMinRole,omitempty"`
+}
+
+// RequiresTwoFactor returns true if users with the role must sign in with
+// a second factor
+func (s AuthSettings) RequiresTwoFactor(role int) bool {
+	return s.TwoFactorMinRole != nil && role >= *s.TwoFactorMinRole
+}
+
+// GetAuthSettings returns the settings of the base, the zero value when
+// they were never saved
+func GetAuthSettings(db Database) (AuthSettings, error) {
+	var s AuthSettings
+	if err := db.FindOne(AuthSettingsCollection, bson.M{}, &s); errors.Is(err, ErrNotFound) {
+		return AuthSettings{}, nil
+	} else if err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+func SaveAuthSettings(db Database, s AuthSettings) error {
+	if _, err := db.DeleteMany(AuthSettingsCollection, bson.M{}); err != nil {
+		return err
+	}
+
+	s.ID = primitive.NewObjectID()
+	return db.InsertOne(AuthSettingsCollection, s)
+}
+
+// EmailToken is a one-time token sent to the user's email
+type EmailToken struct {
+	ID      primitive.ObjectID `bson:"_id"`
+	UserID  primitive.ObjectID `bson:"userId"`
+	Purpose string             `bson:"purpose"`
+	Hash    string             `bson:"hash"`
+	Expires time.Time          `bson:"expires"`
+}
+
+// CreateEmailToken stores the token, the previous ones of the user for the
+// same purpose cannot be used anymore
+func CreateEmailToken(db Database, t EmailToken) error {
+	filter := bson.M{"userId": t.UserID, "purpose": t.Purpose}
+	if _, err := db.DeleteMany(EmailTokensCollection, filter); err != nil {
+		return err
+	}
+	return db.InsertOne(EmailTokensCollection, t)
+}
+
+// ConsumeEmailToken removes the token and returns its user, ErrNotFound if
+// the token does not exist, was used or is expired
+func ConsumeEmailToken(db Database, purpose, hash string) (primitive.ObjectID, error) {
+	var t EmailToken
+	if err := db.FindOne(EmailTokensCollection, bson.M{"purpose": purpose, "hash": hash}, &t); err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	// a token is only used once, even by concurrent requests
+	n, err := db.DeleteOne(EmailTokensCollection, bson.M{FieldID: t.ID})
+	if err != nil {
+		return primitive.NilObjectID, err
+	} else if n == 0 || time.Now().After(t.Expires) {
+		return primitive.NilObjectID, ErrNotFound
+	}
+	return t.UserID, nil
+}
+
+// SetVerified marks the user's email as confirmed or waiting to be
+func SetVerified(db Database, id primitive.ObjectID, verified bool) error {
+	update := bson.M{"$unset": bson.M{"unverified": ""}}
+	if !verified {
+		update = bson.M{"$set": bson.M{"unverified": true}}
+	}
+
+	_, err := db.UpdateOne("sb_tokens", bson.M{FieldID: id}, update)
+	return err
+}
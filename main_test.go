@@ -1,17 +1,18 @@
 package staticbackend
 
 import (
-	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"staticbackend/cache"
 	"staticbackend/db"
+	"staticbackend/function"
 	"staticbackend/internal"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -29,6 +30,7 @@ const (
 var (
 	database   *Database
 	funexec    *functions
+	tasker     *tasks
 	wsURL      string
 	pubKey     string
 	adminToken string
@@ -37,11 +39,26 @@ var (
 )
 
 func TestMain(m *testing.M) {
-	if err := openDatabase("mongodb://localhost:27017"); err != nil {
+	dbHost := os.Getenv("DATABASE_URL")
+	if len(dbHost) == 0 {
+		// without a database we run the tests on a temporary embedded one
+		os.Setenv("DATA_STORE", internal.DataStoreEmbedded)
+		dbHost = filepath.Join(os.TempDir(), "sb_unittest.db")
+	}
+
+	if err := openDatabase(dbHost); err != nil {
 		log.Fatal(err)
 	}
 
-	volatile = cache.NewCache()
+	if len(os.Getenv("REDIS_HOST")) == 0 {
+		mem := cache.NewMemory()
+		mem.LoadRules = loadRules
+		volatile = mem
+	} else {
+		c := cache.NewCache()
+		c.LoadRules = loadRules
+		volatile = c
+	}
 
 	deleteAndSetupTestAccount()
 
@@ -63,23 +80,25 @@ func TestMain(m *testing.M) {
 
 	funexec = &functions{base: &db.Base{PublishDocument: volatile.PublishDocument}}
 
+	ts := &function.TaskScheduler{Client: client, Volatile: volatile, Base: &db.Base{PublishDocument: volatile.PublishDocument}}
+	ts.Start()
+	tasker = &tasks{scheduler: ts}
+
 	os.Exit(m.Run())
 }
 
 func deleteAndSetupTestAccount() {
-	ctx := context.Background()
-
-	if err := client.Database(dbName).Drop(ctx); err != nil {
+	if err := client.Database(dbName).Drop(); err != nil {
 		log.Fatal(err)
 	}
 
 	sysDB := client.Database("sbsys")
 
-	if _, err := sysDB.Collection("accounts").DeleteMany(ctx, bson.M{"email": admEmail}); err != nil {
+	if _, err := sysDB.DeleteMany("accounts", bson.M{"email": admEmail}); err != nil {
 		log.Fatal(err)
 	}
 
-	if _, err := sysDB.Collection("bases").DeleteOne(ctx, bson.M{"name": dbName}); err != nil {
+	if _, err := sysDB.DeleteOne("bases", bson.M{"name": dbName}); err != nil {
 		log.Fatal(err)
 	}
 
@@ -89,7 +108,7 @@ func deleteAndSetupTestAccount() {
 		Email: admEmail,
 	}
 
-	if _, err := sysDB.Collection("accounts").InsertOne(ctx, cus); err != nil {
+	if err := sysDB.InsertOne("accounts", cus); err != nil {
 		log.Fatal(err)
 	}
 
@@ -101,7 +120,7 @@ func deleteAndSetupTestAccount() {
 		IsActive:  true,
 	}
 
-	if _, err := sysDB.Collection("bases").InsertOne(ctx, base); err != nil {
+	if err := sysDB.InsertOne("bases", base); err != nil {
 		log.Fatal(err)
 	}
 
@@ -119,10 +138,19 @@ func deleteAndSetupTestAccount() {
 
 	rootToken = fmt.Sprintf("%s|%s|%s", dbToken.ID.Hex(), dbToken.AccountID.Hex(), dbToken.Token)
 
-	token, _, err = m.createUser(db, dbToken.AccountID, userEmail, userPassword, 0)
+	token, userTok, err := m.createUser(db, dbToken.AccountID, userEmail, userPassword, 0)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	userToken = string(token)
+
+	// the realtime permission checks need the base of the tokens, it's
+	// cached when they're used on an API call
+	for _, tok := range []internal.Token{dbToken, userTok} {
+		key := fmt.Sprintf("%s|%s", tok.ID.Hex(), tok.Token)
+		if err := volatile.SetTyped("base:"+key, base); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
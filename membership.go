@@ -1,7 +1,6 @@
 package staticbackend
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,21 +9,18 @@ import (
 	"strings"
 	"time"
 
-	"staticbackend/cache"
 	"staticbackend/internal"
 	"staticbackend/middleware"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/gbrlsnchs/jwt/v3"
 )
 
 type membership struct {
-	volatile *cache.Cache
+	volatile internal.PubSuber
 }
 
 func (m *membership) emailExists(w http.ResponseWriter, r *http.Request) {
@@ -42,8 +38,7 @@ func (m *membership) emailExists(w http.ResponseWriter, r *http.Request) {
 
 	db := client.Database(conf.Name)
 
-	ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
-	count, err := db.Collection("sb_tokens").CountDocuments(ctx, bson.M{"email": email})
+	count, err := db.Count("sb_tokens", bson.M{"email": email})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -75,45 +70,25 @@ func (m *membership) login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token := fmt.Sprintf("%s|%s", tok.ID.Hex(), tok.Token)
-
-	// get their JWT
-	jwtBytes, err := m.getJWT(token)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	auth := internal.Auth{
-		AccountID: tok.AccountID,
-		UserID:    tok.ID,
-		Email:     tok.Email,
-		Role:      tok.Role,
-		Token:     tok.Token,
-	}
-
-	//TODO: find a good way to find all occurences of those two
-	// and make them easily callable via a shared function
-	if err := m.volatile.SetTyped(token, auth); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if err := m.volatile.SetTyped("base:"+token, conf); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if tok.Unverified {
+		settings, err := internal.GetAuthSettings(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if settings.RequireVerified {
+			http.Error(w, "please confirm your email before signing in", http.StatusForbidden)
+			return
+		}
 	}
 
-	respond(w, http.StatusOK, string(jwtBytes))
+	m.signIn(w, r, conf, *tok)
 }
 
-func (m *membership) validateUserPassword(db *mongo.Database, email, password string) (*internal.Token, error) {
+func (m *membership) validateUserPassword(db internal.Database, email, password string) (*internal.Token, error) {
 	email = strings.ToLower(email)
 
-	ctx := context.Background()
-	sr := db.Collection("sb_tokens").FindOne(ctx, bson.M{"email": email})
-
 	var tok internal.Token
-	if err := sr.Decode(&tok); err != nil {
+	if err := db.FindOne("sb_tokens", bson.M{"email": email}, &tok); err != nil {
 		return nil, err
 	}
 
@@ -143,7 +118,7 @@ func (m *membership) register(w http.ResponseWriter, r *http.Request) {
 	l.Email = strings.ToLower(l.Email)
 
 	// make sure this email does not exists
-	count, err := db.Collection("sb_tokens").CountDocuments(context.Background(), bson.M{"email": l.Email})
+	count, err := db.Count("sb_tokens", bson.M{"email": l.Email})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -152,35 +127,25 @@ func (m *membership) register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jwtBytes, tok, err := m.createAccountAndUser(db, l.Email, l.Password, 0)
+	_, tok, err := m.createAccountAndUser(db, l.Email, l.Password, 0)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	token := string(jwtBytes)
-
-	auth := internal.Auth{
-		AccountID: tok.AccountID,
-		UserID:    tok.ID,
-		Email:     tok.Email,
-		Role:      tok.Role,
-		Token:     tok.Token,
-	}
-
-	if err := m.volatile.SetTyped(token, auth); err != nil {
+	// they'll sign in once their email is confirmed
+	if required, err := startVerification(conf, tok); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
-	}
-	if err := m.volatile.SetTyped("base:"+token, conf); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else if required {
+		respond(w, http.StatusAccepted, true)
 		return
 	}
 
-	respond(w, http.StatusOK, token)
+	m.signIn(w, r, conf, tok)
 }
 
-func (m *membership) createAccountAndUser(db *mongo.Database, email, password string, role int) ([]byte, internal.Token, error) {
+func (m *membership) createAccountAndUser(db internal.Database, email, password string, role int) ([]byte, internal.Token, error) {
 	acctID := primitive.NewObjectID()
 
 	a := internal.Account{
@@ -188,9 +153,7 @@ func (m *membership) createAccountAndUser(db *mongo.Database, email, password st
 		Email: email,
 	}
 
-	ctx := context.Background()
-	_, err := db.Collection("sb_accounts").InsertOne(ctx, a)
-	if err != nil {
+	if err := db.InsertOne("sb_accounts", a); err != nil {
 		return nil, internal.Token{}, err
 	}
 
@@ -201,9 +164,7 @@ func (m *membership) createAccountAndUser(db *mongo.Database, email, password st
 	return jwtBytes, tok, nil
 }
 
-func (m *membership) createUser(db *mongo.Database, accountID primitive.ObjectID, email, password string, role int) ([]byte, internal.Token, error) {
-	ctx := context.Background()
-
+func (m *membership) createUser(db internal.Database, accountID primitive.ObjectID, email, password string, role int) ([]byte, internal.Token, error) {
 	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, internal.Token{}, err
@@ -218,25 +179,25 @@ func (m *membership) createUser(db *mongo.Database, accountID primitive.ObjectID
 		Role:      role,
 	}
 
-	_, err = db.Collection("sb_tokens").InsertOne(ctx, tok)
-	if err != nil {
+	if err := db.InsertOne("sb_tokens", tok); err != nil {
 		return nil, tok, err
 	}
 
 	token := fmt.Sprintf("%s|%s", tok.ID.Hex(), tok.Token)
 
 	// Get their JWT
-	jwtBytes, err := m.getJWT(token)
+	jwtBytes, err := m.getJWT(token, "")
 	if err != nil {
 		return nil, tok, err
 	}
 
 	auth := internal.Auth{
-		AccountID: tok.AccountID,
-		UserID:    tok.ID,
-		Email:     tok.Email,
-		Role:      role,
-		Token:     tok.Token,
+		AccountID:  tok.AccountID,
+		UserID:     tok.ID,
+		Email:      tok.Email,
+		Role:       role,
+		Token:      tok.Token,
+		Attributes: tok.Attributes,
 	}
 	if err := m.volatile.SetTyped(token, auth); err != nil {
 		return nil, tok, err
@@ -313,7 +274,7 @@ func (m *membership) resetPassword(w http.ResponseWriter, r *http.Request) {
 
 func (m *membership) setRole(w http.ResponseWriter, r *http.Request) {
 	conf, a, err := middleware.Extract(r, true)
-	if err != nil || a.Role < 100 {
+	if err != nil || a.Role < internal.RootRole {
 		http.Error(w, "insufficient priviledges", http.StatusUnauthorized)
 		return
 	}
@@ -329,10 +290,56 @@ func (m *membership) setRole(w http.ResponseWriter, r *http.Request) {
 
 	db := client.Database(conf.Name)
 
-	ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
+	data.Email = strings.ToLower(data.Email)
+
 	filter := bson.M{"email": data.Email}
 	update := bson.M{"$set": bson.M{"role": data.Role}}
-	if _, err := db.Collection("sb_tokens").UpdateOne(ctx, filter, update); err != nil {
+	if _, err := db.UpdateOne("sb_tokens", filter, update); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := m.refreshAuth(db, data.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, http.StatusOK, true)
+}
+
+// setAttributes replaces the user's attributes used by permission rules
+func (m *membership) setAttributes(w http.ResponseWriter, r *http.Request) {
+	conf, a, err := middleware.Extract(r, true)
+	if err != nil || a.Role < internal.RootRole {
+		http.Error(w, "insufficient priviledges", http.StatusUnauthorized)
+		return
+	}
+
+	var data = new(struct {
+		Email      string                 `json:"email"`
+		Attributes map[string]interface{} `json:"attributes"`
+	})
+	if err := parseBody(r.Body, &data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := client.Database(conf.Name)
+
+	data.Email = strings.ToLower(data.Email)
+
+	filter := bson.M{"email": data.Email}
+	update := bson.M{"$set": bson.M{"attrs": data.Attributes}}
+	res, err := db.UpdateOne("sb_tokens", filter, update)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if res.MatchedCount == 0 {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	if err := m.refreshAuth(db, data.Email); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -340,9 +347,30 @@ func (m *membership) setRole(w http.ResponseWriter, r *http.Request) {
 	respond(w, http.StatusOK, true)
 }
 
+// refreshAuth updates the cached authentication of the user so a new role or
+// new attributes apply to their current session.
+func (m *membership) refreshAuth(db internal.Database, email string) error {
+	tok, err := internal.FindTokenByEmail(db, email)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s|%s", tok.ID.Hex(), tok.Token)
+
+	var auth internal.Auth
+	if err := m.volatile.GetTyped(key, &auth); err != nil {
+		// not cached, it will be loaded from the database
+		return nil
+	}
+
+	auth.Role = tok.Role
+	auth.Attributes = tok.Attributes
+	return m.volatile.SetTyped(key, auth)
+}
+
 func (m *membership) setPassword(w http.ResponseWriter, r *http.Request) {
 	conf, a, err := middleware.Extract(r, true)
-	if err != nil || a.Role < 100 {
+	if err != nil || a.Role < internal.RootRole {
 		http.Error(w, "insufficient priviledges", http.StatusUnauthorized)
 		return
 	}
@@ -371,10 +399,9 @@ func (m *membership) setPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
 	filter := bson.M{"_id": tok.ID}
 	update := bson.M{"$set": bson.M{"pw": string(newpw)}}
-	if _, err := db.Collection("sb_tokens").UpdateOne(ctx, filter, update); err != nil {
+	if _, err := db.UpdateOne("sb_tokens", filter, update); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -382,17 +409,20 @@ func (m *membership) setPassword(w http.ResponseWriter, r *http.Request) {
 	respond(w, http.StatusOK, true)
 }
 
-func (m *membership) getJWT(token string) ([]byte, error) {
+// getJWT returns an access token valid for accessTokenTTL, session is empty
+// for tokens that cannot be refreshed
+func (m *membership) getJWT(token, session string) ([]byte, error) {
 	now := time.Now()
 	pl := internal.JWTPayload{
 		Payload: jwt.Payload{
 			Issuer:         "StaticBackend",
-			ExpirationTime: jwt.NumericDate(now.Add(12 * time.Hour)),
-			NotBefore:      jwt.NumericDate(now.Add(30 * time.Minute)),
+			ExpirationTime: jwt.NumericDate(now.Add(accessTokenTTL)),
+			NotBefore:      jwt.NumericDate(now),
 			IssuedAt:       jwt.NumericDate(now),
 			JWTID:          primitive.NewObjectID().Hex(),
 		},
-		Token: token,
+		Token:   token,
+		Session: session,
 	}
 
 	return jwt.Sign(pl, internal.HashSecret)
@@ -420,25 +450,21 @@ func (m *membership) sudoGetTokenFromAccountID(w http.ResponseWriter, r *http.Re
 	}
 
 	filter := bson.M{internal.FieldAccountID: oid}
-	ctx := context.Background()
 
-	opt := options.Find()
-	opt.SetLimit(1)
-	opt.SetSort(bson.M{internal.FieldID: 1})
+	opt := internal.FindOptions{
+		Limit: 1,
+		Sort:  bson.D{{Key: internal.FieldID, Value: 1}},
+	}
 
-	cur, err := db.Collection("sb_tokens").Find(ctx, filter, opt)
-	if err != nil {
+	var toks []internal.Token
+	if err := db.Find("sb_tokens", filter, opt, &toks); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer cur.Close(ctx)
 
 	var tok internal.Token
-	if cur.Next(ctx) {
-		if err := cur.Decode(&tok); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	if len(toks) > 0 {
+		tok = toks[0]
 	}
 
 	if len(tok.Token) == 0 {
@@ -448,23 +474,28 @@ func (m *membership) sudoGetTokenFromAccountID(w http.ResponseWriter, r *http.Re
 
 	token := fmt.Sprintf("%s|%s", tok.ID.Hex(), tok.Token)
 
-	jwtBytes, err := m.getJWT(token)
+	jwtBytes, err := m.getJWT(token, "")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	auth := internal.Auth{
-		AccountID: tok.AccountID,
-		UserID:    tok.ID,
-		Email:     tok.Email,
-		Role:      tok.Role,
-		Token:     tok.Token,
+		AccountID:  tok.AccountID,
+		UserID:     tok.ID,
+		Email:      tok.Email,
+		Role:       tok.Role,
+		Token:      tok.Token,
+		Attributes: tok.Attributes,
 	}
 	if err := m.volatile.SetTyped(token, auth); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := m.volatile.SetTyped("base:"+token, conf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	respond(w, http.StatusOK, string(jwtBytes))
 }
@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"staticbackend/internal"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TrustProxy makes the IP allow-list of the API keys use the
+// X-Forwarded-For header, only set TRUST_PROXY behind a single reverse proxy
+// that appends the client's address to it
+var TrustProxy = len(os.Getenv("TRUST_PROXY")) > 0
+
+// apiKeyTouchInterval is how often the last use of a key is saved
+const apiKeyTouchInterval = time.Minute
+
+// IsAPIKey returns true if the bearer token is an API key
+func IsAPIKey(key string) bool {
+	return strings.HasPrefix(key, internal.APIKeyPrefix)
+}
+
+// ValidateAPIKey returns the authentication of the API key. It has the
+// permissions of the root user who created the key, limited to its scopes.
+func ValidateAPIKey(client internal.Persister, r *http.Request, key string) (internal.Auth, error) {
+	a := internal.Auth{}
+
+	conf, ok := r.Context().Value(ContextBase).(internal.BaseConfig)
+	if !ok {
+		return a, fmt.Errorf("invalid StaticBackend public key")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(key, internal.APIKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return a, fmt.Errorf("invalid API key")
+	}
+
+	id, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		return a, fmt.Errorf("invalid API key")
+	}
+
+	db := client.Database(conf.Name)
+
+	// revoked keys are deleted, they're refused right away
+	k, err := internal.FindAPIKey(db, id)
+	if err != nil {
+		return a, fmt.Errorf("invalid API key")
+	}
+
+	hash := internal.HashAPIKeySecret(parts[1])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(k.Hash)) != 1 {
+		return a, fmt.Errorf("invalid API key")
+	}
+
+	now := time.Now()
+	if k.Expired(now) {
+		return a, fmt.Errorf("this API key has expired")
+	}
+
+	ip := ClientIP(r)
+	if !k.AllowsIP(ip) {
+		return a, fmt.Errorf("this API key cannot be used from %s", ip)
+	}
+
+	var tok internal.Token
+	if err := db.FindOne("sb_tokens", bson.M{internal.FieldID: k.UserID}, &tok); err != nil || tok.Role < RootRole {
+		return a, fmt.Errorf("the user who created this API key is not a root user anymore")
+	}
+
+	if now.Sub(k.LastUsed) > apiKeyTouchInterval {
+		if err := internal.TouchAPIKey(db, k.ID, ip, now); err != nil {
+			return a, err
+		}
+	}
+
+	a = internal.Auth{
+		AccountID:  tok.AccountID,
+		UserID:     tok.ID,
+		Email:      tok.Email,
+		Role:       tok.Role,
+		Token:      tok.Token,
+		Attributes: tok.Attributes,
+		APIKeyID:   k.ID.Hex(),
+		Scopes:     k.Scopes,
+	}
+	return a, nil
+}
+
+// authorizeAPIKey validates the API key and its scope for the request, it
+// writes the error response and returns false when the key is refused
+func authorizeAPIKey(client internal.Persister, w http.ResponseWriter, r *http.Request, key string) (internal.Auth, bool) {
+	a, err := ValidateAPIKey(client, r, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return a, false
+	}
+
+	scope, ok := apiKeyScope(r)
+	if !ok {
+		http.Error(w, "API keys cannot be used for this request", http.StatusForbidden)
+		return a, false
+	} else if len(scope) > 0 && !a.Allowed(scope) {
+		http.Error(w, fmt.Sprintf("this API key does not have the %s scope", scope), http.StatusForbidden)
+		return a, false
+	}
+	return a, true
+}
+
+// apiKeyScope returns the permission an API key needs for the request, false
+// for the requests API keys cannot make. It's empty for /fn/exec, the
+// function is in the body and the handler checks the fn:exec scope.
+func apiKeyScope(r *http.Request) (string, bool) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	name := ""
+	if len(parts) > 1 {
+		name = parts[1]
+	}
+
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	switch parts[0] {
+	case "sudo":
+		if name == "sendmail" {
+			return "email:send", true
+		} else if name == "cache" {
+			return "", false
+		}
+		fallthrough
+	case "db", "history":
+		if len(name) == 0 {
+			return "", false
+		} else if read {
+			return "db:read:" + name, true
+		}
+		return "db:write:" + name, true
+	case "query", "sudoquery", "aggregate", "search":
+		if len(name) == 0 {
+			return "", false
+		}
+		return "db:read:" + name, true
+	case "inc", "csv":
+		if len(name) == 0 {
+			return "", false
+		}
+		return "db:write:" + name, true
+	case "storage":
+		if name == "upload" {
+			return "storage:upload", true
+		}
+	case "sudostorage":
+		if name == "delete" {
+			return "storage:delete", true
+		}
+	case "fn":
+		if name == "exec" {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// ClientIP returns the IP address making the request. When TrustProxy is
+// set it's the last address of the X-Forwarded-For header, the one the
+// proxy added, the previous ones are sent by the client.
+func ClientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); TrustProxy && len(fwd) > 0 {
+		addrs := strings.Split(fwd, ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -5,20 +5,20 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"staticbackend/internal"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/gbrlsnchs/jwt/v3"
 )
 
 const (
-	RootRole = 100
+	RootRole = internal.RootRole
 )
 
-func RequireAuth(client *mongo.Client, volatile internal.PubSuber) Middleware {
+func RequireAuth(client internal.Persister, volatile internal.PubSuber) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			key := r.Header.Get("Authorization")
@@ -55,6 +55,16 @@ func RequireAuth(client *mongo.Client, volatile internal.PubSuber) Middleware {
 
 			ctx := r.Context()
 
+			if IsAPIKey(key) {
+				a, ok := authorizeAPIKey(client, w, r, key)
+				if !ok {
+					return
+				}
+
+				next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, ContextAuth, a)))
+				return
+			}
+
 			auth, err := ValidateAuthKey(client, volatile, ctx, key)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
@@ -68,11 +78,12 @@ func RequireAuth(client *mongo.Client, volatile internal.PubSuber) Middleware {
 	}
 }
 
-func ValidateAuthKey(client *mongo.Client, volatile internal.PubSuber, ctx context.Context, key string) (internal.Auth, error) {
+func ValidateAuthKey(client internal.Persister, volatile internal.PubSuber, ctx context.Context, key string) (internal.Auth, error) {
 	a := internal.Auth{}
 
 	var pl internal.JWTPayload
-	if _, err := jwt.Verify([]byte(key), internal.HashSecret, &pl); err != nil {
+	expires := jwt.ValidatePayload(&pl.Payload, jwt.ExpirationTimeValidator(time.Now()))
+	if _, err := jwt.Verify([]byte(key), internal.HashSecret, &pl, expires); err != nil {
 		return a, fmt.Errorf("could not verify your authentication token: %s", err.Error())
 	}
 
@@ -83,12 +94,19 @@ func ValidateAuthKey(client *mongo.Client, volatile internal.PubSuber, ctx conte
 
 	db := client.Database(conf.Name)
 
+	if len(pl.Session) > 0 {
+		if err := validateSession(db, volatile, pl.Session); err != nil {
+			return a, err
+		}
+	}
+
 	var auth internal.Auth
 	if err := volatile.GetTyped(pl.Token, &auth); err == nil {
+		auth.SessionID = pl.Session
 		return auth, nil
 	}
 
-	parts := strings.Split(key, "|")
+	parts := strings.Split(pl.Token, "|")
 	if len(parts) != 2 {
 		return a, fmt.Errorf("invalid authentication token")
 	}
@@ -104,11 +122,12 @@ func ValidateAuthKey(client *mongo.Client, volatile internal.PubSuber, ctx conte
 	}
 
 	a = internal.Auth{
-		AccountID: token.AccountID,
-		UserID:    token.ID,
-		Email:     token.Email,
-		Role:      token.Role,
-		Token:     token.Token,
+		AccountID:  token.AccountID,
+		UserID:     token.ID,
+		Email:      token.Email,
+		Role:       token.Role,
+		Token:      token.Token,
+		Attributes: token.Attributes,
 	}
 	if err := volatile.SetTyped(pl.Token, a); err != nil {
 		return a, err
@@ -119,10 +138,38 @@ func ValidateAuthKey(client *mongo.Client, volatile internal.PubSuber, ctx conte
 		return a, err
 	}
 
+	a.SessionID = pl.Session
 	return a, nil
 }
 
-func RequireRoot(client *mongo.Client) Middleware {
+// validateSession returns an error if the session was revoked or expired,
+// active sessions are cached with their expiry until they're revoked
+func validateSession(db internal.Database, volatile internal.PubSuber, id string) error {
+	key := "session:" + id
+	if v, err := volatile.Get(key); err == nil {
+		if expires, err := time.Parse(time.RFC3339Nano, v); err == nil && time.Now().Before(expires) {
+			return nil
+		}
+	}
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("invalid session")
+	}
+
+	s, err := internal.FindSession(db, oid)
+	if err != nil || time.Now().After(s.Expires) {
+		return fmt.Errorf("your session has ended, please sign in again")
+	}
+
+	return volatile.Set(key, s.Expires.Format(time.RFC3339Nano))
+}
+
+// TwoFactorCookie holds the two-factor session of root users signed in to
+// the web UI with a code
+const TwoFactorCookie = "sb2fa"
+
+func RequireRoot(client internal.Persister, volatile internal.PubSuber) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			key := r.Header.Get("Authorization")
@@ -155,18 +202,39 @@ func RequireRoot(client *mongo.Client) Middleware {
 				return
 			}
 
+			if IsAPIKey(key) {
+				a, ok := authorizeAPIKey(client, w, r, key)
+				if !ok {
+					return
+				}
+
+				next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, ContextAuth, a)))
+				return
+			}
+
 			tok, err := ValidateRootToken(client, conf.Name, key)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
+			// the root token alone is not enough for users with a second
+			// factor, they need the session of a sign in with their code
+			if ok, err := hasTwoFactorSession(client, volatile, r, conf.Name, tok); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if !ok {
+				http.Error(w, "two-factor authentication required, sign in to the web UI with your code or use an API key", http.StatusUnauthorized)
+				return
+			}
+
 			a := internal.Auth{
-				AccountID: tok.AccountID,
-				UserID:    tok.ID,
-				Email:     tok.Email,
-				Role:      tok.Role,
-				Token:     tok.Token,
+				AccountID:  tok.AccountID,
+				UserID:     tok.ID,
+				Email:      tok.Email,
+				Role:       tok.Role,
+				Token:      tok.Token,
+				Attributes: tok.Attributes,
 			}
 
 			ctx = context.WithValue(ctx, ContextAuth, a)
@@ -176,7 +244,29 @@ func RequireRoot(client *mongo.Client) Middleware {
 	}
 }
 
-func ValidateRootToken(client *mongo.Client, base, token string) (internal.Token, error) {
+// hasTwoFactorSession returns true if the root user does not need a second
+// factor or the request has the two-factor session of their sign in
+func hasTwoFactorSession(client internal.Persister, volatile internal.PubSuber, r *http.Request, base string, tok internal.Token) (bool, error) {
+	required, err := internal.TwoFactorRequired(client.Database(base), tok)
+	if err != nil {
+		return false, err
+	} else if !required {
+		return true, nil
+	}
+
+	ck, err := r.Cookie(TwoFactorCookie)
+	if err != nil {
+		return false, nil
+	}
+
+	var s internal.TwoFactorSession
+	if err := volatile.GetTyped(internal.TwoFactorSessionKey(ck.Value), &s); err != nil {
+		return false, nil
+	}
+	return s.Base == base && s.TokenID == tok.ID && time.Now().Before(s.Expires), nil
+}
+
+func ValidateRootToken(client internal.Persister, base, token string) (internal.Token, error) {
 	tok := internal.Token{}
 
 	parts := strings.Split(token, "|")
@@ -30,6 +30,7 @@ func Cors() Middleware {
 			headers.Set("Access-Control-Allow-Methods", strings.ToUpper(r.Header.Get("Access-Control-Request-Method")))
 
 			headers.Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+			headers.Set("Access-Control-Expose-Headers", "SB-Refresh-Token")
 
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
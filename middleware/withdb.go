@@ -7,10 +7,9 @@ import (
 	"staticbackend/internal"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func WithDB(client *mongo.Client, volatile internal.PubSuber) Middleware {
+func WithDB(client internal.Persister, volatile internal.PubSuber) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			key := r.Header.Get("SB-PUBLIC-KEY")
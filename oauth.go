@@ -0,0 +1,817 @@
+package staticbackend
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"staticbackend/internal"
+	"staticbackend/middleware"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// oauthStateTTL is how long users have to sign in at the provider
+	oauthStateTTL = 10 * time.Minute
+	// oauthCodeTTL is how long the app has to exchange its code for a JWT
+	oauthCodeTTL = 2 * time.Minute
+)
+
+var oauthClient = &http.Client{Timeout: 15 * time.Second}
+
+// oauthPresets are the settings of well-known providers, they're used for
+// a provider with the same name when they're not set.
+var oauthPresets = map[string]internal.OAuthProvider{
+	"google": {
+		Issuer: "https://accounts.google.com",
+		Scopes: []string{"openid", "email", "profile"},
+	},
+	"github": {
+		AuthURL:     "https://github.com/login/oauth/authorize",
+		TokenURL:    "https://github.com/login/oauth/access_token",
+		UserInfoURL: "https://api.github.com/user",
+		Scopes:      []string{"read:user", "user:email"},
+	},
+}
+
+// oauthState is kept while the user signs in at the provider
+type oauthState struct {
+	Conf     internal.BaseConfig `json:"conf"`
+	Provider string              `json:"provider"`
+	Verifier string              `json:"verifier"`
+	Nonce    string              `json:"nonce"`
+	Redirect string              `json:"redirect"`
+	Callback string              `json:"callback"`
+	Expires  time.Time           `json:"expires"`
+}
+
+// oauthCode is the one-time code the app exchanges for the user's JWT
+type oauthCode struct {
+	Base    string             `json:"base"`
+	TokenID primitive.ObjectID `json:"tokenId"`
+	Expires time.Time          `json:"expires"`
+}
+
+type oauthEndpoints struct {
+	Issuer      string `json:"issuer"`
+	AuthURL     string `json:"authorization_endpoint"`
+	TokenURL    string `json:"token_endpoint"`
+	UserInfoURL string `json:"userinfo_endpoint"`
+}
+
+type oauthTokens struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// oauthIdentity is the user as known by the provider
+type oauthIdentity struct {
+	Subject  string
+	Email    string
+	Verified bool
+}
+
+// oauthProviders manages the OAuth2 / OpenID Connect providers of the base,
+// it's reserved to root users:
+//
+//	GET /oauth/providers/ lists the providers
+//	GET /oauth/providers/{name} returns the provider's settings
+//	PUT /oauth/providers/{name} creates or replaces the provider
+//	DELETE /oauth/providers/{name} removes the provider
+//
+// Client secrets are never returned.
+func (m *membership) oauthProviders(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	name, _ := ShiftPath(r.URL.Path)
+
+	if len(name) == 0 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "missing provider name", http.StatusBadRequest)
+			return
+		}
+
+		providers, err := internal.ListOAuthProviders(curDB)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for i := range providers {
+			providers[i].ClientSecret = ""
+		}
+
+		respond(w, http.StatusOK, providers)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		p, err := internal.FindOAuthProvider(curDB, name)
+		if errors.Is(err, internal.ErrNotFound) {
+			http.Error(w, "provider not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		p.ClientSecret = ""
+		respond(w, http.StatusOK, p)
+	case http.MethodPost, http.MethodPut:
+		var p internal.OAuthProvider
+		if err := parseBody(r.Body, &p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		p.Name = name
+		if err := validateOAuthProvider(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := internal.SaveOAuthProvider(curDB, p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	case http.MethodDelete:
+		n, err := internal.DeleteOAuthProvider(curDB, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if n == 0 {
+			http.Error(w, "provider not found", http.StatusNotFound)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// validateOAuthProvider fills the settings of well-known providers and
+// makes sure the endpoints can be trusted
+func validateOAuthProvider(p *internal.OAuthProvider) error {
+	if preset, ok := oauthPresets[p.Name]; ok && len(p.Issuer) == 0 && len(p.AuthURL) == 0 {
+		p.Issuer = preset.Issuer
+		p.AuthURL = preset.AuthURL
+		p.TokenURL = preset.TokenURL
+		p.UserInfoURL = preset.UserInfoURL
+		if len(p.Scopes) == 0 {
+			p.Scopes = preset.Scopes
+		}
+	}
+
+	if len(p.ClientID) == 0 {
+		return errors.New("the clientId is required")
+	}
+
+	if len(p.Issuer) > 0 {
+		p.Issuer = strings.TrimSuffix(p.Issuer, "/")
+		if err := checkEndpoint(p.Issuer); err != nil {
+			return err
+		}
+
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "email", "profile"}
+		} else if !hasScope(p.Scopes, "openid") {
+			p.Scopes = append([]string{"openid"}, p.Scopes...)
+		}
+		return nil
+	}
+
+	if len(p.AuthURL) == 0 || len(p.TokenURL) == 0 || len(p.UserInfoURL) == 0 {
+		return errors.New("an issuer or the authUrl, tokenUrl and userInfoUrl are required")
+	}
+
+	for _, s := range []string{p.AuthURL, p.TokenURL, p.UserInfoURL} {
+		if err := checkEndpoint(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEndpoint only allows HTTPS endpoints, except on the local machine.
+// The ID token is trusted because it's received from the token endpoint
+// over TLS.
+func checkEndpoint(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid URL %s: %v", s, err)
+	}
+
+	if u.Scheme == "https" {
+		return nil
+	} else if u.Scheme == "http" && isLoopback(u.Hostname()) {
+		return nil
+	}
+	return fmt.Errorf("%s must use https", s)
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// oauthLogin redirects the user to the provider to sign in, the
+// authorization code flow with PKCE:
+//
+//	GET /oauth/login/{provider}?redirect=https://app/signedin
+//
+// The public key can be passed as the sbpk query string parameter. Once
+// signed in the user is redirected to the app with a one-time code to
+// exchange for their JWT at /oauth/token, or with an error.
+func (m *membership) oauthLogin(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, "invalid StaticBackend key", http.StatusUnauthorized)
+		return
+	}
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	name, _ := ShiftPath(r.URL.Path)
+
+	redirect := r.URL.Query().Get("redirect")
+	if err := checkRedirect(conf, redirect); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, err := internal.FindOAuthProvider(client.Database(conf.Name), name)
+	if errors.Is(err, internal.ErrNotFound) {
+		http.Error(w, "provider not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ep, err := oauthDiscover(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	st := oauthState{
+		Conf:     conf,
+		Provider: p.Name,
+		Redirect: redirect,
+		Callback: callbackURL(r),
+		Expires:  time.Now().Add(oauthStateTTL),
+	}
+	if st.Verifier, err = randomToken(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if st.Nonce, err = randomToken(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := m.volatile.SetTyped("oauth:"+state, st); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+
+	qs := url.Values{}
+	qs.Set("response_type", "code")
+	qs.Set("client_id", p.ClientID)
+	qs.Set("redirect_uri", st.Callback)
+	qs.Set("scope", strings.Join(p.Scopes, " "))
+	qs.Set("state", state)
+	qs.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	qs.Set("code_challenge_method", "S256")
+	if len(p.Issuer) > 0 {
+		qs.Set("nonce", st.Nonce)
+	}
+
+	u, err := url.Parse(ep.AuthURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	q := u.Query()
+	for k, v := range qs {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// checkRedirect makes sure the app's URL is on a domain of the base
+func checkRedirect(conf internal.BaseConfig, redirect string) error {
+	u, err := url.Parse(redirect)
+	if err != nil || len(redirect) == 0 {
+		return errors.New("invalid redirect URL")
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("the redirect URL must use http or https")
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range conf.Whitelist {
+		if strings.ToLower(domain) == host {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in the whitelist of the base", host)
+}
+
+// callbackURL is where the provider sends the user back, it must be
+// registered at the provider
+func callbackURL(r *http.Request) string {
+	return serverURL(r) + "/oauth/callback"
+}
+
+// serverURL returns the scheme and host the request was made to
+func serverURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+// oauthCallback is where the provider sends the user back:
+//
+//	GET /oauth/callback?code=...&state=...
+//
+// The identity is linked to the user with the same verified email, a user
+// is created when none exists.
+func (m *membership) oauthCallback(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+
+	var st oauthState
+	key := "oauth:" + state
+	if len(state) == 0 || m.volatile.GetTyped(key, &st) != nil || time.Now().After(st.Expires) {
+		http.Error(w, "invalid or expired sign in, please try again", http.StatusBadRequest)
+		return
+	}
+
+	// a state is only used once
+	if err := m.volatile.Del(key); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if e := r.URL.Query().Get("error"); len(e) > 0 {
+		redirectTo(w, r, st.Redirect, "error", e)
+		return
+	}
+
+	code, err := m.oauthSignIn(st, r.URL.Query().Get("code"))
+	if err != nil {
+		redirectTo(w, r, st.Redirect, "error", err.Error())
+		return
+	}
+
+	redirectTo(w, r, st.Redirect, "code", code)
+}
+
+// oauthSignIn exchanges the provider's code, finds or creates the user and
+// returns the one-time code for the app
+func (m *membership) oauthSignIn(st oauthState, code string) (string, error) {
+	if len(code) == 0 {
+		return "", errors.New("missing code")
+	}
+
+	db := client.Database(st.Conf.Name)
+
+	p, err := internal.FindOAuthProvider(db, st.Provider)
+	if err != nil {
+		return "", err
+	}
+
+	ep, err := oauthDiscover(p)
+	if err != nil {
+		return "", err
+	}
+
+	tokens, err := exchangeCode(p, ep, st, code)
+	if err != nil {
+		return "", err
+	}
+
+	var id oauthIdentity
+	if len(p.Issuer) > 0 {
+		if id, err = idTokenIdentity(p, ep, st, tokens.IDToken); err != nil {
+			return "", err
+		}
+	}
+
+	if len(id.Email) == 0 && len(ep.UserInfoURL) > 0 {
+		info, err := userInfoIdentity(ep.UserInfoURL, tokens.AccessToken)
+		if err != nil {
+			return "", err
+		} else if len(id.Subject) > 0 && info.Subject != id.Subject {
+			return "", errors.New("the user info does not match the ID token")
+		}
+		id = info
+	}
+
+	if len(id.Subject) == 0 {
+		return "", errors.New("the provider did not return the user's identity")
+	}
+
+	tok, err := m.oauthUser(db, p.Name, id)
+	if err != nil {
+		return "", err
+	}
+
+	oc, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	c := oauthCode{
+		Base:    st.Conf.Name,
+		TokenID: tok.ID,
+		Expires: time.Now().Add(oauthCodeTTL),
+	}
+	if err := m.volatile.SetTyped("oauthcode:"+oc, c); err != nil {
+		return "", err
+	}
+	return oc, nil
+}
+
+// oauthUser returns the user linked to the identity. Otherwise the
+// identity is linked to the user with the same email or a user is created,
+// in both cases the provider must have verified the email. Users that have
+// not verified their email are not linked, whoever created them knows their
+// password.
+func (m *membership) oauthUser(db internal.Database, provider string, id oauthIdentity) (internal.Token, error) {
+	tok, err := internal.FindTokenByIdentity(db, provider, id.Subject)
+	if err == nil {
+		return tok, nil
+	} else if !errors.Is(err, internal.ErrNotFound) {
+		return tok, err
+	}
+
+	email := strings.ToLower(id.Email)
+	if len(email) == 0 {
+		return tok, errors.New("the provider did not return the user's email")
+	} else if !id.Verified {
+		return tok, errors.New("the provider did not verify the user's email")
+	}
+
+	tok, err = internal.FindTokenByEmail(db, email)
+	if errors.Is(err, internal.ErrNotFound) {
+		// the user signs in with the provider, their password is unknown
+		pw, err := randomToken()
+		if err != nil {
+			return tok, err
+		}
+
+		if _, tok, err = m.createAccountAndUser(db, email, pw, 0); err != nil {
+			return tok, err
+		}
+	} else if err != nil {
+		return tok, err
+	} else if tok.Unverified {
+		return tok, errors.New("an account waiting for its email to be verified exists for this email")
+	}
+
+	if err := internal.LinkIdentity(db, tok.ID, provider, id.Subject); err != nil {
+		return tok, err
+	}
+	return tok, nil
+}
+
+// oauthToken exchanges the one-time code of a sign in for the user's JWT:
+//
+//	POST /oauth/token {"code": "..."}
+func (m *membership) oauthToken(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, "invalid StaticBackend key", http.StatusUnauthorized)
+		return
+	}
+
+	var data struct {
+		Code string `json:"code"`
+	}
+	if err := parseBody(r.Body, &data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var c oauthCode
+	key := "oauthcode:" + data.Code
+	if len(data.Code) == 0 || m.volatile.GetTyped(key, &c) != nil || c.Base != conf.Name || time.Now().After(c.Expires) {
+		http.Error(w, "invalid or expired code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := m.volatile.Del(key); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	db := client.Database(conf.Name)
+
+	var tok internal.Token
+	if err := db.FindOne("sb_tokens", bson.M{internal.FieldID: c.TokenID}, &tok); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.signIn(w, r, conf, tok)
+}
+
+// oauthDiscover returns the provider's endpoints, from its OpenID
+// configuration when it has an issuer
+func oauthDiscover(p internal.OAuthProvider) (oauthEndpoints, error) {
+	if len(p.Issuer) == 0 {
+		ep := oauthEndpoints{
+			AuthURL:     p.AuthURL,
+			TokenURL:    p.TokenURL,
+			UserInfoURL: p.UserInfoURL,
+		}
+		return ep, nil
+	}
+
+	var ep oauthEndpoints
+	if err := getJSON(p.Issuer+"/.well-known/openid-configuration", "", &ep); err != nil {
+		return ep, fmt.Errorf("cannot discover the provider %s: %v", p.Name, err)
+	}
+
+	if strings.TrimSuffix(ep.Issuer, "/") != p.Issuer {
+		return ep, fmt.Errorf("the provider's issuer %s does not match %s", ep.Issuer, p.Issuer)
+	}
+
+	for _, s := range []string{ep.AuthURL, ep.TokenURL} {
+		if err := checkEndpoint(s); err != nil {
+			return ep, err
+		}
+	}
+	if len(ep.UserInfoURL) > 0 {
+		if err := checkEndpoint(ep.UserInfoURL); err != nil {
+			return ep, err
+		}
+	}
+	return ep, nil
+}
+
+// exchangeCode gets the tokens of the user, the verifier proves the code
+// was requested by us
+func exchangeCode(p internal.OAuthProvider, ep oauthEndpoints, st oauthState, code string) (oauthTokens, error) {
+	var tokens oauthTokens
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", st.Callback)
+	form.Set("client_id", p.ClientID)
+	form.Set("client_secret", p.ClientSecret)
+	form.Set("code_verifier", st.Verifier)
+
+	req, err := http.NewRequest(http.MethodPost, ep.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return tokens, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return tokens, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return tokens, fmt.Errorf("invalid token response: %v", err)
+	}
+
+	if len(tokens.Error) > 0 {
+		return tokens, fmt.Errorf("%s: %s", tokens.Error, tokens.ErrorDescription)
+	} else if resp.StatusCode > 299 {
+		return tokens, fmt.Errorf("the token endpoint returned %s", resp.Status)
+	} else if len(tokens.IDToken) == 0 && len(p.Issuer) > 0 {
+		return tokens, errors.New("the provider did not return an ID token")
+	}
+	return tokens, nil
+}
+
+// idTokenIdentity validates the claims of the ID token. Its signature is
+// not checked, it's received directly from the token endpoint over TLS.
+func idTokenIdentity(p internal.OAuthProvider, ep oauthEndpoints, st oauthState, idToken string) (oauthIdentity, error) {
+	var id oauthIdentity
+
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return id, errors.New("invalid ID token")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return id, fmt.Errorf("invalid ID token: %v", err)
+	}
+
+	var claims struct {
+		Issuer        string      `json:"iss"`
+		Subject       string      `json:"sub"`
+		Audience      interface{} `json:"aud"`
+		Expires       int64       `json:"exp"`
+		Nonce         string      `json:"nonce"`
+		Email         string      `json:"email"`
+		EmailVerified interface{} `json:"email_verified"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return id, fmt.Errorf("invalid ID token: %v", err)
+	}
+
+	if claims.Issuer != ep.Issuer {
+		return id, errors.New("the ID token is from another issuer")
+	} else if !hasAudience(claims.Audience, p.ClientID) {
+		return id, errors.New("the ID token is for another client")
+	} else if time.Now().After(time.Unix(claims.Expires, 0)) {
+		return id, errors.New("the ID token is expired")
+	} else if claims.Nonce != st.Nonce {
+		return id, errors.New("the ID token is for another sign in")
+	}
+
+	id.Subject = claims.Subject
+	id.Email = claims.Email
+	id.Verified = isTrue(claims.EmailVerified)
+	return id, nil
+}
+
+func hasAudience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isTrue handles providers returning booleans as strings
+func isTrue(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case string:
+		return b == "true"
+	}
+	return false
+}
+
+// userInfoIdentity gets the user from the provider's user info endpoint.
+// Providers without email_verified, like GitHub, list the user's emails at
+// {userinfo}/emails, the primary one is used if it's verified.
+func userInfoIdentity(userInfoURL, accessToken string) (oauthIdentity, error) {
+	var id oauthIdentity
+
+	var info map[string]interface{}
+	if err := getJSON(userInfoURL, accessToken, &info); err != nil {
+		return id, fmt.Errorf("cannot get the user info: %v", err)
+	}
+
+	for _, k := range []string{"sub", "id"} {
+		switch v := info[k].(type) {
+		case string:
+			id.Subject = v
+		case json.Number:
+			id.Subject = v.String()
+		}
+		if len(id.Subject) > 0 {
+			break
+		}
+	}
+
+	id.Email, _ = info["email"].(string)
+
+	if verified, ok := info["email_verified"]; ok {
+		id.Verified = isTrue(verified)
+		return id, nil
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(userInfoURL+"/emails", accessToken, &emails); err != nil {
+		// the email is kept unverified
+		return id, nil
+	}
+
+	for _, e := range emails {
+		if e.Primary {
+			id.Email = e.Email
+			id.Verified = e.Verified
+		}
+	}
+	return id, nil
+}
+
+func getJSON(u, accessToken string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if len(accessToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// redirectTo sends the user back to the app with the parameter added
+func redirectTo(w http.ResponseWriter, r *http.Request, redirect, key, value string) {
+	u, err := withQuery(redirect, key, value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// withQuery adds the query string parameter to the URL
+func withQuery(s, key, value string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// randomToken returns a random URL-safe string for states, nonces and PKCE
+// verifiers
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
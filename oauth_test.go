@@ -0,0 +1,257 @@
+package staticbackend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"staticbackend/internal"
+	"staticbackend/middleware"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+// mockOIDC is a local OpenID Connect provider, codes are the emails of the
+// users signing in
+type mockOIDC struct {
+	*httptest.Server
+	challenges map[string]string
+	nonces     map[string]string
+}
+
+func newMockOIDC() *mockOIDC {
+	p := &mockOIDC{
+		challenges: make(map[string]string),
+		nonces:     make(map[string]string),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusOK, map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		code := r.Form.Get("code")
+		verifier := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if p.challenges[code] != base64.RawURLEncoding.EncodeToString(verifier[:]) {
+			respond(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		} else if r.Form.Get("client_secret") != "mock-secret" {
+			respond(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		claims := map[string]interface{}{
+			"iss":            p.URL,
+			"sub":            "sub-" + code,
+			"aud":            "mock-client",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"nonce":          p.nonces[code],
+			"email":          code,
+			"email_verified": !strings.HasPrefix(code, "unverified"),
+		}
+		b, err := json.Marshal(claims)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		idToken := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(b) + ".sig"
+		respond(w, http.StatusOK, map[string]string{
+			"access_token": "mock-access",
+			"token_type":   "Bearer",
+			"id_token":     idToken,
+		})
+	})
+
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// signIn follows the flow for the email and returns the app's redirect
+func (p *mockOIDC) signIn(t *testing.T, m *membership, email string) *url.URL {
+	resp := dbReq(t, m.oauthLogin, "GET", "/oauth/login/mock?redirect="+url.QueryEscape("http://localhost:3000/signedin"), nil)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	auth, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := auth.Query()
+	if !strings.HasPrefix(auth.String(), p.URL+"/authorize") {
+		t.Fatalf("expected a redirect to the provider got %s", auth)
+	} else if q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("expected a PKCE challenge got %s", auth)
+	}
+
+	p.challenges[email] = q.Get("code_challenge")
+	p.nonces[email] = q.Get("nonce")
+
+	req := httptest.NewRequest("GET", "/oauth/callback?code="+url.QueryEscape(email)+"&state="+q.Get("state"), nil)
+	w := httptest.NewRecorder()
+	m.oauthCallback(w, req)
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to the app got %d: %s", w.Code, w.Body.String())
+	}
+
+	back, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return back
+}
+
+func oauthExchange(t *testing.T, m *membership, code string) *http.Response {
+	b, err := json.Marshal(map[string]string{"code": code})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/oauth/token", bytes.NewReader(b))
+	req.Header.Set("SB-PUBLIC-KEY", pubKey)
+	w := httptest.NewRecorder()
+
+	h := middleware.Chain(http.HandlerFunc(m.oauthToken), middleware.WithDB(client, volatile))
+	h.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestOAuthLogin(t *testing.T) {
+	p := newMockOIDC()
+	defer p.Close()
+
+	m := &membership{volatile: volatile}
+
+	provider := map[string]interface{}{
+		"issuer":       p.URL,
+		"clientId":     "mock-client",
+		"clientSecret": "mock-secret",
+	}
+	resp := dbReq(t, m.oauthProviders, "PUT", "/oauth/providers/mock", provider, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, m.oauthProviders, "GET", "/oauth/providers/mock", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var saved internal.OAuthProvider
+	if err := parseBody(resp.Body, &saved); err != nil {
+		t.Fatal(err)
+	} else if len(saved.ClientSecret) > 0 {
+		t.Error("the client secret should not be returned")
+	} else if saved.Scopes[0] != "openid" {
+		t.Errorf("expected the default scopes got %v", saved.Scopes)
+	}
+
+	// the app must be on a domain of the base
+	resp = dbReq(t, m.oauthLogin, "GET", "/oauth/login/mock?redirect="+url.QueryEscape("https://evil.com/"), nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a redirect outside the whitelist got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	// an existing user is linked by email
+	back := p.signIn(t, m, userEmail)
+	code := back.Query().Get("code")
+	if len(code) == 0 {
+		t.Fatalf("expected a code got %s", back)
+	}
+
+	resp = oauthExchange(t, m, code)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var token string
+	if err := parseBody(resp.Body, &token); err != nil {
+		t.Fatal(err)
+	}
+
+	var pl internal.JWTPayload
+	if _, err := jwt.Verify([]byte(token), internal.HashSecret, &pl); err != nil {
+		t.Fatal(err)
+	}
+
+	curDB := database.client.Database(dbName)
+	tok, err := internal.FindTokenByEmail(curDB, userEmail)
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(pl.Token, tok.ID.Hex()+"|") {
+		t.Errorf("expected a JWT for %s got %s", tok.ID.Hex(), pl.Token)
+	} else if tok.Identities["mock"] != "sub-"+userEmail {
+		t.Errorf("expected the identity to be linked got %v", tok.Identities)
+	}
+
+	// codes are used once
+	resp = oauthExchange(t, m, code)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 reusing a code got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	// a new user is created
+	back = p.signIn(t, m, "oauth@test.com")
+	resp = oauthExchange(t, m, back.Query().Get("code"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	newTok, err := internal.FindTokenByEmail(curDB, "oauth@test.com")
+	if err != nil {
+		t.Fatal(err)
+	} else if newTok.Identities["mock"] != "sub-oauth@test.com" {
+		t.Errorf("expected the identity of the new user got %v", newTok.Identities)
+	}
+
+	// unverified emails are refused
+	back = p.signIn(t, m, "unverified@test.com")
+	if len(back.Query().Get("error")) == 0 {
+		t.Errorf("expected an error for an unverified email got %s", back)
+	}
+
+	// users that did not verify their email are not linked
+	_, pending, err := m.createUser(curDB, tok.AccountID, "pending@test.com", "pending-password", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := internal.SetVerified(curDB, pending.ID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	back = p.signIn(t, m, "pending@test.com")
+	if len(back.Query().Get("error")) == 0 {
+		t.Errorf("expected an error for a user with an unverified email got %s", back)
+	}
+
+	pending, err = internal.FindTokenByEmail(curDB, "pending@test.com")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(pending.Identities) > 0 {
+		t.Errorf("expected the identity not to be linked got %v", pending.Identities)
+	} else if !pending.Unverified {
+		t.Error("expected the user to remain unverified")
+	}
+}
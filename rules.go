@@ -0,0 +1,133 @@
+package staticbackend
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"staticbackend/internal"
+	"staticbackend/middleware"
+)
+
+// rules manages the collection permission rules, it's reserved to root
+// users:
+//
+//	GET /rules/ lists the rules of all collections
+//	GET /rules/{col} returns the collection's rules
+//	PUT /rules/{col} creates or replaces the collection's rules
+//	DELETE /rules/{col} removes the collection's rules
+func (database *Database) rules(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := database.client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	col, _ := ShiftPath(r.URL.Path)
+
+	if len(col) == 0 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "missing collection name", http.StatusBadRequest)
+			return
+		}
+
+		list, err := internal.ListRules(curDB)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(list) == 0 {
+			list = make([]internal.CollectionRules, 0)
+		}
+
+		respond(w, http.StatusOK, list)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		cr, ok, err := internal.GetRules(curDB, col)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, "this collection has no rules", http.StatusNotFound)
+			return
+		}
+
+		respond(w, http.StatusOK, cr)
+	case http.MethodPost, http.MethodPut:
+		var rules []internal.Rule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cr := internal.CollectionRules{Collection: col, Rules: rules}
+		if err := cr.Check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := internal.SetRules(curDB, col, rules); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// the realtime permission checks read the rules from the cache
+		if err := database.cache.SetTyped(internal.RulesKey(conf.Name, col), cr); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	case http.MethodDelete:
+		if err := internal.DeleteRules(curDB, col); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// an empty value reads as no rules
+		if err := database.cache.Set(internal.RulesKey(conf.Name, col), ""); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// cacheRules loads the rules of all bases in the cache for the realtime
+// permission checks.
+func cacheRules() {
+	bases, err := internal.ListDatabases(client.Database("sbsys"))
+	if err != nil {
+		log.Println("error listing bases to cache their rules: ", err)
+		return
+	}
+
+	for _, base := range bases {
+		list, err := internal.ListRules(client.Database(base.Name))
+		if err != nil {
+			log.Printf("error loading the rules of base %s: %v\n", base.Name, err)
+			continue
+		}
+
+		for _, cr := range list {
+			if err := volatile.SetTyped(internal.RulesKey(base.Name, cr.Collection), cr); err != nil {
+				log.Println("error caching rules: ", err)
+			}
+		}
+	}
+}
+
+// loadRules reads the rules of a collection for the realtime permission
+// checks when they're not in the cache
+func loadRules(base, col string) (internal.CollectionRules, bool, error) {
+	return internal.GetRules(client.Database(base), col)
+}
@@ -0,0 +1,225 @@
+package staticbackend
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"staticbackend/db"
+	"staticbackend/internal"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRulesInvalid(t *testing.T) {
+	invalids := [][]internal.Rule{
+		{{Operations: []string{"write"}}},
+		{{Operations: []string{internal.OpRead}, Condition: "doc.a == doc.b"}},
+		{{Operations: []string{internal.OpRead}, Condition: "doc.a == "}},
+		{{Operations: []string{internal.OpRead}, Condition: "(doc.a == 1"}},
+		{{Condition: "doc.a == 1"}},
+	}
+
+	for _, rules := range invalids {
+		resp := dbReq(t, database.rules, "PUT", "/rules/invalidrules", rules, true)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400 for %v got %s", rules, resp.Status)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestRulesEnforcement(t *testing.T) {
+	rules := []internal.Rule{
+		{Operations: []string{internal.OpRead}, Condition: "doc.teamId in auth.teams || doc.public == true"},
+		{Operations: []string{internal.OpCreate, internal.OpUpdate}, Condition: `doc.teamId in auth.teams && doc.status != "locked"`},
+		{Roles: []int{5}, Operations: []string{internal.OpDelete}},
+	}
+
+	resp := dbReq(t, database.rules, "PUT", "/rules/teamdocs", rules, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.rules, "GET", "/rules/teamdocs", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var cr internal.CollectionRules
+	if err := parseBody(resp.Body, &cr); err != nil {
+		t.Fatal(err)
+	} else if len(cr.Rules) != 3 {
+		t.Fatalf("expected 3 rules got %v", cr.Rules)
+	}
+
+	curDB := database.client.Database(dbName)
+
+	ids := make(map[string]primitive.ObjectID)
+	for _, doc := range []bson.M{
+		{"name": "a", "teamId": "a", "status": "open"},
+		{"name": "locked", "teamId": "a", "status": "locked"},
+		{"name": "b", "teamId": "b", "status": "open"},
+		{"name": "public", "teamId": "c", "public": true},
+	} {
+		id := primitive.NewObjectID()
+		doc[internal.FieldID] = id
+		if err := curDB.InsertOne("teamdocs", doc); err != nil {
+			t.Fatal(err)
+		}
+		ids[doc["name"].(string)] = id
+	}
+
+	auth := internal.Auth{
+		AccountID:  primitive.NewObjectID(),
+		UserID:     primitive.NewObjectID(),
+		Attributes: map[string]interface{}{"teams": []interface{}{"a"}},
+	}
+
+	result, err := database.base.List(auth, curDB, "teamdocs", db.ListParams{Page: 1, Size: 25})
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Total != 3 {
+		t.Errorf("expected 3 readable documents got %d", result.Total)
+	}
+
+	if _, err := database.base.GetByID(auth, curDB, "teamdocs", ids["b"].Hex(), db.ReadParams{}); !errors.Is(err, internal.ErrNotFound) {
+		t.Errorf("expected not found reading another team's document got %v", err)
+	}
+
+	if _, err := database.base.Add(auth, curDB, "teamdocs", map[string]interface{}{"teamId": "b"}); !errors.Is(err, internal.ErrPermissionDenied) {
+		t.Errorf("expected permission denied creating for another team got %v", err)
+	}
+	if _, err := database.base.Add(auth, curDB, "teamdocs", map[string]interface{}{"teamId": "a"}); err != nil {
+		t.Errorf("expected to create for their team got %v", err)
+	}
+
+	if _, err := database.base.Update(auth, curDB, "teamdocs", ids["locked"].Hex(), map[string]interface{}{"name": "x"}, db.UpdateOptions{}); !errors.Is(err, internal.ErrNotFound) {
+		t.Errorf("expected not found updating a locked document got %v", err)
+	}
+	if _, err := database.base.Update(auth, curDB, "teamdocs", ids["a"].Hex(), map[string]interface{}{"name": "x"}, db.UpdateOptions{}); err != nil {
+		t.Errorf("expected to update their team's document got %v", err)
+	}
+
+	// the updated document must still be allowed
+	if _, err := database.base.Update(auth, curDB, "teamdocs", ids["a"].Hex(), map[string]interface{}{"teamId": "b"}, db.UpdateOptions{}); !errors.Is(err, internal.ErrPermissionDenied) {
+		t.Errorf("expected permission denied moving a document to another team got %v", err)
+	}
+	if err := database.base.Increase(auth, curDB, "teamdocs", ids["a"].Hex(), "count", 1); err != nil {
+		t.Errorf("expected to increase their team's document got %v", err)
+	}
+
+	var moved bson.M
+	if err := curDB.FindOne("teamdocs", bson.M{internal.FieldID: ids["a"]}, &moved); err != nil {
+		t.Fatal(err)
+	} else if moved["teamId"] != "a" {
+		t.Errorf("expected the denied update to be rolled back got %v", moved)
+	}
+
+	// a missing attribute matches nothing, not the documents without the field
+	noTeams := internal.Auth{AccountID: auth.AccountID, UserID: auth.UserID}
+	result, err = database.base.List(noTeams, curDB, "teamdocs", db.ListParams{Page: 1, Size: 25})
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Total != 1 {
+		t.Errorf("expected only the public document without teams got %d", result.Total)
+	}
+	if _, err := database.base.Add(noTeams, curDB, "teamdocs", map[string]interface{}{"name": "noteam"}); !errors.Is(err, internal.ErrPermissionDenied) {
+		t.Errorf("expected permission denied creating without teams got %v", err)
+	}
+
+	if _, err := database.base.Delete(auth, curDB, "teamdocs", ids["a"].Hex()); !errors.Is(err, internal.ErrPermissionDenied) {
+		t.Errorf("expected permission denied deleting without the role got %v", err)
+	}
+
+	auth.Role = 5
+	if n, err := database.base.Delete(auth, curDB, "teamdocs", ids["b"].Hex()); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("expected role 5 to delete 1 document got %d", n)
+	}
+
+	root := internal.Auth{AccountID: auth.AccountID, UserID: auth.UserID, Role: internal.RootRole}
+	result, err = database.base.List(root, curDB, "teamdocs", db.ListParams{Page: 1, Size: 25})
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Total != 4 {
+		t.Errorf("expected root to read 4 documents got %d", result.Total)
+	}
+
+	// realtime events are checked against the cached rules
+	auth.Role = 0
+	if err := volatile.SetTyped("rules-token", auth); err != nil {
+		t.Fatal(err)
+	} else if err := volatile.SetTyped("base:rules-token", internal.BaseConfig{Name: dbName}); err != nil {
+		t.Fatal(err)
+	}
+
+	checker, ok := volatile.(interface {
+		HasPermission(token, repo, payload string) bool
+	})
+	if !ok {
+		t.Fatal("the cache does not check permissions")
+	}
+
+	// once expired from the cache the rules are loaded again
+	for _, evicted := range []bool{false, true} {
+		if evicted {
+			if err := volatile.Del(internal.RulesKey(dbName, "teamdocs")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for teamID, expected := range map[string]bool{"a": true, "b": false} {
+			b, err := json.Marshal(map[string]interface{}{"id": primitive.NewObjectID(), "teamId": teamID})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ok := checker.HasPermission("rules-token", "db-teamdocs", string(b)); ok != expected {
+				t.Errorf("expected realtime permission %v for team %s got %v (evicted %v)", expected, teamID, ok, evicted)
+			}
+		}
+	}
+
+	resp = dbReq(t, database.rules, "DELETE", "/rules/teamdocs", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	// without rules the permission of the name applies, it's owner only
+	result, err = database.base.List(auth, curDB, "teamdocs", db.ListParams{Page: 1, Size: 25})
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Total != 1 {
+		t.Errorf("expected only the created document without rules got %d", result.Total)
+	}
+}
+
+func TestSetAttributes(t *testing.T) {
+	data := map[string]interface{}{
+		"email":      userEmail,
+		"attributes": map[string]interface{}{"teams": []string{"a", "b"}},
+	}
+
+	m := &membership{volatile: volatile}
+
+	resp := dbReq(t, m.setAttributes, "POST", "/setattributes", data, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	tok, err := internal.FindTokenByEmail(client.Database(dbName), userEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	teams, ok := tok.Attributes["teams"].(primitive.A)
+	if !ok || len(teams) != 2 {
+		t.Errorf("expected 2 teams got %v", tok.Attributes)
+	}
+}
@@ -0,0 +1,84 @@
+package staticbackend
+
+import (
+	"encoding/json"
+	"net/http"
+	"staticbackend/db"
+	"staticbackend/middleware"
+)
+
+// schema manages the collection schemas, it's reserved to root users:
+//
+//	GET /schema/ lists all schemas
+//	GET /schema/{col} returns the collection's schema
+//	PUT /schema/{col} creates or replaces the collection's schema
+//	DELETE /schema/{col} removes the collection's schema
+func (database *Database) schema(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := database.client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	col, _ := ShiftPath(r.URL.Path)
+
+	if len(col) == 0 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "missing collection name", http.StatusBadRequest)
+			return
+		}
+
+		schemas, err := db.ListSchemas(curDB)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, schemas)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		schema, err := db.GetSchema(curDB, col)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if schema == nil {
+			http.Error(w, "this collection has no schema", http.StatusNotFound)
+			return
+		}
+
+		respond(w, http.StatusOK, schema)
+	case http.MethodPost, http.MethodPut:
+		var schema db.Schema
+		if err := json.NewDecoder(r.Body).Decode(&schema); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := schema.Check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := db.SetSchema(curDB, col, schema); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	case http.MethodDelete:
+		if err := db.DeleteSchema(curDB, col); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
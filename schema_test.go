@@ -0,0 +1,122 @@
+package staticbackend
+
+import (
+	"net/http"
+	"staticbackend/db"
+	"testing"
+)
+
+func TestSchemaValidation(t *testing.T) {
+	schema := map[string]interface{}{
+		"type":     "object",
+		"required": []string{"title", "priority"},
+		"properties": map[string]interface{}{
+			"title":    map[string]interface{}{"type": "string", "minLength": 3},
+			"priority": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 5},
+			"status":   map[string]interface{}{"enum": []string{"open", "closed"}},
+			"code":     map[string]interface{}{"type": []string{"string", "null"}, "pattern": "^[A-Z]{3}$"},
+		},
+		"additionalProperties": false,
+	}
+
+	resp := dbReq(t, database.schema, "PUT", "/schema/schemacol", schema, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	valid := map[string]interface{}{"title": "valid", "priority": 5, "status": "open", "code": "ABC"}
+	resp = dbReq(t, database.add, "POST", "/db/schemacol", valid)
+	if resp.StatusCode > 299 {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := parseBody(resp.Body, &created); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := map[string]interface{}{"title": "no", "priority": "high", "status": "done", "code": "abc", "extra": true}
+	resp = dbReq(t, database.add, "POST", "/db/schemacol", invalid)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %s", resp.Status)
+	}
+
+	var ve db.ValidationError
+	if err := parseBody(resp.Body, &ve); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := make(map[string]bool)
+	for _, fe := range ve.Errors {
+		fields[fe.Field] = true
+	}
+	for _, field := range []string{"title", "priority", "status", "code", "extra"} {
+		if !fields[field] {
+			t.Errorf("expected an error for field %s got %v", field, ve.Errors)
+		}
+	}
+
+	update := map[string]interface{}{"priority": 2.5}
+	resp = dbReq(t, database.update, "PUT", "/db/schemacol/"+created.ID, update)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("update: expected status 400 got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	inc := map[string]interface{}{"field": "priority", "range": 1}
+	resp = dbReq(t, database.increase, "PUT", "/inc/schemacol/"+created.ID, inc)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("increase: expected status 400 got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	bulk := []interface{}{valid, map[string]interface{}{"title": "second"}}
+	resp = dbReq(t, database.bulkAdd, "POST", "/db/schemacol?bulk=1", bulk)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bulk: expected status 400 got %s", resp.Status)
+	}
+
+	ve = db.ValidationError{}
+	if err := parseBody(resp.Body, &ve); err != nil {
+		t.Fatal(err)
+	} else if len(ve.Errors) != 1 || ve.Errors[0].Field != "1.priority" {
+		t.Errorf("bulk: expected an error for 1.priority got %v", ve.Errors)
+	}
+
+	resp = dbReq(t, database.add, "POST", "/db/sb_schemas", valid)
+	if resp.StatusCode < 300 {
+		t.Errorf("expected writes to %s to be refused", db.SchemaCollection)
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.schema, "DELETE", "/schema/schemacol", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.add, "POST", "/db/schemacol", invalid)
+	if resp.StatusCode > 299 {
+		t.Errorf("expected document to be accepted without a schema got %s", resp.Status)
+	}
+	resp.Body.Close()
+}
+
+func TestSchemaInvalid(t *testing.T) {
+	schemas := []map[string]interface{}{
+		{"type": "array"},
+		{"type": "object", "properties": map[string]interface{}{"a": map[string]interface{}{"type": "date"}}},
+		{"type": "object", "properties": map[string]interface{}{"a": map[string]interface{}{"pattern": "("}}},
+	}
+
+	for _, schema := range schemas {
+		resp := dbReq(t, database.schema, "PUT", "/schema/badschema", schema, true)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400 for %v got %s", schema, resp.Status)
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,123 @@
+package staticbackend
+
+import (
+	"net/http"
+	"staticbackend/db"
+	"staticbackend/internal"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSearch(t *testing.T) {
+	idx := internal.Index{
+		Keys: []internal.IndexKey{{Field: "title", Weight: 10}, {Field: "body"}},
+		Text: true,
+	}
+	resp := dbReq(t, database.indexes, "POST", "/indexes/notes", idx, true)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	other := internal.Index{Keys: []internal.IndexKey{{Field: "tags"}}, Text: true}
+	resp = dbReq(t, database.indexes, "POST", "/indexes/notes", other, true)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a second text index got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	notes := []map[string]interface{}{
+		{"title": "Groceries", "body": "Buy milk and coffee beans", "done": false},
+		{"title": "Coffee shops", "body": "The best places in town", "done": false},
+		{"title": "Coffee machine", "body": "Repair the coffee machine", "done": true},
+		{"title": "Books", "body": "Read more", "done": false},
+	}
+	for _, note := range notes {
+		resp := dbReq(t, database.add, "POST", "/db/notes", note)
+		if resp.StatusCode > 299 {
+			t.Fatal(GetResponseBody(t, resp))
+		}
+		resp.Body.Close()
+	}
+
+	data := map[string]interface{}{"text": "Coffee", "highlight": true}
+	resp = dbReq(t, database.search, "POST", "/search/notes", data)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var result db.SearchResult
+	if err := parseBody(resp.Body, &result); err != nil {
+		t.Fatal(err)
+	} else if result.Total != 3 || len(result.Results) != 3 {
+		t.Fatalf("expected 3 results got %d %v", result.Total, result.Results)
+	}
+
+	if title := result.Results[2].Doc["title"]; title != "Groceries" {
+		t.Errorf("expected the body match to rank last got %v", title)
+	}
+	for i := 1; i < len(result.Results); i++ {
+		if result.Results[i].Score > result.Results[i-1].Score {
+			t.Errorf("expected results ordered by score got %v", result.Results)
+		}
+	}
+
+	if h := result.Results[2].Highlights["body"]; !strings.Contains(h, "<mark>coffee</mark>") {
+		t.Errorf("expected coffee to be highlighted got %s", h)
+	}
+
+	data["filter"] = [][]interface{}{{"done", "=", true}}
+	resp = dbReq(t, database.search, "POST", "/search/notes?size=1", data)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	result = db.SearchResult{}
+	if err := parseBody(resp.Body, &result); err != nil {
+		t.Fatal(err)
+	} else if result.Total != 1 || result.Results[0].Doc["title"] != "Coffee machine" {
+		t.Errorf("expected only the done note got %v", result.Results)
+	}
+
+	// documents of another account are not found by non-root users
+	acctID, err := primitive.ObjectIDFromHex(result.Results[0].Doc[internal.FieldAccountID].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	curDB := database.client.Database(dbName)
+	err = curDB.InsertOne("notes", bson.M{
+		internal.FieldID:        primitive.NewObjectID(),
+		internal.FieldAccountID: primitive.NewObjectID(),
+		internal.FieldOwnerID:   primitive.NewObjectID(),
+		"title":                 "Coffee of another account",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := internal.Auth{AccountID: acctID, UserID: primitive.NewObjectID()}
+	found, err := database.base.Search(auth, curDB, "notes", nil, db.SearchParams{Text: "coffee"})
+	if err != nil {
+		t.Fatal(err)
+	} else if found.Total != 3 {
+		t.Errorf("expected 3 results for the account got %d", found.Total)
+	}
+
+	auth.Role = internal.RootRole
+	found, err = database.base.Search(auth, curDB, "notes", nil, db.SearchParams{Text: "coffee"})
+	if err != nil {
+		t.Fatal(err)
+	} else if found.Total != 4 {
+		t.Errorf("expected root to find 4 results got %d", found.Total)
+	}
+
+	resp = dbReq(t, database.search, "POST", "/search/tasks", map[string]interface{}{"text": "coffee"})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 searching without text index got %s", resp.Status)
+	}
+	resp.Body.Close()
+}
@@ -1,7 +1,6 @@
 package staticbackend
 
 import (
-	"context"
 	"net/http"
 	"staticbackend/email"
 	"staticbackend/internal"
@@ -40,11 +39,9 @@ func sudoSendMail(w http.ResponseWriter, r *http.Request) {
 
 	db := client.Database("sbsys")
 
-	ctx := context.Background()
-
 	filter := bson.M{internal.FieldID: config.SBID}
 	update := bson.M{"$inc": bson.M{"mes": 1}}
-	if _, err := db.Collection("accounts").UpdateOne(ctx, filter, update); err != nil {
+	if _, err := db.UpdateOne("accounts", filter, update); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"staticbackend/datastore"
 	"staticbackend/db"
 	"staticbackend/email"
 	"staticbackend/function"
@@ -18,15 +19,11 @@ import (
 	"staticbackend/storage"
 	"strings"
 	"syscall"
-	"time"
 
 	"staticbackend/cache"
 
 	"github.com/stripe/stripe-go/v71"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -36,11 +33,13 @@ const (
 )
 
 var (
-	client   *mongo.Client
-	volatile *cache.Cache
+	client   internal.Persister
+	volatile internal.PubSuber
 	emailer  internal.Mailer
 	storer   internal.Storer
 	AppEnv   = os.Getenv("APP_ENV")
+	// PublicURL is the address of the server for the links in emails
+	PublicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
 )
 
 // Start starts the web server and all dependencies services
@@ -53,6 +52,10 @@ func Start(dbHost, port string) {
 
 	initServices(dbHost)
 
+	cacheRules()
+
+	go purgeTrash()
+
 	// websockets
 	hub := newHub(volatile)
 	go hub.run()
@@ -103,7 +106,7 @@ func Start(dbHost, port string) {
 	database := &Database{
 		client: client,
 		cache:  volatile,
-		base:   &db.Base{PublishDocument: volatile.PublishDocument},
+		base:   &db.Base{PublishDocument: documentPublisher()},
 	}
 
 	pubWithDB := []middleware.Middleware{
@@ -119,25 +122,58 @@ func Start(dbHost, port string) {
 
 	stdRoot := []middleware.Middleware{
 		middleware.WithDB(client, volatile),
-		middleware.RequireRoot(client),
+		middleware.RequireRoot(client, volatile),
 	}
 
 	m := &membership{volatile: volatile}
 
 	http.Handle("/login", middleware.Chain(http.HandlerFunc(m.login), pubWithDB...))
+	http.Handle("/login/2fa", middleware.Chain(http.HandlerFunc(m.twoFactorLogin), pubWithDB...))
 	http.Handle("/register", middleware.Chain(http.HandlerFunc(m.register), pubWithDB...))
 	http.Handle("/email", middleware.Chain(http.HandlerFunc(m.emailExists), pubWithDB...))
+	http.Handle("/verify", middleware.Chain(http.HandlerFunc(verify), pubWithDB...))
+	http.Handle("/verify/send", middleware.Chain(http.HandlerFunc(sendVerification), pubWithDB...))
+	http.Handle("/magiclink", middleware.Chain(http.HandlerFunc(magicLink), pubWithDB...))
+	http.Handle("/magiclink/login", middleware.Chain(http.HandlerFunc(m.magicLinkLogin), pubWithDB...))
+	http.Handle("/auth/settings", middleware.Chain(http.HandlerFunc(authSettings), stdRoot...))
+	http.Handle("/apikeys", middleware.Chain(http.HandlerFunc(apiKeys), stdRoot...))
+	http.Handle("/apikeys/", middleware.Chain(http.HandlerFunc(apiKeys), stdRoot...))
+	http.Handle("/refresh", middleware.Chain(http.HandlerFunc(m.refresh), pubWithDB...))
+	http.Handle("/logout", middleware.Chain(http.HandlerFunc(m.logout), stdAuth...))
+	http.Handle("/logout/all", middleware.Chain(http.HandlerFunc(m.logoutAll), stdAuth...))
+	http.Handle("/sessions", middleware.Chain(http.HandlerFunc(m.sessions), stdAuth...))
+	http.Handle("/sessions/", middleware.Chain(http.HandlerFunc(m.sessions), stdAuth...))
+	http.Handle("/2fa", middleware.Chain(http.HandlerFunc(m.twoFactor), stdAuth...))
+	http.Handle("/2fa/", middleware.Chain(http.HandlerFunc(m.twoFactor), stdAuth...))
+	http.Handle("/oauth/providers/", middleware.Chain(http.HandlerFunc(m.oauthProviders), stdRoot...))
+	http.Handle("/oauth/login/", middleware.Chain(http.HandlerFunc(m.oauthLogin), pubWithDB...))
+	http.HandleFunc("/oauth/callback", m.oauthCallback)
+	http.Handle("/oauth/token", middleware.Chain(http.HandlerFunc(m.oauthToken), pubWithDB...))
 	http.Handle("/password/resetcode", middleware.Chain(http.HandlerFunc(m.setResetCode), stdRoot...))
 	http.Handle("/password/reset", middleware.Chain(http.HandlerFunc(m.resetPassword), pubWithDB...))
-	//http.Handle("/setrole", chain(http.HandlerFunc(setRole), withDB))
+	http.Handle("/setrole", middleware.Chain(http.HandlerFunc(m.setRole), stdRoot...))
+	http.Handle("/setattributes", middleware.Chain(http.HandlerFunc(m.setAttributes), stdRoot...))
 
 	http.Handle("/sudogettoken/", middleware.Chain(http.HandlerFunc(m.sudoGetTokenFromAccountID), stdRoot...))
 
 	// database routes
 	http.Handle("/db/", middleware.Chain(http.HandlerFunc(database.dbreq), stdAuth...))
 	http.Handle("/query/", middleware.Chain(http.HandlerFunc(database.query), stdAuth...))
+	http.Handle("/csv/", middleware.Chain(http.HandlerFunc(database.importCSV), stdAuth...))
+	http.Handle("/aggregate/", middleware.Chain(http.HandlerFunc(database.aggregate), stdAuth...))
+	http.Handle("/search/", middleware.Chain(http.HandlerFunc(database.search), stdAuth...))
 	http.Handle("/inc/", middleware.Chain(http.HandlerFunc(database.increase), stdAuth...))
+	http.Handle("/tx", middleware.Chain(http.HandlerFunc(database.tx), stdAuth...))
 	http.Handle("/sudoquery/", middleware.Chain(http.HandlerFunc(database.query), stdRoot...))
+	http.Handle("/schema/", middleware.Chain(http.HandlerFunc(database.schema), stdRoot...))
+	http.Handle("/rules/", middleware.Chain(http.HandlerFunc(database.rules), stdRoot...))
+	http.Handle("/indexes/", middleware.Chain(http.HandlerFunc(database.indexes), stdRoot...))
+	http.Handle("/softdelete/", middleware.Chain(http.HandlerFunc(database.softDelete), stdRoot...))
+	http.Handle("/trash/", middleware.Chain(http.HandlerFunc(database.trash), stdRoot...))
+	http.Handle("/audit/", middleware.Chain(http.HandlerFunc(database.audit), stdRoot...))
+	http.Handle("/history/", middleware.Chain(http.HandlerFunc(database.history), stdAuth...))
+	http.Handle("/export", middleware.Chain(http.HandlerFunc(export), stdRoot...))
+	http.Handle("/import", middleware.Chain(http.HandlerFunc(importBase), stdRoot...))
 	http.Handle("/sudolistall/", middleware.Chain(http.HandlerFunc(database.listCollections), stdRoot...))
 	http.Handle("/sudo/", middleware.Chain(http.HandlerFunc(database.dbreq), stdRoot...))
 	http.Handle("/newid", middleware.Chain(http.HandlerFunc(database.newID), stdAuth...))
@@ -185,7 +221,7 @@ func Start(dbHost, port string) {
 	http.Handle("/sse/msg", middleware.Chain(http.HandlerFunc(receiveMessage), pubWithDB...))
 
 	// server-side functions
-	f := &functions{base: &db.Base{PublishDocument: volatile.PublishDocument}}
+	f := &functions{base: &db.Base{PublishDocument: documentPublisher()}}
 	http.Handle("/fn/add", middleware.Chain(http.HandlerFunc(f.add), stdRoot...))
 	http.Handle("/fn/update", middleware.Chain(http.HandlerFunc(f.update), stdRoot...))
 	http.Handle("/fn/delete/", middleware.Chain(http.HandlerFunc(f.del), stdRoot...))
@@ -194,25 +230,54 @@ func Start(dbHost, port string) {
 	http.Handle("/fn/exec", middleware.Chain(http.HandlerFunc(f.exec), stdAuth...))
 	http.Handle("/fn", middleware.Chain(http.HandlerFunc(f.list), stdRoot...))
 
+	// scheduled tasks
+	ts := &function.TaskScheduler{Client: client, Volatile: volatile, Base: &db.Base{PublishDocument: documentPublisher()}}
+	ts.Start()
+
+	t := &tasks{scheduler: ts}
+	http.Handle("/task/add", middleware.Chain(http.HandlerFunc(t.add), stdRoot...))
+	http.Handle("/task/update", middleware.Chain(http.HandlerFunc(t.update), stdRoot...))
+	http.Handle("/task/del/", middleware.Chain(http.HandlerFunc(t.del), stdRoot...))
+	http.Handle("/task/info/", middleware.Chain(http.HandlerFunc(t.info), stdRoot...))
+	http.Handle("/task", middleware.Chain(http.HandlerFunc(t.list), stdRoot...))
+
 	// ui routes
-	webUI := ui{base: &db.Base{PublishDocument: volatile.PublishDocument}}
+	webUI := ui{base: &db.Base{PublishDocument: documentPublisher()}, scheduler: ts}
 	http.HandleFunc("/ui/login", webUI.auth)
 	http.Handle("/ui/db", middleware.Chain(http.HandlerFunc(webUI.dbCols), stdRoot...))
 	http.Handle("/ui/db/save", middleware.Chain(http.HandlerFunc(webUI.dbSave), stdRoot...))
+	http.Handle("/ui/db/csv", middleware.Chain(http.HandlerFunc(webUI.dbExportCSV), stdRoot...))
 	http.Handle("/ui/db/del/", middleware.Chain(http.HandlerFunc(webUI.dbDel), stdRoot...))
 	http.Handle("/ui/db/", middleware.Chain(http.HandlerFunc(webUI.dbDoc), stdRoot...))
+	http.Handle("/ui/indexes", middleware.Chain(http.HandlerFunc(webUI.dbIndexes), stdRoot...))
+	http.Handle("/ui/indexes/del", middleware.Chain(http.HandlerFunc(webUI.dbIndexDel), stdRoot...))
+	http.Handle("/ui/trash", middleware.Chain(http.HandlerFunc(webUI.trash), stdRoot...))
+	http.Handle("/ui/trash/restore", middleware.Chain(http.HandlerFunc(webUI.trashRestore), stdRoot...))
+	http.Handle("/ui/trash/del", middleware.Chain(http.HandlerFunc(webUI.trashDel), stdRoot...))
 	http.Handle("/ui/fn/new", middleware.Chain(http.HandlerFunc(webUI.fnNew), stdRoot...))
 	http.Handle("/ui/fn/save", middleware.Chain(http.HandlerFunc(webUI.fnSave), stdRoot...))
 	http.Handle("/ui/fn/del/", middleware.Chain(http.HandlerFunc(webUI.fnDel), stdRoot...))
 	http.Handle("/ui/fn/", middleware.Chain(http.HandlerFunc(webUI.fnEdit), stdRoot...))
 	http.Handle("/ui/fn", middleware.Chain(http.HandlerFunc(webUI.fnList), stdRoot...))
+	http.Handle("/ui/task/new", middleware.Chain(http.HandlerFunc(webUI.taskNew), stdRoot...))
+	http.Handle("/ui/task/save", middleware.Chain(http.HandlerFunc(webUI.taskSave), stdRoot...))
+	http.Handle("/ui/task/del/", middleware.Chain(http.HandlerFunc(webUI.taskDel), stdRoot...))
+	http.Handle("/ui/task/", middleware.Chain(http.HandlerFunc(webUI.taskEdit), stdRoot...))
+	http.Handle("/ui/task", middleware.Chain(http.HandlerFunc(webUI.taskList), stdRoot...))
 	http.Handle("/ui/forms", middleware.Chain(http.HandlerFunc(webUI.forms), stdRoot...))
 	http.Handle("/ui/forms/del/", middleware.Chain(http.HandlerFunc(webUI.formDel), stdRoot...))
+	http.Handle("/ui/apikeys", middleware.Chain(http.HandlerFunc(webUI.apiKeys), stdRoot...))
+	http.Handle("/ui/apikeys/new", middleware.Chain(http.HandlerFunc(webUI.apiKeySave), stdRoot...))
+	http.Handle("/ui/apikeys/del/", middleware.Chain(http.HandlerFunc(webUI.apiKeyDel), stdRoot...))
 	http.HandleFunc("/", webUI.login)
 
 	// graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 
+	if w, ok := changeStream(); ok {
+		go watchChanges(ctx, w)
+	}
+
 	// handle stop/kill signal
 	go func() {
 		c := make(chan os.Signal, 1)
@@ -245,7 +310,16 @@ func initServices(dbHost string) {
 		log.Fatal(err)
 	}
 
-	volatile = cache.NewCache()
+	if len(os.Getenv("REDIS_HOST")) == 0 {
+		log.Println("REDIS_HOST not set, using the in-process cache")
+		mem := cache.NewMemory()
+		mem.LoadRules = loadRules
+		volatile = mem
+	} else {
+		c := cache.NewCache()
+		c.LoadRules = loadRules
+		volatile = c
+	}
 
 	mp := os.Getenv("MAIL_PROVIDER")
 	if strings.EqualFold(mp, internal.MailProviderSES) {
@@ -288,7 +362,7 @@ func initServices(dbHost string) {
 		}
 
 		exe.Auth = auth
-		exe.Base = &db.Base{PublishDocument: volatile.PublishDocument}
+		exe.Base = &db.Base{PublishDocument: documentPublisher()}
 		exe.DB = client.Database(conf.Name)
 		exe.Volatile = volatile
 
@@ -299,26 +373,38 @@ func initServices(dbHost string) {
 	go sub.Start()
 }
 func openDatabase(dbHost string) error {
-	uri := dbHost
-
-	ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
-	cl, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
-	if err != nil {
-		return fmt.Errorf("cannot connect to mongo: %v", err)
+	ds := os.Getenv("DATA_STORE")
+	// without a database we run with the embedded data store
+	if len(ds) == 0 && len(dbHost) == 0 {
+		log.Println("DATABASE_URL not set, using the embedded data store")
+		ds = internal.DataStoreEmbedded
 	}
 
-	if err := cl.Ping(ctx, readpref.Primary()); err != nil {
-		return fmt.Errorf("Ping failed: %v", err)
+	switch ds {
+	case internal.DataStorePostgreSQL:
+		pg, err := datastore.NewPostgreSQL(dbHost)
+		if err != nil {
+			return err
+		}
+		client = pg
+	case internal.DataStoreEmbedded:
+		e, err := datastore.NewEmbedded(dbHost)
+		if err != nil {
+			return err
+		}
+		client = e
+	default:
+		mg, err := datastore.NewMongo(dbHost)
+		if err != nil {
+			return err
+		}
+		client = mg
 	}
-
-	client = cl
 	return nil
 }
 
 func ping(w http.ResponseWriter, r *http.Request) {
-	ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
-
-	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+	if err := client.Ping(); err != nil {
 		http.Error(w, "connection failed to database, I'm down.", http.StatusInternalServerError)
 		return
 	}
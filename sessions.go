@@ -0,0 +1,333 @@
+package staticbackend
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"staticbackend/internal"
+	"staticbackend/middleware"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// accessTokenTTL is how long a JWT is valid, the session's refresh token
+	// gets a new one
+	accessTokenTTL = 15 * time.Minute
+	// refreshTokenTTL is how long a session lasts without being refreshed
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// refreshTokenHeader is the response header with the refresh token of a new
+// or refreshed session, the body stays the JWT
+const refreshTokenHeader = "SB-Refresh-Token"
+
+// startSession creates a session for the device making the request and
+// returns its JWT and refresh token
+func (m *membership) startSession(conf internal.BaseConfig, tok internal.Token, r *http.Request) ([]byte, string, error) {
+	db := client.Database(conf.Name)
+
+	if err := internal.DeleteExpiredSessions(db, tok.ID); err != nil {
+		return nil, "", err
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	s := internal.Session{
+		ID:          primitive.NewObjectID(),
+		AccountID:   tok.AccountID,
+		UserID:      tok.ID,
+		Device:      r.UserAgent(),
+		IP:          middleware.ClientIP(r),
+		RefreshHash: hashToken(secret),
+		Created:     now,
+		LastUsed:    now,
+		Expires:     now.Add(refreshTokenTTL),
+	}
+	if err := internal.CreateSession(db, s); err != nil {
+		return nil, "", err
+	}
+
+	jwtBytes, err := m.issueToken(conf, tok, s.ID.Hex())
+	if err != nil {
+		return nil, "", err
+	}
+	return jwtBytes, s.ID.Hex() + "." + secret, nil
+}
+
+// issueToken returns the user's JWT and caches their authentication and
+// base for the requests made with it
+func (m *membership) issueToken(conf internal.BaseConfig, tok internal.Token, session string) ([]byte, error) {
+	token := fmt.Sprintf("%s|%s", tok.ID.Hex(), tok.Token)
+
+	// get their JWT
+	jwtBytes, err := m.getJWT(token, session)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := internal.Auth{
+		AccountID:  tok.AccountID,
+		UserID:     tok.ID,
+		Email:      tok.Email,
+		Role:       tok.Role,
+		Token:      tok.Token,
+		Attributes: tok.Attributes,
+	}
+
+	if err := m.volatile.SetTyped(token, auth); err != nil {
+		return nil, err
+	}
+	if err := m.volatile.SetTyped("base:"+token, conf); err != nil {
+		return nil, err
+	}
+	return jwtBytes, nil
+}
+
+// respondSession sends the JWT with the refresh token in the
+// SB-Refresh-Token header
+func respondSession(w http.ResponseWriter, jwtBytes []byte, refreshToken string) {
+	w.Header().Set(refreshTokenHeader, refreshToken)
+	respond(w, http.StatusOK, string(jwtBytes))
+}
+
+// refresh exchanges a refresh token for a new JWT, the refresh token is
+// replaced by a new one in the SB-Refresh-Token header:
+//
+//	POST /refresh {"refreshToken": "..."}
+//
+// Using a replaced refresh token ends its session, it was likely stolen.
+func (m *membership) refresh(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, "invalid StaticBackend key", http.StatusUnauthorized)
+		return
+	}
+
+	var data struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := parseBody(r.Body, &data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := client.Database(conf.Name)
+
+	parts := strings.SplitN(data.RefreshToken, ".", 2)
+	if len(parts) != 2 {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	sid, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	s, err := internal.FindSession(db, sid)
+	if errors.Is(err, internal.ErrNotFound) {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hash := hashToken(parts[1])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(s.RefreshHash)) != 1 {
+		// only the replaced token ends the session, a wrong one is refused
+		if len(s.PreviousHash) > 0 && subtle.ConstantTimeCompare([]byte(hash), []byte(s.PreviousHash)) == 1 {
+			if err := m.endSession(db, s.UserID, s.ID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if time.Now().After(s.Expires) {
+		http.Error(w, "your session has ended, please sign in again", http.StatusUnauthorized)
+		return
+	}
+
+	var tok internal.Token
+	if err := db.FindOne("sb_tokens", bson.M{internal.FieldID: s.UserID}, &tok); err != nil {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ok, err := internal.RotateSession(db, s.ID, s.RefreshHash, hashToken(secret), time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		// another request refreshed the session with the same token
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	jwtBytes, err := m.issueToken(conf, tok, s.ID.Hex())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respondSession(w, jwtBytes, s.ID.Hex()+"."+secret)
+}
+
+// logout ends the session of the JWT making the request
+func (m *membership) logout(w http.ResponseWriter, r *http.Request) {
+	conf, auth, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sid, err := primitive.ObjectIDFromHex(auth.SessionID)
+	if err != nil {
+		http.Error(w, "this token was issued without a session, use /logout/all", http.StatusBadRequest)
+		return
+	}
+
+	if err := m.endSession(client.Database(conf.Name), auth.UserID, sid); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, http.StatusOK, true)
+}
+
+// logoutAll ends all the sessions of the user and invalidates every token
+// issued for them, sessions or not. For root users this changes their root
+// token.
+func (m *membership) logoutAll(w http.ResponseWriter, r *http.Request) {
+	conf, auth, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := client.Database(conf.Name)
+
+	ids, err := internal.DeleteSessions(db, auth.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, id := range ids {
+		if err := m.volatile.Del("session:" + id.Hex()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// the JWTs hold the user's token, a new one makes them all invalid
+	filter := bson.M{internal.FieldID: auth.UserID}
+	update := bson.M{"$set": bson.M{internal.FieldToken: primitive.NewObjectID().Hex()}}
+	if _, err := db.UpdateOne("sb_tokens", filter, update); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	old := fmt.Sprintf("%s|%s", auth.UserID.Hex(), auth.Token)
+	if err := m.volatile.Del(old); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := m.volatile.Del("base:" + old); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, http.StatusOK, true)
+}
+
+// sessions lists and ends the sessions of the user:
+//
+//	GET /sessions lists the active sessions, the last used first
+//	DELETE /sessions/{id} ends a session
+func (m *membership) sessions(w http.ResponseWriter, r *http.Request) {
+	conf, auth, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	id, _ := ShiftPath(r.URL.Path)
+
+	switch r.Method {
+	case http.MethodGet:
+		list, err := internal.ListSessions(db, auth.UserID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for i := range list {
+			list[i].Current = list[i].ID.Hex() == auth.SessionID
+		}
+
+		respond(w, http.StatusOK, list)
+	case http.MethodDelete:
+		sid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, "invalid session id", http.StatusBadRequest)
+			return
+		}
+
+		s, err := internal.FindSession(db, sid)
+		if errors.Is(err, internal.ErrNotFound) || (err == nil && s.UserID != auth.UserID) {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := m.endSession(db, auth.UserID, sid); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// endSession removes the user's session, its JWTs are refused from now on
+func (m *membership) endSession(db internal.Database, userID, id primitive.ObjectID) error {
+	if _, err := internal.DeleteSession(db, userID, id); err != nil {
+		return err
+	}
+	return m.volatile.Del("session:" + id.Hex())
+}
+
+// hashToken returns the hash stored for refresh tokens and email tokens
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,240 @@
+package staticbackend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"staticbackend/internal"
+	"staticbackend/middleware"
+
+	"github.com/gbrlsnchs/jwt/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sessionReq makes a request with the token, an empty token only sets the
+// public key
+func sessionReq(t *testing.T, hf func(http.ResponseWriter, *http.Request), method, path, token string, v interface{}) *http.Response {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("error marshaling post data:", err)
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(b))
+	req.Header.Set("SB-PUBLIC-KEY", pubKey)
+	req.Header.Set("User-Agent", "unit test")
+
+	chain := []middleware.Middleware{middleware.WithDB(client, volatile)}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		chain = append(chain, middleware.RequireAuth(client, volatile))
+	}
+
+	w := httptest.NewRecorder()
+	middleware.Chain(http.HandlerFunc(hf), chain...).ServeHTTP(w, req)
+	return w.Result()
+}
+
+func sessionLogin(t *testing.T, m *membership, email, pw string) (string, string) {
+	resp := sessionReq(t, m.login, "POST", "/login", "", internal.Login{Email: email, Password: pw})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var token string
+	if err := parseBody(resp.Body, &token); err != nil {
+		t.Fatal(err)
+	}
+
+	refresh := resp.Header.Get("SB-Refresh-Token")
+	if len(refresh) == 0 {
+		t.Fatal("expected a refresh token")
+	}
+	return token, refresh
+}
+
+func TestSessions(t *testing.T) {
+	m := &membership{volatile: volatile}
+
+	curDB := client.Database(dbName)
+	admin, err := internal.FindTokenByEmail(curDB, admEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email, pw := "sessions@test.com", "sessions_pw"
+	legacy, created, err := m.createUser(curDB, admin.AccountID, email, pw, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, refresh := sessionLogin(t, m, email, pw)
+
+	resp := sessionReq(t, m.sessions, "GET", "/sessions", token, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var list []internal.Session
+	if err := parseBody(resp.Body, &list); err != nil {
+		t.Fatal(err)
+	} else if len(list) != 1 {
+		t.Fatalf("expected 1 session got %d", len(list))
+	} else if !list[0].Current || list[0].Device != "unit test" {
+		t.Errorf("expected the current session of the device got %v", list[0])
+	}
+
+	// the refresh token is replaced on each use
+	resp = sessionReq(t, m.refresh, "POST", "/refresh", "", map[string]string{"refreshToken": refresh})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var refreshed string
+	if err := parseBody(resp.Body, &refreshed); err != nil {
+		t.Fatal(err)
+	}
+
+	newRefresh := resp.Header.Get("SB-Refresh-Token")
+	if len(newRefresh) == 0 || newRefresh == refresh {
+		t.Fatalf("expected a new refresh token got %s", newRefresh)
+	}
+
+	resp = sessionReq(t, m.sessions, "GET", "/sessions", refreshed, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	// a wrong refresh token is refused without ending the session
+	sid := strings.SplitN(newRefresh, ".", 2)[0]
+	resp = sessionReq(t, m.refresh, "POST", "/refresh", "", map[string]string{"refreshToken": sid + ".wrong"})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for a wrong refresh token got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	resp = sessionReq(t, m.sessions, "GET", "/sessions", refreshed, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	// reusing a replaced refresh token ends the session
+	resp = sessionReq(t, m.refresh, "POST", "/refresh", "", map[string]string{"refreshToken": refresh})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 reusing a refresh token got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	resp = sessionReq(t, m.sessions, "GET", "/sessions", refreshed, nil)
+	if resp.StatusCode == http.StatusOK {
+		t.Error("expected the session to be ended")
+	}
+	resp.Body.Close()
+
+	// cached sessions are refused once they expire
+	expiring, _ := sessionLogin(t, m, email, pw)
+
+	filter := bson.M{"userId": created.ID}
+	update := bson.M{"$set": bson.M{"expires": time.Now().Add(300 * time.Millisecond)}}
+	if _, err := curDB.UpdateMany(internal.SessionsCollection, filter, update); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = sessionReq(t, m.sessions, "GET", "/sessions", expiring, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	time.Sleep(400 * time.Millisecond)
+
+	resp = sessionReq(t, m.sessions, "GET", "/sessions", expiring, nil)
+	if resp.StatusCode == http.StatusOK {
+		t.Error("expected the expired session to be refused")
+	}
+	resp.Body.Close()
+
+	// logout only ends the current session
+	phone, _ := sessionLogin(t, m, email, pw)
+	laptop, _ := sessionLogin(t, m, email, pw)
+
+	resp = sessionReq(t, m.logout, "POST", "/logout", phone, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = sessionReq(t, m.sessions, "GET", "/sessions", phone, nil)
+	if resp.StatusCode == http.StatusOK {
+		t.Error("expected the logged out session to be refused")
+	}
+	resp.Body.Close()
+
+	resp = sessionReq(t, m.sessions, "GET", "/sessions", laptop, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	// logging out everywhere refuses tokens with or without a session
+	resp = sessionReq(t, m.logoutAll, "POST", "/logout/all", laptop, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	for _, tok := range []string{laptop, string(legacy)} {
+		resp = sessionReq(t, m.sessions, "GET", "/sessions", tok, nil)
+		if resp.StatusCode == http.StatusOK {
+			t.Error("expected the token to be refused after logging out everywhere")
+		}
+		resp.Body.Close()
+	}
+
+	user, err := internal.FindTokenByEmail(curDB, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := curDB.Count(internal.SessionsCollection, bson.M{"userId": user.ID}); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("expected no sessions left got %d", n)
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	tok, err := internal.FindTokenByEmail(client.Database(dbName), userEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	pl := internal.JWTPayload{
+		Payload: jwt.Payload{
+			ExpirationTime: jwt.NumericDate(now.Add(-time.Minute)),
+			IssuedAt:       jwt.NumericDate(now.Add(-time.Hour)),
+			JWTID:          primitive.NewObjectID().Hex(),
+		},
+		Token: fmt.Sprintf("%s|%s", tok.ID.Hex(), tok.Token),
+	}
+
+	b, err := jwt.Sign(pl, internal.HashSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := sessionReq(t, database.list, "GET", "/db/expired", string(b), nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an expired token to be refused got %s", resp.Status)
+	}
+	resp.Body.Close()
+}
@@ -1,7 +1,6 @@
 package staticbackend
 
 import (
-	"context"
 	"fmt"
 	"net/http"
 	"path/filepath"
@@ -63,27 +62,22 @@ func upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	newID := primitive.NewObjectID()
+
 	doc := bson.M{
-		"accountId": auth.AccountID,
-		"key":       fileKey,
-		"url":       url,
-		"size":      h.Size,
-		"on":        time.Now(),
+		internal.FieldID: newID,
+		"accountId":      auth.AccountID,
+		"key":            fileKey,
+		"url":            url,
+		"size":           h.Size,
+		"on":             time.Now(),
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
-	res, err := db.Collection("sb_files").InsertOne(ctx, doc)
-	if err != nil {
+	if err := db.InsertOne("sb_files", doc); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	newID, ok := res.InsertedID.(primitive.ObjectID)
-	if !ok {
-		http.Error(w, "unable to retrived the inserted id", http.StatusInternalServerError)
-		return
-	}
-
 	data := new(struct {
 		ID  string `json:"id"`
 		URL string `json:"url"`
@@ -109,16 +103,11 @@ func deleteFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
 	var result bson.M
 
 	filter := bson.M{internal.FieldID: oid}
 
-	sr := db.Collection("sb_files").FindOne(ctx, filter)
-	if err := sr.Decode(&result); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	} else if err := sr.Err(); err != nil {
+	if err := db.FindOne("sb_files", filter, &result); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -134,7 +123,7 @@ func deleteFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := db.Collection("sb_files").DeleteOne(ctx, filter); err != nil {
+	if _, err := db.DeleteOne("sb_files", filter); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
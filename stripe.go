@@ -1,7 +1,6 @@
 package staticbackend
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -53,13 +52,9 @@ func (wh *stripeWebhook) handlePaymentMethodAttached(pm stripe.PaymentMethod) er
 	stripeID := pm.Customer.ID
 
 	db := client.Database("sbsys")
-	ctx := context.Background()
 
 	var acct internal.Customer
-	sr := db.Collection("accounts").FindOne(ctx, bson.M{"stripeId": stripeID})
-	if err := sr.Decode(&acct); err != nil {
-		return err
-	} else if err := sr.Err(); err != nil {
+	if err := db.FindOne("accounts", bson.M{"stripeId": stripeID}, &acct); err != nil {
 		fmt.Println("customer", stripeID)
 		return err
 	}
@@ -71,13 +66,12 @@ func (wh *stripeWebhook) handlePaymentMethodAttached(pm stripe.PaymentMethod) er
 	filter := bson.M{"_id": acct.ID}
 	update := bson.M{"$set": bson.M{"active": true}}
 
-	res := db.Collection("accounts").FindOneAndUpdate(ctx, filter, update)
-	if err := res.Err(); err != nil {
+	if _, err := db.UpdateOne("accounts", filter, update); err != nil {
 		fmt.Printf("error while saving account: %v %s %s\n", err, stripeID, acct.ID.Hex())
 		return err
 	}
 
 	filter = bson.M{internal.FieldAccountID: acct.ID}
-	res = db.Collection("bases").FindOneAndUpdate(ctx, filter, update)
-	return res.Err()
+	_, err := db.UpdateOne("bases", filter, update)
+	return err
 }
@@ -0,0 +1,187 @@
+package staticbackend
+
+import (
+	"fmt"
+	"net/http"
+	"staticbackend/function"
+	"staticbackend/middleware"
+
+	"github.com/robfig/cron/v3"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type tasks struct {
+	scheduler *function.TaskScheduler
+}
+
+func (t *tasks) add(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var task function.Task
+	if err := parseBody(r.Body, &task); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateTask(task); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	id, err := function.AddTask(curDB, task)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	task.ID, _ = primitive.ObjectIDFromHex(id)
+	task.BaseName = conf.Name
+
+	if err := t.scheduler.Schedule(task); err != nil {
+		// we do not keep a task that cannot be scheduled
+		if err := function.DeleteTask(curDB, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	respond(w, http.StatusCreated, id)
+}
+
+func (t *tasks) update(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var task function.Task
+	if err := parseBody(r.Body, &task); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateTask(task); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	// make sure it exists before touching the scheduler
+	if _, err := function.GetTaskByID(curDB, task.ID.Hex()); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	task.BaseName = conf.Name
+
+	// the task is saved before its job is replaced so the scheduler never
+	// runs a version that is not in the database
+	if err := function.UpdateTask(curDB, task); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := t.scheduler.Schedule(task); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, http.StatusOK, true)
+}
+
+func (t *tasks) del(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	id := getURLPart(r.URL.Path, 3)
+	if err := function.DeleteTask(curDB, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the job might not be scheduled if its interval was invalid at startup
+	_ = t.scheduler.Unschedule(id)
+
+	respond(w, http.StatusOK, true)
+}
+
+func (t *tasks) info(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	id := getURLPart(r.URL.Path, 3)
+
+	task, err := function.GetTaskByID(curDB, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	respond(w, http.StatusOK, task)
+}
+
+func (t *tasks) list(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	results, err := function.ListTasks(curDB)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, http.StatusOK, results)
+}
+
+func validateTask(task function.Task) error {
+	if len(task.Name) == 0 {
+		return fmt.Errorf("the task name is required")
+	} else if len(task.Interval) == 0 {
+		return fmt.Errorf("the task interval is required (cron expression)")
+	} else if _, err := cron.ParseStandard(task.Interval); err != nil {
+		return fmt.Errorf("invalid task interval: %v", err)
+	}
+
+	switch task.Type {
+	case function.TaskTypeFunction:
+		if len(task.Value) == 0 {
+			return fmt.Errorf("the function name to execute is required")
+		}
+	case function.TaskTypeMessage:
+		if len(task.Value) == 0 {
+			return fmt.Errorf("the message type to send is required")
+		}
+		if _, err := task.MetaMessage(); err != nil {
+			return fmt.Errorf("invalid message meta data: %v", err)
+		}
+	default:
+		return fmt.Errorf("the task type should be either %s or %s", function.TaskTypeFunction, function.TaskTypeMessage)
+	}
+	return nil
+}
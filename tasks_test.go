@@ -0,0 +1,94 @@
+package staticbackend
+
+import (
+	"net/http"
+	"staticbackend/function"
+	"testing"
+)
+
+func TestTaskAddUpdateDelete(t *testing.T) {
+	task := function.Task{
+		Name:     "unittest-task",
+		Type:     function.TaskTypeFunction,
+		Value:    "unittest",
+		Interval: "*/5 * * * *",
+	}
+
+	resp := dbReq(t, tasker.add, "POST", "/task/add", task, true)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var id string
+	if err := parseBody(resp.Body, &id); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := len(tasker.scheduler.Scheduler.Jobs())
+
+	resp = dbReq(t, tasker.list, "GET", "/task", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var list []function.Task
+	if err := parseBody(resp.Body, &list); err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, tsk := range list {
+		if tsk.ID.Hex() == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatalf("expected task %s to be in the list", id)
+	}
+
+	// an invalid cron expression must be rejected and keep the current job
+	updated := list[0]
+	for _, tsk := range list {
+		if tsk.ID.Hex() == id {
+			updated = tsk
+		}
+	}
+	updated.Interval = "not a cron"
+
+	resp = dbReq(t, tasker.update, "POST", "/task/update", updated, true)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 got %s", resp.Status)
+	} else if l := len(tasker.scheduler.Scheduler.Jobs()); l != jobs {
+		t.Errorf("expected %d scheduled jobs got %d", jobs, l)
+	}
+
+	updated.Interval = "0 * * * *"
+	resp = dbReq(t, tasker.update, "POST", "/task/update", updated, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	resp = dbReq(t, tasker.info, "GET", "/task/info/"+id, nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var info function.Task
+	if err := parseBody(resp.Body, &info); err != nil {
+		t.Fatal(err)
+	} else if info.Interval != updated.Interval {
+		t.Errorf("expected interval to be %s got %s", updated.Interval, info.Interval)
+	}
+
+	resp = dbReq(t, tasker.del, "GET", "/task/del/"+id, nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	if l := len(tasker.scheduler.Scheduler.Jobs()); l != jobs-1 {
+		t.Errorf("expected %d scheduled jobs after delete got %d", jobs-1, l)
+	}
+}
@@ -0,0 +1,196 @@
+package staticbackend
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"staticbackend/db"
+	"staticbackend/internal"
+	"staticbackend/middleware"
+	"time"
+)
+
+// softDelete manages the soft delete settings of the collections, it's
+// reserved to root users:
+//
+//	GET /softdelete/ lists the collections with soft delete
+//	GET /softdelete/{col} returns the collection's settings
+//	PUT /softdelete/{col} enables soft delete, {"retentionDays": 30}
+//	DELETE /softdelete/{col} disables soft delete
+func (database *Database) softDelete(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := database.client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	col, _ := ShiftPath(r.URL.Path)
+
+	if len(col) == 0 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "missing collection name", http.StatusBadRequest)
+			return
+		}
+
+		list, err := db.ListSoftDelete(curDB)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(list) == 0 {
+			list = make([]db.SoftDelete, 0)
+		}
+
+		respond(w, http.StatusOK, list)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sd, err := db.GetSoftDelete(curDB, col)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if sd == nil {
+			http.Error(w, "this collection does not use soft delete", http.StatusNotFound)
+			return
+		}
+
+		respond(w, http.StatusOK, sd)
+	case http.MethodPost, http.MethodPut:
+		var data struct {
+			RetentionDays int `json:"retentionDays"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if data.RetentionDays < 0 {
+			http.Error(w, "the retention must be a positive number of days", http.StatusBadRequest)
+			return
+		}
+
+		if err := db.SetSoftDelete(curDB, col, data.RetentionDays); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	case http.MethodDelete:
+		if err := db.DeleteSoftDelete(curDB, col); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// trash lists, restores and purges the deleted documents of collections
+// with soft delete, it's reserved to root users:
+//
+//	GET /trash/{col}?page=1&size=25 lists the deleted documents
+//	POST /trash/{col}/{id} restores the document
+//	DELETE /trash/{col}/{id} permanently deletes the document
+func (database *Database) trash(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := database.client.Database(conf.Name)
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	col, rest := ShiftPath(r.URL.Path)
+	id, _ := ShiftPath(rest)
+
+	if len(col) == 0 {
+		http.Error(w, "missing collection name", http.StatusBadRequest)
+		return
+	}
+
+	if len(id) == 0 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "missing document id", http.StatusBadRequest)
+			return
+		}
+
+		page, size := getPagination(r.URL)
+		result, err := database.base.ListTrash(curDB, col, db.ListParams{Page: page, Size: size})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		doc, err := database.base.Restore(curDB, col, id)
+		if errors.Is(err, internal.ErrNotFound) {
+			http.Error(w, "document not found in the trash", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, doc)
+	case http.MethodDelete:
+		n, err := database.base.Purge(curDB, col, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if n == 0 {
+			http.Error(w, "document not found in the trash", http.StatusNotFound)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// purgeInterval is how often the trash of all bases is purged
+const purgeInterval = time.Hour
+
+// purgeTrash permanently deletes the documents older than their collection's
+// retention from the trash, it runs until the process exits.
+func purgeTrash() {
+	for {
+		bases, err := internal.ListDatabases(client.Database("sbsys"))
+		if err != nil {
+			log.Println("error listing bases to purge their trash: ", err)
+		}
+
+		for _, base := range bases {
+			curDB := client.Database(base.Name)
+
+			list, err := db.ListSoftDelete(curDB)
+			if err != nil {
+				log.Printf("error loading the soft delete settings of base %s: %v\n", base.Name, err)
+				continue
+			}
+
+			for _, sd := range list {
+				if _, err := db.PurgeExpired(curDB, sd); err != nil {
+					log.Printf("error purging the trash of %s in base %s: %v\n", sd.Collection, base.Name, err)
+				}
+			}
+		}
+
+		time.Sleep(purgeInterval)
+	}
+}
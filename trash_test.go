@@ -0,0 +1,145 @@
+package staticbackend
+
+import (
+	"net/http"
+	"staticbackend/db"
+	"staticbackend/internal"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSoftDelete(t *testing.T) {
+	resp := dbReq(t, database.softDelete, "PUT", "/softdelete/trashed", map[string]interface{}{"retentionDays": 7}, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.softDelete, "GET", "/softdelete/trashed", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var sd db.SoftDelete
+	if err := parseBody(resp.Body, &sd); err != nil {
+		t.Fatal(err)
+	} else if sd.RetentionDays != 7 {
+		t.Errorf("expected a retention of 7 days got %d", sd.RetentionDays)
+	}
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		resp := dbReq(t, database.add, "POST", "/db/trashed", map[string]interface{}{"n": i})
+		if resp.StatusCode > 299 {
+			t.Fatal(GetResponseBody(t, resp))
+		}
+
+		var created struct {
+			ID string `json:"id"`
+		}
+		if err := parseBody(resp.Body, &created); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, created.ID)
+	}
+
+	resp = dbReq(t, database.del, "DELETE", "/db/trashed/"+ids[0], nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.get, "GET", "/db/trashed/"+ids[0], nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404 getting a deleted document got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.list, "GET", "/db/trashed", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var list db.PagedResult
+	if err := parseBody(resp.Body, &list); err != nil {
+		t.Fatal(err)
+	} else if list.Total != 2 {
+		t.Errorf("expected 2 documents listed got %d", list.Total)
+	}
+
+	// bulk deletes move the documents to the trash as well
+	del := map[string]interface{}{"filter": [][]interface{}{{"n", "==", 1}}}
+	resp = dbReq(t, database.dbreq, "DELETE", "/db/trashed?bulk=1", del)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.trash, "GET", "/trash/trashed", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	if err := parseBody(resp.Body, &list); err != nil {
+		t.Fatal(err)
+	} else if list.Total != 2 {
+		t.Fatalf("expected 2 documents in the trash got %d", list.Total)
+	}
+
+	resp = dbReq(t, database.trash, "POST", "/trash/trashed/"+ids[0], nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.get, "GET", "/db/trashed/"+ids[0], nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the restored document to be readable got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	// the retention is checked against the deletion date
+	curDB := database.client.Database(dbName)
+	oid, err := primitive.ObjectIDFromHex(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := bson.M{"$set": bson.M{internal.FieldDeleted: time.Now().AddDate(0, 0, -8)}}
+	if _, err := curDB.UpdateOne("trashed", bson.M{internal.FieldID: oid}, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.PurgeExpired(curDB, sd); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("expected 1 purged document got %d", n)
+	}
+
+	resp = dbReq(t, database.trash, "DELETE", "/trash/trashed/"+ids[1], nil, true)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404 for a purged document got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.softDelete, "DELETE", "/softdelete/trashed", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = dbReq(t, database.del, "DELETE", "/db/trashed/"+ids[2], nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	if count, err := curDB.Count("trashed", bson.M{}); err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Errorf("expected only the restored document left got %d", count)
+	}
+}
@@ -0,0 +1,426 @@
+package staticbackend
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"staticbackend/internal"
+	"staticbackend/middleware"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// twoFactorTTL is how long users have to enter their code once their
+	// password is accepted, or to confirm a new secret
+	twoFactorTTL = 5 * time.Minute
+	// twoFactorMaxAttempts is how many codes can be tried per challenge
+	twoFactorMaxAttempts = 5
+	// recoveryCodeCount is how many recovery codes users receive
+	recoveryCodeCount = 10
+	// totpIssuer is the name authenticator apps show next to the codes
+	totpIssuer = "StaticBackend"
+)
+
+var (
+	errInvalidChallenge = errors.New("invalid or expired challenge")
+	errInvalidCode      = errors.New("invalid code")
+)
+
+// twoFactorChallenge is a sign in waiting for the user's code. Secret and
+// Recovery are set when the user enrolls, they're saved once a code of the
+// secret is confirmed.
+type twoFactorChallenge struct {
+	Base     string
+	TokenID  primitive.ObjectID
+	Secret   string
+	Recovery []string
+	Expires  time.Time
+}
+
+// twoFactorPrompt is sent when the user has to enter a code, with the secret
+// to add in their authenticator app and their recovery codes if they enroll
+type twoFactorPrompt struct {
+	Challenge     string   `json:"challenge,omitempty"`
+	Enroll        bool     `json:"enroll,omitempty"`
+	Secret        string   `json:"secret,omitempty"`
+	URI           string   `json:"uri,omitempty"`
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+// signIn starts a session for the user, or responds with status 202 and the
+// prompt for their code when they sign in with a second factor
+func (m *membership) signIn(w http.ResponseWriter, r *http.Request, conf internal.BaseConfig, tok internal.Token) {
+	prompt, err := startTwoFactor(m.volatile, conf, tok)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if prompt != nil {
+		respond(w, http.StatusAccepted, prompt)
+		return
+	}
+
+	jwtBytes, refreshToken, err := m.startSession(conf, tok, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respondSession(w, jwtBytes, refreshToken)
+}
+
+// startTwoFactor returns the prompt for the user's code, nil when they sign
+// in without a second factor. Users who must use one but have no secret yet
+// enroll while signing in.
+func startTwoFactor(volatile internal.PubSuber, conf internal.BaseConfig, tok internal.Token) (*twoFactorPrompt, error) {
+	if required, err := internal.TwoFactorRequired(client.Database(conf.Name), tok); err != nil || !required {
+		return nil, err
+	}
+
+	enrolled := len(tok.TOTPSecret) > 0
+
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	c := twoFactorChallenge{
+		Base:    conf.Name,
+		TokenID: tok.ID,
+		Expires: time.Now().Add(twoFactorTTL),
+	}
+	prompt := &twoFactorPrompt{Challenge: id, Enroll: !enrolled}
+
+	if !enrolled {
+		secret, err := internal.NewTOTPSecret()
+		if err != nil {
+			return nil, err
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			return nil, err
+		}
+
+		c.Secret, c.Recovery = secret, hashes
+
+		prompt.Secret = secret
+		prompt.URI = internal.TOTPURI(totpIssuer, tok.Email, secret)
+		prompt.RecoveryCodes = codes
+	}
+
+	if err := volatile.SetTyped("2fa:"+id, c); err != nil {
+		return nil, err
+	}
+	return prompt, nil
+}
+
+// finishTwoFactor checks the code of the challenge and returns the user
+// signing in. The challenge cannot be used anymore once it succeeds or had
+// too many attempts.
+func finishTwoFactor(volatile internal.PubSuber, conf internal.BaseConfig, challenge, code string) (internal.Token, error) {
+	var tok internal.Token
+
+	var c twoFactorChallenge
+	key := "2fa:" + challenge
+	if len(challenge) == 0 || volatile.GetTyped(key, &c) != nil || c.Base != conf.Name || time.Now().After(c.Expires) {
+		return tok, errInvalidChallenge
+	}
+
+	attempts, err := volatile.Inc(key+":attempts", 1)
+	if err != nil {
+		return tok, err
+	} else if attempts > twoFactorMaxAttempts {
+		if err := endChallenge(volatile, key); err != nil {
+			return tok, err
+		}
+		return tok, errInvalidChallenge
+	}
+
+	db := client.Database(conf.Name)
+
+	if err := db.FindOne("sb_tokens", bson.M{internal.FieldID: c.TokenID}, &tok); err != nil {
+		return tok, err
+	}
+
+	var ok bool
+	if len(c.Secret) > 0 {
+		// the first code of a new secret enables it
+		step, valid := internal.ValidateTOTP(c.Secret, code, time.Now())
+		if valid {
+			if err := internal.EnableTOTP(db, tok.ID, c.Secret, c.Recovery, step); err != nil {
+				return tok, err
+			}
+		}
+		ok = valid
+	} else if ok, err = checkTwoFactorCode(db, tok, code); err != nil {
+		return tok, err
+	}
+
+	if !ok {
+		return tok, errInvalidCode
+	}
+
+	if err := endChallenge(volatile, key); err != nil {
+		return tok, err
+	}
+	return tok, nil
+}
+
+func endChallenge(volatile internal.PubSuber, key string) error {
+	if err := volatile.Del(key); err != nil {
+		return err
+	}
+	return volatile.Del(key + ":attempts")
+}
+
+// checkTwoFactorCode accepts a TOTP code or one of the recovery codes of the
+// user, each code is only accepted once
+func checkTwoFactorCode(db internal.Database, tok internal.Token, code string) (bool, error) {
+	if step, ok := internal.ValidateTOTP(tok.TOTPSecret, code, time.Now()); ok {
+		return internal.UseTOTPStep(db, tok.ID, step)
+	}
+
+	code = normalizeRecoveryCode(code)
+	if len(code) == 0 {
+		return false, nil
+	}
+	return internal.UseRecoveryCode(db, tok.ID, hashToken(code))
+}
+
+// newRecoveryCodes returns the recovery codes to show the user and their
+// hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		s := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = s[:4] + "-" + s[4:]
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return strings.ToLower(code)
+}
+
+// twoFactorLogin is the second step of signing in when the user has to
+// enter a code:
+//
+//	POST /login/2fa {"challenge": "...", "code": "123456"}
+//
+// The code is a TOTP code or a recovery code, it responds like /login.
+func (m *membership) twoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, "invalid StaticBackend key", http.StatusUnauthorized)
+		return
+	}
+
+	var data struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := parseBody(r.Body, &data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tok, err := finishTwoFactor(m.volatile, conf, data.Challenge, data.Code)
+	if errors.Is(err, errInvalidChallenge) || errors.Is(err, errInvalidCode) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jwtBytes, refreshToken, err := m.startSession(conf, tok, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respondSession(w, jwtBytes, refreshToken)
+}
+
+// twoFactor manages the two-factor authentication of the signed in user:
+//
+//	GET /2fa returns if it's enabled or required and the recovery codes left
+//	POST /2fa/enroll returns a new secret and its otpauth:// URI
+//	POST /2fa/confirm {"code": "..."} enables it and returns recovery codes
+//	POST /2fa/recovery {"code": "..."} replaces the recovery codes
+//	DELETE /2fa {"code": "..."} disables it
+func (m *membership) twoFactor(w http.ResponseWriter, r *http.Request) {
+	conf, auth, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := client.Database(conf.Name)
+
+	var tok internal.Token
+	if err := db.FindOne("sb_tokens", bson.M{internal.FieldID: auth.UserID}, &tok); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	settings, err := internal.GetAuthSettings(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	enabled := len(tok.TOTPSecret) > 0
+	enrollKey := "2faenroll:" + conf.Name + ":" + tok.ID.Hex()
+
+	_, r.URL.Path = ShiftPath(r.URL.Path)
+	action, _ := ShiftPath(r.URL.Path)
+
+	var data struct {
+		Code string `json:"code"`
+	}
+	if (r.Method == http.MethodPost && action != "enroll") || r.Method == http.MethodDelete {
+		if err := parseBody(r.Body, &data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && len(action) == 0:
+		status := struct {
+			Enabled       bool `json:"enabled"`
+			Required      bool `json:"required"`
+			RecoveryCodes int  `json:"recoveryCodes"`
+		}{enabled, settings.RequiresTwoFactor(tok.Role), len(tok.RecoveryCodes)}
+
+		respond(w, http.StatusOK, status)
+	case r.Method == http.MethodPost && action == "enroll":
+		if enabled {
+			http.Error(w, "two-factor authentication is already enabled", http.StatusBadRequest)
+			return
+		}
+
+		secret, err := internal.NewTOTPSecret()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		c := twoFactorChallenge{
+			Base:    conf.Name,
+			TokenID: tok.ID,
+			Secret:  secret,
+			Expires: time.Now().Add(twoFactorTTL),
+		}
+		if err := m.volatile.SetTyped(enrollKey, c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		prompt := twoFactorPrompt{
+			Secret: secret,
+			URI:    internal.TOTPURI(totpIssuer, tok.Email, secret),
+		}
+		respond(w, http.StatusOK, prompt)
+	case r.Method == http.MethodPost && action == "confirm":
+		var c twoFactorChallenge
+		if m.volatile.GetTyped(enrollKey, &c) != nil || time.Now().After(c.Expires) {
+			http.Error(w, "no enrollment in progress", http.StatusBadRequest)
+			return
+		}
+
+		step, ok := internal.ValidateTOTP(c.Secret, data.Code, time.Now())
+		if !ok {
+			http.Error(w, errInvalidCode.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := internal.EnableTOTP(db, tok.ID, c.Secret, hashes, step); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := m.volatile.Del(enrollKey); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, twoFactorPrompt{RecoveryCodes: codes})
+	case r.Method == http.MethodPost && action == "recovery":
+		if !m.checkCode(w, db, tok, enabled, data.Code) {
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := internal.SetRecoveryCodes(db, tok.ID, hashes); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, twoFactorPrompt{RecoveryCodes: codes})
+	case r.Method == http.MethodDelete && len(action) == 0:
+		if settings.RequiresTwoFactor(tok.Role) {
+			http.Error(w, "two-factor authentication is required for your role", http.StatusForbidden)
+			return
+		}
+
+		if !m.checkCode(w, db, tok, enabled, data.Code) {
+			return
+		}
+
+		if err := internal.DisableTOTP(db, tok.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	default:
+		http.Error(w, fmt.Sprintf("%s /2fa/%s is not supported", r.Method, action), http.StatusMethodNotAllowed)
+	}
+}
+
+// checkCode writes the error response and returns false unless the user
+// has two-factor authentication enabled and the code is valid
+func (m *membership) checkCode(w http.ResponseWriter, db internal.Database, tok internal.Token, enabled bool, code string) bool {
+	if !enabled {
+		http.Error(w, "two-factor authentication is not enabled", http.StatusBadRequest)
+		return false
+	}
+
+	ok, err := checkTwoFactorCode(db, tok, code)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	} else if !ok {
+		http.Error(w, errInvalidCode.Error(), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
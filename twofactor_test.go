@@ -0,0 +1,351 @@
+package staticbackend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"staticbackend/db"
+	"staticbackend/internal"
+	"staticbackend/middleware"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vector for SHA1, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	code, err := internal.TOTPCode(secret, internal.TOTPStep(time.Unix(59, 0)))
+	if err != nil {
+		t.Fatal(err)
+	} else if code != "287082" {
+		t.Errorf("expected 287082 got %s", code)
+	}
+
+	now := time.Unix(1111111109, 0)
+	code, err = internal.TOTPCode(secret, internal.TOTPStep(now))
+	if err != nil {
+		t.Fatal(err)
+	} else if code != "081804" {
+		t.Errorf("expected 081804 got %s", code)
+	}
+
+	if _, ok := internal.ValidateTOTP(secret, code, now.Add(30*time.Second)); !ok {
+		t.Error("expected the code of the previous period to be accepted")
+	}
+	if _, ok := internal.ValidateTOTP(secret, code, now.Add(2*time.Minute)); ok {
+		t.Error("expected an old code to be refused")
+	}
+}
+
+func totpCode(t *testing.T, secret string, offset int64) string {
+	code, err := internal.TOTPCode(secret, internal.TOTPStep(time.Now())+offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func twoFactorPromptOf(t *testing.T, resp *http.Response) twoFactorPrompt {
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+
+	var prompt twoFactorPrompt
+	if err := parseBody(resp.Body, &prompt); err != nil {
+		t.Fatal(err)
+	}
+	return prompt
+}
+
+func TestTwoFactor(t *testing.T) {
+	m := &membership{volatile: volatile}
+
+	curDB := client.Database(dbName)
+	defer internal.SaveAuthSettings(curDB, internal.AuthSettings{})
+
+	email, pw := "2fa@test.com", "2fa_pw"
+	login := internal.Login{Email: email, Password: pw}
+
+	resp := sessionReq(t, m.register, "POST", "/register", "", login)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	token, _ := sessionLogin(t, m, email, pw)
+
+	// enrolling needs a code of the new secret
+	enroll := twoFactorPromptOf(t, sessionReq(t, m.twoFactor, "POST", "/2fa/enroll", token, nil))
+	if len(enroll.Secret) == 0 || len(enroll.URI) == 0 {
+		t.Fatalf("expected a secret and URI got %v", enroll)
+	}
+
+	resp = sessionReq(t, m.twoFactor, "POST", "/2fa/confirm", token, map[string]string{"code": "000000"})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for an invalid code got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	code := totpCode(t, enroll.Secret, 0)
+	confirmed := twoFactorPromptOf(t, sessionReq(t, m.twoFactor, "POST", "/2fa/confirm", token, map[string]string{"code": code}))
+	if len(confirmed.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes got %v", recoveryCodeCount, confirmed)
+	}
+
+	// signing in now needs a second step
+	resp = sessionReq(t, m.login, "POST", "/login", "", login)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status 202 got %s", resp.Status)
+	}
+	prompt := twoFactorPromptOf(t, resp)
+	if len(prompt.Challenge) == 0 || prompt.Enroll {
+		t.Fatalf("expected a challenge got %v", prompt)
+	}
+
+	// the code used to confirm the secret cannot be used again
+	step := map[string]string{"challenge": prompt.Challenge, "code": code}
+	resp = sessionReq(t, m.twoFactorLogin, "POST", "/login/2fa", "", step)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 reusing a code got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	step["code"] = totpCode(t, enroll.Secret, 1)
+	resp = sessionReq(t, m.twoFactorLogin, "POST", "/login/2fa", "", step)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	} else if len(resp.Header.Get("SB-Refresh-Token")) == 0 {
+		t.Error("expected a session after the second step")
+	}
+	resp.Body.Close()
+
+	resp = sessionReq(t, m.twoFactorLogin, "POST", "/login/2fa", "", step)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 reusing a challenge got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	// recovery codes work once
+	resp = sessionReq(t, m.login, "POST", "/login", "", login)
+	prompt = twoFactorPromptOf(t, resp)
+
+	step = map[string]string{"challenge": prompt.Challenge, "code": confirmed.RecoveryCodes[0]}
+	resp = sessionReq(t, m.twoFactorLogin, "POST", "/login/2fa", "", step)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = sessionReq(t, m.login, "POST", "/login", "", login)
+	prompt = twoFactorPromptOf(t, resp)
+
+	step["challenge"] = prompt.Challenge
+	resp = sessionReq(t, m.twoFactorLogin, "POST", "/login/2fa", "", step)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 reusing a recovery code got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	// a challenge only accepts a few attempts
+	for i := 1; i < twoFactorMaxAttempts; i++ {
+		resp = sessionReq(t, m.twoFactorLogin, "POST", "/login/2fa", "", step)
+		resp.Body.Close()
+	}
+
+	step["code"] = confirmed.RecoveryCodes[1]
+	resp = sessionReq(t, m.twoFactorLogin, "POST", "/login/2fa", "", step)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 after too many attempts got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	// users can't turn it off when their role requires it
+	minRole := 0
+	if err := internal.SaveAuthSettings(curDB, internal.AuthSettings{TwoFactorMinRole: &minRole}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = sessionReq(t, m.twoFactor, "DELETE", "/2fa", token, map[string]string{"code": confirmed.RecoveryCodes[1]})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403 disabling a required 2FA got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	// users without a secret enroll while signing in when it's required
+	other := internal.Login{Email: "2fa-required@test.com", Password: "2fa_pw"}
+	resp = sessionReq(t, m.register, "POST", "/register", "", other)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status 202 got %s", resp.Status)
+	}
+	prompt = twoFactorPromptOf(t, resp)
+	if !prompt.Enroll || len(prompt.Secret) == 0 || len(prompt.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected to enroll got %v", prompt)
+	}
+
+	step = map[string]string{"challenge": prompt.Challenge, "code": totpCode(t, prompt.Secret, 0)}
+	resp = sessionReq(t, m.twoFactorLogin, "POST", "/login/2fa", "", step)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	if tok, err := internal.FindTokenByEmail(curDB, other.Email); err != nil {
+		t.Fatal(err)
+	} else if tok.TOTPSecret != prompt.Secret || len(tok.RecoveryCodes) != recoveryCodeCount {
+		t.Error("expected 2FA to be enabled once the code is confirmed")
+	}
+
+	if err := internal.SaveAuthSettings(curDB, internal.AuthSettings{}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = sessionReq(t, m.twoFactor, "DELETE", "/2fa", token, map[string]string{"code": confirmed.RecoveryCodes[1]})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	sessionLogin(t, m, email, pw)
+}
+
+func TestTwoFactorRoot(t *testing.T) {
+	m := &membership{volatile: volatile}
+
+	curDB := client.Database(dbName)
+	admin, err := internal.FindTokenByEmail(curDB, admEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, tok, err := m.createUser(curDB, admin.AccountID, "2fa-root@test.com", "2fa_root_pw", internal.RootRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := internal.NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := internal.EnableTOTP(curDB, tok.ID, secret, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err = internal.FindTokenByEmail(curDB, tok.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := fmt.Sprintf("%s|%s|%s", tok.ID.Hex(), tok.AccountID.Hex(), tok.Token)
+
+	rootReq := func(cookies ...*http.Cookie) *http.Response {
+		req := httptest.NewRequest("GET", "/sudolistall", nil)
+		req.Header.Set("SB-PUBLIC-KEY", pubKey)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", root))
+		for _, ck := range cookies {
+			req.AddCookie(ck)
+		}
+
+		w := httptest.NewRecorder()
+		h := middleware.Chain(http.HandlerFunc(database.listCollections), middleware.WithDB(client, volatile), middleware.RequireRoot(client, volatile))
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// the root token alone does not skip the code
+	resp := rootReq()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without a two-factor session got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	resp = rootReq(&http.Cookie{Name: middleware.TwoFactorCookie, Value: "forged"})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 with an unknown two-factor session got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	// entering the code in the web UI starts the two-factor session
+	baseID, err := primitive.ObjectIDFromHex(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := internal.FindDatabase(client.Database("sbsys"), baseID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prompt, err := startTwoFactor(volatile, conf, tok)
+	if err != nil {
+		t.Fatal(err)
+	} else if prompt == nil {
+		t.Fatal("expected to be asked for a code")
+	}
+
+	form := url.Values{"pk": {pubKey}, "challenge": {prompt.Challenge}, "code": {totpCode(t, secret, 0)}}
+	req := httptest.NewRequest("POST", "/ui/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	ui{}.auth(w, req)
+	resp = w.Result()
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected status 303 after the code got %s", resp.Status)
+	}
+
+	var session *http.Cookie
+	for _, ck := range resp.Cookies() {
+		if ck.Name == middleware.TwoFactorCookie {
+			session = ck
+		}
+	}
+	if session == nil {
+		t.Fatal("expected a two-factor session cookie")
+	}
+
+	// the cookie expires with the session kept in the cache
+	var s internal.TwoFactorSession
+	if err := volatile.GetTyped(internal.TwoFactorSessionKey(session.Value), &s); err != nil {
+		t.Fatal(err)
+	} else if !session.Expires.Equal(s.Expires.Truncate(time.Second)) {
+		t.Errorf("expected the cookie to expire at %v got %v", s.Expires, session.Expires)
+	} else if d := time.Until(s.Expires); d > internal.CacheTTL || d < internal.CacheTTL-time.Minute {
+		t.Errorf("expected the session to last %v got %v", internal.CacheTTL, d)
+	}
+
+	resp = rootReq(session)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	// root users covered by the policy need the session before enrolling
+	minRole := internal.RootRole
+	if err := internal.SaveAuthSettings(curDB, internal.AuthSettings{TwoFactorMinRole: &minRole}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = dbReq(t, database.listCollections, "GET", "/sudolistall", nil, true)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 when the role requires 2FA got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	if err := internal.SaveAuthSettings(curDB, internal.AuthSettings{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the secrets are in sb_tokens, like all sb_ collections it's root only
+	user := internal.Auth{AccountID: tok.AccountID, UserID: primitive.NewObjectID()}
+	if _, err := database.base.List(user, curDB, "sb_tokens", db.ListParams{Page: 1, Size: 25}); !errors.Is(err, internal.ErrPermissionDenied) {
+		t.Errorf("expected permission denied reading sb_tokens got %v", err)
+	}
+}
@@ -2,8 +2,11 @@ package staticbackend
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
+	"net/url"
 	"staticbackend/db"
 	"staticbackend/function"
 	"staticbackend/internal"
@@ -17,7 +20,8 @@ import (
 )
 
 type ui struct {
-	base *db.Base
+	base      *db.Base
+	scheduler *function.TaskScheduler
 }
 
 func (ui) login(w http.ResponseWriter, r *http.Request) {
@@ -46,11 +50,25 @@ func (ui) createApp(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// uiTwoFactor is the second step of signing in to the web UI when the root
+// user has to enter a code
+type uiTwoFactor struct {
+	PublicKey string
+	Prompt    *twoFactorPrompt
+}
+
+// URI is the otpauth:// link of the secret, html/template only allows
+// http(s) and mailto links otherwise
+func (d uiTwoFactor) URI() template.URL {
+	return template.URL(d.Prompt.URI)
+}
+
 func (ui) auth(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
 	pk := r.Form.Get("pk")
 	token := r.Form.Get("token")
+	challenge := r.Form.Get("challenge")
 
 	id, err := primitive.ObjectIDFromHex(pk)
 	if err != nil {
@@ -66,11 +84,49 @@ func (ui) auth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := middleware.ValidateRootToken(client, conf.Name, token); err != nil {
+	if len(challenge) > 0 {
+		tok, err := finishTwoFactor(volatile, conf, challenge, r.Form.Get("code"))
+		if errors.Is(err, errInvalidCode) {
+			data := uiTwoFactor{PublicKey: pk, Prompt: &twoFactorPrompt{Challenge: challenge}}
+			render(w, r, "login.html", data, &Flash{Type: "danger", Message: "invalid code"})
+			return
+		} else if err != nil {
+			render(w, r, "login.html", nil, &Flash{Type: "danger", Message: err.Error()})
+			return
+		}
+
+		// the root token is only accepted with the session of this sign in
+		if err := setTwoFactorCookie(w, conf, tok); err != nil {
+			render(w, r, "login.html", nil, &Flash{Type: "danger", Message: err.Error()})
+			return
+		}
+
+		token = fmt.Sprintf("%s|%s|%s", tok.ID.Hex(), tok.AccountID.Hex(), tok.Token)
+		setUICookies(w, pk, token)
+		http.Redirect(w, r, "/ui/db", http.StatusSeeOther)
+		return
+	}
+
+	tok, err := middleware.ValidateRootToken(client, conf.Name, token)
+	if err != nil {
 		render(w, r, "login.html", nil, &Flash{Type: "danger", Message: "invalid public key / token"})
 		return
 	}
 
+	prompt, err := startTwoFactor(volatile, conf, tok)
+	if err != nil {
+		render(w, r, "login.html", nil, &Flash{Type: "danger", Message: err.Error()})
+		return
+	} else if prompt != nil {
+		render(w, r, "login.html", uiTwoFactor{PublicKey: pk, Prompt: prompt}, nil)
+		return
+	}
+
+	setUICookies(w, pk, token)
+	http.Redirect(w, r, "/ui/db", http.StatusSeeOther)
+}
+
+func setUICookies(w http.ResponseWriter, pk, token string) {
 	ckToken := &http.Cookie{
 		Name:     "token",
 		Value:    token,
@@ -88,8 +144,34 @@ func (ui) auth(w http.ResponseWriter, r *http.Request) {
 		Path:     "/",
 	}
 	http.SetCookie(w, ckPk)
+}
 
-	http.Redirect(w, r, "/ui/db", http.StatusSeeOther)
+// setTwoFactorCookie starts the two-factor session of a root user who
+// entered their code, it lasts as long as it's kept in the cache
+func setTwoFactorCookie(w http.ResponseWriter, conf internal.BaseConfig, tok internal.Token) error {
+	id, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	s := internal.TwoFactorSession{
+		Base:    conf.Name,
+		TokenID: tok.ID,
+		Expires: time.Now().Add(internal.CacheTTL),
+	}
+	if err := volatile.SetTyped(internal.TwoFactorSessionKey(id), s); err != nil {
+		return err
+	}
+
+	ck := &http.Cookie{
+		Name:     middleware.TwoFactorCookie,
+		Value:    id,
+		Expires:  s.Expires,
+		HttpOnly: true,
+		Path:     "/",
+	}
+	http.SetCookie(w, ck)
+	return nil
 }
 
 func (x *ui) dbCols(w http.ResponseWriter, r *http.Request) {
@@ -132,10 +214,15 @@ func (x *ui) dbCols(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var filter bson.M
+	var flash *Flash
 
-	// handle post
+	// handle post, a CSV file is imported in the collection
 	if r.Method == http.MethodPost {
-		r.ParseForm()
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			flash = x.importCSV(auth, curDB, r)
+		} else {
+			r.ParseForm()
+		}
 
 		col = r.Form.Get("col")
 		params.SortBy = r.Form.Get("sortby")
@@ -187,7 +274,98 @@ func (x *ui) dbCols(w http.ResponseWriter, r *http.Request) {
 		data.SortDescending = "0"
 	}
 
-	render(w, r, "db_cols.html", data, nil)
+	render(w, r, "db_cols.html", data, flash)
+}
+
+// importCSV creates the documents of the uploaded CSV and returns the
+// outcome to display
+func (x *ui) importCSV(auth internal.Auth, curDB internal.Database, r *http.Request) *Flash {
+	if err := r.ParseMultipartForm(maxCSVSize); err != nil {
+		return &Flash{Type: "danger", Message: err.Error()}
+	}
+
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		return &Flash{Type: "danger", Message: err.Error()}
+	}
+	defer f.Close()
+
+	opt, err := getCSVOptions(r.Form.Get("types"))
+	if err != nil {
+		return &Flash{Type: "danger", Message: err.Error()}
+	}
+
+	result, err := x.base.ImportCSV(auth, curDB, r.Form.Get("col"), f, opt)
+	if err != nil {
+		return &Flash{Type: "danger", Message: err.Error()}
+	} else if len(result.Errors) > 0 {
+		var msgs []string
+		for _, re := range result.Errors {
+			msg := fmt.Sprintf("row %d: %s", re.Row, re.Message)
+			if len(re.Field) > 0 {
+				msg = fmt.Sprintf("row %d, %s: %s", re.Row, re.Field, re.Message)
+			}
+			msgs = append(msgs, msg)
+		}
+		return &Flash{Type: "danger", Message: "nothing imported, " + strings.Join(msgs, "; ")}
+	}
+
+	return &Flash{Type: "success", Message: fmt.Sprintf("%d documents imported", result.Created)}
+}
+
+// dbExportCSV downloads all the documents matching the query of the
+// collection page
+func (x ui) dbExportCSV(w http.ResponseWriter, r *http.Request) {
+	conf, auth, err := middleware.Extract(r, false)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	r.ParseForm()
+
+	col := r.Form.Get("col")
+
+	filter := bson.M{}
+	if query := r.Form.Get("query"); len(query) > 0 {
+		var clauses [][]interface{}
+		if err := json.Unmarshal([]byte(query), &clauses); err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		filter, err = db.ParseQuery(clauses)
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+	}
+
+	params := db.ListParams{
+		Page:           1,
+		Size:           500,
+		SortBy:         r.Form.Get("sortby"),
+		SortDescending: r.Form.Get("desc") == "1",
+	}
+
+	var docs []bson.M
+	for {
+		list, err := x.base.Query(auth, curDB, col, filter, params)
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		docs = append(docs, list.Results...)
+		if int64(len(list.Results)) < params.Size {
+			break
+		}
+		params.Page++
+	}
+
+	writeCSV(w, col, docs)
 }
 
 func (x ui) dbDoc(w http.ResponseWriter, r *http.Request) {
@@ -202,7 +380,7 @@ func (x ui) dbDoc(w http.ResponseWriter, r *http.Request) {
 	col := r.URL.Query().Get("col")
 	id := getURLPart(r.URL.Path, 3)
 
-	doc, err := x.base.GetByID(auth, curDB, col, id)
+	doc, err := x.base.GetByID(auth, curDB, col, id, db.ReadParams{})
 	if err != nil {
 		renderErr(w, r, err)
 		return
@@ -265,7 +443,7 @@ func (x ui) dbSave(w http.ResponseWriter, r *http.Request) {
 		update[field] = value
 	}
 
-	if _, err := x.base.Update(auth, curDB, col, id, update); err != nil {
+	if _, err := x.base.Update(auth, curDB, col, id, update, db.UpdateOptions{}); err != nil {
 		renderErr(w, r, err)
 		return
 	}
@@ -294,6 +472,236 @@ func (x ui) dbDel(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/ui/db", http.StatusSeeOther)
 }
 
+func (x ui) dbIndexes(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	names, err := x.base.ListCollections(curDB)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	data := new(struct {
+		Collection  string
+		Collections []string
+		Indexes     []internal.Index
+	})
+
+	data.Collections = names
+	data.Collection = r.URL.Query().Get("col")
+	if len(data.Collection) == 0 && len(names) > 0 {
+		data.Collection = names[0]
+	}
+
+	var flash *Flash
+
+	// handle post, creates the index
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+
+		data.Collection = r.Form.Get("col")
+
+		idx := internal.Index{
+			Name:   r.Form.Get("name"),
+			Unique: r.Form.Get("unique") == "1",
+			Text:   r.Form.Get("text") == "1",
+		}
+
+		// fields are separated by , and prefixed by - for descending order,
+		// text index fields can have a weight i.e. title:10
+		for _, field := range strings.Split(r.Form.Get("fields"), ",") {
+			field = strings.TrimSpace(field)
+			if len(field) == 0 {
+				continue
+			}
+
+			key := internal.IndexKey{Field: strings.TrimPrefix(field, "-")}
+			key.Desc = strings.HasPrefix(field, "-")
+
+			if parts := strings.SplitN(key.Field, ":", 2); len(parts) == 2 {
+				weight, err := strconv.ParseInt(parts[1], 10, 32)
+				if err != nil {
+					renderErr(w, r, err)
+					return
+				}
+				key.Field, key.Weight = parts[0], int32(weight)
+			}
+
+			idx.Keys = append(idx.Keys, key)
+		}
+
+		if ttl := r.Form.Get("ttl"); len(ttl) > 0 {
+			i, err := strconv.ParseInt(ttl, 10, 32)
+			if err != nil {
+				renderErr(w, r, err)
+				return
+			}
+			idx.TTL = int32(i)
+		}
+
+		if err := db.ValidateIndex(curDB, data.Collection, &idx); err != nil {
+			flash = &Flash{Type: "danger", Message: err.Error()}
+		} else if err := curDB.CreateIndex(data.Collection, idx); err != nil {
+			flash = &Flash{Type: "danger", Message: err.Error()}
+		} else {
+			flash = &Flash{Type: "success", Message: "index " + idx.Name + " created"}
+		}
+	}
+
+	if len(data.Collection) > 0 {
+		data.Indexes, err = curDB.ListIndexes(data.Collection)
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+	}
+
+	render(w, r, "db_indexes.html", data, flash)
+}
+
+func (x ui) dbIndexDel(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	col := r.URL.Query().Get("col")
+	name := r.URL.Query().Get("name")
+
+	if err := curDB.DropIndex(col, name); err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/ui/indexes?col="+url.QueryEscape(col), http.StatusSeeOther)
+}
+
+func (x ui) trash(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	names, err := x.base.ListCollections(curDB)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	data := new(struct {
+		Collection  string
+		Collections []string
+		SoftDelete  *db.SoftDelete
+		Columns     []string
+		Docs        []bson.M
+	})
+
+	data.Collections = names
+	data.Collection = r.URL.Query().Get("col")
+	if len(data.Collection) == 0 && len(names) > 0 {
+		data.Collection = names[0]
+	}
+
+	var flash *Flash
+
+	// handle post, enables, changes or disables soft delete
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+
+		data.Collection = r.Form.Get("col")
+
+		if r.Form.Get("enabled") != "1" {
+			if err := db.DeleteSoftDelete(curDB, data.Collection); err != nil {
+				flash = &Flash{Type: "danger", Message: err.Error()}
+			} else {
+				flash = &Flash{Type: "success", Message: "documents are now deleted permanently"}
+			}
+		} else {
+			days, err := strconv.Atoi(r.Form.Get("retention"))
+			if err != nil {
+				days = db.DefaultRetentionDays
+			}
+
+			if err := db.SetSoftDelete(curDB, data.Collection, days); err != nil {
+				flash = &Flash{Type: "danger", Message: err.Error()}
+			} else {
+				flash = &Flash{Type: "success", Message: "deleted documents are now moved to the trash"}
+			}
+		}
+	}
+
+	if len(data.Collection) > 0 {
+		data.SoftDelete, err = db.GetSoftDelete(curDB, data.Collection)
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		list, err := x.base.ListTrash(curDB, data.Collection, db.ListParams{Page: 1, Size: 50})
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		data.Docs = list.Results
+		data.Columns = x.readColumnNames(list.Results)
+	}
+
+	render(w, r, "trash.html", data, flash)
+}
+
+func (x ui) trashRestore(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	col := r.URL.Query().Get("col")
+	id := r.URL.Query().Get("id")
+
+	if _, err := x.base.Restore(curDB, col, id); err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/ui/trash?col="+url.QueryEscape(col), http.StatusSeeOther)
+}
+
+func (x ui) trashDel(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	col := r.URL.Query().Get("col")
+	id := r.URL.Query().Get("id")
+
+	if _, err := x.base.Purge(curDB, col, id); err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/ui/trash?col="+url.QueryEscape(col), http.StatusSeeOther)
+}
+
 func (ui) readColumnNames(docs []bson.M) []string {
 	if len(docs) == 0 {
 		return nil
@@ -472,3 +880,254 @@ func (x *ui) fnDel(w http.ResponseWriter, r *http.Request) {
 
 	http.Redirect(w, r, "/ui/fn", http.StatusSeeOther)
 }
+
+func (x ui) taskList(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	results, err := function.ListTasks(curDB)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	render(w, r, "task_list.html", results, nil)
+}
+
+func (x ui) taskNew(w http.ResponseWriter, r *http.Request) {
+	task := function.Task{Type: function.TaskTypeFunction}
+	render(w, r, "task_edit.html", x.taskEditData(task), nil)
+}
+
+func (x ui) taskEdit(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	id := getURLPart(r.URL.Path, 3)
+
+	task, err := function.GetTaskByID(curDB, id)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	render(w, r, "task_edit.html", x.taskEditData(task), nil)
+}
+
+func (x ui) taskSave(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	r.ParseForm()
+
+	id := r.Form.Get("id")
+
+	task := function.Task{
+		Name:     r.Form.Get("name"),
+		Type:     r.Form.Get("type"),
+		Value:    r.Form.Get("value"),
+		Interval: r.Form.Get("interval"),
+		BaseName: conf.Name,
+	}
+
+	if task.Type == function.TaskTypeMessage {
+		task.Meta = function.MetaMessage{
+			Data:    r.Form.Get("data"),
+			Channel: r.Form.Get("channel"),
+		}
+	}
+
+	if err := validateTask(task); err != nil {
+		render(w, r, "task_edit.html", x.taskEditData(task), &Flash{Type: "danger", Message: err.Error()})
+		return
+	}
+
+	if id == "new" {
+		newID, err := function.AddTask(curDB, task)
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		task.ID, _ = primitive.ObjectIDFromHex(newID)
+		if err := x.scheduler.Schedule(task); err != nil {
+			if err := function.DeleteTask(curDB, newID); err != nil {
+				renderErr(w, r, err)
+				return
+			}
+
+			task.ID = primitive.NilObjectID
+			render(w, r, "task_edit.html", x.taskEditData(task), &Flash{Type: "danger", Message: err.Error()})
+			return
+		}
+
+		http.Redirect(w, r, "/ui/task/"+newID, http.StatusSeeOther)
+		return
+	}
+
+	cur, err := function.GetTaskByID(curDB, id)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	task.ID = cur.ID
+	if err := function.UpdateTask(curDB, task); err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	if err := x.scheduler.Schedule(task); err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/ui/task/"+id, http.StatusSeeOther)
+}
+
+func (x ui) taskDel(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	id := getURLPart(r.URL.Path, 4)
+	if err := function.DeleteTask(curDB, id); err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	_ = x.scheduler.Unschedule(id)
+
+	http.Redirect(w, r, "/ui/task", http.StatusSeeOther)
+}
+
+func (ui) taskEditData(task function.Task) interface{} {
+	data := new(struct {
+		Task  function.Task
+		IsNew bool
+		Meta  function.MetaMessage
+		Types []string
+	})
+
+	data.Task = task
+	data.IsNew = task.ID.IsZero()
+	data.Types = []string{function.TaskTypeFunction, function.TaskTypeMessage}
+
+	if task.Type == function.TaskTypeMessage {
+		data.Meta, _ = task.MetaMessage()
+	}
+
+	return data
+}
+
+func (x ui) apiKeys(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	x.renderAPIKeys(w, r, client.Database(conf.Name), "", nil)
+}
+
+func (x ui) apiKeySave(w http.ResponseWriter, r *http.Request) {
+	conf, auth, err := middleware.Extract(r, true)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	r.ParseForm()
+
+	data := apiKeyRequest{
+		Name:       r.Form.Get("name"),
+		Scopes:     splitList(r.Form.Get("scopes")),
+		AllowedIPs: splitList(r.Form.Get("allowedIps")),
+	}
+
+	if exp := r.Form.Get("expires"); len(exp) > 0 {
+		t, err := time.Parse("2006-01-02", exp)
+		if err != nil {
+			x.renderAPIKeys(w, r, curDB, "", &Flash{Type: "danger", Message: "invalid expiry date"})
+			return
+		}
+		data.Expires = t
+	}
+
+	if err := validateAPIKey(data); err != nil {
+		x.renderAPIKeys(w, r, curDB, "", &Flash{Type: "danger", Message: err.Error()})
+		return
+	}
+
+	key, _, err := createAPIKey(curDB, auth, data)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	x.renderAPIKeys(w, r, curDB, key, nil)
+}
+
+func (x ui) apiKeyDel(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	id, err := primitive.ObjectIDFromHex(getURLPart(r.URL.Path, 4))
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	if _, err := internal.DeleteAPIKey(curDB, id); err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/ui/apikeys", http.StatusSeeOther)
+}
+
+// renderAPIKeys lists the API keys, newKey is only shown once after it's
+// created
+func (ui) renderAPIKeys(w http.ResponseWriter, r *http.Request, curDB internal.Database, newKey string, flash *Flash) {
+	keys, err := internal.ListAPIKeys(curDB)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	data := new(struct {
+		Keys   []internal.APIKey
+		NewKey string
+	})
+
+	data.Keys = keys
+	data.NewKey = newKey
+
+	render(w, r, "apikeys.html", data, flash)
+}
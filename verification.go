@@ -0,0 +1,441 @@
+package staticbackend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	textTemplate "text/template"
+	"time"
+
+	emailFuncs "staticbackend/email"
+	"staticbackend/internal"
+	"staticbackend/middleware"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// verifyTokenTTL is how long users have to confirm their email
+	verifyTokenTTL = 48 * time.Hour
+	// magicLinkTTL is how long a magic link can be used to sign in
+	magicLinkTTL = 15 * time.Minute
+)
+
+// defaultEmailTemplates are sent when the base has no template of its own
+var defaultEmailTemplates = map[string]internal.EmailTemplate{
+	internal.EmailTokenVerify: {
+		Subject: "Confirm your email",
+		Body: `<p>Hi,</p>
+<p>Please confirm your email by following this link:</p>
+<p><a href="{{.Link}}">{{.Link}}</a></p>
+<p>The link expires on {{.Expires.Format "2006-01-02 15:04 MST"}}.</p>`,
+	},
+	internal.EmailTokenMagicLink: {
+		Subject: "Your sign in link",
+		Body: `<p>Hi,</p>
+<p>Follow this link to sign in:</p>
+<p><a href="{{.Link}}">{{.Link}}</a></p>
+<p>The link can be used once and expires in 15 minutes. If you did not ask
+to sign in you can ignore this email.</p>`,
+	},
+}
+
+// emailTokenData is what the email templates receive
+type emailTokenData struct {
+	Email   string
+	Link    string
+	Token   string
+	Expires time.Time
+}
+
+// authSettings manages the email verification, magic link and two-factor
+// settings of the base, it's reserved to root users:
+//
+//	GET /auth/settings returns the settings
+//	PUT /auth/settings replaces them
+func authSettings(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	curDB := client.Database(conf.Name)
+
+	switch r.Method {
+	case http.MethodGet:
+		s, err := internal.GetAuthSettings(curDB)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, s)
+	case http.MethodPost, http.MethodPut:
+		var s internal.AuthSettings
+		if err := parseBody(r.Body, &s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := validateAuthSettings(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := internal.SaveAuthSettings(curDB, s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, http.StatusOK, true)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func validateAuthSettings(s internal.AuthSettings) error {
+	if s.RequireVerified && !s.VerifyEmail {
+		return errors.New("requireVerified needs verifyEmail")
+	} else if s.VerifyEmail && len(s.VerifyURL) == 0 && len(PublicURL) == 0 {
+		return errors.New("verifyEmail needs a verifyUrl when PUBLIC_URL is not set")
+	} else if s.TwoFactorMinRole != nil && *s.TwoFactorMinRole < 0 {
+		return errors.New("twoFactorMinRole cannot be negative")
+	}
+
+	for _, link := range []string{s.VerifyURL, s.MagicLinkURL} {
+		if len(link) == 0 {
+			continue
+		}
+
+		u, err := url.Parse(link)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid URL %s", link)
+		}
+	}
+
+	for purpose, tmpl := range s.Templates {
+		if _, ok := defaultEmailTemplates[purpose]; !ok {
+			return fmt.Errorf("unknown email template %s", purpose)
+		}
+
+		data := emailTokenData{Expires: time.Now()}
+		if _, _, err := renderEmail(tmpl, data); err != nil {
+			return fmt.Errorf("invalid %s template: %v", purpose, err)
+		}
+	}
+	return nil
+}
+
+// renderEmail returns the subject and HTML body of the email
+func renderEmail(tmpl internal.EmailTemplate, data emailTokenData) (string, string, error) {
+	st, err := textTemplate.New("subject").Parse(tmpl.Subject)
+	if err != nil {
+		return "", "", err
+	}
+
+	bt, err := template.New("body").Parse(tmpl.Body)
+	if err != nil {
+		return "", "", err
+	}
+
+	var subject, body bytes.Buffer
+	if err := st.Execute(&subject, data); err != nil {
+		return "", "", err
+	} else if err := bt.Execute(&body, data); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(subject.String()), body.String(), nil
+}
+
+// sendEmailToken emails a link with a new one-time token to the user. The
+// link goes to the page of the app set in the settings, for email
+// verification without one it confirms the email directly on PublicURL.
+func sendEmailToken(conf internal.BaseConfig, settings internal.AuthSettings, tok internal.Token, purpose string) error {
+	db := client.Database(conf.Name)
+
+	secret, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := verifyTokenTTL
+	page := settings.VerifyURL
+	if purpose == internal.EmailTokenMagicLink {
+		ttl = magicLinkTTL
+		page = settings.MagicLinkURL
+	}
+
+	if len(page) == 0 {
+		// the link is never built from the request, its host is not trusted
+		if len(PublicURL) == 0 {
+			return errors.New("PUBLIC_URL is not set, the settings need a link to the app")
+		}
+		page = PublicURL + "/verify?sbpk=" + conf.ID.Hex()
+	}
+
+	link, err := withQuery(page, "token", secret)
+	if err != nil {
+		return err
+	}
+
+	et := internal.EmailToken{
+		ID:      primitive.NewObjectID(),
+		UserID:  tok.ID,
+		Purpose: purpose,
+		Hash:    hashToken(secret),
+		Expires: time.Now().Add(ttl),
+	}
+	if err := internal.CreateEmailToken(db, et); err != nil {
+		return err
+	}
+
+	tmpl := defaultEmailTemplates[purpose]
+	if custom, ok := settings.Templates[purpose]; ok {
+		if len(custom.Subject) > 0 {
+			tmpl.Subject = custom.Subject
+		}
+		if len(custom.Body) > 0 {
+			tmpl.Body = custom.Body
+		}
+	}
+
+	data := emailTokenData{
+		Email:   tok.Email,
+		Link:    link,
+		Token:   secret,
+		Expires: et.Expires,
+	}
+
+	subject, body, err := renderEmail(tmpl, data)
+	if err != nil {
+		return err
+	}
+
+	ed := internal.SendMailData{
+		From:     FromEmail,
+		FromName: FromName,
+		To:       tok.Email,
+		Subject:  subject,
+		HTMLBody: body,
+		TextBody: emailFuncs.StripHTML(body),
+	}
+	return emailer.Send(ed)
+}
+
+// verify confirms the user's email with the token they received:
+//
+//	POST /verify {"token": "..."}
+//	GET /verify?sbpk=...&token=... from the email when there's no verifyUrl
+func verify(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, "invalid StaticBackend key", http.StatusUnauthorized)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if r.Method == http.MethodPost {
+		var data struct {
+			Token string `json:"token"`
+		}
+		if err := parseBody(r.Body, &data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		token = data.Token
+	}
+
+	db := client.Database(conf.Name)
+
+	userID, err := internal.ConsumeEmailToken(db, internal.EmailTokenVerify, hashToken(token))
+	if errors.Is(err, internal.ErrNotFound) {
+		http.Error(w, "invalid or expired link", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := internal.SetVerified(db, userID, true); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("Your email is confirmed, you may close this page."))
+		return
+	}
+
+	respond(w, http.StatusOK, true)
+}
+
+// sendVerification sends the confirmation email again:
+//
+//	POST /verify/send {"email": "..."}
+//
+// It responds the same whether the user exists or not.
+func sendVerification(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, "invalid StaticBackend key", http.StatusUnauthorized)
+		return
+	}
+
+	var data struct {
+		Email string `json:"email"`
+	}
+	if err := parseBody(r.Body, &data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := client.Database(conf.Name)
+
+	tok, err := internal.FindTokenByEmail(db, strings.ToLower(data.Email))
+	if errors.Is(err, internal.ErrNotFound) || (err == nil && !tok.Unverified) {
+		respond(w, http.StatusOK, true)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	settings, err := internal.GetAuthSettings(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := sendEmailToken(conf, settings, tok, internal.EmailTokenVerify); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, http.StatusOK, true)
+}
+
+// magicLink emails a link to sign in without a password to the user:
+//
+//	POST /magiclink {"email": "..."}
+//
+// The link goes to the magicLinkUrl of the settings which exchanges its
+// token at /magiclink/login. It responds the same whether the user exists
+// or not.
+func magicLink(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, "invalid StaticBackend key", http.StatusUnauthorized)
+		return
+	}
+
+	var data struct {
+		Email string `json:"email"`
+	}
+	if err := parseBody(r.Body, &data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := client.Database(conf.Name)
+
+	settings, err := internal.GetAuthSettings(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if len(settings.MagicLinkURL) == 0 {
+		http.Error(w, "magic links need a magicLinkUrl in the auth settings", http.StatusBadRequest)
+		return
+	}
+
+	tok, err := internal.FindTokenByEmail(db, strings.ToLower(data.Email))
+	if errors.Is(err, internal.ErrNotFound) {
+		respond(w, http.StatusOK, true)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := sendEmailToken(conf, settings, tok, internal.EmailTokenMagicLink); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, http.StatusOK, true)
+}
+
+// magicLinkLogin signs the user in with the token of their magic link, it
+// responds like /login. The email is confirmed as well.
+//
+//	POST /magiclink/login {"token": "..."}
+func (m *membership) magicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	conf, _, err := middleware.Extract(r, false)
+	if err != nil {
+		http.Error(w, "invalid StaticBackend key", http.StatusUnauthorized)
+		return
+	}
+
+	var data struct {
+		Token string `json:"token"`
+	}
+	if err := parseBody(r.Body, &data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := client.Database(conf.Name)
+
+	userID, err := internal.ConsumeEmailToken(db, internal.EmailTokenMagicLink, hashToken(data.Token))
+	if errors.Is(err, internal.ErrNotFound) {
+		http.Error(w, "invalid or expired link", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var tok internal.Token
+	if err := db.FindOne("sb_tokens", bson.M{internal.FieldID: userID}, &tok); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if tok.Unverified {
+		if err := internal.SetVerified(db, tok.ID, true); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	m.signIn(w, r, conf, tok)
+}
+
+// startVerification marks the new user as unverified and sends them the
+// confirmation email when the base verifies emails. It returns true if
+// the user must confirm their email before signing in.
+func startVerification(conf internal.BaseConfig, tok internal.Token) (bool, error) {
+	db := client.Database(conf.Name)
+
+	settings, err := internal.GetAuthSettings(db)
+	if err != nil || !settings.VerifyEmail {
+		return false, err
+	}
+
+	if err := internal.SetVerified(db, tok.ID, false); err != nil {
+		return false, err
+	}
+
+	// the user can ask for the email again, it's not a reason to fail
+	if err := sendEmailToken(conf, settings, tok, internal.EmailTokenVerify); err != nil {
+		log.Println("error sending the verification email", err)
+	}
+	return settings.RequireVerified, nil
+}
@@ -0,0 +1,173 @@
+package staticbackend
+
+import (
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"staticbackend/internal"
+)
+
+// captureMailer keeps the emails instead of sending them
+type captureMailer struct {
+	sent []internal.SendMailData
+}
+
+func (c *captureMailer) Send(data internal.SendMailData) error {
+	c.sent = append(c.sent, data)
+	return nil
+}
+
+var hrefRe = regexp.MustCompile(`href="([^"]+)"`)
+
+// lastLink returns the link of the last email sent
+func (c *captureMailer) lastLink(t *testing.T) *url.URL {
+	if len(c.sent) == 0 {
+		t.Fatal("expected an email to be sent")
+	}
+
+	m := hrefRe.FindStringSubmatch(c.sent[len(c.sent)-1].HTMLBody)
+	if m == nil {
+		t.Fatalf("expected a link in %s", c.sent[len(c.sent)-1].HTMLBody)
+	}
+
+	u, err := url.Parse(html.UnescapeString(m[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestEmailVerification(t *testing.T) {
+	mailer := &captureMailer{}
+	prev := emailer
+	emailer = mailer
+	defer func() { emailer = prev }()
+
+	curDB := client.Database(dbName)
+	defer internal.SaveAuthSettings(curDB, internal.AuthSettings{})
+
+	m := &membership{volatile: volatile}
+
+	settings := map[string]interface{}{
+		"verifyEmail":     true,
+		"requireVerified": true,
+		"magicLinkUrl":    "http://localhost:3000/magic",
+		"templates": map[string]interface{}{
+			"verify": map[string]string{"subject": "Welcome {{.Email}"},
+		},
+	}
+	resp := dbReq(t, authSettings, "PUT", "/auth/settings", settings, true)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid template got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	settings["templates"] = map[string]interface{}{
+		"verify": map[string]string{"subject": "Welcome {{.Email}}"},
+	}
+
+	// the links to the server are built from PUBLIC_URL only
+	prevURL := PublicURL
+	PublicURL = ""
+	defer func() { PublicURL = prevURL }()
+
+	resp = dbReq(t, authSettings, "PUT", "/auth/settings", settings, true)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 without a verifyUrl nor PUBLIC_URL got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	PublicURL = "https://sb.example.com"
+
+	resp = dbReq(t, authSettings, "PUT", "/auth/settings", settings, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	email, pw := "verify@test.com", "verify_pw"
+	login := internal.Login{Email: email, Password: pw}
+
+	resp = sessionReq(t, m.register, "POST", "/register", "", login)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	if len(mailer.sent) != 1 {
+		t.Fatalf("expected a verification email got %d emails", len(mailer.sent))
+	} else if mailer.sent[0].Subject != "Welcome "+email {
+		t.Errorf("expected the custom subject got %s", mailer.sent[0].Subject)
+	}
+
+	resp = sessionReq(t, m.login, "POST", "/login", "", login)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403 for an unverified user got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	// without a verifyUrl the link confirms the email directly
+	link := mailer.lastLink(t)
+	if link.Host != "sb.example.com" || link.Path != "/verify" || len(link.Query().Get("sbpk")) == 0 {
+		t.Fatalf("expected a link to /verify on PUBLIC_URL got %s", link)
+	}
+
+	resp = sessionReq(t, verify, "GET", link.RequestURI(), "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	resp = sessionReq(t, verify, "GET", link.RequestURI(), "", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 reusing a link got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	resp = sessionReq(t, m.login, "POST", "/login", "", login)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	// magic links sign in without a password
+	resp = sessionReq(t, magicLink, "POST", "/magiclink", "", map[string]string{"email": email})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	}
+	resp.Body.Close()
+
+	link = mailer.lastLink(t)
+	if !strings.HasPrefix(link.String(), "http://localhost:3000/magic?") {
+		t.Fatalf("expected a link to the app got %s", link)
+	}
+
+	token := map[string]string{"token": link.Query().Get("token")}
+	resp = sessionReq(t, m.magicLinkLogin, "POST", "/magiclink/login", "", token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(GetResponseBody(t, resp))
+	} else if len(resp.Header.Get("SB-Refresh-Token")) == 0 {
+		t.Error("expected a session for the magic link")
+	}
+	resp.Body.Close()
+
+	resp = sessionReq(t, m.magicLinkLogin, "POST", "/magiclink/login", "", token)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 reusing a magic link got %s", resp.Status)
+	}
+	resp.Body.Close()
+
+	// unknown emails get the same response and no email
+	sent := len(mailer.sent)
+	resp = sessionReq(t, magicLink, "POST", "/magiclink", "", map[string]string{"email": "nobody@test.com"})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200 for an unknown email got %s", resp.Status)
+	} else if len(mailer.sent) != sent {
+		t.Error("expected no email for an unknown user")
+	}
+	resp.Body.Close()
+}